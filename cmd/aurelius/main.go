@@ -42,6 +42,31 @@ func main() {
 It will be created if it doesn't exist.`)
 		noThrottle = flag.Bool(
 			"noThrottle", false, "Don't limit streaming throughput to playback speed.")
+		transcodeCacheMiB = flag.Int64(
+			"transcodeCache", 0,
+			"Maximum size in MiB of the cache of transcoded tracks, or 0 to disable caching.")
+		prefetchTracks = flag.Int(
+			"prefetch", 0,
+			"Number of upcoming tracks to transcode into the cache while a track is streamed.")
+		computeReplayGain = flag.Bool(
+			"computeReplayGain", false,
+			"Measure the loudness of tracks without ReplayGain tags to compute ReplayGain for them.")
+		detectSilence = flag.Bool(
+			"detectSilence", false,
+			"Measure the silence at the start and end of tracks, so that clients can skip it.")
+		silenceThreshold = flag.Float64(
+			"silenceThreshold", -60, "Level in dBFS at or below which audio is considered silent.")
+		fingerprint = flag.Bool(
+			"fingerprint", false,
+			"Compute acoustic fingerprints of tracks, so that duplicate recordings can be found.")
+		allowTagEditing = flag.Bool(
+			"allowTagEditing", false, "Allow clients to change the tags of tracks, modifying the media files.")
+		include = flag.String(
+			"include", "",
+			"Comma-separated glob patterns of files and directories to add to the library even if excluded, e.g. hidden ones.")
+		exclude = flag.String(
+			"exclude", "",
+			"Comma-separated glob patterns of files and directories to leave out of the library.")
 		passphrase = flag.String(
 			"pass", "",
 			`Passphrase used for login. If unspecified, access will not be restricted.
@@ -89,6 +114,15 @@ so use of HTTPS is recommended.`)
 	mlConfig.RootPath = *mediaPath
 	mlConfig.StoragePath = *storagePath
 	mlConfig.ThrottleStreaming = !*noThrottle
+	mlConfig.TranscodeCacheSize = *transcodeCacheMiB * 1024 * 1024
+	mlConfig.PrefetchTracks = *prefetchTracks
+	mlConfig.ComputeReplayGain = *computeReplayGain
+	mlConfig.DetectSilence = *detectSilence
+	mlConfig.SilenceThreshold = *silenceThreshold
+	mlConfig.ComputeFingerprints = *fingerprint
+	mlConfig.AllowTagEditing = *allowTagEditing
+	mlConfig.Include = splitList(*include)
+	mlConfig.Exclude = splitList(*exclude)
 
 	ml, err := media.NewLibrary(mlConfig)
 	if err != nil {
@@ -364,6 +398,18 @@ func parseLogLevel(levelStr string) (slog.Level, bool) {
 	}
 }
 
+// splitList splits a comma-separated list, dropping empty elements and the
+// space around them.
+func splitList(list string) []string {
+	var elems []string
+	for elem := range strings.SplitSeq(list, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
 // A fileOnlyServer serves local files from the directory tree rooted at root.
 // Requests for directories are rejected.
 type fileOnlyServer struct {
@@ -46,6 +46,16 @@ func (ml *Library) handleDir(
 		return
 	}
 
+	// Hidden subdirectories are only listed if the directory itself is
+	// hidden, which means that it was opened directly.
+	dir, err := ml.db.GetDir(dirLibraryPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "GetDir failed", "error", err)
+		return
+	}
+	showHidden := dir != nil && dir.Hidden
+
 	result := Dir{
 		Url:       ml.libraryToUrlPath("dirs", dirLibraryPath),
 		TopLevel:  ml.libraryToUrlPath("dirs", ""),
@@ -57,6 +67,9 @@ func (ml *Library) handleDir(
 	}
 
 	for _, d := range subdirs {
+		if d.Hidden && !showHidden {
+			continue
+		}
 		result.Dirs = append(result.Dirs, DirEntry{
 			Name: filepath.Base(d.Path),
 			Url:  ml.libraryToUrlPath("dirs", d.Path),
@@ -0,0 +1,40 @@
+package media
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// DuplicatesResponse is the JSON representation of the duplicate tracks found
+// in the library. Each group lists tracks that are the same recording.
+type DuplicatesResponse struct {
+	Groups [][]Track `json:"groups"`
+}
+
+// handleDuplicates lists groups of tracks with matching acoustic
+// fingerprints. Fingerprints are only computed when
+// LibraryConfig.ComputeFingerprints is set.
+func handleDuplicates(ml *Library, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	groups, err := ml.db.FindDuplicates()
+	if err != nil {
+		slog.ErrorContext(ctx, "FindDuplicates failed", "error", err)
+		http.Error(w, "Failed to find duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	response := DuplicatesResponse{Groups: make([][]Track, len(groups))}
+	for i, group := range groups {
+		response.Groups[i] = make([]Track, len(group))
+		for j := range group {
+			track := &group[j]
+			favorite, err := ml.db.IsFavorite(joinLibraryPath(track.Dir, track.Name))
+			if err != nil {
+				slog.ErrorContext(ctx, "IsFavorite failed", "error", err)
+			}
+			response.Groups[i][j] = ml.makeTrack(track, favorite)
+		}
+	}
+	writeJson(r, w, &response)
+}
@@ -6,3 +6,10 @@ import "github.com/beakbeak/aurelius/internal/mediadb"
 func (ml *Library) DB() *mediadb.DB {
 	return ml.db
 }
+
+// RadioStationCount returns the number of running radio stations.
+func (ml *Library) RadioStationCount() int {
+	ml.radioMu.Lock()
+	defer ml.radioMu.Unlock()
+	return len(ml.radioStations)
+}
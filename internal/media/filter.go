@@ -0,0 +1,72 @@
+package media
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A streamFilter is an audio filter that may be requested with the filter
+// parameter of a stream request. Clients choose from a fixed set of presets,
+// since arbitrary filter graphs could be used to exhaust the server's
+// resources.
+type streamFilter struct {
+	spec  string  // filter description for aurelib.NewFilterGraph
+	tempo float64 // factor by which the filter changes the speed, if it does
+}
+
+// streamFilters are the presets accepted by the filter parameter.
+var streamFilters = map[string]streamFilter{
+	"loudnorm":   {spec: "loudnorm"},
+	"dynaudnorm": {spec: "dynaudnorm"},
+
+	// compresses loud passages and raises quiet ones for listening at low
+	// volume
+	"night": {spec: "acompressor=threshold=0.05:ratio=4:attack=20:release=250:makeup=3,alimiter"},
+
+	"speed0.75": {spec: "atempo=0.75", tempo: 0.75},
+	"speed1.25": {spec: "atempo=1.25", tempo: 1.25},
+	"speed1.5":  {spec: "atempo=1.5", tempo: 1.5},
+	"speed2":    {spec: "atempo=2", tempo: 2},
+}
+
+// streamEqualizers are the presets accepted by the eq parameter.
+var streamEqualizers = map[string]string{
+	"bass":   "bass=g=6",
+	"treble": "treble=g=4",
+	"vocal":  "bass=g=-3,equalizer=f=2500:t=o:w=1.5:g=3",
+}
+
+// parseStreamFilter interprets the eq and filter parameters in the query of a
+// stream request. eq names a preset from streamEqualizers, and filter is a
+// comma-separated list of presets from streamFilters, applied in order after
+// the equalizer. It returns a filter description for aurelib.NewFilterGraph,
+// or "" if no filtering was requested, along with the factor by which the
+// filters change the speed of the audio.
+func parseStreamFilter(query url.Values) (spec string, tempo float64, _ error) {
+	var specs []string
+	tempo = 1
+
+	if eq := query.Get("eq"); eq != "" {
+		eqSpec, ok := streamEqualizers[eq]
+		if !ok {
+			return "", 0, fmt.Errorf("unknown equalizer preset: %v", eq)
+		}
+		specs = append(specs, eqSpec)
+	}
+
+	if filterArg := query.Get("filter"); filterArg != "" {
+		for _, name := range strings.Split(filterArg, ",") {
+			filter, ok := streamFilters[name]
+			if !ok {
+				return "", 0, fmt.Errorf("unknown filter preset: %v", name)
+			}
+			specs = append(specs, filter.spec)
+			if filter.tempo != 0 {
+				tempo *= filter.tempo
+			}
+		}
+	}
+
+	return strings.Join(specs, ","), tempo, nil
+}
@@ -0,0 +1,353 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beakbeak/aurelius/internal/mediadb"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// hlsSegmentDuration is the length of each segment of an HLS stream, except
+// for the last, which may be shorter.
+const hlsSegmentDuration = 6 * time.Second
+
+// hlsSegmentExtension is the file extension of HLS segment URLs. Segments are
+// stored in MPEG transport streams.
+const hlsSegmentExtension = ".ts"
+
+// hlsPreRoll is the length of the extra audio encoded on either side of a
+// segment, so that the encoder's priming and padding can be discarded.
+const hlsPreRoll = 250 * time.Millisecond
+
+// hlsSegmentMaxAge is how long, in seconds, clients may cache a segment.
+// Segment names include a version covering everything the audio depends on
+// besides the query (see hlsSegmentVersion), so a segment never changes.
+const hlsSegmentMaxAge = 365 * 24 * 60 * 60
+
+// hlsCodecs lists the codecs that may be requested for HLS streams. They must
+// be supported by both the MPEG-TS container and common HLS clients.
+var hlsCodecs = []string{"aac", "mp3"}
+
+// hlsSegmentCount returns the number of segments in an HLS stream of the given
+// duration.
+func hlsSegmentCount(duration time.Duration) int {
+	return int((duration + hlsSegmentDuration - 1) / hlsSegmentDuration)
+}
+
+// hlsSegmentVersion returns the part of a segment name that identifies the
+// track's contents, along with the stored metadata that affects the encoded
+// audio: the ReplayGain values, which may have been computed by the scanner
+// for the whole album, the default ReplayGain mode from the track's directory
+// config, and the detected silence, which is trimmed if requested.
+func hlsSegmentVersion(track *mediadb.Track) string {
+	metadata := &track.Metadata
+	digest := sha256.New()
+	digest.Write(track.Hash)
+	fmt.Fprintf(digest, "\x00%q", metadata.ReplayGainMode)
+	if rg := metadata.ReplayGain; rg != nil {
+		fmt.Fprintf(digest, "\x00rg:%v,%v,%v,%v", rg.Track, rg.Album, rg.TrackNoclip, rg.AlbumNoclip)
+	}
+	if silence := metadata.Silence; silence != nil {
+		fmt.Fprintf(digest, "\x00silence:%v,%v,%v", silence.Leading, silence.Trailing, silence.Threshold)
+	}
+	return hex.EncodeToString(digest.Sum(nil)[:8])
+}
+
+// parseHLSOptions interprets the query parameters of an HLS request for track.
+// They are the same as those of a stream request, including filters, except
+// that only hlsCodecs may be used.
+func parseHLSOptions(src aurelib.Source, track *mediadb.Track, req *http.Request) (*streamOptions, error) {
+	options, err := parseStreamOptions(src, req.URL.Query(), "aac", replayGainMode(track))
+	if err != nil {
+		return nil, err
+	}
+
+	supported := false
+	for _, codec := range hlsCodecs {
+		if options.codec == codec {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("codec not supported for HLS: %v", options.codec)
+	}
+
+	options.formatName = "mpegts"
+	options.mimeType = "video/mp2t"
+	options.config.MuxerOptions = nil
+	if options.codec == "mp3" {
+		// frames that borrow bits from their predecessors can't follow a frame
+		// from a different segment
+		options.config.EncoderOptions = map[string]string{"reservoir": "0"}
+	}
+	return options, nil
+}
+
+// handleHLSPlaylist serves an HLS media playlist for a track. The playlist
+// lists segments of fixed duration, which are encoded on demand by
+// handleHLSSegment. Query parameters are passed along to the segment URLs.
+//
+// Requesting a playlist doesn't record a play, since clients may request it
+// again at any time, e.g., to resume playback.
+func (ml *Library) handleHLSPlaylist(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to get track", "path", libraryPath, "error", err)
+		return
+	}
+	if track == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	selection, err := parseStreamSelection(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream selection", "error", err)
+		return
+	}
+	trimSilence, err := parseTrimSilence(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+	src, err := ml.newTrackSource(libraryPath, track, trimSilence, selection...)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.ErrorContext(ctx, "failed to open track", "path", libraryPath, "error", err)
+		return
+	}
+	defer src.Destroy()
+
+	options, err := parseHLSOptions(src, track, req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+
+	duration := options.outputDuration(src)
+	if duration <= 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "track has unknown duration", "path", libraryPath)
+		return
+	}
+
+	query := ""
+	if req.URL.RawQuery != "" {
+		query = "?" + req.URL.RawQuery
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(hlsSegmentDuration.Seconds())))
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	version := hlsSegmentVersion(track)
+	segmentCount := hlsSegmentCount(duration)
+	for i := range segmentCount {
+		segmentDuration := min(hlsSegmentDuration, duration-time.Duration(i)*hlsSegmentDuration)
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n", segmentDuration.Seconds())
+		fmt.Fprintf(&playlist, "segments/%d-%s%s%s\n", i, version, hlsSegmentExtension, query)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write([]byte(playlist.String())); err != nil {
+		slog.DebugContext(ctx, "failed to write playlist", "error", err)
+	}
+}
+
+// handleHLSSegment encodes and serves one segment of an HLS stream. The
+// segment is identified by segmentName, as listed in the playlist produced by
+// handleHLSPlaylist. A segment of an earlier version of the track is not
+// found.
+//
+// Segments are encoded independently, starting from a seek to the beginning
+// of the segment. Timestamps are continuous across segments; see
+// encodeSegment.
+func (ml *Library) handleHLSSegment(
+	libraryPath string,
+	segmentName string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	baseName, ok := strings.CutSuffix(segmentName, hlsSegmentExtension)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	indexStr, version, ok := strings.Cut(baseName, "-")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to get track", "path", libraryPath, "error", err)
+		return
+	}
+	if track == nil || version != hlsSegmentVersion(track) {
+		http.NotFound(w, req)
+		return
+	}
+
+	// segments are determined entirely by the version and the query
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(fmt.Appendf(nil, "%s/%d?%s", version, index, req.URL.RawQuery)))
+	w.Header().Set("ETag", etag)
+	if match := req.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	selection, err := parseStreamSelection(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream selection", "error", err)
+		return
+	}
+	trimSilence, err := parseTrimSilence(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+	src, err := ml.newTrackSource(libraryPath, track, trimSilence, selection...)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.ErrorContext(ctx, "failed to open track", "path", libraryPath, "error", err)
+		return
+	}
+	defer src.Destroy()
+
+	options, err := parseHLSOptions(src, track, req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+
+	duration := options.outputDuration(src)
+	if index >= hlsSegmentCount(duration) {
+		http.NotFound(w, req)
+		return
+	}
+	startTime := time.Duration(index) * hlsSegmentDuration
+	endTime := min(startTime+hlsSegmentDuration, duration)
+
+	if ml.config.DeterministicStreaming {
+		options.config.BitExact = true
+	}
+
+	data, err := encodeSegment(ctx, src, options, startTime, endTime, endTime == duration)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to encode segment", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", options.mimeType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", hlsSegmentMaxAge))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		slog.DebugContext(ctx, "failed to write segment", "error", err)
+	}
+}
+
+// encodeSegment encodes the audio of src between startTime and endTime, and
+// returns the encoded data. The times refer to the output, which differs from
+// src if options.filter changes the tempo. isLast indicates that endTime is
+// the end of the output.
+//
+// Independently encoded segments would each begin with the encoder's priming
+// and end with its padding, which are heard as gaps between segments. To avoid
+// them, encoding starts and ends hlsPreRoll beyond the segment, and only the
+// packets that start within the segment are kept. Encoding starts at a
+// multiple of the encoder's frame size, so the packets of every segment lie on
+// the same grid and adjacent segments neither overlap nor leave a gap.
+func encodeSegment(
+	ctx context.Context,
+	src aurelib.Source,
+	options *streamOptions,
+	startTime time.Duration,
+	endTime time.Duration,
+	isLast bool,
+) ([]byte, error) {
+	// the frame size and sample rate are only known once the encoder has been
+	// opened
+	probe, err := aurelib.NewBufferSink(options.formatName, options.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sink: %w", err)
+	}
+	frameSize := int64(probe.FrameSize())
+	sampleRate := int64(probe.StreamInfo().SampleRate)
+	probe.Destroy()
+
+	preRollFrames := int64((startTime-hlsPreRoll).Seconds()*float64(sampleRate)) / frameSize
+	encodeStart := time.Duration(0)
+	if preRollFrames > 0 {
+		// round up, so that the sink rounds back down to the same sample
+		encodeStart = time.Duration((preRollFrames*frameSize*int64(time.Second) + sampleRate - 1) / sampleRate)
+	}
+
+	segmentConfig := *options.config
+	segmentConfig.StartTime = encodeStart
+	segmentConfig.OutputStart = startTime
+	segmentConfig.OutputEnd = 0
+	if !isLast {
+		segmentConfig.OutputEnd = endTime
+	}
+
+	sink, err := aurelib.NewBufferSink(options.formatName, &segmentConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sink: %w", err)
+	}
+	defer sink.Destroy()
+
+	transcodeOptions := aurelib.NewTranscodeOptions()
+	transcodeOptions.Volume = options.volume
+	transcodeOptions.Filter = options.filter
+	transcodeOptions.StartTime = options.sourceTime(encodeStart)
+	if !isLast {
+		transcodeOptions.EndTime = options.sourceTime(endTime + hlsPreRoll)
+	}
+	transcodeOptions.DecodeError = func(err error) {
+		slog.ErrorContext(ctx, "failed to decode frame", "error", err)
+	}
+	if err := aurelib.Transcode(ctx, src, sink, transcodeOptions); err != nil {
+		return nil, err
+	}
+	sink.Flush()
+	return bytes.Clone(sink.Buffer()), nil
+}
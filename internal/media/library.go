@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/beakbeak/aurelius/internal/mediadb"
@@ -55,6 +56,59 @@ type LibraryConfig struct {
 	// and muxing. It should be set to true when deterministic output is needed,
 	// such as when performing automated testing. (Default: false)
 	DeterministicStreaming bool
+
+	// TranscodeCacheSize is the maximum number of bytes of transcoded tracks to
+	// keep in StoragePath. Complete transcodes are served from the cache when
+	// the same track is requested again with the same encoding parameters. If
+	// 0, transcodes are not cached. (Default: 0)
+	TranscodeCacheSize int64
+
+	// PrefetchTracks is the number of upcoming tracks to transcode into the
+	// transcode cache in the background when a track is streamed, unless the
+	// stream request specifies otherwise. Has no effect if TranscodeCacheSize
+	// is 0. (Default: 0)
+	PrefetchTracks int
+
+	// ComputeReplayGain controls whether the loudness of tracks without
+	// ReplayGain tags is measured when they are scanned, so that ReplayGain can
+	// be applied to them. Each directory is treated as an album when computing
+	// album gain. Enabling it causes such tracks to be decoded in full during
+	// the next scan. (Default: false)
+	ComputeReplayGain bool
+
+	// DetectSilence controls whether the silence at the start and end of each
+	// track is measured when it is scanned, so that it can be skipped with the
+	// trimSilence parameter of a stream request. Enabling it causes every track
+	// to be decoded in full during the next scan. (Default: false)
+	DetectSilence bool
+
+	// SilenceThreshold is the level in dBFS at or below which audio is
+	// considered silent by DetectSilence. (Default: -60)
+	SilenceThreshold float64
+
+	// ComputeFingerprints controls whether an acoustic fingerprint of each
+	// track is computed when it is scanned, so that copies of the same
+	// recording in different formats can be listed with the duplicates API.
+	// Enabling it causes the start of every track to be decoded during the
+	// next scan. (Default: false)
+	ComputeFingerprints bool
+
+	// AllowTagEditing controls whether the tags of tracks can be changed with
+	// the tag-edit API, which rewrites the files in RootPath. The database is
+	// updated when the filesystem watcher sees the rewritten file.
+	// (Default: false)
+	AllowTagEditing bool
+
+	// Include and Exclude hold glob patterns matching files and directories in
+	// RootPath that are added to the library even if they would be excluded,
+	// and that are left out of it. Patterns without a slash match names, and
+	// others match paths relative to RootPath. Hidden files and directories
+	// are excluded unless an include pattern matches them. Files of types
+	// the library doesn't recognize are never added. Patterns in
+	// aurelius.yaml files take precedence. Files are added and removed
+	// accordingly when the patterns change. (Default: none)
+	Include []string
+	Exclude []string
 }
 
 // NewLibraryConfig creates a new LibraryConfig object with default values.
@@ -64,6 +118,7 @@ func NewLibraryConfig() *LibraryConfig {
 		StreamAheadBytes:  512 * 1024,
 		StreamAheadTime:   10 * time.Second,
 		ThrottleStreaming: true,
+		SilenceThreshold:  -60,
 	}
 }
 
@@ -74,6 +129,20 @@ type Library struct {
 	db      *mediadb.DB
 	watcher *mediadb.Watcher
 	handler http.Handler
+
+	transcodeCache *transcodeCache // nil if caching is disabled
+	prefetcher     *prefetcher     // nil if caching is disabled
+
+	radioMu       sync.Mutex // guards radioStations
+	radioStations map[string]*radioStation
+	radioWG       sync.WaitGroup // tracks running radio stations
+
+	tagWriteMu    sync.Mutex // guards tagWriteLocks
+	tagWriteLocks map[string]*tagWriteLock
+
+	paddingScanMu sync.Mutex      // guards paddingScans
+	paddingScans  map[string]bool // library paths of running padding scans
+	paddingScanWG sync.WaitGroup  // tracks running padding scans
 }
 
 // NewLibrary creates a new Library object.
@@ -107,12 +176,33 @@ func NewLibrary(config *LibraryConfig) (*Library, error) {
 	}
 
 	ml := Library{
-		config: *config,
-		db:     db,
+		config:        *config,
+		db:            db,
+		radioStations: make(map[string]*radioStation),
+		tagWriteLocks: make(map[string]*tagWriteLock),
+		paddingScans:  make(map[string]bool),
 	}
 	ml.setupHandler()
 
 	scanner := mediadb.NewScanner(db, config.RootPath)
+	scanner.ComputeReplayGain(config.ComputeReplayGain)
+	scanner.DetectSilence(config.DetectSilence, config.SilenceThreshold)
+	scanner.ComputeFingerprints(config.ComputeFingerprints)
+	if err := scanner.FilePatterns(config.Include, config.Exclude); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid file patterns: %w", err)
+	}
+
+	if config.TranscodeCacheSize > 0 {
+		cacheDir := filepath.Join(config.StoragePath, "transcodes")
+		if ml.transcodeCache, err = newTranscodeCache(cacheDir, config.TranscodeCacheSize); err != nil {
+			db.Close()
+			return nil, err
+		}
+		scanner.OnHashesReplaced(ml.transcodeCache.invalidate)
+		ml.prefetcher = newPrefetcher(&ml)
+	}
+
 	if err := scanner.FullScan(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to scan media library: %w", err)
@@ -130,8 +220,15 @@ func NewLibrary(config *LibraryConfig) (*Library, error) {
 	return &ml, nil
 }
 
-// Close stops the filesystem watcher and closes the database.
+// Close stops the filesystem watcher, any radio stations, background
+// transcodes and padding scans, and closes the database.
 func (ml *Library) Close() error {
+	ml.stopRadioStations()
+	if ml.prefetcher != nil {
+		ml.prefetcher.stop()
+	}
+	ml.paddingScanWG.Wait()
+
 	var firstErr error
 	if ml.watcher != nil {
 		if err := ml.watcher.Close(); err != nil && firstErr == nil {
@@ -157,13 +254,20 @@ func (ml *Library) setupHandler() {
 	mux.HandleFunc("GET /dirs/{dir}", makeHandler(ml, handleGetDirWrapper))
 	mux.HandleFunc("GET /playlists/{playlist}", makeHandler(ml, handleGetPlaylistWrapper))
 	mux.HandleFunc("GET /playlists/{playlist}/tracks/{track}", makeHandler(ml, handleGetPlaylistTrackWrapper))
+	mux.HandleFunc("GET /playlists/{playlist}/stream", makeHandler(ml, handleStreamPlaylistWrapper))
 	mux.HandleFunc("GET /tracks/{track}", makeHandler(ml, handleGetTrackWrapper))
 	mux.HandleFunc("GET /tracks/{track}/stream", makeHandler(ml, handleStreamTrackWrapper))
+	mux.HandleFunc("GET /tracks/{track}/hls/playlist.m3u8", makeHandler(ml, handleHLSPlaylistWrapper))
+	mux.HandleFunc("GET /tracks/{track}/hls/segments/{segment}", makeHandler(ml, handleHLSSegmentWrapper))
+	mux.HandleFunc("GET /tracks/{track}/waveform", makeHandler(ml, handleGetWaveformWrapper))
+	mux.HandleFunc("GET /radio/{station}", makeHandler(ml, handleRadioWrapper))
 	mux.HandleFunc("GET /images/{image}", makeHandler(ml, handleGetImageWrapper))
 	mux.HandleFunc("GET /tracks/{track}/images/{image}", makeHandler(ml, handleGetTrackImageWrapper))
 	mux.HandleFunc("POST /tracks/{track}/favorite", makeHandler(ml, handleSetTrackFavoriteWrapper))
 	mux.HandleFunc("POST /tracks/{track}/unfavorite", makeHandler(ml, handleUnsetTrackFavoriteWrapper))
+	mux.HandleFunc("PATCH /tracks/{track}/tags", makeHandler(ml, handleSetTrackTagsWrapper))
 	mux.HandleFunc("GET /search", makeHandler(ml, handleSearch))
+	mux.HandleFunc("GET /duplicates", makeHandler(ml, handleDuplicates))
 	ml.handler = http.StripPrefix(ml.config.Prefix, mux)
 }
 
@@ -229,6 +333,21 @@ func handleGetPlaylistTrackWrapper(ml *Library, w http.ResponseWriter, r *http.R
 	ml.handleGetM3UPlaylistTrack(path, pos, w, r)
 }
 
+func handleStreamPlaylistWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("playlist")
+	slog.InfoContext(r.Context(), "stream playlist", "playlist", id)
+	if id == "favorites" {
+		ml.handleStreamPlaylist(ml.favoritesTrackAt(r.URL.Query().Get("prefix")), w, r)
+		return
+	}
+	path, ok := parseAt(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ml.handleStreamPlaylist(ml.m3uPlaylistTrackAt(path), w, r)
+}
+
 func handleGetTrackWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
 	if path, ok := parseAt(r.PathValue("track")); ok {
 		ml.handleGetTrack(path, w, r)
@@ -246,6 +365,37 @@ func handleStreamTrackWrapper(ml *Library, w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func handleHLSPlaylistWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	if path, ok := parseAt(r.PathValue("track")); ok {
+		slog.InfoContext(r.Context(), "stream", "path", path, "hls", true)
+		ml.handleHLSPlaylist(path, w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleHLSSegmentWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	if path, ok := parseAt(r.PathValue("track")); ok {
+		ml.handleHLSSegment(path, r.PathValue("segment"), w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetWaveformWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	if path, ok := parseAt(r.PathValue("track")); ok {
+		ml.handleGetWaveform(path, w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleRadioWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	station := r.PathValue("station")
+	slog.InfoContext(r.Context(), "radio", "station", station)
+	ml.handleRadio(station, w, r)
+}
+
 func handleGetImageWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
 	image := r.PathValue("image")
 	if hashHex, ok := strings.CutPrefix(image, "hash:"); ok {
@@ -279,6 +429,14 @@ func handleUnsetTrackFavoriteWrapper(ml *Library, w http.ResponseWriter, r *http
 	}
 }
 
+func handleSetTrackTagsWrapper(ml *Library, w http.ResponseWriter, r *http.Request) {
+	if path, ok := parseAt(r.PathValue("track")); ok {
+		ml.handleSetTrackTags(path, w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
 func writeJson(
 	req *http.Request,
 	w http.ResponseWriter,
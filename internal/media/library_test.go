@@ -3,11 +3,15 @@ package media_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -16,10 +20,15 @@ import (
 	"path/filepath"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/beakbeak/aurelius/internal/maputil"
 	"github.com/beakbeak/aurelius/internal/media"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
 )
 
 var (
@@ -219,6 +228,55 @@ func combineQueryArgs(argTables [][]ArgTableEntry) []string {
 	return queryStrings
 }
 
+// openStreamedAudio writes streamed audio data to a temporary file and opens
+// it with aurelib so that its format can be inspected.
+func openStreamedAudio(
+	t *testing.T,
+	data []byte,
+	fileName string,
+) *aurelib.FileSource {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), fileName)
+	if err := os.WriteFile(filePath, data, 0o644); err != nil {
+		t.Fatalf("WriteFile(\"%s\") failed: %v", filePath, err)
+	}
+
+	src, err := aurelib.NewFileSource(filePath)
+	if err != nil {
+		t.Fatalf("failed to decode streamed audio: %v", err)
+	}
+	t.Cleanup(src.Destroy)
+	return src
+}
+
+// decodedDuration decodes all audio produced by src and returns its duration.
+func decodedDuration(
+	t *testing.T,
+	src aurelib.Source,
+) time.Duration {
+	t.Helper()
+	sampleCount := uint64(0)
+	for {
+		if recoverable, err := src.Decode(); err != nil && !recoverable {
+			t.Fatalf("Decode() failed: %v", err)
+		}
+		for {
+			status, err := src.ReceiveFrame()
+			if err != nil {
+				t.Fatalf("ReceiveFrame() failed: %v", err)
+			}
+			if status == aurelib.ReceiveFrameEof {
+				info := src.StreamInfo()
+				return time.Duration(sampleCount) * time.Second / time.Duration(info.SampleRate)
+			}
+			if status != aurelib.ReceiveFrameCopyAndCallAgain {
+				break
+			}
+			sampleCount += uint64(src.FrameSize())
+		}
+	}
+}
+
 // JSON utilities //////////////////////////////////////////////////////////////
 
 func jsonEqual(
@@ -294,6 +352,13 @@ func removeJsonElement(
 // Library utilities ///////////////////////////////////////////////////////////
 
 func createDefaultLibrary(t *testing.T) *media.Library {
+	t.Helper()
+	return createLibraryWithCache(t, 0)
+}
+
+// createLibraryWithCache is like createDefaultLibrary, with a transcode cache
+// of the given size.
+func createLibraryWithCache(t *testing.T, cacheSize int64) *media.Library {
 	t.Helper()
 	clearStorage(t)
 
@@ -303,6 +368,7 @@ func createDefaultLibrary(t *testing.T) *media.Library {
 	mlConfig.Prefix = apiPrefix
 	mlConfig.ThrottleStreaming = false
 	mlConfig.DeterministicStreaming = true
+	mlConfig.TranscodeCacheSize = cacheSize
 	ml, err := media.NewLibrary(mlConfig)
 	if err != nil {
 		t.Fatalf("failed to create Library: %v", err)
@@ -471,6 +537,11 @@ func TestTrack(t *testing.T) {
 			// FFmpeg returns inconsistent values for "encoder" tag with .mka files
 			removeJsonElement(trackInfo, "tags", "encoder")
 
+			// Padding depends on the demuxer's interpretation of the file and is
+			// tested separately
+			removeJsonElement(trackInfo, "startPadding")
+			removeJsonElement(trackInfo, "endTrimming")
+
 			baseline := baselines[path]
 
 			if updateBaselines {
@@ -791,6 +862,1208 @@ func TestStream(t *testing.T) {
 	writeBaselines(baselines)
 }
 
+func TestStreamOpus(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	tests := []struct {
+		query    string
+		fileName string
+	}{
+		{"?codec=opus", "out.opus"},
+		{"?codec=opus&container=ogg&quality=3.5", "out.opus"},
+		{"?codec=opus&container=webm&kbitRate=64", "out.webm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			body := simpleRequest(t, ml, "GET", trackAt("test.flac", "stream")+tt.query, "")
+
+			src := openStreamedAudio(t, body, tt.fileName)
+			if codec := src.CodecName(); codec != "opus" {
+				t.Errorf("expected codec %q, got %q", "opus", codec)
+			}
+			if sampleRate := src.StreamInfo().SampleRate; sampleRate != 48000 {
+				t.Errorf("expected sample rate 48000, got %v", sampleRate)
+			}
+		})
+	}
+
+	simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "stream")+"?codec=opus&container=wav", "")
+}
+
+func TestStreamAAC(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	for _, query := range []string{"?codec=aac", "?codec=aac&quality=5", "?codec=aac&kbitRate=128"} {
+		t.Run(query, func(t *testing.T) {
+			body := simpleRequest(t, ml, "GET", trackAt("test.flac", "stream")+query, "")
+
+			src := openStreamedAudio(t, body, "out.m4a")
+			if codec := src.CodecName(); codec != "aac" {
+				t.Errorf("expected codec %q, got %q", "aac", codec)
+			}
+		})
+	}
+}
+
+func TestStreamOriginal(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	t.Run("file", func(t *testing.T) {
+		expected, err := os.ReadFile(filepath.Join(testMediaPath, "test.flac"))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		ml.ServeHTTP(w, httptest.NewRequest("GET", trackAt("test.flac", "stream")+"?codec=original", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "audio/flac" {
+			t.Errorf("expected Content-Type %q, got %q", "audio/flac", contentType)
+		}
+		if !bytes.Equal(w.Body.Bytes(), expected) {
+			t.Error("streamed data does not match file contents")
+		}
+	})
+
+	for _, query := range []string{"?codec=original", "?codec=original&startTime=1s"} {
+		t.Run("fragment"+query, func(t *testing.T) {
+			body := simpleRequest(t, ml, "GET", trackAt("test.flac::002", "stream")+query, "")
+
+			src := openStreamedAudio(t, body, "out.flac")
+			if codec := src.CodecName(); codec != "flac" {
+				t.Errorf("expected codec %q, got %q", "flac", codec)
+			}
+		})
+	}
+
+	t.Run("startTime", func(t *testing.T) {
+		body := simpleRequest(t, ml, "GET", trackAt("test.ogg", "stream")+"?codec=original&startTime=1s", "")
+
+		src := openStreamedAudio(t, body, "out.ogg")
+		if codec := src.CodecName(); codec != "vorbis" {
+			t.Errorf("expected codec %q, got %q", "vorbis", codec)
+		}
+	})
+}
+
+func TestStreamSelection(t *testing.T) {
+	ml := createDefaultLibrary(t)
+	uri := trackAt("test.mka", "stream") + "?codec=wav&prefetch=0"
+
+	expected := simpleRequest(t, ml, "GET", uri, "")
+	for _, stream := range []string{"0", "disposition:default"} {
+		t.Run(stream, func(t *testing.T) {
+			body := simpleRequest(t, ml, "GET", uri+"&stream="+url.QueryEscape(stream), "")
+			if !bytes.Equal(body, expected) {
+				t.Error("selected stream does not match default stream")
+			}
+		})
+	}
+
+	body := simpleRequest(t, ml, "GET", trackAt("test.mka", "stream")+"?codec=original&stream=0", "")
+	src := openStreamedAudio(t, body, "out.ogg")
+	if codec := src.CodecName(); codec != "vorbis" {
+		t.Errorf("expected codec %q, got %q", "vorbis", codec)
+	}
+
+	for _, stream := range []string{"1", "-1", "language:xyz", "disposition:comment", "disposition:bogus", "bogus"} {
+		simpleRequestShouldFail(t, ml, "GET", uri+"&stream="+url.QueryEscape(stream), "")
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	ml := createDefaultLibrary(t)
+	uri := trackAt("test.flac", "stream") + "?codec=flac&prefetch=0"
+
+	var trackInfo media.Track
+	unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.flac"), ""), &trackInfo)
+	trackDuration := time.Duration(trackInfo.Duration * float64(time.Second))
+
+	t.Run("speed", func(t *testing.T) {
+		body := simpleRequest(t, ml, "GET", uri+"&filter=speed2", "")
+		src := openStreamedAudio(t, body, "out.flac")
+		expected := trackDuration / 2
+		if duration := decodedDuration(t, src); (duration - expected).Abs() > 50*time.Millisecond {
+			t.Errorf("expected duration %v, got %v", expected, duration)
+		}
+	})
+
+	for _, query := range []string{"&eq=bass", "&filter=night", "&eq=vocal&filter=loudnorm,speed1.25"} {
+		t.Run(query, func(t *testing.T) {
+			body := simpleRequest(t, ml, "GET", uri+query, "")
+			src := openStreamedAudio(t, body, "out.flac")
+			if codec := src.CodecName(); codec != "flac" {
+				t.Errorf("expected codec %q, got %q", "flac", codec)
+			}
+		})
+	}
+
+	for _, query := range []string{"&eq=bogus", "&filter=bogus", "&filter=night,", "&filter=" + url.QueryEscape("atempo=3")} {
+		simpleRequestShouldFail(t, ml, "GET", uri+query, "")
+	}
+}
+
+func TestComputeReplayGain(t *testing.T) {
+	clearStorage(t)
+
+	mlConfig := media.NewLibraryConfig()
+	mlConfig.RootPath = testMediaPath
+	mlConfig.StoragePath = testStoragePath
+	mlConfig.Prefix = apiPrefix
+	mlConfig.ThrottleStreaming = false
+	mlConfig.DeterministicStreaming = true
+	mlConfig.ComputeReplayGain = true
+	ml, err := media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	defer ml.Close()
+
+	dirInfo := getDirInfo(t, ml, dirAt(""))
+	var computed []media.Track
+	for _, track := range dirInfo.Tracks {
+		if track.Name == "test-positive-gain.ogg" && track.ReplayGainComputed {
+			t.Errorf("expected tagged ReplayGain of %q not to be replaced", track.Name)
+		}
+		if track.ReplayGainComputed {
+			computed = append(computed, track)
+		}
+	}
+	if len(computed) == 0 {
+		t.Fatalf("expected ReplayGain to be computed for tracks without tags")
+	}
+
+	// album gain is computed for the whole directory
+	for _, track := range computed {
+		if track.ReplayGainTrack <= 0 || track.ReplayGainTrack == 1 {
+			t.Errorf("unexpected track gain for %q: %v", track.Name, track.ReplayGainTrack)
+		}
+		if track.ReplayGainAlbum != computed[0].ReplayGainAlbum {
+			t.Errorf(
+				"expected album gain of %q to be %v, got %v",
+				track.Name, computed[0].ReplayGainAlbum, track.ReplayGainAlbum,
+			)
+		}
+	}
+
+	body := simpleRequest(t, ml, "GET", trackAt(computed[0].Name, "stream")+"?codec=flac&replayGain=album", "")
+	src := openStreamedAudio(t, body, "out.flac")
+	if duration := decodedDuration(t, src); duration <= 0 {
+		t.Errorf("expected audio to be streamed with computed ReplayGain")
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	clearStorage(t)
+
+	mlConfig := media.NewLibraryConfig()
+	mlConfig.RootPath = testMediaPath
+	mlConfig.StoragePath = testStoragePath
+	mlConfig.Prefix = apiPrefix
+	mlConfig.ThrottleStreaming = false
+	mlConfig.DeterministicStreaming = true
+	mlConfig.DetectSilence = true
+	// treat quiet passages as silence, so that there's something to trim
+	mlConfig.SilenceThreshold = -20
+	ml, err := media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+
+	for _, path := range []string{"test.flac", "test.ogg", "test.flac::002"} {
+		t.Run(path, func(t *testing.T) {
+			var trackInfo media.Track
+			unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt(path), ""), &trackInfo)
+			if trackInfo.Silence == nil {
+				t.Fatalf("expected silence to be detected")
+			}
+			silence := trackInfo.Silence
+			if silence.Leading < 0 || silence.Trailing < 0 || silence.Leading+silence.Trailing >= trackInfo.Duration {
+				t.Fatalf("invalid silence: %+v (duration %v)", *silence, trackInfo.Duration)
+			}
+
+			uri := trackAt(path, "stream") + "?codec=flac&prefetch=0"
+			for query, trimmed := range map[string]float64{
+				"":                  0,
+				"&trimSilence=true": silence.Leading + silence.Trailing,
+			} {
+				body := simpleRequest(t, ml, "GET", uri+query, "")
+				src := openStreamedAudio(t, body, "out.flac")
+				expected := time.Duration((trackInfo.Duration - trimmed) * float64(time.Second))
+				if duration := decodedDuration(t, src); (duration - expected).Abs() > 50*time.Millisecond {
+					t.Errorf("%q: expected duration %v, got %v", query, expected, duration)
+				}
+			}
+		})
+	}
+
+	simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "stream")+"?trimSilence=bogus", "")
+	simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "stream")+"?codec=original&trimSilence=true", "")
+
+	// tracks are scanned again when the threshold changes
+	ml.Close()
+	mlConfig.SilenceThreshold = -40
+	if ml, err = media.NewLibrary(mlConfig); err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	defer ml.Close()
+
+	var trackInfo media.Track
+	unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.flac"), ""), &trackInfo)
+	if trackInfo.Silence == nil || trackInfo.Silence.Threshold != -40 {
+		t.Errorf("expected silence to be detected again with the new threshold, got %+v", trackInfo.Silence)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	clearStorage(t)
+
+	mlConfig := media.NewLibraryConfig()
+	mlConfig.RootPath = testMediaPath
+	mlConfig.StoragePath = testStoragePath
+	mlConfig.Prefix = apiPrefix
+	mlConfig.ThrottleStreaming = false
+	mlConfig.DeterministicStreaming = true
+	mlConfig.ComputeFingerprints = true
+	ml, err := media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	defer ml.Close()
+
+	var response media.DuplicatesResponse
+	unmarshalJson(t, simpleRequest(t, ml, "GET", api("duplicates"), ""), &response)
+
+	// the test files are the same recording in different formats, while the
+	// fragments of test.flac are shorter parts of it
+	var found []string
+	for _, group := range response.Groups {
+		for _, track := range group {
+			if strings.Contains(track.Name, "::") {
+				t.Errorf("fragment %q reported as a duplicate", track.Name)
+			}
+			if track.Name == "test.wav" {
+				for _, other := range group {
+					found = append(found, other.Name)
+				}
+			}
+		}
+	}
+	for _, name := range []string{"test.flac", "test.mp3", "test.ogg", "test.wav"} {
+		if !slices.Contains(found, name) {
+			t.Errorf("expected %q in the duplicates of test.wav, got %v", name, found)
+		}
+	}
+}
+
+func TestTagEditing(t *testing.T) {
+	// edit copies of the test files, so that the originals are unchanged
+	rootPath := t.TempDir()
+	names := []string{"test.flac", "test.mp3", "test.ogg"}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(testMediaPath, name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(rootPath, name), data, 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	clearStorage(t)
+	mlConfig := media.NewLibraryConfig()
+	mlConfig.RootPath = rootPath
+	mlConfig.StoragePath = testStoragePath
+	mlConfig.Prefix = apiPrefix
+	mlConfig.ThrottleStreaming = false
+	mlConfig.DeterministicStreaming = true
+
+	// editing is disabled by default
+	ml, err := media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	simpleRequestShouldFail(t, ml, "PATCH", trackAt("test.flac", "tags"), `{"title": "x"}`)
+	ml.Close()
+
+	mlConfig.AllowTagEditing = true
+	ml, err = media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	defer ml.Close()
+
+	simpleRequestShouldFail(t, ml, "PATCH", trackAt("nonexistent.mp3", "tags"), `{"title": "x"}`)
+	simpleRequestShouldFail(t, ml, "PATCH", trackAt("test.flac", "tags"), `not json`)
+
+	getTags := func(name string) map[string]string {
+		var track media.Track
+		unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt(name), ""), &track)
+		return track.Tags
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			original := getTags(name)
+			simpleRequest(t, ml, "PATCH", trackAt(name, "tags"), `{"title": "Edited title", "artist": ""}`)
+
+			src, err := aurelib.NewFileSource(filepath.Join(rootPath, name))
+			if err != nil {
+				t.Fatalf("NewFileSource failed: %v", err)
+			}
+			defer src.Destroy()
+			if duration := decodedDuration(t, src); duration < src.Duration()-time.Second {
+				t.Errorf("expected %v of audio after editing tags, got %v", src.Duration(), duration)
+			}
+
+			// the watcher updates the database after a quiet period
+			deadline := time.Now().Add(10 * time.Second)
+			tags := getTags(name)
+			for tags["title"] != "Edited title" && time.Now().Before(deadline) {
+				time.Sleep(100 * time.Millisecond)
+				tags = getTags(name)
+			}
+			if tags["title"] != "Edited title" {
+				t.Fatalf("expected title to be updated, got tags %v", tags)
+			}
+			if _, ok := tags["artist"]; ok {
+				t.Errorf("expected artist to be removed, got tags %v", tags)
+			}
+			for key, value := range original {
+				if key == "title" || key == "artist" || strings.HasPrefix(key, "encoder") {
+					continue
+				}
+				if tags[key] != value {
+					t.Errorf("expected tag %q to be kept as %q, got %q", key, value, tags[key])
+				}
+			}
+		})
+	}
+
+	// concurrent edits of one file are applied one after the other, so that
+	// neither is lost
+	edits := map[string]string{"comment": "First edit", "genre": "Second edit"}
+	var wg sync.WaitGroup
+	statusCodes := make(chan int, len(edits))
+	for key, value := range edits {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, statusCode := simpleRequestWithStatus(t, ml, "PATCH", trackAt("test.flac", "tags"),
+				fmt.Sprintf(`{%q: %q}`, key, value))
+			statusCodes <- statusCode
+		}()
+	}
+	wg.Wait()
+	close(statusCodes)
+	for statusCode := range statusCodes {
+		if statusCode != http.StatusOK {
+			t.Fatalf("concurrent tag edit failed with code %v", statusCode)
+		}
+	}
+	src, err := aurelib.NewFileSource(filepath.Join(rootPath, "test.flac"))
+	if err != nil {
+		t.Fatalf("NewFileSource failed: %v", err)
+	}
+	fileTags := maputil.LowerCaseKeys(src.Tags())
+	src.Destroy()
+	for key, value := range edits {
+		if fileTags[key] != value {
+			t.Errorf("expected tag %q to be %q after concurrent edits, got %q", key, value, fileTags[key])
+		}
+	}
+}
+
+func TestChapters(t *testing.T) {
+	// mark chapters in a copy of a test file with Vorbis comments
+	rootPath := t.TempDir()
+	data, err := os.ReadFile(filepath.Join(testMediaPath, "test.ogg"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	filePath := filepath.Join(rootPath, "book.ogg")
+	if err := os.WriteFile(filePath, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := aurelib.WriteTags(filePath, map[string]string{
+		"CHAPTER001":     "00:00:00.000",
+		"CHAPTER001NAME": "Opening",
+		"CHAPTER002":     "00:00:05.000",
+		"CHAPTER002NAME": "Finale",
+	}); err != nil {
+		t.Fatalf("WriteTags failed: %v", err)
+	}
+
+	src, err := aurelib.NewFileSource(filePath)
+	if err != nil {
+		t.Fatalf("NewFileSource failed: %v", err)
+	}
+	chapters := src.Chapters()
+	src.Destroy()
+	if len(chapters) != 2 {
+		t.Fatalf("expected 2 chapters, got %+v", chapters)
+	}
+	if chapters[1].Start != 5*time.Second || chapters[0].End != 5*time.Second {
+		t.Errorf("expected chapters to meet at 5s, got %+v", chapters)
+	}
+
+	clearStorage(t)
+	mlConfig := media.NewLibraryConfig()
+	mlConfig.RootPath = rootPath
+	mlConfig.StoragePath = testStoragePath
+	mlConfig.Prefix = apiPrefix
+	mlConfig.ThrottleStreaming = false
+	mlConfig.DeterministicStreaming = true
+	ml, err := media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+
+	tracks := make(map[string]media.Track)
+	for _, track := range getDirInfo(t, ml, dirAt("")).Tracks {
+		tracks[track.Name] = track
+	}
+	for name, title := range map[string]string{"book.ogg::001": "Opening", "book.ogg::002": "Finale"} {
+		track, ok := tracks[name]
+		if !ok {
+			t.Fatalf("expected chapter %q in directory listing, got %v", name, tracks)
+		}
+		if track.Tags["title"] != title {
+			t.Errorf("expected title of %q to be %q, got %q", name, title, track.Tags["title"])
+		}
+	}
+	if duration := tracks["book.ogg::001"].Duration; math.Abs(duration-5) > 0.1 {
+		t.Errorf("expected first chapter to last 5s, got %v", duration)
+	}
+	if expected, duration := tracks["book.ogg"].Duration-5, tracks["book.ogg::002"].Duration; math.Abs(duration-expected) > 0.1 {
+		t.Errorf("expected last chapter to last %v, got %v", expected, duration)
+	}
+	ml.Close()
+
+	// chapters can be turned off for a directory
+	if err := os.WriteFile(filepath.Join(rootPath, "aurelius.yaml"), []byte("chapters: false\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ml, err = media.NewLibrary(mlConfig)
+	if err != nil {
+		t.Fatalf("failed to create Library: %v", err)
+	}
+	defer ml.Close()
+
+	dirInfo := getDirInfo(t, ml, dirAt(""))
+	if len(dirInfo.Tracks) != 1 || dirInfo.Tracks[0].Name != "book.ogg" {
+		t.Errorf("expected only book.ogg with chapters ignored, got %v", dirInfo.Tracks)
+	}
+}
+
+func TestWaveform(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	for _, path := range []string{"test.flac", "test.mp3", "test.flac::002"} {
+		t.Run(path, func(t *testing.T) {
+			var waveform media.Waveform
+			unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt(path, "waveform")+"?points=200", ""), &waveform)
+
+			if len(waveform.Min) != 200 || len(waveform.Max) != 200 {
+				t.Fatalf("expected 200 points, got %v and %v", len(waveform.Min), len(waveform.Max))
+			}
+			audible := false
+			for i := range waveform.Min {
+				if waveform.Min[i] < -1 || waveform.Max[i] > 1 || waveform.Min[i] > waveform.Max[i] {
+					t.Fatalf("invalid peak at %v: [%v, %v]", i, waveform.Min[i], waveform.Max[i])
+				}
+				if waveform.Max[i]-waveform.Min[i] > 0.01 {
+					audible = true
+				}
+			}
+			if !audible {
+				t.Errorf("expected waveform to show audio")
+			}
+
+			// the second request is served from the database, which stores
+			// peaks with 16-bit precision
+			var cached media.Waveform
+			unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt(path, "waveform")+"?points=200", ""), &cached)
+			if len(cached.Min) != len(waveform.Min) {
+				t.Fatalf("expected %v cached points, got %v", len(waveform.Min), len(cached.Min))
+			}
+			for i := range cached.Min {
+				if math.Abs(float64(cached.Min[i]-waveform.Min[i])) > 1e-4 ||
+					math.Abs(float64(cached.Max[i]-waveform.Max[i])) > 1e-4 {
+					t.Fatalf("cached peak at %v differs: [%v, %v] vs [%v, %v]",
+						i, cached.Min[i], cached.Max[i], waveform.Min[i], waveform.Max[i])
+				}
+			}
+
+			// other resolutions are derived from the same cached peaks
+			var halved media.Waveform
+			unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt(path, "waveform")+"?points=100", ""), &halved)
+			if len(halved.Min) != 100 {
+				t.Fatalf("expected 100 points, got %v", len(halved.Min))
+			}
+			for i := range halved.Min {
+				if halved.Min[i] != min(cached.Min[2*i], cached.Min[2*i+1]) ||
+					halved.Max[i] != max(cached.Max[2*i], cached.Max[2*i+1]) {
+					t.Fatalf("peak at %v doesn't combine the peaks at higher resolution", i)
+				}
+			}
+		})
+	}
+
+	var waveform media.Waveform
+	unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.flac", "waveform"), ""), &waveform)
+	if len(waveform.Min) != 1000 {
+		t.Errorf("expected default of 1000 points, got %v", len(waveform.Min))
+	}
+
+	for _, query := range []string{"?points=0", "?points=-1", "?points=bogus", "?points=100000"} {
+		simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "waveform")+query, "")
+	}
+	simpleRequestShouldFail(t, ml, "GET", trackAt("nonexistent.mp3", "waveform"), "")
+}
+
+func TestReaderSource(t *testing.T) {
+	for _, name := range []string{"test.flac", "test.mp3", "test.ogg", "test.wav", "test.mka"} {
+		t.Run(name, func(t *testing.T) {
+			filePath := filepath.Join(testMediaPath, name)
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+
+			fileSrc, err := aurelib.NewFileSource(filePath)
+			if err != nil {
+				t.Fatalf("NewFileSource failed: %v", err)
+			}
+			defer fileSrc.Destroy()
+
+			readerSrc, err := aurelib.NewReaderSource(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("NewReaderSource failed: %v", err)
+			}
+			defer readerSrc.Destroy()
+
+			if readerSrc.CodecName() != fileSrc.CodecName() {
+				t.Errorf("expected codec %q, got %q", fileSrc.CodecName(), readerSrc.CodecName())
+			}
+			if readerSrc.StreamInfo() != fileSrc.StreamInfo() {
+				t.Errorf("expected stream info %+v, got %+v", fileSrc.StreamInfo(), readerSrc.StreamInfo())
+			}
+			if !reflect.DeepEqual(readerSrc.Tags(), fileSrc.Tags()) {
+				t.Errorf("expected tags %v, got %v", fileSrc.Tags(), readerSrc.Tags())
+			}
+			if fileDuration, readerDuration := decodedDuration(t, fileSrc), decodedDuration(t, readerSrc); readerDuration != fileDuration {
+				t.Errorf("expected decoded duration %v, got %v", fileDuration, readerDuration)
+			}
+
+			if err := readerSrc.SeekTo(time.Second); err != nil {
+				t.Fatalf("SeekTo failed: %v", err)
+			}
+			if duration := decodedDuration(t, readerSrc); duration >= readerSrc.Duration() {
+				t.Errorf("expected less than %v after seeking, got %v", readerSrc.Duration(), duration)
+			}
+		})
+	}
+
+	if _, err := aurelib.NewReaderSource(bytes.NewReader([]byte("not audio"))); err == nil {
+		t.Error("NewReaderSource succeeded on invalid data")
+	}
+}
+
+// encodeToWriter encodes src to writer as FLAC in the given container format
+// with a WriterSink.
+func encodeToWriter(
+	t *testing.T,
+	src aurelib.Source,
+	formatName string,
+	writer io.Writer,
+) error {
+	t.Helper()
+	config := aurelib.NewSinkConfig()
+	config.Codec = "flac"
+	sink, err := aurelib.NewWriterSink(formatName, config, writer)
+	if err != nil {
+		return err
+	}
+	defer sink.Destroy()
+	return aurelib.Transcode(context.Background(), src, sink, nil)
+}
+
+// failingWriter accepts limit bytes, then fails.
+type failingWriter struct {
+	limit int
+	err   error
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	if len(data) > w.limit {
+		return 0, w.err
+	}
+	w.limit -= len(data)
+	return len(data), nil
+}
+
+func TestWriterSink(t *testing.T) {
+	open := func(t *testing.T) aurelib.Source {
+		src, err := aurelib.NewFileSource(filepath.Join(testMediaPath, "test.ogg"))
+		if err != nil {
+			t.Fatalf("NewFileSource failed: %v", err)
+		}
+		t.Cleanup(src.Destroy)
+		return src
+	}
+
+	t.Run("Encode", func(t *testing.T) {
+		src := open(t)
+		var buffer bytes.Buffer
+		if err := encodeToWriter(t, src, "flac", &buffer); err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+
+		encoded, err := aurelib.NewReaderSource(bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			t.Fatalf("NewReaderSource failed: %v", err)
+		}
+		defer encoded.Destroy()
+		if codec := encoded.CodecName(); codec != "flac" {
+			t.Errorf("expected codec \"flac\", got %q", codec)
+		}
+		expected := src.Duration()
+		if duration := decodedDuration(t, encoded); duration < expected-50*time.Millisecond ||
+			duration > expected+50*time.Millisecond {
+			t.Errorf("expected decoded duration of about %v, got %v", expected, duration)
+		}
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		writeErr := fmt.Errorf("test write error")
+		for _, limit := range []int{0, 16 * 1024} {
+			src := open(t)
+			err := encodeToWriter(t, src, "flac", &failingWriter{limit, writeErr})
+			if !errors.Is(err, writeErr) {
+				t.Errorf("limit %v: expected error wrapping %v, got %v", limit, writeErr, err)
+			}
+		}
+	})
+}
+
+func TestTranscode(t *testing.T) {
+	transcode := func(t *testing.T, ctx context.Context, options *aurelib.TranscodeOptions) ([]byte, error) {
+		t.Helper()
+		src, err := aurelib.NewFileSource(filepath.Join(testMediaPath, "test.flac"))
+		if err != nil {
+			t.Fatalf("NewFileSource failed: %v", err)
+		}
+		defer src.Destroy()
+
+		sink, err := aurelib.NewBufferSink("wav", aurelib.NewSinkConfig())
+		if err != nil {
+			t.Fatalf("NewBufferSink failed: %v", err)
+		}
+		defer sink.Destroy()
+
+		err = aurelib.Transcode(ctx, src, sink, options)
+		sink.Flush()
+		return bytes.Clone(sink.Buffer()), err
+	}
+
+	t.Run("Range", func(t *testing.T) {
+		var progress []time.Duration
+		options := aurelib.NewTranscodeOptions()
+		options.StartTime = 500 * time.Millisecond
+		options.EndTime = 1500 * time.Millisecond
+		options.Progress = func(encoded time.Duration) {
+			progress = append(progress, encoded)
+		}
+
+		data, err := transcode(t, context.Background(), options)
+		if err != nil {
+			t.Fatalf("Transcode failed: %v", err)
+		}
+
+		src, err := aurelib.NewReaderSource(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("NewReaderSource failed: %v", err)
+		}
+		defer src.Destroy()
+		if duration := decodedDuration(t, src); duration != time.Second {
+			t.Errorf("expected decoded duration %v, got %v", time.Second, duration)
+		}
+
+		if len(progress) == 0 {
+			t.Fatal("progress wasn't reported")
+		}
+		if !slices.IsSorted(progress) {
+			t.Errorf("progress went backward: %v", progress)
+		}
+		if last := progress[len(progress)-1]; last != time.Second {
+			t.Errorf("expected final progress %v, got %v", time.Second, last)
+		}
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		options := aurelib.NewTranscodeOptions()
+		options.EndTime = 2 * time.Second
+		options.Filter = "atempo=2"
+		data, err := transcode(t, context.Background(), options)
+		if err != nil {
+			t.Fatalf("Transcode failed: %v", err)
+		}
+
+		src, err := aurelib.NewReaderSource(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("NewReaderSource failed: %v", err)
+		}
+		defer src.Destroy()
+		if duration := decodedDuration(t, src); (duration - time.Second).Abs() > 50*time.Millisecond {
+			t.Errorf("expected decoded duration of about %v, got %v", time.Second, duration)
+		}
+
+		options.Filter = "bogus"
+		if _, err := transcode(t, context.Background(), options); err == nil {
+			t.Error("Transcode succeeded with an invalid filter")
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := transcode(t, ctx, nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestHLS(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	for _, query := range []string{"", "?codec=mp3&replayGain=off"} {
+		t.Run(query, func(t *testing.T) {
+			playlist := string(simpleRequest(t, ml, "GET", trackAt("test.flac", "hls", "playlist.m3u8")+query, ""))
+			if !strings.HasPrefix(playlist, "#EXTM3U\n") {
+				t.Fatalf("invalid playlist:\n%s", playlist)
+			}
+			if !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+				t.Errorf("playlist is not complete:\n%s", playlist)
+			}
+
+			var segmentUris []string
+			for _, line := range strings.Split(playlist, "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					segmentUris = append(segmentUris, line)
+				}
+			}
+			if len(segmentUris) == 0 {
+				t.Fatalf("playlist contains no segments:\n%s", playlist)
+			}
+
+			expectedCodec := "aac"
+			if query != "" {
+				expectedCodec = "mp3"
+			}
+			for _, segmentUri := range segmentUris {
+				body := simpleRequest(t, ml, "GET", trackAt("test.flac", "hls", segmentUri), "")
+				src := openStreamedAudio(t, body, "segment.ts")
+				if codec := src.CodecName(); codec != expectedCodec {
+					t.Errorf("expected codec %q, got %q", expectedCodec, codec)
+				}
+			}
+
+			lastUri := segmentUris[len(segmentUris)-1]
+			beyondUri := strings.Replace(lastUri,
+				fmt.Sprintf("/%d-", len(segmentUris)-1), fmt.Sprintf("/%d-", len(segmentUris)), 1)
+			simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "hls", beyondUri), "")
+
+			staleUri := strings.Replace(segmentUris[0], "/0-", "/0-0", 1)
+			simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "hls", staleUri), "")
+		})
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		playlistDuration := func(query string) float64 {
+			playlist := string(simpleRequest(t, ml, "GET", trackAt("test.flac", "hls", "playlist.m3u8")+query, ""))
+			total := 0.
+			for _, line := range strings.Split(playlist, "\n") {
+				if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+					seconds, err := strconv.ParseFloat(strings.TrimSuffix(value, ","), 64)
+					if err != nil {
+						t.Fatalf("invalid segment duration: %v", line)
+					}
+					total += seconds
+				}
+			}
+			return total
+		}
+
+		// the segments cover the output, which is shorter when sped up
+		normal, fast := playlistDuration(""), playlistDuration("?filter=speed2")
+		if math.Abs(fast-normal/2) > 0.01 {
+			t.Errorf("expected duration %v with speed2, got %v", normal/2, fast)
+		}
+
+		playlist := string(simpleRequest(t, ml, "GET", trackAt("test.flac", "hls", "playlist.m3u8")+"?filter=speed2", ""))
+		for _, line := range strings.Split(playlist, "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				body := simpleRequest(t, ml, "GET", trackAt("test.flac", "hls", line), "")
+				openStreamedAudio(t, body, "segment.ts")
+			}
+		}
+
+		simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "hls", "playlist.m3u8")+"?filter=bogus", "")
+	})
+
+	simpleRequestShouldFail(t, ml, "GET", trackAt("test.flac", "hls", "playlist.m3u8")+"?codec=vorbis", "")
+}
+
+func TestGapless(t *testing.T) {
+	ml := createDefaultLibrary(t)
+
+	t.Run("track info", func(t *testing.T) {
+		var mp3Info, flacInfo media.Track
+		unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.mp3"), ""), &mp3Info)
+		unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.flac"), ""), &flacInfo)
+
+		// test.mp3 has a LAME tag
+		if mp3Info.StartPadding == 0 {
+			t.Error("expected start padding for test.mp3")
+		}
+		if flacInfo.StartPadding != 0 || flacInfo.EndTrimming != 0 {
+			t.Errorf("expected no padding for test.flac, got %v/%v", flacInfo.StartPadding, flacInfo.EndTrimming)
+		}
+	})
+
+	t.Run("mp3", func(t *testing.T) {
+		body := simpleRequest(t, ml, "GET", trackAt("test.flac", "stream")+"?codec=mp3&gapless=true", "")
+		if xing := bytes.Index(body, []byte("Xing")); xing < 0 || xing > 64 {
+			t.Fatal("expected Xing header in first frame")
+		}
+		if !bytes.Contains(body[:512], []byte("LAME")) {
+			t.Fatal("expected LAME tag in first frame")
+		}
+
+		src := openStreamedAudio(t, body, "out.mp3")
+		if codec := src.CodecName(); codec != "mp3" {
+			t.Errorf("expected codec %q, got %q", "mp3", codec)
+		}
+
+		var trackInfo media.Track
+		unmarshalJson(t, simpleRequest(t, ml, "GET", trackAt("test.flac"), ""), &trackInfo)
+		expected := time.Duration(trackInfo.Duration * float64(time.Second))
+		if diff := (src.Duration() - expected).Abs(); diff > 50*time.Millisecond {
+			t.Errorf("expected duration %v, got %v", expected, src.Duration())
+		}
+	})
+
+	t.Run("opus", func(t *testing.T) {
+		body := simpleRequest(t, ml, "GET", trackAt("test.flac", "stream")+"?codec=opus&gapless=true", "")
+		head := bytes.Index(body, []byte("OpusHead"))
+		if head < 0 || len(body) < head+12 {
+			t.Fatal("expected OpusHead packet")
+		}
+		if preSkip := binary.LittleEndian.Uint16(body[head+10:]); preSkip == 0 {
+			t.Error("expected nonzero pre-skip")
+		}
+	})
+}
+
+func TestStreamRange(t *testing.T) {
+	ml := createDefaultLibrary(t)
+	uri := trackAt("test.flac", "stream") + "?codec=wav"
+
+	rangeRequest := func(byteRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("Range", byteRange)
+		w := httptest.NewRecorder()
+		ml.ServeHTTP(w, req)
+		return w
+	}
+
+	full := rangeRequest("bytes=0-")
+	if full.Code != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, full.Code)
+	}
+	fullBody := full.Body.Bytes()
+	if contentLength := full.Header().Get("Content-Length"); contentLength != fmt.Sprint(len(fullBody)) {
+		t.Errorf("expected Content-Length %d, got %q", len(fullBody), contentLength)
+	}
+	openStreamedAudio(t, fullBody, "out.wav")
+
+	// the size is also reported for requests without a Range header
+	plain := httptest.NewRecorder()
+	ml.ServeHTTP(plain, httptest.NewRequest("GET", uri, nil))
+	if plain.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, plain.Code)
+	}
+	if contentLength := plain.Header().Get("Content-Length"); contentLength != fmt.Sprint(len(fullBody)) {
+		t.Errorf("expected Content-Length %d, got %q", len(fullBody), contentLength)
+	}
+	if !bytes.Equal(plain.Body.Bytes(), fullBody) {
+		t.Error("full content does not match ranged content")
+	}
+
+	for _, r := range [][2]int{
+		{0, 99},
+		{1000, 1999},
+		{len(fullBody) / 2, len(fullBody)/2 + 4095},
+		{len(fullBody) - 100, len(fullBody) - 1},
+	} {
+		t.Run(fmt.Sprintf("%d-%d", r[0], r[1]), func(t *testing.T) {
+			w := rangeRequest(fmt.Sprintf("bytes=%d-%d", r[0], r[1]))
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("expected status %d, got %d", http.StatusPartialContent, w.Code)
+			}
+			expectedRange := fmt.Sprintf("bytes %d-%d/%d", r[0], r[1], len(fullBody))
+			if contentRange := w.Header().Get("Content-Range"); contentRange != expectedRange {
+				t.Errorf("expected Content-Range %q, got %q", expectedRange, contentRange)
+			}
+			if !bytes.Equal(w.Body.Bytes(), fullBody[r[0]:r[1]+1]) {
+				t.Error("partial content does not match full content")
+			}
+		})
+	}
+
+	unsatisfiable := rangeRequest(fmt.Sprintf("bytes=%d-", len(fullBody)))
+	if unsatisfiable.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected status %d, got %d", http.StatusRequestedRangeNotSatisfiable, unsatisfiable.Code)
+	}
+}
+
+func TestTranscodeCache(t *testing.T) {
+	ml := createLibraryWithCache(t, 1024*1024*1024)
+	uri := trackAt("test.flac", "stream") + "?codec=vorbis&prefetch=0"
+
+	first := simpleRequest(t, ml, "GET", uri, "")
+	cacheEntries, err := os.ReadDir(filepath.Join(testStoragePath, "transcodes"))
+	if err != nil {
+		t.Fatalf("failed to read transcode cache directory: %v", err)
+	}
+	if len(cacheEntries) != 1 {
+		t.Fatalf("expected 1 cached transcode, got %d", len(cacheEntries))
+	}
+
+	second := simpleRequest(t, ml, "GET", uri, "")
+	if !bytes.Equal(first, second) {
+		t.Error("cached transcode does not match original")
+	}
+
+	// byte ranges are supported for cached transcodes of any codec
+	req := httptest.NewRequest("GET", uri, nil)
+	req.Header.Set("Range", "bytes=100-199")
+	w := httptest.NewRecorder()
+	ml.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), first[100:200]) {
+		t.Error("partial content does not match full content")
+	}
+
+	// partial streams aren't cached
+	simpleRequest(t, ml, "GET", trackAt("test.flac", "stream")+"?codec=mp3&startTime=1s", "")
+	if cacheEntries, _ = os.ReadDir(filepath.Join(testStoragePath, "transcodes")); len(cacheEntries) != 1 {
+		t.Errorf("expected 1 cached transcode, got %d", len(cacheEntries))
+	}
+}
+
+// waitForTranscodes waits for the transcode cache to hold count entries and
+// returns their contents by file name.
+func waitForTranscodes(t *testing.T, count int) map[string][]byte {
+	t.Helper()
+	cacheDir := filepath.Join(testStoragePath, "transcodes")
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		cacheEntries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			t.Fatalf("failed to read transcode cache directory: %v", err)
+		}
+		transcodes := make(map[string][]byte)
+		for _, entry := range cacheEntries {
+			if strings.HasPrefix(entry.Name(), "tmp-") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(cacheDir, entry.Name()))
+			if err != nil {
+				t.Fatalf("failed to read cached transcode: %v", err)
+			}
+			transcodes[entry.Name()] = data
+		}
+		if len(transcodes) == count && len(transcodes) == len(cacheEntries) {
+			return transcodes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d cached transcodes, got %d", count, len(transcodes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		query   string
+		current string
+		next    string
+	}{
+		{"Dir", "", "test.flac::003", "test.mka"},
+		{"Playlist", "&playlist=at:test.m3u&pos=0", "test.flac", "test.mp3"},
+		{"Favorites", "&playlist=favorites&pos=0", "test.flac", "test.ogg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ml := createLibraryWithCache(t, 1024*1024*1024)
+			simpleRequest(t, ml, "POST", trackAt("test.flac", "favorite"), "")
+			simpleRequest(t, ml, "POST", trackAt("test.ogg", "favorite"), "")
+
+			encoding := "?codec=vorbis&quality=2"
+			current := simpleRequest(
+				t, ml, "GET", trackAt(tc.current, "stream")+encoding+"&prefetch=1&session=test"+tc.query, "")
+			transcodes := waitForTranscodes(t, 2)
+
+			next := simpleRequest(t, ml, "GET", trackAt(tc.next, "stream")+encoding+"&prefetch=0", "")
+			found := false
+			for _, data := range transcodes {
+				if bytes.Equal(data, next) {
+					found = true
+				} else if !bytes.Equal(data, current) {
+					t.Error("unexpected cached transcode")
+				}
+			}
+			if !found {
+				t.Errorf("%s was not prefetched", tc.next)
+			}
+			waitForTranscodes(t, 2)
+		})
+	}
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		ml := createDefaultLibrary(t)
+
+		// WAV output isn't prefetched, so only the Vorbis stream is cached
+		simpleRequest(t, ml, "GET", trackAt("test.flac::003", "stream")+"?codec=wav&prefetch=1&session=test", "")
+		simpleRequest(t, ml, "GET", trackAt("test.flac::003", "stream")+"?codec=vorbis&prefetch=0", "")
+		waitForTranscodes(t, 1)
+	})
+}
+
+func TestStreamPlaylist(t *testing.T) {
+	ml := createDefaultLibrary(t)
+	playlistPath := playlistAt("test.m3u")
+
+	var expected time.Duration
+	length := getPlaylistLength(t, ml, playlistPath)
+	for i := 0; i < length; i++ {
+		entry := getPlaylistEntry(t, ml, playlistPath, i)
+		var trackInfo media.Track
+		unmarshalJson(t, simpleRequest(t, ml, "GET", entry.Path, ""), &trackInfo)
+		expected += time.Duration(trackInfo.Duration * float64(time.Second))
+	}
+	tolerance := time.Duration(length) * 50 * time.Millisecond
+
+	for _, crossfade := range []time.Duration{0, time.Second} {
+		t.Run(fmt.Sprint("crossfade=", crossfade), func(t *testing.T) {
+			query := fmt.Sprintf("?codec=flac&crossfade=%v", crossfade)
+			body := simpleRequest(t, ml, "GET", playlistPath+"/stream"+query, "")
+			duration := decodedDuration(t, openStreamedAudio(t, body, "out.ogg"))
+
+			// each transition overlaps two tracks
+			expectedWithFade := expected - time.Duration(length-1)*crossfade
+			if diff := (duration - expectedWithFade).Abs(); diff > tolerance {
+				t.Errorf("expected duration %v, got %v", expectedWithFade, duration)
+			}
+		})
+	}
+
+	simpleRequestShouldFail(t, ml, "GET", playlistPath+"/stream?crossfade=-1s", "")
+	simpleRequestShouldFail(t, ml, "GET", playlistPath+"/stream?crossfade=1h", "")
+	simpleRequestShouldFail(t, ml, "GET", playlistPath+"/stream?codec=original", "")
+	simpleRequestShouldFail(t, ml, "GET", api("playlists", "favorites", "stream")+"?prefix=nonexistent", "")
+}
+
+func TestRadio(t *testing.T) {
+	ml := createDefaultLibrary(t)
+	server := httptest.NewServer(ml)
+	defer server.Close()
+
+	listen := func(station string, query string, icy bool) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", server.URL+api("radio", station)+query, nil)
+		if err != nil {
+			t.Fatalf("NewRequest() failed: %v", err)
+		}
+		if icy {
+			req.Header.Set("Icy-MetaData", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	readBytes := func(r io.Reader, n int) []byte {
+		t.Helper()
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("ReadFull() failed: %v", err)
+		}
+		return buf
+	}
+
+	icyListener := listen(atPath(""), "", true)
+	if icyListener.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, icyListener.StatusCode)
+	}
+	if contentType := icyListener.Header.Get("Content-Type"); contentType != "audio/mpeg" {
+		t.Errorf("expected Content-Type %q, got %q", "audio/mpeg", contentType)
+	}
+	metaInt, err := strconv.Atoi(icyListener.Header.Get("icy-metaint"))
+	if err != nil {
+		t.Fatalf("invalid icy-metaint: %v", err)
+	}
+	readBytes(icyListener.Body, metaInt)
+	metadataLength := int(readBytes(icyListener.Body, 1)[0]) * 16
+	if metadata := readBytes(icyListener.Body, metadataLength); !bytes.HasPrefix(metadata, []byte("StreamTitle='")) {
+		t.Errorf("expected stream title in metadata, got %q", metadata)
+	}
+
+	// listeners with the same query share a station
+	plainListener := listen(atPath(""), "", false)
+	if header := readBytes(plainListener.Body, 3); string(header) != "ID3" {
+		t.Errorf("expected stream to start with ID3 tag, got %q", header)
+	}
+	if count := ml.RadioStationCount(); count != 1 {
+		t.Errorf("expected 1 station, got %v", count)
+	}
+
+	oggListener := listen(atPath("foo"), "?codec=vorbis", false)
+	if header := readBytes(oggListener.Body, 4); string(header) != "OggS" {
+		t.Errorf("expected Ogg stream, got %q", header)
+	}
+	if count := ml.RadioStationCount(); count != 2 {
+		t.Errorf("expected 2 stations, got %v", count)
+	}
+
+	// stations stop when their listeners leave
+	icyListener.Body.Close()
+	plainListener.Body.Close()
+	oggListener.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); ml.RadioStationCount() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stations to stop, %v still running", ml.RadioStationCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp := listen("bogus", "", false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown station, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if resp := listen(atPath(""), "?codec=flac", false); resp.StatusCode == http.StatusOK {
+		t.Error("expected unsupported codec to fail")
+	}
+}
+
 func TestTrackImages(t *testing.T) {
 	ml := createDefaultLibrary(t)
 
@@ -1333,4 +2606,15 @@ func TestPlayHistory(t *testing.T) {
 	if count != 2 {
 		t.Fatalf("expected 2 plays after streaming with startTime=2s, got %d", count)
 	}
+
+	// Fetching an HLS playlist should NOT record a play.
+	simpleRequest(t, ml, "GET", trackAt(trackPath, "hls", "playlist.m3u8"), "")
+
+	count, err = db.PlayCount(trackPath)
+	if err != nil {
+		t.Fatalf("PlayCount failed: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 plays after fetching an HLS playlist, got %d", count)
+	}
 }
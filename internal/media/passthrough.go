@@ -0,0 +1,302 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beakbeak/aurelius/internal/mediadb"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// originalMimeTypes maps lower-case file extensions to the MIME types used when
+// serving track files unmodified. Extensions not listed here are looked up with
+// mime.TypeByExtension.
+var originalMimeTypes = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".mka":  "audio/x-matroska",
+	".mp3":  "audio/mpeg",
+	".mp4":  "audio/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".webm": "audio/webm",
+}
+
+// A remuxFormat describes the container used to stream encoded packets of a
+// particular codec without re-encoding them.
+type remuxFormat struct {
+	formatName   string
+	mimeType     string
+	muxerOptions map[string]string
+}
+
+// fragmentedMP4Options are muxer options that allow MP4 output to be streamed
+// progressively. See the "aac" case in handleStreamTrack.
+var fragmentedMP4Options = map[string]string{
+	"movflags":      "+empty_moov+default_base_moof",
+	"frag_duration": "1000000", // microseconds
+}
+
+// remuxFormats maps codec names, as returned by aurelib.Source.CodecName, to
+// the container used for remuxing. Codecs not listed here use
+// fallbackRemuxFormat.
+var remuxFormats = map[string]remuxFormat{
+	"aac":       {"mp4", "audio/mp4", fragmentedMP4Options},
+	"alac":      {"mp4", "audio/mp4", fragmentedMP4Options},
+	"flac":      {"flac", "audio/flac", nil},
+	"mp3":       {"mp3", "audio/mpeg", nil},
+	"opus":      {"ogg", "audio/ogg", nil},
+	"pcm_s16le": {"wav", "audio/wav", nil},
+	"pcm_s24le": {"wav", "audio/wav", nil},
+	"pcm_u8":    {"wav", "audio/wav", nil},
+	"vorbis":    {"ogg", "audio/ogg", nil},
+}
+
+// Matroska accepts nearly any codec.
+var fallbackRemuxFormat = remuxFormat{"matroska", "audio/x-matroska", nil}
+
+// requestsStartOfStream returns true if req asks for the stream from the
+// beginning, rather than for a later byte range (e.g., after seeking in the
+// browser).
+func requestsStartOfStream(req *http.Request) bool {
+	rangeHeader := req.Header.Get("Range")
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// handleStreamOriginal streams a track without transcoding it.
+//
+// Whole files are served as they are stored, with support for byte ranges.
+// Fragment tracks, and requests with a start time or a stream selection, have
+// their encoded packets copied into a new container instead. Trimming is done at packet
+// granularity, so the stream may begin or end slightly outside of the
+// requested bounds.
+func (ml *Library) handleStreamOriginal(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	var startTime time.Duration
+	if startTimeArgs, ok := req.URL.Query()["startTime"]; ok {
+		var err error
+		if startTime, err = time.ParseDuration(startTimeArgs[0]); err != nil || startTime < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.ErrorContext(ctx, "invalid start time", "startTime", startTimeArgs[0], "error", err)
+			return
+		}
+	}
+
+	// packets can't be cut at the precise bounds of the detected silence
+	if trimSilence, err := parseTrimSilence(req.URL.Query()); err != nil || trimSilence {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "trimSilence isn't supported for the original codec", "error", err)
+		return
+	}
+
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to get track", "path", libraryPath, "error", err)
+		return
+	}
+	if track == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	// files are served as they are stored unless only part of one is requested
+	_, selectsStream := req.URL.Query()["stream"]
+	if startTime == 0 && track.Metadata.Fragment == nil && !selectsStream {
+		ml.serveOriginalFile(libraryPath, w, req)
+	} else {
+		ml.streamRemuxed(libraryPath, track, startTime, w, req)
+	}
+}
+
+// serveOriginalFile serves the unmodified contents of a track file.
+func (ml *Library) serveOriginalFile(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+	fsPath := ml.libraryToFsPath(libraryPath)
+
+	file, err := os.Open(fsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, req)
+		slog.ErrorContext(ctx, "track file not found", "path", fsPath)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to open track file", "path", fsPath, "error", err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to stat track file", "path", fsPath, "error", err)
+		return
+	}
+
+	if requestsStartOfStream(req) {
+		if err := ml.db.RecordPlay(libraryPath); err != nil {
+			slog.ErrorContext(ctx, "failed to record play", "error", err)
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(fsPath))
+	mimeType, ok := originalMimeTypes[ext]
+	if !ok {
+		if mimeType = mime.TypeByExtension(ext); mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	http.ServeContent(w, req, "", info.ModTime(), file)
+}
+
+// newRemuxer creates a BufferRemuxer for the packets of src, using a container
+// suited to its codec. It returns the MIME type of the container.
+func newRemuxer(src aurelib.PacketSource) (*aurelib.BufferRemuxer, string, error) {
+	format, ok := remuxFormats[src.CodecName()]
+	if !ok {
+		format = fallbackRemuxFormat
+	}
+
+	remuxer, err := aurelib.NewBufferRemuxer(format.formatName, src.CodecParameters(), format.muxerOptions)
+	if err != nil && format.formatName != fallbackRemuxFormat.formatName {
+		slog.Warn("failed to create remuxer; using fallback format",
+			"codec", src.CodecName(), "format", format.formatName, "error", err)
+		format = fallbackRemuxFormat
+		remuxer, err = aurelib.NewBufferRemuxer(format.formatName, src.CodecParameters(), format.muxerOptions)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return remuxer, format.mimeType, nil
+}
+
+// streamRemuxed streams the encoded packets of a track, beginning at
+// startTime, in a new container.
+func (ml *Library) streamRemuxed(
+	libraryPath string,
+	track *mediadb.Track,
+	startTime time.Duration,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	selection, err := parseStreamSelection(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream selection", "error", err)
+		return
+	}
+	src, err := ml.newTrackSource(libraryPath, track, false, selection...)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.ErrorContext(ctx, "failed to open track", "path", libraryPath, "error", err)
+		return
+	}
+	defer src.Destroy()
+
+	packetSrc, ok := src.(aurelib.PacketSource)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "source can't be remuxed", "path", libraryPath)
+		return
+	}
+
+	if startTime > 0 {
+		if err := src.SeekTo(startTime); err != nil {
+			slog.ErrorContext(ctx, "seek failed", "error", err)
+		}
+	} else {
+		if err := ml.db.RecordPlay(libraryPath); err != nil {
+			slog.ErrorContext(ctx, "failed to record play", "error", err)
+		}
+	}
+
+	remuxer, mimeType, err := newRemuxer(packetSrc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to create remuxer", "error", err)
+		return
+	}
+	defer remuxer.Destroy()
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+
+	writeBuffer := func() (int, error) {
+		buffer := remuxer.Buffer()
+		if len(buffer) == 0 {
+			return 0, nil
+		}
+
+		count, err := w.Write(buffer)
+		if count > 0 {
+			remuxer.Drain(uint(count))
+		}
+		return count, err
+	}
+
+	throttle := ml.newStreamThrottle()
+
+	firstPacket := true
+	var firstPacketTime time.Duration
+
+	for {
+		packet, err := packetSrc.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			slog.ErrorContext(ctx, "failed to read packet", "error", err)
+			break
+		}
+
+		if firstPacket {
+			firstPacketTime = packet.StartTime()
+			firstPacket = false
+		}
+		bufferStartTime := packet.StartTime() - firstPacketTime
+		bufferEndTime := bufferStartTime + packet.Duration()
+
+		if err := remuxer.WritePacket(packet); err != nil {
+			slog.ErrorContext(ctx, "failed to write packet", "error", err)
+			break
+		}
+		byteSize, err := writeBuffer()
+		if err != nil {
+			slog.DebugContext(ctx, "failed to write buffer", "error", err)
+			return
+		}
+
+		throttle.wait(bufferStartTime, byteSize, bufferEndTime)
+	}
+
+	if err := remuxer.WriteTrailer(); err != nil {
+		slog.ErrorContext(ctx, "failed to write trailer", "error", err)
+	}
+	if _, err := writeBuffer(); err != nil {
+		slog.DebugContext(ctx, "failed to write buffer", "error", err)
+	}
+}
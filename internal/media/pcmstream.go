@@ -0,0 +1,317 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// A pcmStream presents uncompressed WAV output for a Source as an
+// io.ReadSeeker, so that it can be served with http.ServeContent and support
+// HTTP Range requests.
+//
+// The WAV header is produced once by FFmpeg's muxer, with the sizes of the
+// RIFF and data chunks filled in. Audio data is produced on demand starting
+// from the sample corresponding to the current offset, using Source.SeekTo and
+// discarding any decoded samples that precede it. The total size is computed
+// from the exact number of samples in the Source if it is known, or from
+// Source.Duration otherwise; if the decoded audio turns out shorter or longer
+// than expected, it is padded with silence or truncated.
+type pcmStream struct {
+	src      aurelib.Source
+	config   *aurelib.SinkConfig
+	volume   float64
+	throttle *streamThrottle
+
+	header     []byte
+	sinkInfo   aurelib.StreamInfo
+	frameBytes int64 // bytes per sample across all channels
+	size       int64
+
+	pos  int64
+	pipe *pcmPipeline
+}
+
+// pcmPipeline decodes and encodes audio data starting at a fixed offset in the
+// stream.
+type pcmPipeline struct {
+	sink    *aurelib.BufferSink
+	decoder *aurelib.Decoder
+
+	pos      int64 // stream offset of the next byte produced
+	startPos int64 // stream offset at which the pipeline was started
+
+	skipBytes int64 // encoded bytes still to be discarded
+
+	flushed bool
+}
+
+// pcmRawFormat is the name of the FFmpeg container format used to produce
+// headerless audio data matching the contents of a WAV file's data chunk.
+const pcmRawFormat = "s16le"
+
+// newPCMStream creates a pcmStream for src. srcLength is the exact number of
+// samples in src (see trackSampleCount), or 0 if it is unknown. config must
+// specify the pcm_s16le codec.
+func newPCMStream(
+	src aurelib.Source,
+	srcLength uint64,
+	config *aurelib.SinkConfig,
+	volume float64,
+	throttle *streamThrottle,
+) (*pcmStream, error) {
+	duration := src.Duration()
+	if srcLength == 0 && duration <= 0 {
+		return nil, fmt.Errorf("unknown duration")
+	}
+
+	probe, err := aurelib.NewBufferSink("wav", config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sink: %w", err)
+	}
+	defer probe.Destroy()
+	probe.Flush()
+
+	s := pcmStream{
+		src:      src,
+		config:   config,
+		volume:   volume,
+		throttle: throttle,
+		header:   bytes.Clone(probe.Buffer()),
+		sinkInfo: probe.StreamInfo(),
+	}
+
+	s.frameBytes = int64(s.sinkInfo.ChannelCount() * s.sinkInfo.BytesPerSample())
+	if s.frameBytes <= 0 {
+		return nil, fmt.Errorf("unsupported output format")
+	}
+
+	sinkRate := float64(s.sinkInfo.SampleRate)
+	var totalSamples int64
+	if srcLength > 0 {
+		totalSamples = int64(math.Round(float64(srcLength) * sinkRate / float64(src.StreamInfo().SampleRate)))
+	} else {
+		totalSamples = int64(math.Round(duration.Seconds() * sinkRate))
+	}
+	dataSize := totalSamples * s.frameBytes
+	if err := setWAVSizes(s.header, dataSize); err != nil {
+		return nil, err
+	}
+	s.size = int64(len(s.header)) + dataSize
+	return &s, nil
+}
+
+// setWAVSizes fills in the sizes of the RIFF and data chunks in header, a WAV
+// header ending at the start of the data chunk's contents. FFmpeg's muxer
+// writes placeholders when it can't seek back to the header. Sizes that don't
+// fit in 32 bits are left as placeholders, which most readers take to mean
+// "until the end of the file".
+func setWAVSizes(header []byte, dataSize int64) error {
+	if len(header) < 20 ||
+		string(header[:4]) != "RIFF" ||
+		string(header[len(header)-8:len(header)-4]) != "data" {
+		return fmt.Errorf("unexpected WAV header")
+	}
+	riffSize := int64(len(header)) - 8 + dataSize
+	if riffSize > math.MaxUint32 {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(header[4:], uint32(riffSize))
+	binary.LittleEndian.PutUint32(header[len(header)-4:], uint32(dataSize))
+	return nil
+}
+
+// Close frees the resources used by the pcmStream. It does not destroy the
+// Source.
+func (s *pcmStream) Close() error {
+	s.stopPipeline()
+	return nil
+}
+
+// Seek implements io.Seeker.
+func (s *pcmStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Read implements io.Reader.
+func (s *pcmStream) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), s.size-s.pos)]
+
+	if s.pipe == nil || s.pipe.pos != s.pos {
+		if err := s.startPipeline(); err != nil {
+			return 0, err
+		}
+	}
+
+	if headerSize := int64(len(s.header)); s.pos < headerSize {
+		n := copy(p, s.header[s.pos:])
+		s.advance(n)
+		return n, nil
+	}
+
+	chunkStartTime := s.playedTime()
+	n, err := s.readData(p)
+	s.advance(n)
+	s.throttle.wait(chunkStartTime, n, s.playedTime())
+	return n, err
+}
+
+func (s *pcmStream) advance(byteCount int) {
+	s.pos += int64(byteCount)
+	s.pipe.pos = s.pos
+}
+
+// playedTime returns the amount of audio produced by the current pipeline.
+func (s *pcmStream) playedTime() time.Duration {
+	dataStart := max(s.pipe.startPos, int64(len(s.header)))
+	samples := max(s.pos-dataStart, 0) / s.frameBytes
+	return time.Duration(float64(samples) / float64(s.sinkInfo.SampleRate) * float64(time.Second))
+}
+
+func (s *pcmStream) readData(p []byte) (int, error) {
+	pipe := s.pipe
+	for {
+		buffer := pipe.sink.Buffer()
+		if len(buffer) > 0 && pipe.skipBytes > 0 {
+			pipe.skipBytes -= int64(pipe.sink.Drain(uint(min(pipe.skipBytes, int64(len(buffer))))))
+			continue
+		}
+		if len(buffer) > 0 {
+			n := copy(p, buffer)
+			pipe.sink.Drain(uint(n))
+			return n, nil
+		}
+		if pipe.flushed {
+			// the source ended earlier than its reported duration
+			clear(p)
+			return len(p), nil
+		}
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// startPipeline sets up a new pcmPipeline producing data from the current
+// stream position.
+func (s *pcmStream) startPipeline() error {
+	s.stopPipeline()
+
+	dataPos := max(s.pos-int64(len(s.header)), 0)
+	targetSample := dataPos / s.frameBytes
+
+	// The Decoder seeks to any later position, and discards the decoded audio
+	// that precedes it. The beginning must be sought explicitly, since the
+	// Source may have been read by a previous pipeline.
+	startTime := time.Duration(float64(targetSample) / float64(s.sinkInfo.SampleRate) * float64(time.Second))
+	if startTime == 0 {
+		if err := s.src.SeekTo(0); err != nil {
+			return fmt.Errorf("seek failed: %w", err)
+		}
+	}
+
+	success := false
+	pipe := pcmPipeline{
+		pos:       s.pos,
+		startPos:  s.pos,
+		skipBytes: dataPos % s.frameBytes,
+	}
+	defer func() {
+		if !success {
+			pipe.destroy()
+		}
+	}()
+
+	var err error
+	if pipe.sink, err = aurelib.NewBufferSink(pcmRawFormat, s.config); err != nil {
+		return fmt.Errorf("failed to create sink: %w", err)
+	}
+	if pipe.decoder, err = aurelib.NewDecoder(s.src, pipe.sink.StreamInfo(), s.volume, startTime); err != nil {
+		return err
+	}
+	pipe.decoder.DecodeError = func(err error) {
+		slog.Error("failed to decode frame", "error", err)
+	}
+
+	success = true
+	s.pipe = &pipe
+	return nil
+}
+
+func (s *pcmStream) stopPipeline() {
+	if s.pipe != nil {
+		s.pipe.destroy()
+		s.pipe = nil
+	}
+}
+
+func (pipe *pcmPipeline) destroy() {
+	if pipe.decoder != nil {
+		pipe.decoder.Destroy()
+	}
+	if pipe.sink != nil {
+		pipe.sink.Destroy()
+	}
+}
+
+// fill encodes at least one frame of audio into the pipeline's sink, or
+// flushes the sink if the end of the Source has been reached.
+func (s *pcmStream) fill() error {
+	pipe := s.pipe
+	decoder := pipe.decoder
+	fifo := decoder.Fifo()
+
+	if err := decoder.Fill(pipe.sink.FrameSize()); err != nil {
+		return err
+	}
+	eof := decoder.Done()
+	if err := decoder.Err(); err != nil {
+		slog.Error("failed to decode frame", "error", err)
+	}
+
+	outFrameSize := pipe.sink.FrameSize()
+	if eof {
+		outFrameSize = 1
+	}
+	for fifo.Size() >= outFrameSize {
+		frame, err := fifo.ReadFrame(pipe.sink.FrameSize())
+		if err != nil {
+			return fmt.Errorf("failed to read frame from FIFO: %w", err)
+		}
+		if _, err := pipe.sink.Encode(frame); err != nil {
+			return fmt.Errorf("failed to encode frame: %w", err)
+		}
+	}
+
+	if eof && !pipe.flushed {
+		if err := aurelib.FlushSink(pipe.sink); err != nil {
+			return fmt.Errorf("failed to flush sink: %w", err)
+		}
+		pipe.flushed = true
+	}
+	pipe.sink.Flush()
+	return nil
+}
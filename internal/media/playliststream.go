@@ -0,0 +1,371 @@
+package media
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/beakbeak/aurelius/internal/mediadb"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// maxCrossfade is the longest crossfade that may be requested for a playlist
+// stream.
+const maxCrossfade = 30 * time.Second
+
+// A playlistTrackDecoder decodes one track of a playlist stream into a Fifo, in
+// the format accepted by the stream's Sink.
+type playlistTrackDecoder struct {
+	libraryPath string
+	src         aurelib.Source
+	decoder     *aurelib.Decoder
+	fifo        *aurelib.Fifo // the Decoder's Fifo
+	done        bool          // whether the end of the track has been reached
+}
+
+// Destroy frees resources held by the playlistTrackDecoder, including its
+// Source.
+func (d *playlistTrackDecoder) Destroy() {
+	if d.decoder != nil {
+		d.decoder.Destroy()
+	}
+	d.src.Destroy()
+}
+
+// newPlaylistTrackDecoder creates a playlistTrackDecoder that converts the
+// output of src to the format described by sinkStreamInfo, scaling its
+// loudness by volume. It takes ownership of src, even if it fails.
+func newPlaylistTrackDecoder(
+	libraryPath string,
+	src aurelib.Source,
+	sinkStreamInfo aurelib.StreamInfo,
+	volume float64,
+) (*playlistTrackDecoder, error) {
+	d := &playlistTrackDecoder{libraryPath: libraryPath, src: src}
+
+	var err error
+	if d.decoder, err = aurelib.NewDecoder(src, sinkStreamInfo, volume, 0); err != nil {
+		d.Destroy()
+		return nil, err
+	}
+	d.fifo = d.decoder.Fifo()
+	return d, nil
+}
+
+// fill decodes audio until the Fifo holds at least sampleCount samples or the
+// end of the track is reached. Errors end the track early.
+func (d *playlistTrackDecoder) fill(ctx context.Context, sampleCount uint) {
+	if d.done {
+		return
+	}
+	d.decoder.DecodeError = func(err error) {
+		slog.ErrorContext(ctx, "failed to decode frame", "path", d.libraryPath, "error", err)
+	}
+
+	if err := d.decoder.Fill(sampleCount); err != nil {
+		slog.ErrorContext(ctx, "failed to decode track", "path", d.libraryPath, "error", err)
+		d.done = true
+		return
+	}
+	if err := d.decoder.Err(); err != nil {
+		slog.ErrorContext(ctx, "failed to decode frame", "path", d.libraryPath, "error", err)
+	}
+	d.done = d.decoder.Done()
+}
+
+// moveSamples transfers at most sampleCount samples from one Fifo to another.
+func moveSamples(from *aurelib.Fifo, to *aurelib.Fifo, sampleCount uint) error {
+	if sampleCount == 0 {
+		return nil
+	}
+	frame, err := from.ReadFrame(sampleCount)
+	if err != nil {
+		return err
+	}
+	defer frame.Destroy()
+	return to.WriteFrame(frame)
+}
+
+// crossfadeSamples removes sampleCount samples from each of two Fifos, mixes
+// them so that the audio of from fades into that of to, and writes the result
+// to out.
+func crossfadeSamples(from *aurelib.Fifo, to *aurelib.Fifo, out *aurelib.Fifo, sampleCount uint) error {
+	if sampleCount == 0 {
+		return nil
+	}
+	fadeOut, err := from.ReadFrame(sampleCount)
+	if err != nil {
+		return err
+	}
+	defer fadeOut.Destroy()
+
+	fadeIn, err := to.ReadFrame(sampleCount)
+	if err != nil {
+		return err
+	}
+	defer fadeIn.Destroy()
+
+	if err := aurelib.CrossfadeFrames(fadeOut, fadeIn, 0, sampleCount); err != nil {
+		return err
+	}
+	return out.WriteFrame(fadeOut)
+}
+
+// handleStreamPlaylist streams every track of a playlist, one after another,
+// as a single encoded stream. trackAt returns the library path of the track at
+// a position in the playlist, or "" after the last track.
+//
+// The query accepts the same encoding and ReplayGain parameters as
+// handleStreamTrack, except that the default codec is MP3, and codec=original
+// and startTime are not supported. ReplayGain is applied to each track
+// separately, entirely on the server side. If crossfade is given as a
+// duration, the end of each track is mixed with the start of the next over
+// that length of time.
+func (ml *Library) handleStreamPlaylist(
+	trackAt func(pos int) (string, error),
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	var crossfade time.Duration
+	if crossfadeArgs, ok := query["crossfade"]; ok {
+		var err error
+		if crossfade, err = time.ParseDuration(crossfadeArgs[0]); err != nil ||
+			crossfade < 0 || crossfade > maxCrossfade {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.ErrorContext(ctx, "invalid crossfade", "crossfade", crossfadeArgs[0], "error", err)
+			return
+		}
+	}
+
+	trimSilence, err := parseTrimSilence(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+
+	// openNextTrack opens the next track in the playlist that can be decoded,
+	// skipping the rest. It returns an empty path at the end of the playlist.
+	pos := 0
+	openNextTrack := func() (string, aurelib.Source, *mediadb.Track) {
+		for ; ; pos++ {
+			libraryPath, err := trackAt(pos)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to get playlist track", "position", pos, "error", err)
+				return "", nil, nil
+			}
+			if libraryPath == "" {
+				return "", nil, nil
+			}
+
+			src, track, err := ml.newAudioSource(libraryPath, trimSilence)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to open track", "path", libraryPath, "error", err)
+				continue
+			}
+			pos++
+			return libraryPath, src, track
+		}
+	}
+
+	firstPath, firstSrc, firstTrack := openNextTrack()
+	if firstSrc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.ErrorContext(ctx, "no playable tracks in playlist")
+		return
+	}
+
+	// the format of the first track is used for the whole stream
+	options, err := parseStreamOptions(firstSrc, query, "mp3", replayGainMode(firstTrack))
+	if err != nil {
+		firstSrc.Destroy()
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "invalid stream options", "error", err)
+		return
+	}
+	config := options.config
+	if ml.config.DeterministicStreaming {
+		config.BitExact = true
+	}
+
+	sink, err := aurelib.NewBufferSink(options.formatName, config)
+	if err != nil {
+		firstSrc.Destroy()
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to create sink", "error", err)
+		return
+	}
+	defer sink.Destroy()
+
+	sinkStreamInfo := sink.StreamInfo()
+
+	// newDecoder takes ownership of src
+	newDecoder := func(libraryPath string, src aurelib.Source, track *mediadb.Track) (*playlistTrackDecoder, error) {
+		volume, err := parseReplayGain(src, query, replayGainMode(track))
+		if err != nil {
+			src.Destroy()
+			return nil, err
+		}
+		decoder, err := newPlaylistTrackDecoder(libraryPath, src, sinkStreamInfo, volume)
+		if err != nil {
+			return nil, err
+		}
+		if err := ml.db.RecordPlay(libraryPath); err != nil {
+			slog.ErrorContext(ctx, "failed to record play", "error", err)
+		}
+		return decoder, nil
+	}
+
+	current, err := newDecoder(firstPath, firstSrc, firstTrack)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to set up track", "path", firstPath, "error", err)
+		return
+	}
+	defer func() {
+		if current != nil {
+			current.Destroy()
+		}
+	}()
+
+	// samples from all tracks are collected here before encoding
+	fifo, err := aurelib.NewFifo(sinkStreamInfo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to create FIFO", "error", err)
+		return
+	}
+	defer fifo.Destroy()
+
+	w.Header().Set("Content-Type", options.mimeType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+
+	writeBuffer := func() (int, error) {
+		buffer := sink.Buffer()
+		if len(buffer) == 0 {
+			return 0, nil
+		}
+
+		count, err := w.Write(buffer)
+		if count > 0 {
+			sink.Drain(uint(count))
+		}
+		return count, err
+	}
+
+	playedSamples := uint64(0)
+	getPlayedTime := func() time.Duration {
+		// calculate with millisecond precision to prevent overflow
+		return time.Duration(((playedSamples * 1000) /
+			uint64(sinkStreamInfo.SampleRate)) * 1000000)
+	}
+
+	throttle := ml.newStreamThrottle()
+	frameSize := sink.FrameSize()
+	fadeSamples := uint(math.Round(crossfade.Seconds() * float64(sinkStreamInfo.SampleRate)))
+
+	done := false
+
+PlayLoop:
+	for !done {
+		// Keep enough of the current track buffered to crossfade with the next
+		// one once the end of the current track is reached.
+		current.fill(ctx, frameSize+fadeSamples)
+
+		if remaining := current.fifo.Size(); !current.done || remaining > fadeSamples {
+			if err := moveSamples(current.fifo, fifo, min(remaining-min(remaining, fadeSamples), frameSize)); err != nil {
+				slog.ErrorContext(ctx, "failed to buffer samples", "error", err)
+				break PlayLoop
+			}
+		} else {
+			var next *playlistTrackDecoder
+			for next == nil {
+				nextPath, nextSrc, nextTrack := openNextTrack()
+				if nextSrc == nil {
+					break
+				}
+				if next, err = newDecoder(nextPath, nextSrc, nextTrack); err != nil {
+					slog.ErrorContext(ctx, "failed to set up track", "path", nextPath, "error", err)
+				}
+			}
+
+			if next == nil {
+				if err := moveSamples(current.fifo, fifo, remaining); err != nil {
+					slog.ErrorContext(ctx, "failed to buffer samples", "error", err)
+				}
+				done = true
+			} else {
+				// the next track may be shorter than the crossfade
+				next.fill(ctx, remaining)
+				fade := min(remaining, next.fifo.Size())
+
+				if err := moveSamples(current.fifo, fifo, remaining-fade); err != nil {
+					slog.ErrorContext(ctx, "failed to buffer samples", "error", err)
+					break PlayLoop
+				}
+				if err := crossfadeSamples(current.fifo, next.fifo, fifo, fade); err != nil {
+					slog.ErrorContext(ctx, "failed to crossfade tracks", "error", err)
+					break PlayLoop
+				}
+				current.Destroy()
+				current = next
+			}
+		}
+
+		var outFrameSize uint
+		if !done {
+			outFrameSize = frameSize
+		} else {
+			outFrameSize = 1
+		}
+
+		bufferStartTime := getPlayedTime()
+		for fifo.Size() >= outFrameSize {
+			frame, err := fifo.ReadFrame(frameSize)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to read frame from FIFO", "error", err)
+				break PlayLoop
+			}
+			playedSamples += uint64(frame.Size)
+			if _, err = sink.Encode(frame); err != nil {
+				slog.ErrorContext(ctx, "failed to encode frame", "error", err)
+				break PlayLoop
+			}
+		}
+		byteSize, err := writeBuffer()
+		if err != nil {
+			slog.DebugContext(ctx, "failed to write buffer", "error", err)
+			return
+		}
+
+		throttle.wait(bufferStartTime, byteSize, getPlayedTime())
+	}
+
+	if err = aurelib.FlushSink(sink); err != nil {
+		slog.ErrorContext(ctx, "failed to flush sink", "error", err)
+	}
+	if _, err = writeBuffer(); err != nil {
+		slog.DebugContext(ctx, "failed to write buffer", "error", err)
+	}
+}
+
+// m3uPlaylistTrackAt returns a function that looks up the tracks of the M3U
+// playlist at playlistPath, for use with handleStreamPlaylist.
+func (ml *Library) m3uPlaylistTrackAt(playlistPath string) func(pos int) (string, error) {
+	return func(pos int) (string, error) {
+		return ml.db.GetM3UPlaylistTrackAt(playlistPath, pos)
+	}
+}
+
+// favoritesTrackAt returns a function that looks up favorite tracks in
+// directories matching prefix, for use with handleStreamPlaylist.
+func (ml *Library) favoritesTrackAt(prefix string) func(pos int) (string, error) {
+	return func(pos int) (string, error) {
+		return ml.db.GetFavoriteAt(pos, prefix)
+	}
+}
@@ -0,0 +1,321 @@
+package media
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/beakbeak/aurelius/internal/mediadb"
+)
+
+const (
+	// prefetchWorkers is the number of tracks that may be transcoded in the
+	// background at once.
+	prefetchWorkers = 2
+
+	// prefetchQueueLength is the number of background transcodes that may be
+	// waiting for a worker. Further transcodes are dropped.
+	prefetchQueueLength = 32
+
+	// maxPrefetchTracks is the largest number of upcoming tracks that a stream
+	// request may ask to have transcoded in the background.
+	maxPrefetchTracks = 10
+)
+
+// streamContextParams are the query parameters of a stream request that
+// describe where the track is being played from, rather than how it is
+// encoded.
+var streamContextParams = []string{"playlist", "pos", "prefix", "prefetch", "session", "startTime"}
+
+// uncompressedCodecs lists the codecs whose output isn't prefetched, since it
+// would quickly fill the transcode cache.
+var uncompressedCodecs = []string{"wav"}
+
+// A prefetchJob is a request to transcode a track into the transcode cache.
+type prefetchJob struct {
+	ctx         context.Context // canceled when the job's session moves on
+	session     *prefetchSession
+	libraryPath string
+	query       url.Values // encoding parameters, as for a stream request
+}
+
+// A prefetchSession is the set of pending transcodes scheduled for a client
+// session.
+type prefetchSession struct {
+	key     string
+	cancel  context.CancelFunc
+	pending int // jobs not yet finished; guarded by prefetcher.mu
+}
+
+// A prefetcher transcodes tracks that are likely to be played next into the
+// transcode cache, using a fixed number of background workers. Each client
+// session has at most one set of pending transcodes; scheduling new ones
+// cancels the old. A session is forgotten once its transcodes are finished.
+type prefetcher struct {
+	ml     *Library
+	jobs   chan prefetchJob
+	ctx    context.Context // canceled when the prefetcher is stopped
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex // guards sessions
+	sessions map[string]*prefetchSession
+}
+
+// newPrefetcher creates a prefetcher and starts its workers.
+func newPrefetcher(ml *Library) *prefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{
+		ml:       ml,
+		jobs:     make(chan prefetchJob, prefetchQueueLength),
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[string]*prefetchSession),
+	}
+	p.wg.Add(prefetchWorkers)
+	for range prefetchWorkers {
+		go p.work()
+	}
+	return p
+}
+
+// stop cancels all pending and running transcodes and waits for the workers
+// to exit.
+func (p *prefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// schedule replaces the pending transcodes of session with transcodes of the
+// tracks at libraryPaths, in order.
+func (p *prefetcher) schedule(session string, libraryPaths []string, query url.Values) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	s := &prefetchSession{key: session, cancel: cancel, pending: len(libraryPaths)}
+
+	p.mu.Lock()
+	if old, ok := p.sessions[session]; ok {
+		old.cancel()
+	}
+	p.sessions[session] = s
+	p.mu.Unlock()
+
+	for i, libraryPath := range libraryPaths {
+		select {
+		case p.jobs <- prefetchJob{ctx, s, libraryPath, query}:
+		default:
+			slog.Debug("prefetch queue full", "path", libraryPath)
+			p.finish(s, len(libraryPaths)-i)
+			return
+		}
+	}
+	if len(libraryPaths) == 0 {
+		p.finish(s, 0)
+	}
+}
+
+// finish records that jobCount jobs of a session have finished or been
+// dropped. When none are left, the session's context is released, and the
+// session is forgotten unless it has already been replaced.
+func (p *prefetcher) finish(s *prefetchSession, jobCount int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.pending -= jobCount; s.pending > 0 {
+		return
+	}
+	s.cancel()
+	if p.sessions[s.key] == s {
+		delete(p.sessions, s.key)
+	}
+}
+
+func (p *prefetcher) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case job := <-p.jobs:
+			if job.ctx.Err() == nil {
+				if err := p.ml.transcodeToCache(job.ctx, job.libraryPath, job.query); err != nil {
+					slog.Warn("failed to prefetch track", "path", job.libraryPath, "error", err)
+				}
+			}
+			p.finish(job.session, 1)
+		}
+	}
+}
+
+// transcodeToCache transcodes the track at libraryPath into the transcode cache
+// with the encoding described by query, unless it is already cached.
+func (ml *Library) transcodeToCache(ctx context.Context, libraryPath string, query url.Values) error {
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil || track == nil {
+		return err
+	}
+
+	selection, err := parseStreamSelection(query)
+	if err != nil {
+		return err
+	}
+	trimSilence, err := parseTrimSilence(query)
+	if err != nil {
+		return err
+	}
+	src, err := ml.newTrackSource(libraryPath, track, trimSilence, selection...)
+	if err != nil {
+		return err
+	}
+	defer src.Destroy()
+
+	options, err := parseStreamOptions(src, query, "wav", replayGainMode(track))
+	if err != nil {
+		return err
+	}
+	if ml.config.DeterministicStreaming {
+		options.config.BitExact = true
+	}
+	if options.describesLength() {
+		ml.ensurePadding(ctx, libraryPath, track)
+	}
+
+	key := options.cacheKey(track)
+	if file := ml.transcodeCache.open(track.Hash, key); file != nil {
+		file.Close()
+		return nil
+	}
+
+	cacheWriter, err := ml.transcodeCache.create(track.Hash, key)
+	if err != nil {
+		return err
+	}
+	encoder, err := newTrackEncoder(src, trackSampleCount(track, trimSilence, selection), options, 0, cacheWriter)
+	if err != nil {
+		cacheWriter.Abort()
+		return err
+	}
+	defer encoder.Destroy()
+
+	slog.Debug("prefetching track", "path", libraryPath)
+	if encoder.run(ctx, nil) {
+		cacheWriter.Commit()
+	} else {
+		cacheWriter.Abort()
+	}
+	return nil
+}
+
+// prefetchAfter schedules background transcodes of the tracks that follow
+// libraryPath, as requested by the query of a stream request:
+//
+//   - prefetch: the number of tracks to transcode
+//   - playlist: "favorites" or "at:{path}" if the track is being played from a
+//     playlist, along with its position in pos (and, for favorites, the
+//     directory prefix in prefix). Otherwise, the tracks that follow it in its
+//     directory are transcoded.
+//   - session: identifies the client, so that its pending transcodes can be
+//     canceled when it moves elsewhere. The client's address is used by
+//     default.
+func (ml *Library) prefetchAfter(libraryPath string, req *http.Request) {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	count := ml.config.PrefetchTracks
+	if prefetchArgs, ok := query["prefetch"]; ok {
+		var err error
+		if count, err = strconv.Atoi(prefetchArgs[0]); err != nil {
+			slog.WarnContext(ctx, "invalid prefetch count", "prefetch", prefetchArgs[0], "error", err)
+			return
+		}
+	}
+	count = min(count, maxPrefetchTracks)
+	if ml.prefetcher == nil || count <= 0 {
+		return
+	}
+	codec := query.Get("codec")
+	if codec == "" || slices.Contains(uncompressedCodecs, codec) {
+		return
+	}
+
+	var libraryPaths []string
+	if playlist := query.Get("playlist"); playlist != "" {
+		pos, err := strconv.Atoi(query.Get("pos"))
+		if err != nil {
+			slog.WarnContext(ctx, "invalid playlist position", "pos", query.Get("pos"), "error", err)
+			return
+		}
+		var trackAt func(pos int) (string, error)
+		if playlist == "favorites" {
+			trackAt = ml.favoritesTrackAt(query.Get("prefix"))
+		} else if playlistPath, ok := parseAt(playlist); ok {
+			trackAt = ml.m3uPlaylistTrackAt(playlistPath)
+		} else {
+			slog.WarnContext(ctx, "invalid playlist", "playlist", playlist)
+			return
+		}
+		for i := 1; i <= count; i++ {
+			nextPath, err := trackAt(pos + i)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to look up playlist track", "error", err)
+				return
+			}
+			if nextPath == "" {
+				break
+			}
+			libraryPaths = append(libraryPaths, nextPath)
+		}
+	} else {
+		dir, name := mediadb.SplitLibraryPath(libraryPath)
+		tracks, err := ml.db.GetTracksInDir(dir)
+		if err != nil {
+			slog.ErrorContext(ctx, "GetTracksInDir failed", "error", err)
+			return
+		}
+
+		// follow the order of the directory listing, which hides fragment
+		// source files
+		fragmentSourceFiles := make(map[string]bool)
+		for _, t := range tracks {
+			if t.Metadata.Fragment != nil {
+				fragmentSourceFiles[t.Metadata.Fragment.SourceFile] = true
+			}
+		}
+		found := false
+		for _, t := range tracks {
+			if !found {
+				found = t.Name == name
+				continue
+			}
+			if fragmentSourceFiles[t.Name] {
+				continue
+			}
+			if len(libraryPaths) == count {
+				break
+			}
+			libraryPaths = append(libraryPaths, joinLibraryPath(t.Dir, t.Name))
+		}
+	}
+
+	session := query.Get("session")
+	if session == "" {
+		session = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			session = host
+		}
+	}
+
+	encodingQuery := url.Values{}
+	for key, values := range query {
+		encodingQuery[key] = values
+	}
+	for _, key := range streamContextParams {
+		encodingQuery.Del(key)
+	}
+
+	ml.prefetcher.schedule(session, libraryPaths, encodingQuery)
+}
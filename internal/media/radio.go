@@ -0,0 +1,651 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beakbeak/aurelius/internal/mediadb"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// radioCodecs lists the codecs that may be requested for radio stations. They
+// must be usable in a stream that listeners can join at any point.
+var radioCodecs = []string{"mp3", "vorbis", "opus"}
+
+// radioMetaInt is the number of audio bytes between ICY metadata blocks.
+const radioMetaInt = 16000
+
+// radioBurstBytes is the approximate amount of recently encoded audio sent to
+// a listener upon connecting, so that playback can begin immediately.
+const radioBurstBytes = 64 * 1024
+
+// radioLead is how far a station's encoder is allowed to run ahead of real time
+// when streaming is throttled.
+const radioLead = time.Second
+
+// radioListenerQueue is the number of chunks that may be queued for a listener.
+// When streaming is throttled, listeners that fall further behind are
+// disconnected.
+const radioListenerQueue = 64
+
+// radioMaxSearchResults limits the number of tracks played by a station that
+// selects tracks with a search query.
+const radioMaxSearchResults = 1000
+
+// A radioChunk is a piece of a station's encoded stream.
+type radioChunk struct {
+	data     []byte
+	title    string // the title of the track being played
+	joinable bool   // whether a listener may begin receiving the stream here
+}
+
+// A radioListener receives the stream of a radioStation.
+type radioListener struct {
+	chunks chan radioChunk // closed by the station when it stops sending
+	done   chan struct{}   // closed when the listener disconnects
+}
+
+// A radioStation continuously plays a shuffled selection of tracks, encoding
+// them once for all of its listeners.
+type radioStation struct {
+	key      string
+	mimeType string
+	isOgg    bool
+	header   []byte // the container header, sent to each listener first
+	stop     chan struct{}
+
+	sink        *aurelib.BufferSink
+	current     *playlistTrackDecoder
+	nextDecoder func() (*playlistTrackDecoder, error)
+
+	mu        sync.Mutex // guards the following fields
+	burst     []radioChunk
+	listeners map[*radioListener]struct{}
+}
+
+// radioTrackList returns a function that lists the tracks selected by a
+// station ID: "favorites", "search", or a directory path in "at:" form. query
+// supplies the favorites prefix or the search query.
+func (ml *Library) radioTrackList(stationID string, query url.Values) (func() ([]string, error), bool) {
+	switch stationID {
+	case "favorites":
+		prefix := query.Get("prefix")
+		return func() ([]string, error) {
+			count, err := ml.db.CountFavorites(prefix)
+			if err != nil {
+				return nil, err
+			}
+			paths := make([]string, 0, count)
+			for pos := range count {
+				libraryPath, err := ml.db.GetFavoriteAt(pos, prefix)
+				if err != nil {
+					return nil, err
+				}
+				if libraryPath != "" {
+					paths = append(paths, libraryPath)
+				}
+			}
+			return paths, nil
+		}, true
+
+	case "search":
+		searchQuery := query.Get("q")
+		return func() ([]string, error) {
+			results, err := ml.db.Search(searchQuery+" .t", radioMaxSearchResults)
+			if err != nil {
+				return nil, err
+			}
+			var paths []string
+			for _, result := range results.Results {
+				paths = append(paths, result.Path)
+			}
+			return paths, nil
+		}, true
+	}
+
+	if dir, ok := parseAt(stationID); ok {
+		return func() ([]string, error) {
+			return ml.db.GetTrackPathsUnder(dir)
+		}, true
+	}
+	return nil, false
+}
+
+// handleRadio serves the stream of a radio station. Stations are identified
+// by stationID together with the query, so listeners requesting the same
+// selection of tracks and encoding share a station.
+//
+// The query accepts the encoding and ReplayGain parameters of
+// handleStreamTrack, except that only radioCodecs may be used. MP3 is the
+// default. ReplayGain is applied entirely on the server side.
+//
+// If the request includes the header "Icy-MetaData: 1", the title of the
+// current track is inserted into the stream as ICY metadata.
+func (ml *Library) handleRadio(
+	stationID string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	trackList, ok := ml.radioTrackList(stationID, query)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	station, listener, initial, err := ml.joinRadioStation(stationID+"?"+query.Encode(), query, trackList)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.ErrorContext(ctx, "failed to start radio station", "station", stationID, "error", err)
+		return
+	}
+	defer ml.leaveRadioStation(station, listener)
+
+	w.Header().Set("Content-Type", station.mimeType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", stationID)
+
+	var icy *icyWriter
+	if req.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(radioMetaInt))
+		icy = &icyWriter{w: w, metaInt: radioMetaInt, remaining: radioMetaInt}
+	}
+
+	write := func(chunk radioChunk) error {
+		if icy != nil {
+			return icy.write(chunk.data, chunk.title)
+		}
+		_, err := w.Write(chunk.data)
+		return err
+	}
+
+	for _, chunk := range initial {
+		if err := write(chunk); err != nil {
+			slog.DebugContext(ctx, "failed to write buffer", "error", err)
+			return
+		}
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk, ok := <-listener.chunks:
+			if !ok {
+				return
+			}
+			if err := write(chunk); err != nil {
+				slog.DebugContext(ctx, "failed to write buffer", "error", err)
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// joinRadioStation adds a listener to the station identified by key, starting
+// the station if it isn't running. It returns the data that the listener
+// should receive before anything sent to it by the station.
+func (ml *Library) joinRadioStation(
+	key string,
+	query url.Values,
+	trackList func() ([]string, error),
+) (*radioStation, *radioListener, []radioChunk, error) {
+	// Holding radioMu while joining ensures that the station can't stop
+	// between being found and gaining a listener.
+	ml.radioMu.Lock()
+	defer ml.radioMu.Unlock()
+
+	station, running := ml.radioStations[key]
+	if !running {
+		var err error
+		if station, err = ml.newRadioStation(key, query, trackList); err != nil {
+			return nil, nil, nil, err
+		}
+		ml.radioStations[key] = station
+	}
+
+	listener := &radioListener{
+		chunks: make(chan radioChunk, radioListenerQueue),
+		done:   make(chan struct{}),
+	}
+
+	station.mu.Lock()
+	initial := []radioChunk{{data: station.header, joinable: true}}
+	joined := false
+	for _, chunk := range station.burst {
+		joined = joined || chunk.joinable
+		if joined {
+			initial = append(initial, chunk)
+		}
+	}
+	station.listeners[listener] = struct{}{}
+	station.mu.Unlock()
+
+	if !running {
+		ml.radioWG.Add(1)
+		go func() {
+			defer ml.radioWG.Done()
+			ml.runRadioStation(station)
+		}()
+	}
+	return station, listener, initial, nil
+}
+
+// leaveRadioStation removes a listener from a station. The station stops when
+// it has no listeners left (see retireRadioStation).
+func (ml *Library) leaveRadioStation(station *radioStation, listener *radioListener) {
+	close(listener.done)
+
+	station.mu.Lock()
+	defer station.mu.Unlock()
+	delete(station.listeners, listener)
+}
+
+// retireRadioStation removes a station that has no listeners from
+// radioStations, so that it can stop. It returns false, leaving the station
+// running, if a listener has joined since the station found itself without
+// listeners.
+//
+// The check and the removal happen while holding radioMu, as does
+// joinRadioStation, so a listener never joins a station that is stopping; it
+// starts a new one instead.
+func (ml *Library) retireRadioStation(station *radioStation) bool {
+	ml.radioMu.Lock()
+	defer ml.radioMu.Unlock()
+
+	station.mu.Lock()
+	idle := len(station.listeners) == 0
+	station.mu.Unlock()
+	if !idle {
+		return false
+	}
+
+	if ml.radioStations[station.key] == station {
+		delete(ml.radioStations, station.key)
+	}
+	return true
+}
+
+// stopRadioStations stops all running stations, disconnecting their
+// listeners, and waits for them to finish.
+func (ml *Library) stopRadioStations() {
+	ml.radioMu.Lock()
+	for key, station := range ml.radioStations {
+		close(station.stop)
+		delete(ml.radioStations, key)
+	}
+	ml.radioMu.Unlock()
+
+	ml.radioWG.Wait()
+}
+
+// newRadioStation creates a station that plays the tracks listed by trackList,
+// encoded as requested by query. The station begins streaming when
+// runRadioStation is called.
+func (ml *Library) newRadioStation(
+	key string,
+	query url.Values,
+	trackList func() ([]string, error),
+) (*radioStation, error) {
+	trimSilence, err := parseTrimSilence(query)
+	if err != nil {
+		return nil, err
+	}
+
+	nextTrack := shuffleTracks(trackList)
+	firstPath, firstSrc, firstTrack, err := ml.openRadioTrack(nextTrack, trimSilence)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseStreamOptions(firstSrc, query, "mp3", replayGainMode(firstTrack))
+	if err == nil && !slices.Contains(radioCodecs, options.codec) {
+		err = fmt.Errorf("codec not supported for radio: %v", options.codec)
+	}
+	if err != nil {
+		firstSrc.Destroy()
+		return nil, err
+	}
+	config := options.config
+	config.MuxerOptions = nil
+	if ml.config.DeterministicStreaming {
+		config.BitExact = true
+	}
+
+	station := &radioStation{
+		key:       key,
+		mimeType:  options.mimeType,
+		isOgg:     options.formatName == "ogg",
+		stop:      make(chan struct{}),
+		listeners: make(map[*radioListener]struct{}),
+	}
+	if options.codec == "mp3" {
+		// expected by Icecast clients
+		station.mimeType = "audio/mpeg"
+	}
+
+	if station.sink, err = aurelib.NewBufferSink(options.formatName, config); err != nil {
+		firstSrc.Destroy()
+		return nil, fmt.Errorf("failed to create sink: %w", err)
+	}
+	station.sink.Flush()
+	station.header = bytes.Clone(station.sink.Buffer())
+	station.sink.Drain(uint(len(station.header)))
+
+	sinkStreamInfo := station.sink.StreamInfo()
+	if station.current, err = ml.newRadioTrackDecoder(firstPath, firstSrc, firstTrack, query, sinkStreamInfo); err != nil {
+		station.sink.Destroy()
+		return nil, err
+	}
+	station.nextDecoder = func() (*playlistTrackDecoder, error) {
+		libraryPath, src, track, err := ml.openRadioTrack(nextTrack, trimSilence)
+		if err != nil {
+			return nil, err
+		}
+		return ml.newRadioTrackDecoder(libraryPath, src, track, query, sinkStreamInfo)
+	}
+	return station, nil
+}
+
+// shuffleTracks returns a function that returns the tracks listed by
+// trackList in random order. The list is reloaded each time every track has
+// been returned, so that changes to the library are picked up.
+func shuffleTracks(trackList func() ([]string, error)) func() (string, error) {
+	var paths []string
+	return func() (string, error) {
+		if len(paths) == 0 {
+			var err error
+			if paths, err = trackList(); err != nil {
+				return "", err
+			}
+			if len(paths) == 0 {
+				return "", fmt.Errorf("no tracks selected")
+			}
+			rand.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+		}
+		libraryPath := paths[0]
+		paths = paths[1:]
+		return libraryPath, nil
+	}
+}
+
+// openRadioTrack opens the next track returned by nextTrack that can be
+// decoded, leaving out its leading and trailing silence if trimSilence is
+// true. It returns the track's path, Source and database entry, which is nil
+// if it hasn't been scanned. It gives up after a number of failures, in case
+// none of the tracks can be opened.
+func (ml *Library) openRadioTrack(
+	nextTrack func() (string, error),
+	trimSilence bool,
+) (string, aurelib.Source, *mediadb.Track, error) {
+	const maxAttempts = 10
+
+	for range maxAttempts {
+		libraryPath, err := nextTrack()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		src, track, err := ml.newAudioSource(libraryPath, trimSilence)
+		if err != nil {
+			slog.Error("failed to open track", "path", libraryPath, "error", err)
+			continue
+		}
+		return libraryPath, src, track, nil
+	}
+	return "", nil, nil, fmt.Errorf("failed to open %v tracks", maxAttempts)
+}
+
+// newRadioTrackDecoder prepares src, opened for track, to be played by a
+// station. It takes ownership of src.
+func (ml *Library) newRadioTrackDecoder(
+	libraryPath string,
+	src aurelib.Source,
+	track *mediadb.Track,
+	query url.Values,
+	sinkStreamInfo aurelib.StreamInfo,
+) (*playlistTrackDecoder, error) {
+	volume, err := parseReplayGain(src, query, replayGainMode(track))
+	if err != nil {
+		src.Destroy()
+		return nil, err
+	}
+	return newPlaylistTrackDecoder(libraryPath, src, sinkStreamInfo, volume)
+}
+
+// radioTrackTitle returns the title of a track as shown to radio listeners.
+func radioTrackTitle(libraryPath string, tags map[string]string) string {
+	title := tags["title"]
+	if title == "" {
+		title = path.Base(libraryPath)
+	}
+	if artist := tags["artist"]; artist != "" {
+		title = artist + " - " + title
+	}
+	return title
+}
+
+// runRadioStation encodes the stream of a station and sends it to its
+// listeners until the station is stopped or has no listeners.
+func (ml *Library) runRadioStation(station *radioStation) {
+	ctx := context.Background()
+	slog.Info("radio station started", "station", station.key)
+
+	defer func() {
+		ml.radioMu.Lock()
+		if ml.radioStations[station.key] == station {
+			delete(ml.radioStations, station.key)
+		}
+		ml.radioMu.Unlock()
+
+		station.mu.Lock()
+		for listener := range station.listeners {
+			close(listener.chunks)
+			delete(station.listeners, listener)
+		}
+		station.mu.Unlock()
+
+		station.current.Destroy()
+		station.sink.Destroy()
+		slog.Info("radio station stopped", "station", station.key)
+	}()
+
+	sink := station.sink
+	sinkStreamInfo := sink.StreamInfo()
+
+	fifo, err := aurelib.NewFifo(sinkStreamInfo)
+	if err != nil {
+		slog.Error("failed to create FIFO", "error", err)
+		return
+	}
+	defer fifo.Destroy()
+
+	frameSize := sink.FrameSize()
+	title := radioTrackTitle(station.current.libraryPath, station.current.src.Tags())
+	throttled := ml.config.ThrottleStreaming
+	startTime := time.Now()
+	playedSamples := uint64(0)
+
+	for {
+		select {
+		case <-station.stop:
+			return
+		default:
+		}
+
+		current := station.current
+		current.fill(ctx, frameSize)
+		if err := moveSamples(current.fifo, fifo, current.fifo.Size()); err != nil {
+			slog.Error("failed to buffer samples", "error", err)
+			return
+		}
+		if current.done {
+			next, err := station.nextDecoder()
+			if err != nil {
+				slog.Error("failed to open next radio track", "station", station.key, "error", err)
+				return
+			}
+			current.Destroy()
+			station.current = next
+			title = radioTrackTitle(next.libraryPath, next.src.Tags())
+		}
+
+		for fifo.Size() >= frameSize {
+			frame, err := fifo.ReadFrame(frameSize)
+			if err != nil {
+				slog.Error("failed to read frame from FIFO", "error", err)
+				return
+			}
+			playedSamples += uint64(frame.Size)
+			if _, err = sink.Encode(frame); err != nil {
+				slog.Error("failed to encode frame", "error", err)
+				return
+			}
+		}
+
+		// Flushing after each batch of frames keeps Ogg pages intact within
+		// chunks, so that listeners can join at the start of any chunk that
+		// begins with a page.
+		sink.Flush()
+		if len(sink.Buffer()) > 0 {
+			data := bytes.Clone(sink.Buffer())
+			sink.Drain(uint(len(data)))
+			chunk := radioChunk{
+				data:     data,
+				title:    title,
+				joinable: !station.isOgg || bytes.HasPrefix(data, []byte("OggS")),
+			}
+			if !station.broadcast(chunk, throttled) && ml.retireRadioStation(station) {
+				return
+			}
+		}
+
+		if throttled {
+			playedTime := time.Duration(playedSamples) * time.Second / time.Duration(sinkStreamInfo.SampleRate)
+			if ahead := playedTime - time.Since(startTime); ahead > radioLead {
+				select {
+				case <-station.stop:
+					return
+				case <-time.After(ahead - radioLead):
+				}
+			}
+		}
+	}
+}
+
+// broadcast sends a chunk to all listeners and records it for listeners that
+// join later. If throttled is true, listeners that aren't keeping up are
+// disconnected; otherwise, broadcast waits for them. It returns false if the
+// station has no listeners, in which case the station should be retired with
+// retireRadioStation.
+func (station *radioStation) broadcast(chunk radioChunk, throttled bool) bool {
+	station.mu.Lock()
+	station.burst = append(station.burst, chunk)
+	burstSize := 0
+	for i := len(station.burst) - 1; i >= 0; i-- {
+		if burstSize += len(station.burst[i].data); burstSize > radioBurstBytes {
+			station.burst = station.burst[i:]
+			break
+		}
+	}
+	listeners := make([]*radioListener, 0, len(station.listeners))
+	for listener := range station.listeners {
+		listeners = append(listeners, listener)
+	}
+	station.mu.Unlock()
+
+	if len(listeners) == 0 {
+		return false
+	}
+
+	for _, listener := range listeners {
+		if throttled {
+			select {
+			case listener.chunks <- chunk:
+			case <-listener.done:
+			default:
+				station.mu.Lock()
+				if _, ok := station.listeners[listener]; ok {
+					delete(station.listeners, listener)
+					close(listener.chunks)
+				}
+				station.mu.Unlock()
+			}
+		} else {
+			select {
+			case listener.chunks <- chunk:
+			case <-listener.done:
+			}
+		}
+	}
+	return true
+}
+
+// An icyWriter inserts ICY metadata blocks into an audio stream.
+type icyWriter struct {
+	w         http.ResponseWriter
+	metaInt   int
+	remaining int // bytes of audio until the next metadata block
+	sentTitle string
+}
+
+// write writes audio data, inserting a metadata block with the given title
+// wherever one is due. The title is only sent when it changes.
+func (iw *icyWriter) write(data []byte, title string) error {
+	for len(data) > 0 {
+		n := min(len(data), iw.remaining)
+		if _, err := iw.w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		iw.remaining -= n
+
+		if iw.remaining == 0 {
+			if _, err := iw.w.Write(icyMetadata(title, title != iw.sentTitle)); err != nil {
+				return err
+			}
+			iw.sentTitle = title
+			iw.remaining = iw.metaInt
+		}
+	}
+	return nil
+}
+
+// icyMetadata returns an ICY metadata block. If sendTitle is false, the block
+// is empty, which tells the client that the metadata hasn't changed.
+func icyMetadata(title string, sendTitle bool) []byte {
+	const maxLength = 255 * 16
+
+	if !sendTitle {
+		return []byte{0}
+	}
+
+	metadata := "StreamTitle='" + strings.ReplaceAll(title, "'", "’") + "';"
+	if len(metadata) > maxLength {
+		metadata = metadata[:maxLength-2] + "';"
+	}
+	blockCount := (len(metadata) + 15) / 16
+
+	block := make([]byte, 1+blockCount*16)
+	block[0] = byte(blockCount)
+	copy(block[1:], metadata)
+	return block
+}
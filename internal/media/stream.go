@@ -1,80 +1,348 @@
 package media
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/beakbeak/aurelius/internal/mediadb"
 	"github.com/beakbeak/aurelius/pkg/aurelib"
 	"github.com/beakbeak/aurelius/pkg/fragment"
 )
 
 // newAudioSource opens an audio file as an aurelib.Source. For fragment
-// tracks, it uses the stored fragment metadata to construct the source.
-func (ml *Library) newAudioSource(libraryPath string) (aurelib.Source, error) {
+// tracks, it uses the stored fragment metadata to construct the source. If
+// trimSilence is true, the silence detected at the start and end of the track
+// by the scanner is left out in the same way. options select the audio stream
+// to decode (see parseStreamSelection). The track is returned along with the
+// Source, or nil if the file hasn't been scanned.
+func (ml *Library) newAudioSource(
+	libraryPath string,
+	trimSilence bool,
+	options ...aurelib.SourceOption,
+) (aurelib.Source, *mediadb.Track, error) {
 	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := ml.newTrackSource(libraryPath, track, trimSilence, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, track, nil
+}
+
+// trackSampleCount returns the exact number of samples produced by a Source
+// opened for track by newTrackSource, or 0 if it isn't known, as for
+// fragments, whose bounds are given as times, or for an audio stream other
+// than the default one.
+func trackSampleCount(track *mediadb.Track, trimSilence bool, selection []aurelib.SourceOption) uint64 {
+	if track == nil || track.Metadata.Fragment != nil || len(selection) > 0 {
+		return 0
+	}
+	if silence := track.Metadata.Silence; trimSilence && silence != nil && (silence.Leading > 0 || silence.Trailing > 0) {
+		return 0
+	}
+	return track.Metadata.SampleCount
+}
+
+// newTrackSource is like newAudioSource, for a track that has already been
+// looked up in the database. track is nil if the file hasn't been scanned.
+func (ml *Library) newTrackSource(
+	libraryPath string,
+	track *mediadb.Track,
+	trimSilence bool,
+	options ...aurelib.SourceOption,
+) (aurelib.Source, error) {
+	if track == nil {
+		return aurelib.NewFileSource(ml.libraryToFsPath(libraryPath), options...)
+	}
+
+	silence := track.Metadata.Silence
+	if !trimSilence || silence != nil && silence.Leading == 0 && silence.Trailing == 0 {
+		silence = nil
+	}
+
+	var src aurelib.Source
+	var err error
+	if track.Metadata.Fragment != nil || silence != nil {
+		sourcePath := ml.libraryToFsPath(libraryPath)
+		var startTime, endTime time.Duration
+		if fi := track.Metadata.Fragment; fi != nil {
+			sourcePath = filepath.Join(ml.libraryToFsPath(track.Dir), fi.SourceFile)
+			startTime = time.Duration(fi.Start * float64(time.Second))
+			endTime = time.Duration(fi.End * float64(time.Second))
+		}
+		if silence != nil {
+			if endTime == 0 {
+				endTime = startTime + time.Duration(track.Metadata.Duration*float64(time.Second))
+			}
+			startTime += time.Duration(silence.Leading * float64(time.Second))
+			endTime -= time.Duration(silence.Trailing * float64(time.Second))
+		}
+		src, err = fragment.New(sourcePath, startTime, endTime, options...)
+	} else {
+		src, err = aurelib.NewFileSource(ml.libraryToFsPath(libraryPath), options...)
+	}
 	if err != nil {
 		return nil, err
 	}
+
+	if rg := track.Metadata.ReplayGain; rg != nil && rg.Computed {
+		src = computedReplayGainSource{src, rg}
+	}
+	return src, nil
+}
+
+// replayGainMode returns the ReplayGain mode that the directory config of
+// track sets for requests that don't specify one, or an empty string if it
+// sets none or track is nil.
+func replayGainMode(track *mediadb.Track) string {
 	if track == nil {
-		return aurelib.NewFileSource(ml.libraryToFsPath(libraryPath))
+		return ""
 	}
+	return track.Metadata.ReplayGainMode
+}
 
-	if track.Metadata.Fragment != nil {
-		fi := track.Metadata.Fragment
-		sourcePath := filepath.Join(ml.libraryToFsPath(track.Dir), fi.SourceFile)
-		startTime := time.Duration(fi.Start * float64(time.Second))
-		endTime := time.Duration(fi.End * float64(time.Second))
-		return fragment.New(sourcePath, startTime, endTime)
+// A computedReplayGainSource is a Source without ReplayGain tags, for which the
+// scanner computed ReplayGain values from the loudness of the audio.
+type computedReplayGainSource struct {
+	aurelib.Source
+	replayGain *mediadb.ReplayGain
+}
+
+func (src computedReplayGainSource) ReplayGain(
+	mode aurelib.ReplayGainMode,
+	preventClipping bool,
+) float64 {
+	switch {
+	case mode == aurelib.ReplayGainAlbum && preventClipping:
+		return src.replayGain.Album
+	case mode == aurelib.ReplayGainAlbum:
+		return src.replayGain.AlbumNoclip
+	case preventClipping:
+		return src.replayGain.Track
+	default:
+		return src.replayGain.TrackNoclip
+	}
+}
+
+// parseStreamSelection interprets the stream parameter in the query of a
+// request, which selects one of the audio streams of a file that has several.
+// It may be the position of the stream among the file's audio streams, or
+// "language:{tag}" or "disposition:{name}" to select the first stream with the
+// given language or disposition.
+func parseStreamSelection(query url.Values) ([]aurelib.SourceOption, error) {
+	stream := query.Get("stream")
+	if stream == "" {
+		return nil, nil
+	}
+	if language, ok := strings.CutPrefix(stream, "language:"); ok {
+		return []aurelib.SourceOption{aurelib.WithLanguage(language)}, nil
+	}
+	if disposition, ok := strings.CutPrefix(stream, "disposition:"); ok {
+		return []aurelib.SourceOption{aurelib.WithDisposition(disposition)}, nil
 	}
+	index, err := strconv.Atoi(stream)
+	if err != nil || index < 0 {
+		return nil, fmt.Errorf("invalid stream: %v", stream)
+	}
+	return []aurelib.SourceOption{aurelib.WithAudioStream(index)}, nil
+}
+
+// A streamThrottle limits streaming throughput to playback speed. The stream is
+// allowed to run ahead of the play position by the greater of
+// LibraryConfig.StreamAheadBytes and LibraryConfig.StreamAheadTime.
+type streamThrottle struct {
+	aheadBytes int
+	aheadTime  time.Duration
+	startTime  time.Time
 
-	return aurelib.NewFileSource(ml.libraryToFsPath(libraryPath))
+	writtenBuffers []throttleBufferInfo
 }
 
-func (ml *Library) handleStreamTrack(
-	libraryPath string,
-	w http.ResponseWriter,
-	req *http.Request,
-) {
-	ctx := req.Context()
-	reject := func(status int, format string, args ...interface{}) {
-		w.WriteHeader(status)
-		slog.ErrorContext(ctx, format, args...)
+type throttleBufferInfo struct {
+	startTime time.Duration
+	byteSize  int
+}
+
+// newStreamThrottle returns a streamThrottle configured by the Library, or nil
+// if streaming is not throttled. A nil *streamThrottle never waits.
+func (ml *Library) newStreamThrottle() *streamThrottle {
+	if !ml.config.ThrottleStreaming {
+		return nil
 	}
-	rejectInternalError := func(format string, args ...interface{}) {
-		reject(http.StatusInternalServerError, format, args...)
+	return &streamThrottle{
+		aheadBytes: ml.config.StreamAheadBytes,
+		aheadTime:  ml.config.StreamAheadTime,
+		startTime:  time.Now(),
 	}
-	rejectBadRequest := func(format string, args ...interface{}) {
-		reject(http.StatusBadRequest, format, args...)
+}
+
+// wait records that byteSize bytes of audio starting at bufferStartTime were
+// written, then sleeps until the play position catches up to the stream-ahead
+// limits. playedTime is the total stream time written so far.
+func (t *streamThrottle) wait(bufferStartTime time.Duration, byteSize int, playedTime time.Duration) {
+	if t == nil {
+		return
 	}
-	rejectNotFound := func(format string, args ...interface{}) {
-		reject(http.StatusNotFound, format, args...)
+
+	t.writtenBuffers = append(t.writtenBuffers, throttleBufferInfo{
+		startTime: bufferStartTime,
+		byteSize:  byteSize,
+	})
+	remaningBufferBytes := 0
+	for i := len(t.writtenBuffers) - 1; i >= 0; i-- {
+		remaningBufferBytes += t.writtenBuffers[i].byteSize
+		if remaningBufferBytes < t.aheadBytes {
+			continue
+		}
+		timeToWake := min(t.writtenBuffers[i].startTime, playedTime-t.aheadTime)
+		timeToSleep := timeToWake - time.Since(t.startTime)
+		if timeToSleep > time.Millisecond {
+			//log.Printf("sleeping %v", timeToSleep)
+			time.Sleep(timeToSleep)
+		}
+		break
 	}
+}
 
-	// set up source
-	src, err := ml.newAudioSource(libraryPath)
+// bitRateFromQuality maps a quality value on the scale used by libvorbis (-1
+// to 10) linearly onto a bit rate between minKbitRate and maxKbitRate. It is
+// used for encoders that don't support FFmpeg's global_quality setting.
+func bitRateFromQuality(quality float32, minKbitRate, maxKbitRate uint) uint {
+	quality = min(max(quality, -1), 10)
+	scale := (quality + 1) / 11
+	return uint(float32(minKbitRate)+scale*float32(maxKbitRate-minKbitRate)) * 1000
+}
+
+// parseTrimSilence interprets the trimSilence parameter in the query of a
+// stream request, which skips the silence detected at the start and end of
+// each track.
+func parseTrimSilence(query url.Values) (bool, error) {
+	trimSilenceArg := query.Get("trimSilence")
+	if trimSilenceArg == "" {
+		return false, nil
+	}
+	trimSilence, err := strconv.ParseBool(trimSilenceArg)
 	if err != nil {
-		rejectNotFound("failed to open '%v': %v\n", libraryPath, err)
-		return
+		return false, fmt.Errorf("invalid value for trimSilence: %v (%v)", trimSilenceArg, err)
 	}
-	defer src.Destroy()
+	return trimSilence, nil
+}
+
+// parseReplayGain interprets the ReplayGain parameters in the query of a
+// request to stream src, and returns the volume adjustment they call for. The
+// mode defaults to defaultMode, as returned by replayGainMode, or "track" if it
+// is empty.
+func parseReplayGain(src aurelib.Source, query url.Values, defaultMode string) (float64, error) {
+	replayGainStr := "track"
+	if defaultMode != "" {
+		replayGainStr = defaultMode
+	}
+	preventClipping := true
+
+	if replayGainArgs, ok := query["replayGain"]; ok {
+		replayGainStr = replayGainArgs[0]
+	}
+
+	if preventClippingArgs, ok := query["preventClipping"]; ok {
+		var err error
+		if preventClipping, err = strconv.ParseBool(preventClippingArgs[0]); err != nil {
+			return 0, fmt.Errorf("invalid value for preventClipping: %v (%v)", preventClippingArgs[0], err)
+		}
+	}
+
+	switch replayGainStr {
+	case "track":
+		return src.ReplayGain(aurelib.ReplayGainTrack, preventClipping), nil
+	case "album":
+		return src.ReplayGain(aurelib.ReplayGainAlbum, preventClipping), nil
+	case "off":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("invalid ReplayGain mode: %v", replayGainStr)
+	}
+}
+
+// streamOptions describes the encoding requested by the query parameters of a
+// stream request.
+type streamOptions struct {
+	codec       string
+	config      *aurelib.SinkConfig
+	formatName  string
+	mimeType    string
+	volume      float64 // volume adjustment to apply on the server side
+	gapless     bool    // whether to describe encoder padding for gapless playback
+	stream      string  // the audio stream selected by the request, if any
+	filter      string  // filter description for aurelib.NewFilterGraph, if any
+	tempo       float64 // factor by which filter changes the speed of the audio
+	trimSilence bool    // whether the silence at the start and end is skipped
+}
+
+// outputDuration returns the duration of the output for the whole of src,
+// which differs from that of src if filter changes the tempo.
+func (options *streamOptions) outputDuration(src aurelib.Source) time.Duration {
+	return time.Duration(float64(src.Duration()) / options.tempo)
+}
 
+// sourceTime returns the position in the Source that corresponds to the given
+// position in the output.
+func (options *streamOptions) sourceTime(outputTime time.Duration) time.Duration {
+	return time.Duration(float64(outputTime) * options.tempo)
+}
+
+// describesLength returns whether the encoded output begins with a
+// description of its exact length, which requires the track's sample count.
+func (options *streamOptions) describesLength() bool {
+	return options.codec == "mp3" && options.gapless
+}
+
+// cacheKey returns a string that identifies the encoded output produced with
+// the options from track, for use with transcodeCache. Besides the options, it
+// covers the silence that is trimmed from the track, which changes when the
+// track is scanned with a different threshold.
+func (options *streamOptions) cacheKey(track *mediadb.Track) string {
+	config := options.config
+	silence := ""
+	if s := track.Metadata.Silence; options.trimSilence && s != nil {
+		silence = fmt.Sprintf("%v,%v,%v", s.Leading, s.Trailing, s.Threshold)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%v|%v|%v|%v|%s|%v|%v|%v|%v|%s|%s|%v|%s",
+		options.codec, options.formatName, config.Codec, config.ChannelLayout, config.SampleRate,
+		config.SampleFormat, config.CompressionLevel, config.Quality, fmt.Sprint(config.BitRate),
+		config.MuxerOptions, config.EncoderOptions, options.volume, options.gapless, options.stream,
+		options.filter, options.trimSilence, silence)
+}
+
+// parseStreamOptions interprets the encoding and ReplayGain parameters in the
+// query of a request to stream src. defaultCodec is used if no codec is
+// specified, and defaultReplayGain if no ReplayGain mode is (see
+// parseReplayGain).
+func parseStreamOptions(
+	src aurelib.Source,
+	query url.Values,
+	defaultCodec string,
+	defaultReplayGain string,
+) (*streamOptions, error) {
 	srcStreamInfo := src.StreamInfo()
 
-	// set up sink
 	config := aurelib.NewSinkConfig()
 	config.ChannelLayout = srcStreamInfo.ChannelLayout()
 	config.SampleFormat = srcStreamInfo.SampleFormat()
 	config.SampleRate = srcStreamInfo.SampleRate
 
-	replayGainStr := "track"
-	preventClipping := true
-
-	query := req.URL.Query()
-
-	codec := "wav"
+	codec := defaultCodec
 	if codecArgs, ok := query["codec"]; ok {
 		codec = codecArgs[0]
 	}
@@ -110,17 +378,47 @@ func (ml *Library) handleStreamTrack(
 		formatName = "wav"
 		mimeType = "audio/wav"
 
+	case "aac":
+		config.Codec = "aac"
+
+		// MP4 normally requires a seekable output so that the index can be
+		// written after the media data. A fragmented MP4 with an empty initial
+		// index can be produced progressively instead, which allows playback
+		// to begin before the whole track has been encoded.
+		formatName = "mp4"
+		mimeType = "audio/mp4"
+		config.MuxerOptions = fragmentedMP4Options
+
+	case "opus":
+		// Opus always operates at 48 kHz internally. Other sample rates are
+		// accepted by libopus, but are resampled by the decoder anyway.
+		config.Codec = "libopus"
+		config.SampleRate = 48000
+
+		container := "ogg"
+		if containerArgs, ok := query["container"]; ok {
+			container = containerArgs[0]
+		}
+		switch container {
+		case "ogg":
+			formatName = "ogg"
+			mimeType = "audio/ogg"
+		case "webm":
+			formatName = "webm"
+			mimeType = "audio/webm"
+		default:
+			return nil, fmt.Errorf("unknown container requested for opus: %v", container)
+		}
+
 	default:
-		rejectBadRequest("unknown codec requested: %v\n", codec[0])
-		return
+		return nil, fmt.Errorf("unknown codec requested: %v", codec)
 	}
 
 	if qualityArgs, ok := query["quality"]; ok {
 		if quality, err := strconv.ParseFloat(qualityArgs[0], 32); err == nil {
 			config.Quality = float32(quality)
 		} else {
-			rejectBadRequest("invalid quality requested: %v (%v)\n", qualityArgs[0], err)
-			return
+			return nil, fmt.Errorf("invalid quality requested: %v (%v)", qualityArgs[0], err)
 		}
 	}
 
@@ -128,8 +426,7 @@ func (ml *Library) handleStreamTrack(
 		if kbitRate, err := strconv.ParseUint(kbitRateArgs[0], 0, 0); err == nil {
 			config.BitRate = uint(kbitRate) * 1000
 		} else {
-			rejectBadRequest("invalid kbit rate requested: %v (%v)\n", kbitRateArgs[0], err)
-			return
+			return nil, fmt.Errorf("invalid kbit rate requested: %v (%v)", kbitRateArgs[0], err)
 		}
 	}
 
@@ -137,8 +434,21 @@ func (ml *Library) handleStreamTrack(
 		if sampleRate, err := strconv.ParseUint(sampleRateArgs[0], 0, 0); err == nil {
 			config.SampleRate = uint(sampleRate)
 		} else {
-			rejectBadRequest("invalid sample rate requested: %v (%v)\n", sampleRateArgs[0], err)
-			return
+			return nil, fmt.Errorf("invalid sample rate requested: %v (%v)", sampleRateArgs[0], err)
+		}
+	}
+
+	// libopus ignores global_quality, and FFmpeg's native AAC encoder uses an
+	// incompatible scale, so the quality scale used by other codecs is
+	// converted to a target bit rate.
+	if config.Quality >= -1 {
+		switch codec {
+		case "opus":
+			config.BitRate = bitRateFromQuality(config.Quality, 16, 192)
+			config.Quality = -2
+		case "aac":
+			config.BitRate = bitRateFromQuality(config.Quality, 32, 320)
+			config.Quality = -2
 		}
 	}
 
@@ -148,28 +458,23 @@ func (ml *Library) handleStreamTrack(
 	if channelLayoutArgs, ok := query["channelLayout"]; ok {
 		config.ChannelLayout = channelLayoutArgs[0]
 	}
-	if replayGainArgs, ok := query["replayGain"]; ok {
-		replayGainStr = replayGainArgs[0]
-	}
 
-	if preventClippingArgs, ok := query["preventClipping"]; ok {
-		if preventClipping, err = strconv.ParseBool(preventClippingArgs[0]); err != nil {
-			rejectBadRequest("invalid value for preventClipping: %v (%v)\n", preventClippingArgs[0], err)
-			return
+	gapless := false
+	if gaplessArgs, ok := query["gapless"]; ok {
+		var err error
+		if gapless, err = strconv.ParseBool(gaplessArgs[0]); err != nil {
+			return nil, fmt.Errorf("invalid value for gapless: %v (%v)", gaplessArgs[0], err)
 		}
 	}
+	if gapless && codec == "mp3" {
+		// handleStreamTrack writes a Xing/LAME header, which must be the first
+		// frame in the stream
+		config.MuxerOptions = map[string]string{"id3v2_version": "0"}
+	}
 
-	volume := 1.
-	switch replayGainStr {
-	case "track":
-		volume = src.ReplayGain(aurelib.ReplayGainTrack, preventClipping)
-	case "album":
-		volume = src.ReplayGain(aurelib.ReplayGainAlbum, preventClipping)
-	case "off":
-		// already set up
-	default:
-		rejectBadRequest("invalid ReplayGain mode: %v\n", replayGainStr)
-		return
+	volume, err := parseReplayGain(src, query, defaultReplayGain)
+	if err != nil {
+		return nil, err
 	}
 
 	// volume < 1 is applied on the client side for better quality
@@ -178,9 +483,100 @@ func (ml *Library) handleStreamTrack(
 		volume = 1.
 	}
 
+	filter, tempo, err := parseStreamFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	trimSilence, err := parseTrimSilence(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamOptions{
+		codec:      codec,
+		config:     config,
+		formatName: formatName,
+		mimeType:   mimeType,
+		volume:     volume,
+		gapless:    gapless,
+		stream:     query.Get("stream"),
+		filter:     filter,
+		tempo:      tempo,
+
+		trimSilence: trimSilence,
+	}, nil
+}
+
+func (ml *Library) handleStreamTrack(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+	reject := func(status int, format string, args ...interface{}) {
+		w.WriteHeader(status)
+		slog.ErrorContext(ctx, format, args...)
+	}
+	rejectInternalError := func(format string, args ...interface{}) {
+		reject(http.StatusInternalServerError, format, args...)
+	}
+	rejectBadRequest := func(format string, args ...interface{}) {
+		reject(http.StatusBadRequest, format, args...)
+	}
+	rejectNotFound := func(format string, args ...interface{}) {
+		reject(http.StatusNotFound, format, args...)
+	}
+
+	if codecArgs, ok := req.URL.Query()["codec"]; ok && codecArgs[0] == "original" {
+		ml.handleStreamOriginal(libraryPath, w, req)
+		return
+	}
+
+	selection, err := parseStreamSelection(req.URL.Query())
+	if err != nil {
+		rejectBadRequest("invalid stream selection: %v\n", err)
+		return
+	}
+	trimSilence, err := parseTrimSilence(req.URL.Query())
+	if err != nil {
+		rejectBadRequest("invalid stream options: %v\n", err)
+		return
+	}
+
+	// set up source
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		rejectInternalError("failed to get track '%v': %v\n", libraryPath, err)
+		return
+	}
+	src, err := ml.newTrackSource(libraryPath, track, trimSilence, selection...)
+	if err != nil {
+		rejectNotFound("failed to open '%v': %v\n", libraryPath, err)
+		return
+	}
+	defer src.Destroy()
+
+	query := req.URL.Query()
+
+	options, err := parseStreamOptions(src, query, "wav", replayGainMode(track))
+	if err != nil {
+		rejectBadRequest("invalid stream options: %v\n", err)
+		return
+	}
+	codec := options.codec
+	config := options.config
+	mimeType := options.mimeType
+	volume := options.volume
+
+	if track != nil && options.describesLength() {
+		ml.ensurePadding(ctx, libraryPath, track)
+	}
+
 	startFromBeginning := true
+	var startTime time.Duration
 	if startTimeArgs, ok := query["startTime"]; ok {
-		startTime, err := time.ParseDuration(startTimeArgs[0])
+		startTime, err = time.ParseDuration(startTimeArgs[0])
 		if err != nil {
 			rejectBadRequest("invalid start time: %v (%v)\n", startTimeArgs[0], err)
 			return
@@ -195,168 +591,258 @@ func (ml *Library) handleStreamTrack(
 		}
 	}
 
-	if startFromBeginning {
-		if err := ml.db.RecordPlay(libraryPath); err != nil {
-			slog.ErrorContext(ctx, "failed to record play", "error", err)
-		}
-	}
-
 	if ml.config.DeterministicStreaming {
 		config.BitExact = true
 	}
 
-	sink, err := aurelib.NewBufferSink(formatName, config)
-	if err != nil {
-		rejectInternalError("failed to create sink: %v\n", err)
-		return
+	// prepare the tracks that are likely to be played next, unless this is a
+	// seek within the current track
+	if startFromBeginning && requestsStartOfStream(req) {
+		ml.prefetchAfter(libraryPath, req)
 	}
-	defer sink.Destroy()
 
-	sinkStreamInfo := sink.StreamInfo()
+	// Complete transcodes are cached by the hash of the track, so that they
+	// can be served again without re-encoding.
+	var trackHash []byte
+	if ml.transcodeCache != nil && startFromBeginning && track != nil {
+		trackHash = track.Hash
+	}
+	if trackHash != nil {
+		if file := ml.transcodeCache.open(trackHash, options.cacheKey(track)); file != nil {
+			defer file.Close()
+			ml.serveCachedTranscode(libraryPath, file, mimeType, w, req)
+			return
+		}
+	}
 
-	// set up FIFO
-	fifo, err := aurelib.NewFifo(sinkStreamInfo)
-	if err != nil {
-		rejectInternalError("failed to create FIFO: %v\n", err)
-		return
+	// Uncompressed, unfiltered output is served with its size and support for
+	// byte ranges, since the size of the output and the position of each
+	// sample are known in advance. It isn't cached, since it can be produced
+	// from any position as cheaply as it can be read back.
+	if codec == "wav" && options.filter == "" && startFromBeginning {
+		if stream, err := newPCMStream(src, trackSampleCount(track, trimSilence, selection), config, volume, ml.newStreamThrottle()); err != nil {
+			slog.WarnContext(ctx, "byte ranges unavailable", "error", err)
+		} else {
+			defer stream.Close()
+
+			// seeking in the browser produces requests for later ranges,
+			// which shouldn't count as plays
+			if requestsStartOfStream(req) {
+				if err := ml.db.RecordPlay(libraryPath); err != nil {
+					slog.ErrorContext(ctx, "failed to record play", "error", err)
+				}
+			}
+
+			w.Header().Set("Content-Type", mimeType)
+			w.Header().Set("Cache-Control", "no-cache, no-store")
+			http.ServeContent(w, req, "", time.Time{}, stream)
+			return
+		}
 	}
-	defer fifo.Destroy()
 
-	// set up resampler
-	resampler, err := aurelib.NewResampler()
-	if err != nil {
-		rejectInternalError("failed to create resampler: %v\n", err)
-		return
+	if startFromBeginning {
+		if err := ml.db.RecordPlay(libraryPath); err != nil {
+			slog.ErrorContext(ctx, "failed to record play", "error", err)
+		}
 	}
-	defer resampler.Destroy()
 
-	if err := resampler.Setup(srcStreamInfo, sinkStreamInfo, volume); err != nil {
-		rejectInternalError("failed to setup resampler: %v\n", err)
-		return
+	var cacheWriter *transcodeCacheWriter
+	complete := false
+	if trackHash != nil {
+		if cacheWriter, err = ml.transcodeCache.create(trackHash, options.cacheKey(track)); err != nil {
+			slog.WarnContext(ctx, "failed to create transcode cache entry", "error", err)
+		} else {
+			// partial transcodes must not be cached
+			defer func() {
+				if complete {
+					cacheWriter.Commit()
+				} else {
+					cacheWriter.Abort()
+				}
+			}()
+		}
+	}
+	// the stream is written to the response and, if caching, to the cache entry
+	var output io.Writer = w
+	if cacheWriter != nil {
+		output = io.MultiWriter(w, cacheWriter)
 	}
 
 	// start streaming
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("Cache-Control", "no-cache, no-store") //?
 
-	writeBuffer := func() (int, error) {
-		buffer := sink.Buffer()
-		if len(buffer) == 0 {
-			return 0, nil
-		}
-
-		count, err := w.Write(buffer)
-		if count > 0 {
-			sink.Drain(uint(count))
-		}
-		//log.Printf("wrote %v bytes\n", count)
-		return count, err
+	encoder, err := newTrackEncoder(src, trackSampleCount(track, trimSilence, selection), options, startTime, output)
+	if err != nil {
+		rejectInternalError("failed to set up encoder: %v\n", err)
+		return
 	}
+	defer encoder.Destroy()
+
+	complete = encoder.run(ctx, ml.newStreamThrottle())
+}
 
-	startTime := time.Now()
-	playedSamples := uint64(0)
-	getPlayedTime := func() time.Duration {
-		// calculate with millisecond precision to prevent overflow
-		return time.Duration(((playedSamples * 1000) /
-			uint64(sinkStreamInfo.SampleRate)) * 1000000)
+// A countingWriter passes data to an io.Writer, counting the bytes written and
+// keeping the first error.
+type countingWriter struct {
+	w     io.Writer
+	count int
+	err   error
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	count, err := cw.w.Write(data)
+	cw.count += count
+	if err != nil && cw.err == nil {
+		cw.err = err
 	}
+	return count, err
+}
+
+// A trackEncoder encodes the audio of a Source in the format described by a
+// streamOptions, and writes it to an io.Writer.
+type trackEncoder struct {
+	src       aurelib.Source
+	srcLength uint64 // the exact number of samples in src, or 0 if unknown
+	options   *streamOptions
+	startTime time.Duration // the position in src at which encoding starts
+	dest      io.Writer
+	output    *countingWriter
+	header    bytes.Buffer // the container header, held back until run
+	sink      *aurelib.WriterSink
+}
 
-	type bufferInfo struct {
-		startTime time.Duration
-		byteSize  int
+// Destroy frees resources held by the trackEncoder. The Source is not
+// destroyed.
+func (e *trackEncoder) Destroy() {
+	if e.sink != nil {
+		e.sink.Destroy()
 	}
-	var writtenBuffers []bufferInfo
+}
 
-	done := false
+// newTrackEncoder creates a trackEncoder for src, which has been positioned at
+// startTime. srcLength is the exact number of samples in the whole of src (see
+// trackSampleCount), or 0 if it is unknown. The encoded stream will be written
+// to output by run.
+func newTrackEncoder(
+	src aurelib.Source,
+	srcLength uint64,
+	options *streamOptions,
+	startTime time.Duration,
+	output io.Writer,
+) (*trackEncoder, error) {
+	e := &trackEncoder{
+		src:       src,
+		srcLength: srcLength,
+		options:   options,
+		startTime: startTime,
+		dest:      output,
+	}
+	e.output = &countingWriter{w: &e.header}
+
+	var err error
+	if e.sink, err = aurelib.NewWriterSink(options.formatName, options.config, e.output); err != nil {
+		return nil, fmt.Errorf("failed to create sink: %w", err)
+	}
+	return e, nil
+}
 
-PlayLoop:
-	for !done {
-		fifoSize := fifo.Size()
+// run encodes the remainder of the Source. It returns true if the whole Source
+// was encoded and written without errors.
+func (e *trackEncoder) run(ctx context.Context, throttle *streamThrottle) bool {
+	src, sink := e.src, e.sink
+	sinkStreamInfo := sink.StreamInfo()
 
-	DecodeLoop:
-		for fifo.Size() < sink.FrameSize() {
-			if recoverable, err := src.Decode(); err != nil {
-				slog.ErrorContext(ctx, "failed to decode frame", "error", err)
-				if !recoverable {
-					done = true
-					break DecodeLoop
-				}
-			}
+	e.output.w = e.dest
 
-			for {
-				receiveStatus, err := src.ReceiveFrame()
-				if err != nil {
-					slog.ErrorContext(ctx, "failed to receive frame", "error", err)
-					done = true
-					break DecodeLoop
-				}
-				if receiveStatus == aurelib.ReceiveFrameEof {
-					done = true
-					break DecodeLoop
-				}
-				if receiveStatus != aurelib.ReceiveFrameCopyAndCallAgain {
-					break
-				}
-				if err = src.ResampleFrame(resampler, fifo); err != nil {
-					slog.ErrorContext(ctx, "failed to copy frame to output", "error", err)
-					done = true
-					break DecodeLoop
-				}
-			}
+	// FFmpeg's MP3 muxer can't write a Xing/LAME header when streaming, so it
+	// is written here, ahead of the container header. Ogg and WebM streams
+	// already describe the encoder delay in their headers (e.g., as the
+	// pre-skip of an Opus stream).
+	if e.options.describesLength() {
+		frame, err := aurelib.NewMP3InfoFrame(
+			sinkStreamInfo.SampleRate, sinkStreamInfo.ChannelCount(), sink.InitialPadding(), e.outputLength())
+		if err != nil {
+			slog.WarnContext(ctx, "failed to create MP3 info frame", "error", err)
+		} else if _, err := e.output.Write(frame); err != nil {
+			slog.DebugContext(ctx, "failed to write stream", "error", err)
+			return false
 		}
-
-		latestWrittenBuffer := bufferInfo{
-			startTime: getPlayedTime(),
+	}
+	if _, err := e.output.Write(e.header.Bytes()); err != nil {
+		slog.DebugContext(ctx, "failed to write stream", "error", err)
+		return false
+	}
+
+	failed := false
+	options := aurelib.NewTranscodeOptions()
+	options.Volume = e.options.volume
+	options.Filter = e.options.filter
+	options.DecodeError = func(err error) {
+		slog.ErrorContext(ctx, "failed to decode frame", "error", err)
+		failed = true
+	}
+	if throttle != nil {
+		var bufferStartTime time.Duration
+		bufferStartCount := e.output.count
+		options.Progress = func(encodedTime time.Duration) {
+			throttle.wait(bufferStartTime, e.output.count-bufferStartCount, encodedTime)
+			bufferStartTime, bufferStartCount = encodedTime, e.output.count
 		}
-		playedSamples += uint64(fifo.Size() - fifoSize)
+	}
 
-		var outFrameSize uint
-		if !done {
-			outFrameSize = sink.FrameSize()
-		} else {
-			outFrameSize = 1
+	if err := aurelib.Transcode(ctx, src, sink, options); err != nil {
+		switch {
+		// failures to write are expected when the client goes away
+		case e.output.err != nil:
+			slog.DebugContext(ctx, "failed to write stream", "error", e.output.err)
+		case ctx.Err() != nil:
+			slog.DebugContext(ctx, "encoding canceled", "error", err)
+		default:
+			slog.ErrorContext(ctx, "failed to encode stream", "error", err)
 		}
+		return false
+	}
+	return !failed
+}
 
-		for fifo.Size() >= outFrameSize {
-			frame, err := fifo.ReadFrame(sink.FrameSize())
-			if err != nil {
-				slog.ErrorContext(ctx, "failed to read frame from FIFO", "error", err)
-				break PlayLoop
-			}
-			if _, err = sink.Encode(frame); err != nil {
-				slog.ErrorContext(ctx, "failed to encode frame", "error", err)
-				break PlayLoop
-			}
-		}
-		latestWrittenBuffer.byteSize, err = writeBuffer()
-		if err != nil {
-			slog.DebugContext(ctx, "failed to write buffer", "error", err)
-			break PlayLoop
-		}
+// outputLength returns the number of samples that run will encode. It is
+// exact if the length of the Source is known, and otherwise estimated from its
+// duration.
+func (e *trackEncoder) outputLength() uint64 {
+	srcRate := float64(e.src.StreamInfo().SampleRate)
+	sinkRate := float64(e.sink.StreamInfo().SampleRate)
+
+	var remaining float64
+	if e.srcLength > 0 {
+		startSample := uint64(math.Round(e.startTime.Seconds() * srcRate))
+		remaining = float64(e.srcLength-min(startSample, e.srcLength)) / srcRate
+	} else {
+		remaining = max(e.src.Duration()-e.startTime, 0).Seconds()
+	}
+	return uint64(math.Round(remaining * sinkRate / e.options.tempo))
+}
 
-		if ml.config.ThrottleStreaming {
-			writtenBuffers = append(writtenBuffers, latestWrittenBuffer)
-			remaningBufferBytes := 0
-			for i := len(writtenBuffers) - 1; i >= 0; i-- {
-				remaningBufferBytes += writtenBuffers[i].byteSize
-				if remaningBufferBytes < ml.config.StreamAheadBytes {
-					continue
-				}
-				timeToWake := min(writtenBuffers[i].startTime, getPlayedTime()-ml.config.StreamAheadTime)
-				timeToSleep := timeToWake - time.Since(startTime)
-				if timeToSleep > time.Millisecond {
-					//log.Printf("sleeping %v", timeToSleep)
-					time.Sleep(timeToSleep)
-				}
-				break
-			}
+// serveCachedTranscode serves a complete transcode of a track from the
+// transcode cache, with support for byte ranges.
+func (ml *Library) serveCachedTranscode(
+	libraryPath string,
+	file *os.File,
+	mimeType string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	// seeking in the browser produces requests for later ranges, which
+	// shouldn't count as plays
+	if requestsStartOfStream(req) {
+		if err := ml.db.RecordPlay(libraryPath); err != nil {
+			slog.ErrorContext(ctx, "failed to record play", "error", err)
 		}
 	}
 
-	if err = aurelib.FlushSink(sink); err != nil {
-		slog.ErrorContext(ctx, "failed to flush sink", "error", err)
-	}
-	if _, err = writeBuffer(); err != nil {
-		slog.DebugContext(ctx, "failed to write buffer", "error", err)
-	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	http.ServeContent(w, req, "", time.Time{}, file)
 }
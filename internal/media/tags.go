@@ -0,0 +1,105 @@
+package media
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// maxTagsRequestSize is the largest request body accepted by the tag-edit API.
+const maxTagsRequestSize = 1024 * 1024
+
+// A tagWriteLock serializes the tag edits of one file, so that concurrent
+// requests don't each rewrite the original and lose the other's changes.
+type tagWriteLock struct {
+	mu    sync.Mutex
+	users int // requests holding or waiting for mu; guarded by Library.tagWriteMu
+}
+
+// lockTagWrites waits until no other request is editing the tags of the file
+// at libraryPath, and returns a function that lets the next one proceed.
+func (ml *Library) lockTagWrites(libraryPath string) (unlock func()) {
+	ml.tagWriteMu.Lock()
+	lock := ml.tagWriteLocks[libraryPath]
+	if lock == nil {
+		lock = &tagWriteLock{}
+		ml.tagWriteLocks[libraryPath] = lock
+	}
+	lock.users++
+	ml.tagWriteMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		ml.tagWriteMu.Lock()
+		defer ml.tagWriteMu.Unlock()
+		if lock.users--; lock.users == 0 {
+			delete(ml.tagWriteLocks, libraryPath)
+		}
+	}
+}
+
+// handleSetTrackTags rewrites the file of the track at libraryPath with the
+// tags in the request body, a JSON object mapping tag names to values. Tags
+// with empty values are removed, and others are left unchanged. The database is
+// updated by the filesystem watcher once it sees the new file, so the response
+// doesn't reflect the change.
+func (ml *Library) handleSetTrackTags(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	if !ml.config.AllowTagEditing {
+		w.WriteHeader(http.StatusForbidden)
+		slog.ErrorContext(ctx, "tag editing is disabled", "path", libraryPath)
+		return
+	}
+
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		slog.ErrorContext(ctx, "GetTrack failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if track == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if track.Metadata.Fragment != nil {
+		// the tags of fragments come from the directory configuration
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "can't edit tags of a fragment", "path", libraryPath)
+		return
+	}
+
+	var tags map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxTagsRequestSize)).Decode(&tags); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(ctx, "failed to decode tags", "error", err)
+		return
+	}
+	for key := range tags {
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.ErrorContext(ctx, "empty tag name")
+			return
+		}
+	}
+
+	unlock := ml.lockTagWrites(libraryPath)
+	defer unlock()
+
+	slog.InfoContext(ctx, "writing tags", "path", libraryPath, "tags", tags)
+	if err := aurelib.WriteTags(ml.libraryToFsPath(libraryPath), tags); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "failed to write tags", "path", libraryPath, "error", err)
+		return
+	}
+	writeJson(req, w, nil)
+}
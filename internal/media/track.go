@@ -1,6 +1,7 @@
 package media
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 
 	"github.com/beakbeak/aurelius/internal/mediadb"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
 )
 
 // Image describes an image attached to a track.
@@ -33,7 +35,26 @@ type Track struct {
 	BitRate         int               `json:"bitRate"`
 	SampleRate      uint              `json:"sampleRate"`
 	SampleFormat    string            `json:"sampleFormat"`
+	StartPadding    uint              `json:"startPadding,omitempty"`
+	EndTrimming     uint              `json:"endTrimming,omitempty"`
 	Dir             string            `json:"dir"`
+
+	// Streams lists the audio streams that can be selected with the stream
+	// parameter of a stream request, if the file has more than one.
+	Streams []mediadb.AudioStream `json:"streams,omitempty"`
+
+	// ReplayGainComputed is true if the track has no ReplayGain tags, and its
+	// ReplayGain values were computed from its measured loudness instead.
+	ReplayGainComputed bool `json:"replayGainComputed,omitempty"`
+
+	// Silence holds the durations of the silence at the start and end of the
+	// track, which can be skipped with the trimSilence parameter of a stream
+	// request, if silence detection is enabled.
+	Silence *mediadb.Silence `json:"silence,omitempty"`
+
+	// ReplayGainMode is the ReplayGain mode that the config of the track's
+	// directory sets as the default, if any.
+	ReplayGainMode string `json:"replayGainMode,omitempty"`
 }
 
 func (ml *Library) handleSetTrackFavorite(
@@ -76,9 +97,11 @@ func (ml *Library) makeTrack(track *mediadb.Track, favorite bool) Track {
 
 	replayGainTrack := 1.0
 	replayGainAlbum := 1.0
+	replayGainComputed := false
 	if track.Metadata.ReplayGain != nil {
 		replayGainTrack = track.Metadata.ReplayGain.Track
 		replayGainAlbum = track.Metadata.ReplayGain.Album
+		replayGainComputed = track.Metadata.ReplayGain.Computed
 	}
 
 	trackPath := joinLibraryPath(track.Dir, track.Name)
@@ -95,10 +118,81 @@ func (ml *Library) makeTrack(track *mediadb.Track, favorite bool) Track {
 		BitRate:         track.Metadata.BitRate,
 		SampleRate:      track.Metadata.SampleRate,
 		SampleFormat:    track.Metadata.SampleFormat,
+		StartPadding:    track.Metadata.StartPadding,
+		EndTrimming:     track.Metadata.EndTrimming,
 		Dir:             ml.libraryToUrlPath("dirs", track.Dir),
+		Streams:         track.Metadata.Streams,
+
+		ReplayGainComputed: replayGainComputed,
+		Silence:            track.Metadata.Silence,
+		ReplayGainMode:     track.Metadata.ReplayGainMode,
+	}
+}
+
+// needsPadding returns whether the gapless padding and exact sample count of
+// track have yet to be scanned. This is the case for a track that was scanned
+// before they were stored. Fragments have no padding of their own.
+func needsPadding(track *mediadb.Track) bool {
+	m := &track.Metadata
+	return m.SampleCount == 0 && !m.PaddingScanned && m.Fragment == nil
+}
+
+// ensurePadding scans the padding and sample count of a track if needed (see
+// needsPadding), and saves them for later requests. track is updated in place.
+// If the scan fails, the track is marked as scanned so that it isn't retried.
+func (ml *Library) ensurePadding(ctx context.Context, libraryPath string, track *mediadb.Track) {
+	if !needsPadding(track) {
+		return
+	}
+
+	var start, end uint
+	var sampleCount uint64
+	if src, err := aurelib.NewFileSource(ml.libraryToFsPath(libraryPath)); err != nil {
+		slog.WarnContext(ctx, "failed to open track", "path", libraryPath, "error", err)
+	} else {
+		start, end, sampleCount, err = src.ScanPadding()
+		src.Destroy()
+		if err != nil {
+			slog.WarnContext(ctx, "failed to scan padding", "path", libraryPath, "error", err)
+		}
+	}
+	track.Metadata.StartPadding = start
+	track.Metadata.EndTrimming = end
+	track.Metadata.SampleCount = sampleCount
+	track.Metadata.PaddingScanned = true
+
+	if err := ml.db.SetTrackPadding(libraryPath, track.Hash, start, end, sampleCount); err != nil {
+		slog.ErrorContext(ctx, "failed to store padding", "path", libraryPath, "error", err)
 	}
 }
 
+// schedulePaddingScan runs ensurePadding for track in the background, unless
+// a scan of the same track is already running, so that track info requests
+// don't wait for it.
+func (ml *Library) schedulePaddingScan(libraryPath string, track *mediadb.Track) {
+	if !needsPadding(track) {
+		return
+	}
+
+	ml.paddingScanMu.Lock()
+	defer ml.paddingScanMu.Unlock()
+	if ml.paddingScans[libraryPath] {
+		return
+	}
+	ml.paddingScans[libraryPath] = true
+
+	trackCopy := *track
+	ml.paddingScanWG.Add(1)
+	go func() {
+		defer ml.paddingScanWG.Done()
+		ml.ensurePadding(context.Background(), libraryPath, &trackCopy)
+
+		ml.paddingScanMu.Lock()
+		delete(ml.paddingScans, libraryPath)
+		ml.paddingScanMu.Unlock()
+	}()
+}
+
 func (ml *Library) handleGetTrack(
 	libraryPath string,
 	w http.ResponseWriter,
@@ -115,6 +209,7 @@ func (ml *Library) handleGetTrack(
 		http.NotFound(w, req)
 		return
 	}
+	ml.schedulePaddingScan(libraryPath, track)
 
 	favorite, err := ml.db.IsFavorite(libraryPath)
 	if err != nil {
@@ -0,0 +1,234 @@
+package media
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcodeTempPrefix is the file name prefix of incomplete cache entries.
+const transcodeTempPrefix = "tmp-"
+
+// A transcodeCache stores complete transcoded streams on disk, so that they can
+// be served again without re-encoding. Entries are named after the hash of the
+// track and a key describing the encoding, and are evicted in least recently
+// used order when the cache exceeds its size limit.
+type transcodeCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex // guards the following fields
+	entries map[string]*list.Element
+	lru     *list.List // of *transcodeCacheEntry; most recently used first
+	size    int64
+}
+
+type transcodeCacheEntry struct {
+	name string
+	size int64
+}
+
+// newTranscodeCache opens the cache stored in dir, creating dir if it doesn't
+// exist. Existing entries are indexed in order of their modification times,
+// which are updated when entries are used. Incomplete entries left behind by
+// a previous process are removed.
+func newTranscodeCache(dir string, maxSize int64) (*transcodeCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create transcode cache directory: %w", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcode cache directory: %w", err)
+	}
+
+	type fileInfo struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []fileInfo
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, transcodeTempPrefix) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				slog.Warn("failed to remove incomplete transcode", "name", name, "error", err)
+			}
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, fileInfo{name, info.Size(), info.ModTime()})
+	}
+	slices.SortFunc(files, func(a, b fileInfo) int { return b.modTime.Compare(a.modTime) })
+
+	cache := &transcodeCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, file := range files {
+		cache.entries[file.name] = cache.lru.PushBack(&transcodeCacheEntry{file.name, file.size})
+		cache.size += file.size
+	}
+
+	cache.mu.Lock()
+	cache.evict()
+	cache.mu.Unlock()
+	return cache, nil
+}
+
+// transcodeCacheName returns the file name of the entry for the given track
+// hash and encoding key.
+func transcodeCacheName(trackHash []byte, key string) string {
+	keyHash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(trackHash) + "-" + hex.EncodeToString(keyHash[:16])
+}
+
+// open returns the entry for the given track hash and encoding key, or nil if
+// there is none. The entry is marked as recently used.
+func (c *transcodeCache) open(trackHash []byte, key string) *os.File {
+	name := transcodeCacheName(trackHash, key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+
+	filePath := filepath.Join(c.dir, name)
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.Warn("failed to open cached transcode", "name", name, "error", err)
+		c.remove(element)
+		return nil
+	}
+
+	c.lru.MoveToFront(element)
+	now := time.Now()
+	if err := os.Chtimes(filePath, now, now); err != nil {
+		slog.Debug("failed to update cached transcode time", "name", name, "error", err)
+	}
+	return file
+}
+
+// create starts a new entry for the given track hash and encoding key. The
+// entry isn't visible until it is committed with transcodeCacheWriter.Commit.
+func (c *transcodeCache) create(trackHash []byte, key string) (*transcodeCacheWriter, error) {
+	file, err := os.CreateTemp(c.dir, transcodeTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &transcodeCacheWriter{
+		cache: c,
+		name:  transcodeCacheName(trackHash, key),
+		file:  file,
+	}, nil
+}
+
+// invalidate removes all entries belonging to tracks with the given hashes.
+func (c *transcodeCache) invalidate(trackHashes [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, trackHash := range trackHashes {
+		prefix := hex.EncodeToString(trackHash) + "-"
+		for name, element := range c.entries {
+			if strings.HasPrefix(name, prefix) {
+				c.remove(element)
+			}
+		}
+	}
+}
+
+// remove deletes an entry. c.mu must be held.
+func (c *transcodeCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*transcodeCacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+
+	if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove cached transcode", "name", entry.name, "error", err)
+	}
+}
+
+// evict removes the least recently used entries until the cache fits within
+// its size limit. c.mu must be held.
+func (c *transcodeCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// A transcodeCacheWriter receives the data of a new cache entry.
+type transcodeCacheWriter struct {
+	cache *transcodeCache
+	name  string
+	file  *os.File
+	size  int64
+	err   error
+}
+
+// Write appends data to the entry. Errors aren't returned, so that a failure
+// of the cache doesn't interrupt the stream being cached; instead, the entry is
+// discarded when it is committed.
+func (w *transcodeCacheWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return len(data), nil
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+		slog.Warn("failed to write transcode cache entry", "error", err)
+	}
+	return len(data), nil
+}
+
+// Commit adds the complete entry to the cache, replacing any existing entry
+// with the same name.
+func (w *transcodeCacheWriter) Commit() {
+	tempPath := w.file.Name()
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil || w.size > w.cache.maxSize {
+		os.Remove(tempPath)
+		return
+	}
+
+	c := w.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[w.name]; ok {
+		c.remove(element)
+	}
+	if err := os.Rename(tempPath, filepath.Join(c.dir, w.name)); err != nil {
+		slog.Warn("failed to commit transcode cache entry", "name", w.name, "error", err)
+		os.Remove(tempPath)
+		return
+	}
+	c.entries[w.name] = c.lru.PushFront(&transcodeCacheEntry{w.name, w.size})
+	c.size += w.size
+	c.evict()
+}
+
+// Abort discards the entry.
+func (w *transcodeCacheWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,106 @@
+package media
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+const (
+	// defaultWaveformPoints is the number of peaks in a waveform when the
+	// request doesn't specify the resolution.
+	defaultWaveformPoints = 1000
+
+	// maxWaveformPoints is the highest resolution of waveform that may be
+	// requested.
+	maxWaveformPoints = 10000
+)
+
+// Waveform is the JSON representation of a track's waveform returned by the
+// API. The track is divided into spans of equal duration, and Min and Max hold
+// the lowest and highest sample value in each span, across all channels. Full
+// scale is -1 to 1.
+type Waveform struct {
+	Duration float64   `json:"duration"`
+	Min      []float32 `json:"min"`
+	Max      []float32 `json:"max"`
+}
+
+// handleGetWaveform decodes the track at libraryPath to produce its waveform,
+// at the resolution given by the points parameter. The full-resolution
+// waveform is cached in the database by track hash, so a track is only decoded
+// once, and reduced to the requested resolution for each request.
+func (ml *Library) handleGetWaveform(
+	libraryPath string,
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx := req.Context()
+
+	track, err := ml.db.GetTrack(libraryPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "GetTrack failed", "error", err)
+		return
+	}
+	if track == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	points := defaultWaveformPoints
+	if pointsArg := req.URL.Query().Get("points"); pointsArg != "" {
+		if points, err = strconv.Atoi(pointsArg); err != nil || points < 1 || points > maxWaveformPoints {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.ErrorContext(ctx, "invalid waveform resolution", "points", pointsArg)
+			return
+		}
+	}
+
+	blocks, err := ml.db.GetWaveform(track.Hash)
+	if err != nil {
+		slog.ErrorContext(ctx, "GetWaveform failed", "error", err)
+	}
+	if blocks == nil {
+		if blocks, err = ml.measureWaveform(req, libraryPath); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.ErrorContext(ctx, "failed to measure waveform", "path", libraryPath, "error", err)
+			return
+		}
+		if err := ml.db.SaveWaveform(track.Hash, blocks); err != nil {
+			slog.ErrorContext(ctx, "SaveWaveform failed", "error", err)
+		}
+	}
+	peaks := aurelib.DownsamplePeaks(blocks, points)
+
+	waveform := Waveform{
+		Duration: track.Metadata.Duration,
+		Min:      make([]float32, len(peaks)),
+		Max:      make([]float32, len(peaks)),
+	}
+	for i, peak := range peaks {
+		waveform.Min[i] = peak.Min
+		waveform.Max[i] = peak.Max
+	}
+	writeJson(req, w, waveform)
+}
+
+// measureWaveform decodes the track at libraryPath and returns its peaks at
+// full resolution.
+func (ml *Library) measureWaveform(req *http.Request, libraryPath string) ([]aurelib.Peak, error) {
+	src, _, err := ml.newAudioSource(libraryPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Destroy()
+
+	meter := aurelib.NewWaveformMeter(src.StreamInfo())
+	defer meter.Destroy()
+
+	if err := aurelib.Transcode(req.Context(), src, meter, nil); err != nil {
+		return nil, err
+	}
+	return meter.Blocks(), nil
+}
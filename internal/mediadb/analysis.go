@@ -0,0 +1,138 @@
+package mediadb
+
+import (
+	"context"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// analyzeTrack decodes a track once to perform the analyses enabled in the
+// Scanner that apply to it: measuring the loudness of a track without
+// ReplayGain tags, detecting silence, and computing an acoustic fingerprint.
+// The results are stored in metadata, and the fingerprint is returned. If the
+// whole file was decoded, its padding is stored too (see storePadding).
+//
+// previous, if not nil, is the track previously scanned from the same audio.
+// Its results are reused, and only the analyses they lack are performed. The
+// returned fingerprint is nil if the audio was already fingerprinted.
+//
+// If the track can't be decoded, its loudness and silence are marked as failed,
+// and an empty fingerprint is returned, so that it isn't decoded again on every
+// scan.
+func (s *Scanner) analyzeTrack(
+	wr *WalkResult,
+	entry FileInfo,
+	metadata *TrackMetadata,
+	previous *Track,
+) ([]uint32, error) {
+	fingerprint := s.fingerprint
+	if previous != nil {
+		if p := &previous.Metadata; p.PaddingScanned || p.SampleCount > 0 {
+			storePadding(metadata, p.StartPadding, p.EndTrimming, p.SampleCount)
+		}
+		if metadata.ReplayGain == nil && previous.Metadata.Loudness != nil {
+			metadata.Loudness = previous.Metadata.Loudness
+			if rg := previous.Metadata.ReplayGain; rg != nil && rg.Computed {
+				metadata.ReplayGain = rg
+			}
+		}
+		if silence := previous.Metadata.Silence; silence != nil && silence.Threshold == s.silenceThreshold {
+			metadata.Silence = silence
+		}
+		if fingerprint {
+			fingerprinted, err := s.db.hasFingerprint(previous.Hash)
+			if err != nil {
+				return nil, err
+			}
+			fingerprint = !fingerprinted
+		}
+	}
+
+	measureLoudness := s.computeReplayGain && metadata.ReplayGain == nil && metadata.Loudness == nil
+	detectSilence := s.detectSilence && metadata.Silence == nil
+	if !measureLoudness && !detectSilence && !fingerprint {
+		return nil, nil
+	}
+
+	result, err := s.runAnalyses(wr, entry, metadata, measureLoudness, detectSilence, fingerprint)
+	if err != nil && measureLoudness {
+		metadata.Loudness = &Loudness{Failed: true}
+	}
+	if err != nil && detectSilence {
+		metadata.Silence = &Silence{Threshold: s.silenceThreshold, Failed: true}
+	}
+	if fingerprint && result == nil {
+		result = []uint32{}
+	}
+	return result, err
+}
+
+func (s *Scanner) runAnalyses(
+	wr *WalkResult,
+	entry FileInfo,
+	metadata *TrackMetadata,
+	measureLoudness, detectSilence, fingerprint bool,
+) ([]uint32, error) {
+	src, err := s.openSource(wr, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Destroy()
+
+	var outputs []aurelib.TranscodeOutput
+
+	var loudnessMeter *aurelib.LoudnessMeter
+	if measureLoudness {
+		if loudnessMeter, err = aurelib.NewLoudnessMeter(); err != nil {
+			return nil, err
+		}
+		defer loudnessMeter.Destroy()
+		outputs = append(outputs, aurelib.TranscodeOutput{Sink: loudnessMeter})
+	}
+
+	var silenceMeter *aurelib.SilenceMeter
+	if detectSilence {
+		silenceMeter = aurelib.NewSilenceMeter(src.StreamInfo(), s.silenceThreshold)
+		defer silenceMeter.Destroy()
+		outputs = append(outputs, aurelib.TranscodeOutput{Sink: silenceMeter})
+	}
+
+	var fingerprintMeter *aurelib.FingerprintMeter
+	if fingerprint {
+		fingerprintMeter = aurelib.NewFingerprintMeter()
+		defer fingerprintMeter.Destroy()
+		outputs = append(outputs, aurelib.TranscodeOutput{
+			Sink:    fingerprintMeter,
+			EndTime: aurelib.FingerprintDuration,
+		})
+	}
+
+	if err := aurelib.TranscodeAll(context.Background(), src, outputs); err != nil {
+		return nil, err
+	}
+
+	if loudnessMeter != nil {
+		storeLoudness(metadata, loudnessMeter)
+	}
+	if silenceMeter != nil {
+		storeSilence(metadata, silenceMeter, s.silenceThreshold)
+	}
+	if fileSrc, ok := src.(*aurelib.FileSource); ok {
+		if start, end, sampleCount, ok := fileSrc.DecodedPadding(); ok {
+			storePadding(metadata, start, end, sampleCount)
+		}
+	}
+	if fingerprintMeter != nil {
+		return fingerprintMeter.Fingerprint(), nil
+	}
+	return nil, nil
+}
+
+// storePadding stores the gapless padding and exact sample count of a whole
+// file in metadata, and marks them as scanned.
+func storePadding(metadata *TrackMetadata, startPadding, endTrimming uint, sampleCount uint64) {
+	metadata.StartPadding = startPadding
+	metadata.EndTrimming = endTrimming
+	metadata.SampleCount = sampleCount
+	metadata.PaddingScanned = true
+}
@@ -0,0 +1,182 @@
+package mediadb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/beakbeak/aurelius/internal/maputil"
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// minChapters is the number of chapters a file must have for them to be
+// exposed as fragments. A single chapter would only duplicate the file.
+const minChapters = 2
+
+// getChapters returns the chapters stored for the file with the given hash.
+// found is false if the file's chapters haven't been read yet.
+func (db *DB) getChapters(hash []byte) (chapters []Chapter, found bool, err error) {
+	var data string
+	switch err := db.db.QueryRow(`SELECT chapters FROM chapters WHERE hash = ?`, hash).Scan(&data); {
+	case err == sql.ErrNoRows:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+	if err := json.Unmarshal([]byte(data), &chapters); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal chapters: %w", err)
+	}
+	return chapters, true, nil
+}
+
+// insertChapters stores the chapters read from files during a scan.
+func insertChapters(tx *sql.Tx, wr *WalkResult) error {
+	if len(wr.Chapters) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO chapters (hash, chapters) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for hash, chapters := range wr.Chapters {
+		data, err := json.Marshal(chapters)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chapters: %w", err)
+		}
+		if _, err := stmt.Exec([]byte(hash), string(data)); err != nil {
+			return fmt.Errorf("failed to insert chapters: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileChapters returns the chapters of the audio file source, whose hash is
+// sourceHash. The file is only read if its chapters aren't in the database, in
+// which case they are recorded in wr.Chapters to be stored by Apply.
+func (s *Scanner) fileChapters(wr *WalkResult, source FileInfo, sourceHash []byte) ([]Chapter, error) {
+	if chapters, ok := wr.Chapters[string(sourceHash)]; ok {
+		return chapters, nil
+	}
+	if chapters, found, err := s.db.getChapters(sourceHash); err != nil {
+		return nil, err
+	} else if found {
+		return chapters, nil
+	}
+
+	avChapters, err := aurelib.ReadChapters(s.fsPath(source.Dir, source.Name))
+	if err != nil {
+		return nil, err
+	}
+	chapters := make([]Chapter, 0, len(avChapters))
+	for _, avChapter := range avChapters {
+		tags := maputil.LowerCaseKeys(avChapter.Tags)
+		chapters = append(chapters, Chapter{
+			Start:  avChapter.Start.Seconds(),
+			End:    avChapter.End.Seconds(),
+			Title:  tags["title"],
+			Artist: tags["artist"],
+		})
+	}
+	wr.Chapters[string(sourceHash)] = chapters
+	return chapters, nil
+}
+
+// chapterFragments resolves the chapters embedded in the audio file source
+// into fragments, which are added to wr.Fragments, and returns their entries.
+// Fragments are numbered in the same way as those defined in aurelius.yaml,
+// and take their titles from the chapters.
+func (s *Scanner) chapterFragments(wr *WalkResult, source FileInfo, sourceHash []byte) []FileInfo {
+	chapters, err := s.fileChapters(wr, source, sourceHash)
+	if err != nil {
+		slog.Warn("failed to read chapters", "dir", source.Dir, "name", source.Name, "error", err)
+		return nil
+	}
+	if len(chapters) < minChapters {
+		return nil
+	}
+
+	toDuration := func(seconds float64) time.Duration {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	entries := make([]FileInfo, 0, len(chapters))
+	for i, chapter := range chapters {
+		index := i + 1
+		entry := FileInfo{
+			Dir:   source.Dir,
+			Name:  MakeFragmentName(source.Name, index),
+			Mtime: source.Mtime,
+		}
+		wr.Fragments[JoinLibraryPath(entry.Dir, entry.Name)] = resolvedFragment{
+			SourceFSPath: s.fsPath(source.Dir, source.Name),
+			SourceFile:   source.Name,
+			Config: &FragmentConfig{
+				Source: source.Name,
+				Start:  toDuration(chapter.Start),
+				End:    toDuration(chapter.End),
+				Title:  chapter.Title,
+				Artist: chapter.Artist,
+			},
+			Index: index,
+			hash:  computeFragmentHash(nil, sourceHash, index),
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// expandChapters adds fragments to wr.Files for the chapters embedded in the
+// audio files found by walkFilesystem. Directories listed in ignoreDirs and
+// files listed in fragmentedFiles, which have fragments defined in
+// aurelius.yaml or a cue sheet, are skipped.
+func (s *Scanner) expandChapters(wr *WalkResult, ignoreDirs, fragmentedFiles map[string]bool) {
+	// Unchanged files are identified by the hashes in the database, to avoid
+	// hashing every file in the library.
+	type knownFile struct {
+		mtime int64
+		hash  []byte
+	}
+	known := make(map[string]knownFile)
+	if err := s.db.ForEachTrack(func(t *Track) error {
+		if t.Metadata.Fragment == nil {
+			known[JoinLibraryPath(t.Dir, t.Name)] = knownFile{mtime: t.Mtime, hash: t.Hash}
+		}
+		return nil
+	}); err != nil {
+		slog.Warn("failed to list tracks for chapter expansion", "error", err)
+	}
+
+	var sources []FileInfo
+	for key, entry := range wr.Files {
+		if _, isFragment := wr.Fragments[key]; !isFragment && !ignoreDirs[entry.Dir] && !fragmentedFiles[key] {
+			sources = append(sources, entry)
+		}
+	}
+
+	count := 0
+	for _, source := range sources {
+		key := JoinLibraryPath(source.Dir, source.Name)
+		var hash []byte
+		if file, ok := known[key]; ok && file.mtime == source.Mtime {
+			hash = file.hash
+		} else {
+			var err error
+			if hash, err = computePartialHash(s.fsPath(source.Dir, source.Name)); err != nil {
+				slog.Warn("failed to hash file", "dir", source.Dir, "name", source.Name, "error", err)
+				continue
+			}
+		}
+		for _, entry := range s.chapterFragments(wr, source, hash) {
+			wr.Files[JoinLibraryPath(entry.Dir, entry.Name)] = entry
+			count++
+		}
+	}
+
+	if count > 0 {
+		slog.Info("expanded fragments from chapters", "count", count)
+	}
+}
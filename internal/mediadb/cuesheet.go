@@ -0,0 +1,222 @@
+package mediadb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// cueFramesPerSecond is the number of frames per second in cue sheet
+// timestamps, which are in the form mm:ss:ff.
+const cueFramesPerSecond = 75
+
+// LoadCueSheet reads and parses a cue sheet from the given path. It returns a
+// fragment for each audio track, starting at the track's INDEX 01 and ending
+// where the next track in the same file starts. The fragments take their
+// titles and artists from the TITLE and PERFORMER of each track, their album
+// from the cue sheet's TITLE, and their track numbers from TRACK.
+//
+// The Source of each fragment is the name given by FILE, which might not
+// match the name of the audio file; see resolveCueSource.
+func LoadCueSheet(fsPath string) ([]FragmentConfig, error) {
+	data, err := os.ReadFile(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	// Cue sheets are often written by Windows programs, with a byte order
+	// mark or in a legacy encoding, which is assumed to be Latin-1.
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		data = []byte(string(runes))
+	}
+
+	type cueTrack struct {
+		number    string
+		source    string
+		start     time.Duration
+		hasStart  bool
+		title     string
+		performer string
+	}
+
+	var (
+		albumTitle     string
+		albumPerformer string
+		file           string
+		tracks         []*cueTrack
+		inTrack        bool      // whether a TRACK has been seen
+		track          *cueTrack // the current track, if it is an audio track
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		command, args := parseCueLine(scanner.Text())
+		switch strings.ToUpper(command) {
+		case "FILE":
+			if len(args) == 0 {
+				return nil, fmt.Errorf("line %d: FILE without a name", lineNumber)
+			}
+			// Names may be relative paths written on Windows.
+			file = path.Base(strings.ReplaceAll(args[0], `\`, "/"))
+
+		case "TRACK":
+			inTrack = true
+			track = nil
+			if len(args) < 2 || !strings.EqualFold(args[1], "AUDIO") {
+				continue
+			}
+			number, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid track number %q", lineNumber, args[0])
+			}
+			track = &cueTrack{number: strconv.Itoa(number)}
+			tracks = append(tracks, track)
+
+		case "INDEX":
+			if track == nil || len(args) < 2 || args[0] != "01" {
+				continue
+			}
+			start, err := parseCueTime(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			if file == "" {
+				return nil, fmt.Errorf("line %d: INDEX before FILE", lineNumber)
+			}
+			track.source = file
+			track.start = start
+			track.hasStart = true
+
+		case "TITLE", "PERFORMER":
+			if len(args) == 0 {
+				continue
+			}
+			value := args[0]
+			switch {
+			case inTrack && track == nil:
+				// ignore the titles of data tracks
+			case track != nil && strings.EqualFold(command, "TITLE"):
+				track.title = value
+			case track != nil:
+				track.performer = value
+			case strings.EqualFold(command, "TITLE"):
+				albumTitle = value
+			default:
+				albumPerformer = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var fragments []FragmentConfig
+	for i, t := range tracks {
+		if !t.hasStart {
+			continue
+		}
+		fc := FragmentConfig{
+			Source: t.source,
+			Start:  t.start,
+			Artist: t.performer,
+			Title:  t.title,
+			Album:  albumTitle,
+			Track:  t.number,
+		}
+		if fc.Artist == "" {
+			fc.Artist = albumPerformer
+		}
+		for _, next := range tracks[i+1:] {
+			if next.hasStart {
+				if next.source == t.source {
+					fc.End = next.start
+				}
+				break
+			}
+		}
+		fragments = append(fragments, fc)
+	}
+	return fragments, nil
+}
+
+// parseCueLine splits a line of a cue sheet into its command and arguments.
+// Arguments may be enclosed in double quotes to include spaces.
+func parseCueLine(line string) (command string, args []string) {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var field string
+		if line[0] == '"' {
+			if end := strings.IndexByte(line[1:], '"'); end >= 0 {
+				field, line = line[1:end+1], line[end+2:]
+			} else {
+				field, line = line[1:], ""
+			}
+		} else if end := strings.IndexAny(line, " \t"); end >= 0 {
+			field, line = line[:end], line[end:]
+		} else {
+			field, line = line, ""
+		}
+		fields = append(fields, field)
+		line = strings.TrimLeft(line, " \t")
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// parseCueTime parses a cue sheet timestamp in the form mm:ss:ff, where ff is
+// a number of frames.
+func parseCueTime(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var values [3]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		values[i] = value
+	}
+	minutes, seconds, frames := values[0], values[1], values[2]
+	if seconds >= 60 || frames >= cueFramesPerSecond {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second +
+		time.Duration(frames)*time.Second/cueFramesPerSecond, nil
+}
+
+// resolveCueSource returns the name of the audio file in audioFiles, the
+// names of the audio files in a cue sheet's directory, that is referred to by
+// a FILE name in the cue sheet. Cue sheets often name a file that was later
+// converted to another format, so if no file has the exact name, a single file
+// with the same name apart from its extension is used.
+func resolveCueSource(name string, audioFiles map[string]bool) (string, bool) {
+	if audioFiles[name] {
+		return name, true
+	}
+	base := strings.TrimSuffix(name, path.Ext(name))
+	var match string
+	for file := range audioFiles {
+		if strings.TrimSuffix(file, path.Ext(file)) == base {
+			if match != "" {
+				return "", false // ambiguous
+			}
+			match = file
+		}
+	}
+	return match, match != ""
+}
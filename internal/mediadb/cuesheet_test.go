@@ -0,0 +1,166 @@
+package mediadb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCueSheet(t *testing.T) {
+	writeCueSheet := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "album.cue")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("single file", func(t *testing.T) {
+		path := writeCueSheet(t, "\xef\xbb\xbf"+`REM GENRE Rock
+PERFORMER "Album Artist"
+TITLE "Test Album"
+FILE "Album Artist - Test Album.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    INDEX 00 00:00:00
+    INDEX 01 00:00:32
+  TRACK 02 AUDIO
+    TITLE "Second Song"
+    PERFORMER "Guest Artist"
+    INDEX 00 03:58:10
+    INDEX 01 04:00:00
+  TRACK 03 AUDIO
+    TITLE "Third"
+    INDEX 01 07:30:74
+`)
+		fragments, err := LoadCueSheet(path)
+		if err != nil {
+			t.Fatalf("LoadCueSheet failed: %v", err)
+		}
+		want := []FragmentConfig{
+			{
+				Source: "Album Artist - Test Album.wav",
+				Start:  32 * time.Second / 75,
+				End:    4 * time.Minute,
+				Artist: "Album Artist",
+				Title:  "First",
+				Album:  "Test Album",
+				Track:  "1",
+			},
+			{
+				Source: "Album Artist - Test Album.wav",
+				Start:  4 * time.Minute,
+				End:    7*time.Minute + 30*time.Second + 74*time.Second/75,
+				Artist: "Guest Artist",
+				Title:  "Second Song",
+				Album:  "Test Album",
+				Track:  "2",
+			},
+			{
+				Source: "Album Artist - Test Album.wav",
+				Start:  7*time.Minute + 30*time.Second + 74*time.Second/75,
+				Artist: "Album Artist",
+				Title:  "Third",
+				Album:  "Test Album",
+				Track:  "3",
+			},
+		}
+		if len(fragments) != len(want) {
+			t.Fatalf("expected %d fragments, got %d: %+v", len(want), len(fragments), fragments)
+		}
+		for i := range want {
+			if fragments[i] != want[i] {
+				t.Errorf("fragment %d = %+v, want %+v", i, fragments[i], want[i])
+			}
+		}
+	})
+
+	t.Run("multiple files and data track", func(t *testing.T) {
+		path := writeCueSheet(t, `FILE "C:\Rips\one.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 01 01:00:00
+FILE "two.flac" WAVE
+  TRACK 03 AUDIO
+    INDEX 01 00:00:00
+FILE "data.bin" BINARY
+  TRACK 04 MODE1/2352
+    TITLE "Data"
+    INDEX 01 00:00:00
+`)
+		fragments, err := LoadCueSheet(path)
+		if err != nil {
+			t.Fatalf("LoadCueSheet failed: %v", err)
+		}
+		if len(fragments) != 3 {
+			t.Fatalf("expected 3 fragments, got %d: %+v", len(fragments), fragments)
+		}
+		if fragments[0].Source != "one.flac" || fragments[0].End != time.Minute {
+			t.Errorf("fragment 0 = %+v", fragments[0])
+		}
+		if fragments[1].Source != "one.flac" || fragments[1].End != 0 {
+			t.Errorf("fragment 1 should last until the end of one.flac: %+v", fragments[1])
+		}
+		if fragments[2].Source != "two.flac" || fragments[2].End != 0 || fragments[2].Track != "3" {
+			t.Errorf("fragment 2 = %+v", fragments[2])
+		}
+	})
+
+	t.Run("Latin-1", func(t *testing.T) {
+		path := writeCueSheet(t, "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    TITLE \"Caf\xe9\"\n    INDEX 01 00:00:00\n")
+		fragments, err := LoadCueSheet(path)
+		if err != nil {
+			t.Fatalf("LoadCueSheet failed: %v", err)
+		}
+		if len(fragments) != 1 || fragments[0].Title != "Café" {
+			t.Errorf("expected title %q, got %+v", "Café", fragments)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, content := range []string{
+			"TRACK 01 AUDIO\n  INDEX 01 00:00:00\n",
+			"FILE \"a.wav\" WAVE\n  TRACK xx AUDIO\n",
+			"FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:60:00\n",
+		} {
+			if _, err := LoadCueSheet(writeCueSheet(t, content)); err == nil {
+				t.Errorf("expected error for %q", content)
+			}
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := LoadCueSheet(filepath.Join(t.TempDir(), "missing.cue")); err == nil {
+			t.Error("expected error for missing file")
+		}
+	})
+}
+
+func TestResolveCueSource(t *testing.T) {
+	audioFiles := map[string]bool{
+		"album.flac":  true,
+		"other.flac":  true,
+		"other.opus":  true,
+		"single.flac": true,
+	}
+	tests := []struct {
+		name   string
+		want   string
+		wantOk bool
+	}{
+		{"album.flac", "album.flac", true},
+		{"album.wav", "album.flac", true},
+		{"other.wav", "", false},
+		{"other.opus", "other.opus", true},
+		{"missing.wav", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := resolveCueSource(tt.name, audioFiles)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("resolveCueSource(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
@@ -33,6 +33,21 @@ func Open(path string) (*DB, error) {
 		return nil, fmt.Errorf("failed to clean orphaned images: %w", err)
 	}
 
+	// Clean up waveforms, fingerprints and chapters of tracks that no longer
+	// exist.
+	if _, err := sqlDB.Exec("DELETE FROM waveforms WHERE hash NOT IN (SELECT hash FROM tracks_with_deletes)"); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to clean orphaned waveforms: %w", err)
+	}
+	if _, err := sqlDB.Exec("DELETE FROM fingerprints WHERE hash NOT IN (SELECT hash FROM tracks_with_deletes)"); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to clean orphaned fingerprints: %w", err)
+	}
+	if _, err := sqlDB.Exec("DELETE FROM chapters WHERE hash NOT IN (SELECT hash FROM tracks_with_deletes)"); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to clean orphaned chapters: %w", err)
+	}
+
 	return &DB{db: sqlDB}, nil
 }
 
@@ -188,6 +203,44 @@ func (db *DB) GetTracksInDir(dir string) ([]Track, error) {
 	return tracks, rows.Err()
 }
 
+// GetTrackPathsUnder returns the library paths of all tracks in the given
+// directory and its subdirectories. If dir is empty, all tracks are returned.
+// Source files hidden by fragments are excluded.
+func (db *DB) GetTrackPathsUnder(dir string) ([]string, error) {
+	where := `WHERE NOT EXISTS (
+		SELECT 1 FROM tracks frag
+		WHERE frag.dir = t.dir
+		AND json_extract(frag.metadata, '$.fragment.sourceFile') = t.name
+	)`
+	var args []any
+	if dir = CleanLibraryPath(dir); dir != "" {
+		where += ` AND (t.dir = ? OR t.dir LIKE ? || '/%')`
+		args = append(args, dir, dir)
+	}
+
+	rows, err := db.db.Query(
+		`SELECT CASE WHEN t.dir = '' THEN t.name
+			ELSE t.dir || '/' || t.name END
+		FROM tracks t `+where+`
+		ORDER BY t.dir, t.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var libraryPath string
+		if err := rows.Scan(&libraryPath); err != nil {
+			return nil, err
+		}
+		paths = append(paths, libraryPath)
+	}
+	return paths, rows.Err()
+}
+
 // GetTrackImagesInDir returns image metadata for all tracks in the given
 // directory, keyed by track ID.
 func (db *DB) GetTrackImagesInDir(dir string) (map[int64][]Image, error) {
@@ -243,10 +296,28 @@ func (db *DB) GetFavoritesInDir(dir string) (map[int64]bool, error) {
 	return result, rows.Err()
 }
 
-// GetSubdirs returns all immediate subdirectories of the given directory.
+// GetDir returns the directory at the given library path, or nil if it isn't
+// in the database.
+func (db *DB) GetDir(libraryPath string) (*Dir, error) {
+	var d Dir
+	err := db.db.QueryRow(
+		`SELECT path, parent, image_fingerprint, hidden FROM dirs WHERE path = ?`,
+		libraryPath,
+	).Scan(&d.Path, &d.Parent, &d.ImageFingerprint, &d.Hidden)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetSubdirs returns all immediate subdirectories of the given directory,
+// including hidden ones.
 func (db *DB) GetSubdirs(parent string) ([]Dir, error) {
 	rows, err := db.db.Query(
-		`SELECT path, parent FROM dirs WHERE parent = ? ORDER BY path`,
+		`SELECT path, parent, hidden FROM dirs WHERE parent = ? ORDER BY path`,
 		parent,
 	)
 	if err != nil {
@@ -257,7 +328,7 @@ func (db *DB) GetSubdirs(parent string) ([]Dir, error) {
 	var dirs []Dir
 	for rows.Next() {
 		var d Dir
-		if err := rows.Scan(&d.Path, &d.Parent); err != nil {
+		if err := rows.Scan(&d.Path, &d.Parent, &d.Hidden); err != nil {
 			return nil, err
 		}
 		dirs = append(dirs, d)
@@ -307,7 +378,7 @@ func (db *DB) SoftDeletedTrackByHash(hash []byte) (*Track, error) {
 
 // AllDirs returns all directories in the database.
 func (db *DB) AllDirs() (map[string]Dir, error) {
-	rows, err := db.db.Query(`SELECT path, parent, image_fingerprint FROM dirs`)
+	rows, err := db.db.Query(`SELECT path, parent, image_fingerprint, hidden FROM dirs`)
 	if err != nil {
 		return nil, err
 	}
@@ -316,7 +387,7 @@ func (db *DB) AllDirs() (map[string]Dir, error) {
 	dirs := make(map[string]Dir)
 	for rows.Next() {
 		var d Dir
-		if err := rows.Scan(&d.Path, &d.Parent, &d.ImageFingerprint); err != nil {
+		if err := rows.Scan(&d.Path, &d.Parent, &d.ImageFingerprint, &d.Hidden); err != nil {
 			return nil, err
 		}
 		dirs[d.Path] = d
@@ -492,6 +563,21 @@ func (db *DB) GetM3UPlaylistTrackAt(playlistPath string, pos int) (string, error
 	return libraryPath, err
 }
 
+// SetTrackPadding stores the gapless padding and exact sample count of the
+// track at the given library path (see TrackMetadata), and marks them as
+// scanned, unless the track has changed since hash was read.
+func (db *DB) SetTrackPadding(libraryPath string, hash []byte, startPadding, endTrimming uint, sampleCount uint64) error {
+	dir, name := SplitLibraryPath(libraryPath)
+	_, err := db.db.Exec(
+		`UPDATE tracks_with_deletes
+		SET metadata = json_set(metadata,
+			'$.startPadding', ?, '$.endTrimming', ?, '$.sampleCount', ?, '$.paddingScanned', json('true'))
+		WHERE dir = ? AND name = ? AND hash = ?`,
+		startPadding, endTrimming, sampleCount, dir, name, hash,
+	)
+	return err
+}
+
 // RecordPlay records a play event for the track at the given library path.
 func (db *DB) RecordPlay(libraryPath string) error {
 	dir, name := SplitLibraryPath(libraryPath)
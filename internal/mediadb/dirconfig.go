@@ -2,9 +2,13 @@ package mediadb
 
 import (
 	"fmt"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/beakbeak/aurelius/internal/maputil"
 	"go.yaml.in/yaml/v4"
 )
 
@@ -24,6 +28,129 @@ type FragmentConfig struct {
 // DirConfig represents the contents of an aurelius.yaml file.
 type DirConfig struct {
 	Fragments []FragmentConfig
+
+	// IgnoreChapters is true if chapters embedded in the directory's audio
+	// files should not be exposed as fragments.
+	IgnoreChapters bool
+
+	// Tags holds tags that override those of every track in the directory,
+	// keyed by lower-case tag name.
+	Tags map[string]string
+
+	// FileTags maps the names of tracks in the directory, including
+	// fragments, to tags that override theirs. Tags with empty values are
+	// removed.
+	FileTags map[string]map[string]string
+
+	// Cover is the name of an image file in the directory that is preferred
+	// over any other image as the cover of the directory's tracks.
+	Cover string
+
+	// ReplayGain is the ReplayGain mode ("track", "album" or "off") applied
+	// to the directory's tracks when a client doesn't request one, or empty
+	// for the default.
+	ReplayGain string
+
+	// Hidden is non-nil if the config sets whether the directory is hidden
+	// from directory listings and search results.
+	Hidden *bool
+
+	// Include and Exclude hold glob patterns matching files and directories
+	// that are added to the library even if an ancestor's patterns exclude
+	// them, and that are left out of it. Exclude replaces the exclude
+	// patterns inherited from ancestors. Patterns without a slash match
+	// names, and others match paths relative to the directory.
+	Include []string
+	Exclude []string
+
+	// patterns holds the include and exclude patterns of the config and of
+	// the ancestor configs it inherits from, nearest first.
+	patterns []filePatterns
+
+	// mtime is the modification time of the config file, in Unix seconds.
+	mtime int64
+
+	// overridesMtime is the latest modification time of the config file and
+	// of the ancestor configs it inherits from that override the metadata of
+	// tracks, in Unix seconds.
+	overridesMtime int64
+}
+
+// overridesTracks reports whether the config changes the metadata of tracks
+// in its directory. It is false for a nil config.
+func (c *DirConfig) overridesTracks() bool {
+	return c != nil && (len(c.Tags) > 0 || len(c.FileTags) > 0 || c.Cover != "" || c.ReplayGain != "")
+}
+
+// overridesTrack reports whether the config changes the metadata of the track
+// with the given name in its directory. It is false for a nil config.
+func (c *DirConfig) overridesTrack(name string) bool {
+	return c != nil && (len(c.Tags) > 0 || len(c.FileTags[name]) > 0 || c.Cover != "" || c.ReplayGain != "")
+}
+
+// hidden reports whether the config hides its directory. It is false for a
+// nil config.
+func (c *DirConfig) hidden() bool {
+	return c != nil && c.Hidden != nil && *c.Hidden
+}
+
+// excludes reports whether the file or directory at libraryPath, in the
+// config's directory, is excluded by the patterns of the config or those it
+// inherits. Patterns of nearer configs take precedence. It is false for a nil
+// config.
+func (c *DirConfig) excludes(libraryPath string) bool {
+	return c != nil && excludedBy(c.patterns, libraryPath)
+}
+
+// inheritDirConfig returns the effective config of the library directory dir,
+// given the effective config of its parent and the directory's own config,
+// either of which may be nil. The directory inherits the parent's tag
+// overrides, cover, ReplayGain mode, hidden flag and exclude patterns unless
+// its own config sets them, and the parent's include patterns, which its own
+// take precedence over. Hidden files stay excluded unless an include pattern
+// matches them. Fragments, per-file tags and the chapters setting aren't
+// inherited. It returns nil if there are no settings to apply.
+func inheritDirConfig(parent, config *DirConfig, dir string) *DirConfig {
+	if config != nil && (config.Include != nil || config.Exclude != nil) {
+		config.patterns = []filePatterns{{dir: dir, include: config.Include, exclude: config.Exclude}}
+	}
+	if config.overridesTracks() {
+		config.overridesMtime = config.mtime
+	}
+	inherited := parent != nil && (len(parent.Tags) > 0 || parent.Cover != "" ||
+		parent.ReplayGain != "" || parent.Hidden != nil || len(parent.patterns) > 0)
+	if !inherited {
+		return config
+	}
+
+	var merged DirConfig
+	if config != nil {
+		merged = *config
+	}
+	if len(parent.Tags) > 0 {
+		merged.Tags = maps.Clone(parent.Tags)
+		if config != nil {
+			maps.Copy(merged.Tags, config.Tags)
+		}
+	}
+	if merged.Cover == "" {
+		merged.Cover = parent.Cover
+	}
+	if merged.ReplayGain == "" {
+		merged.ReplayGain = parent.ReplayGain
+	}
+	if merged.Hidden == nil {
+		merged.Hidden = parent.Hidden
+	}
+	parentPatterns := parent.patterns
+	if config != nil && config.Exclude != nil {
+		parentPatterns = withoutExcludes(parentPatterns)
+	}
+	merged.patterns = slices.Concat(merged.patterns, parentPatterns)
+	if len(parent.Tags) > 0 || parent.Cover != "" || parent.ReplayGain != "" {
+		merged.overridesMtime = max(merged.overridesMtime, parent.overridesMtime)
+	}
+	return &merged
 }
 
 // rawFragmentConfig is the YAML representation of a FragmentConfig.
@@ -39,10 +166,23 @@ type rawFragmentConfig struct {
 
 // rawDirConfig is the YAML representation of a DirConfig.
 type rawDirConfig struct {
-	Fragments []rawFragmentConfig `yaml:"fragments,omitempty"`
+	Fragments   []rawFragmentConfig          `yaml:"fragments,omitempty"`
+	Chapters    *bool                        `yaml:"chapters,omitempty"`
+	Album       string                       `yaml:"album,omitempty"`
+	AlbumArtist string                       `yaml:"albumartist,omitempty"`
+	Year        string                       `yaml:"year,omitempty"`
+	Genre       string                       `yaml:"genre,omitempty"`
+	Compilation *bool                        `yaml:"compilation,omitempty"`
+	Files       map[string]map[string]string `yaml:"files,omitempty"`
+	Cover       string                       `yaml:"cover,omitempty"`
+	ReplayGain  string                       `yaml:"replaygain,omitempty"`
+	Hidden      *bool                        `yaml:"hidden,omitempty"`
+	Include     []string                     `yaml:"include,omitempty"`
+	Exclude     []string                     `yaml:"exclude,omitempty"`
 }
 
 // LoadDirConfig reads and parses an aurelius.yaml file from the given path.
+// Settings inherited from the configs of parent directories aren't included.
 func LoadDirConfig(fsPath string) (*DirConfig, error) {
 	f, err := os.Open(fsPath)
 	if err != nil {
@@ -50,14 +190,67 @@ func LoadDirConfig(fsPath string) (*DirConfig, error) {
 	}
 	defer f.Close()
 
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
 	var raw rawDirConfig
 	if err := yaml.NewDecoder(f).Decode(&raw); err != nil {
 		return nil, fmt.Errorf("failed to parse %s: %w", fsPath, err)
 	}
 
+	if strings.ContainsAny(raw.Cover, `/\`) {
+		return nil, fmt.Errorf("cover %q is not a file name", raw.Cover)
+	}
+	switch raw.ReplayGain {
+	case "", "track", "album", "off":
+	default:
+		return nil, fmt.Errorf("invalid replaygain mode %q", raw.ReplayGain)
+	}
+	if err := validatePatterns(slices.Concat(raw.Include, raw.Exclude)); err != nil {
+		return nil, err
+	}
+
 	config := &DirConfig{
-		Fragments: make([]FragmentConfig, len(raw.Fragments)),
+		Fragments:      make([]FragmentConfig, len(raw.Fragments)),
+		IgnoreChapters: raw.Chapters != nil && !*raw.Chapters,
+		Cover:          raw.Cover,
+		ReplayGain:     raw.ReplayGain,
+		Hidden:         raw.Hidden,
+		Include:        raw.Include,
+		Exclude:        raw.Exclude,
+		mtime:          info.ModTime().Unix(),
+	}
+
+	// Directory-wide tags use the names FFmpeg gives them when reading files.
+	tags := map[string]string{
+		"album":        raw.Album,
+		"album_artist": raw.AlbumArtist,
+		"date":         raw.Year,
+		"genre":        raw.Genre,
+	}
+	if raw.Compilation != nil {
+		tags["compilation"] = "0"
+		if *raw.Compilation {
+			tags["compilation"] = "1"
+		}
 	}
+	for key, value := range tags {
+		if value != "" {
+			if config.Tags == nil {
+				config.Tags = make(map[string]string)
+			}
+			config.Tags[key] = value
+		}
+	}
+	if len(raw.Files) > 0 {
+		config.FileTags = make(map[string]map[string]string, len(raw.Files))
+		for name, fileTags := range raw.Files {
+			config.FileTags[name] = maputil.LowerCaseKeys(fileTags)
+		}
+	}
+
 	for i, rf := range raw.Fragments {
 		fc := FragmentConfig{
 			Source: rf.Source,
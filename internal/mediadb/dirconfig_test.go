@@ -1,7 +1,9 @@
 package mediadb
 
 import (
+	"maps"
 	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -102,5 +104,296 @@ fragments:
 		if len(config.Fragments) != 0 {
 			t.Errorf("expected 0 fragments, got %d", len(config.Fragments))
 		}
+		if config.IgnoreChapters {
+			t.Error("expected chapters to be enabled by default")
+		}
+	})
+
+	t.Run("chapters disabled", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("chapters: false\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		config, err := LoadDirConfig(f.Name())
+		if err != nil {
+			t.Fatalf("LoadDirConfig failed: %v", err)
+		}
+		if !config.IgnoreChapters {
+			t.Error("expected chapters to be ignored")
+		}
+	})
+
+	t.Run("tag overrides", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(`
+album: Test Album
+albumartist: Various Artists
+year: 1999
+genre: Rock
+compilation: true
+cover: folder.jpg
+files:
+  01.flac:
+    Title: First
+    track: 1
+  02.flac:
+    comment: ""
+`); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		config, err := LoadDirConfig(f.Name())
+		if err != nil {
+			t.Fatalf("LoadDirConfig failed: %v", err)
+		}
+		wantTags := map[string]string{
+			"album":        "Test Album",
+			"album_artist": "Various Artists",
+			"date":         "1999",
+			"genre":        "Rock",
+			"compilation":  "1",
+		}
+		if !maps.Equal(config.Tags, wantTags) {
+			t.Errorf("tags = %v, want %v", config.Tags, wantTags)
+		}
+		if want := map[string]string{"title": "First", "track": "1"}; !maps.Equal(config.FileTags["01.flac"], want) {
+			t.Errorf("tags of 01.flac = %v, want %v", config.FileTags["01.flac"], want)
+		}
+		if want := map[string]string{"comment": ""}; !maps.Equal(config.FileTags["02.flac"], want) {
+			t.Errorf("tags of 02.flac = %v, want %v", config.FileTags["02.flac"], want)
+		}
+		if config.Cover != "folder.jpg" {
+			t.Errorf("cover = %q, want %q", config.Cover, "folder.jpg")
+		}
+		if !config.overridesTracks() {
+			t.Error("expected config to override tracks")
+		}
+	})
+
+	t.Run("no overrides", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("compilation: false\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		config, err := LoadDirConfig(f.Name())
+		if err != nil {
+			t.Fatalf("LoadDirConfig failed: %v", err)
+		}
+		if want := map[string]string{"compilation": "0"}; !maps.Equal(config.Tags, want) {
+			t.Errorf("tags = %v, want %v", config.Tags, want)
+		}
+		if (*DirConfig)(nil).overridesTracks() {
+			t.Error("expected nil config not to override tracks")
+		}
+	})
+
+	t.Run("invalid cover", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("cover: ../cover.jpg\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if _, err := LoadDirConfig(f.Name()); err == nil {
+			t.Error("expected error for cover outside the directory")
+		}
+	})
+	t.Run("inheritable settings", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(`replaygain: album
+hidden: false
+include: [".cover.flac"]
+exclude: ["*/Samples/*", "*.sample.flac"]
+`); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		config, err := LoadDirConfig(f.Name())
+		if err != nil {
+			t.Fatalf("LoadDirConfig failed: %v", err)
+		}
+		if config.ReplayGain != "album" {
+			t.Errorf("replaygain = %q, want %q", config.ReplayGain, "album")
+		}
+		if config.Hidden == nil || *config.Hidden {
+			t.Errorf("expected hidden to be set to false")
+		}
+		if want := []string{".cover.flac"}; !slices.Equal(config.Include, want) {
+			t.Errorf("include = %v, want %v", config.Include, want)
+		}
+		if want := []string{"*/Samples/*", "*.sample.flac"}; !slices.Equal(config.Exclude, want) {
+			t.Errorf("exclude = %v, want %v", config.Exclude, want)
+		}
+		if config.mtime == 0 {
+			t.Error("expected mtime to be set")
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		for _, content := range []string{"replaygain: loud\n", "exclude: [\"[\"]\n", "include: [\"[\"]\n"} {
+			f, err := os.CreateTemp(t.TempDir(), "aurelius*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteString(content); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			if _, err := LoadDirConfig(f.Name()); err == nil {
+				t.Errorf("expected error for %q", content)
+			}
+		}
+	})
+}
+
+func TestInheritDirConfig(t *testing.T) {
+	hidden := true
+	visible := false
+	root := inheritDirConfig(nil, &DirConfig{
+		Tags:       map[string]string{"genre": "Rock", "album": "Root"},
+		Cover:      "folder.jpg",
+		ReplayGain: "album",
+		Hidden:     &hidden,
+		Exclude:    []string{"*.sample.flac", "*/Samples/*"},
+		mtime:      100,
+	}, "")
+
+	t.Run("inherited", func(t *testing.T) {
+		config := inheritDirConfig(root, nil, "a")
+		if config == nil {
+			t.Fatal("expected inherited config")
+		}
+		if !maps.Equal(config.Tags, root.Tags) {
+			t.Errorf("tags = %v, want %v", config.Tags, root.Tags)
+		}
+		if config.Cover != "folder.jpg" || config.ReplayGain != "album" || !config.hidden() {
+			t.Errorf("expected cover, ReplayGain mode and hidden flag to be inherited, got %+v", config)
+		}
+		if config.overridesMtime != 100 {
+			t.Errorf("overridesMtime = %d, want 100", config.overridesMtime)
+		}
+	})
+
+	t.Run("overridden", func(t *testing.T) {
+		config := inheritDirConfig(root, &DirConfig{
+			Fragments:  []FragmentConfig{{Source: "a.flac"}},
+			Tags:       map[string]string{"genre": "Jazz"},
+			ReplayGain: "off",
+			Hidden:     &visible,
+			Exclude:    []string{},
+			mtime:      50,
+		}, "a")
+		if want := map[string]string{"genre": "Jazz", "album": "Root"}; !maps.Equal(config.Tags, want) {
+			t.Errorf("tags = %v, want %v", config.Tags, want)
+		}
+		if config.ReplayGain != "off" || config.hidden() || len(config.Fragments) != 1 {
+			t.Errorf("expected own settings to take precedence, got %+v", config)
+		}
+		if config.excludes("a/x.sample.flac") {
+			t.Error("expected empty exclude list to replace inherited patterns")
+		}
+		if config.overridesMtime != 100 {
+			t.Errorf("overridesMtime = %d, want 100", config.overridesMtime)
+		}
+		if root.Tags["genre"] != "Rock" {
+			t.Error("expected parent tags to be unchanged")
+		}
+	})
+
+	t.Run("overrides mtime", func(t *testing.T) {
+		parent := inheritDirConfig(nil, &DirConfig{Hidden: &hidden, mtime: 200}, "")
+		config := inheritDirConfig(parent, &DirConfig{
+			FileTags: map[string]map[string]string{"a.flac": {"title": "A"}},
+			mtime:    50,
+		}, "a")
+		if config.overridesMtime != 50 {
+			t.Errorf("overridesMtime = %d, want 50", config.overridesMtime)
+		}
+		if !config.overridesTrack("a.flac") || config.overridesTrack("b.flac") {
+			t.Error("expected only the track with per-file tags to be overridden")
+		}
+	})
+
+	t.Run("nothing to inherit", func(t *testing.T) {
+		if config := inheritDirConfig(nil, nil, "a"); config != nil {
+			t.Errorf("expected nil config, got %+v", config)
+		}
+		own := &DirConfig{IgnoreChapters: true}
+		if config := inheritDirConfig(&DirConfig{IgnoreChapters: true}, own, "a"); config != own {
+			t.Errorf("expected own config, got %+v", config)
+		}
+	})
+
+	t.Run("excludes", func(t *testing.T) {
+		config := inheritDirConfig(inheritDirConfig(root, nil, "a"), nil, "a/b")
+		for libraryPath, want := range map[string]bool{
+			"a/b/x.sample.flac":  true,
+			"a/b/x.flac":         false,
+			"a/Samples/x.flac":   true,
+			"a/b/Samples/x.flac": false,
+			"a/Samples":          false,
+		} {
+			if got := config.excludes(libraryPath); got != want {
+				t.Errorf("excludes(%q) = %v, want %v", libraryPath, got, want)
+			}
+		}
+
+		nested := inheritDirConfig(root, &DirConfig{Exclude: []string{"*/Samples/*"}}, "a")
+		if !nested.excludes("a/b/Samples/x.flac") || nested.excludes("a/Samples/x.flac") {
+			t.Error("expected patterns to be relative to the directory that defines them")
+		}
+		if (*DirConfig)(nil).excludes("a/x.flac") {
+			t.Error("expected nil config not to exclude anything")
+		}
+	})
+
+	t.Run("includes", func(t *testing.T) {
+		config := inheritDirConfig(root, &DirConfig{Include: []string{"keep.sample.flac"}}, "a")
+		config = inheritDirConfig(config, nil, "a/b")
+		for libraryPath, want := range map[string]bool{
+			"a/b/keep.sample.flac": false,
+			"a/b/x.sample.flac":    true,
+			"a/Samples/x.flac":     true,
+		} {
+			if got := config.excludes(libraryPath); got != want {
+				t.Errorf("excludes(%q) = %v, want %v", libraryPath, got, want)
+			}
+		}
+
+		hidden := inheritDirConfig(&DirConfig{patterns: libraryPatterns(nil, []string{"*.wav"})}, &DirConfig{
+			Include: []string{".extras"},
+			Exclude: []string{},
+		}, "a")
+		for libraryPath, want := range map[string]bool{
+			"a/.extras": false,
+			"a/.hidden": true,
+			"a/x.wav":   false,
+		} {
+			if got := hidden.excludes(libraryPath); got != want {
+				t.Errorf("excludes(%q) = %v, want %v", libraryPath, got, want)
+			}
+		}
 	})
 }
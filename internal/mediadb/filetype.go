@@ -16,10 +16,12 @@ const (
 	FileTypeTrack
 	FileTypeImage
 	FileTypeDirConfig
+	FileTypeCueSheet
 )
 
 var (
 	rePlaylist = regexp.MustCompile(`(?i)\.m3u$`)
+	reCueSheet = regexp.MustCompile(`(?i)\.cue$`)
 	reImage    = regexp.MustCompile(`(?i)\.(jpg|jpeg|png|gif)$`)
 	reIgnore   = regexp.MustCompile(`(?i)\.(txt|nfo|diz)$`)
 	reTrack    = regexp.MustCompile(`(?i)\.(opus|m4a|wma|wmv|wav|` + strings.Join(aurelib.InputExtensions(), "|") + `)$`)
@@ -32,6 +34,8 @@ func GetFileType(filename string) FileType {
 		return FileTypeDirConfig
 	case rePlaylist.MatchString(filename):
 		return FileTypePlaylist
+	case reCueSheet.MatchString(filename):
+		return FileTypeCueSheet
 	case reImage.MatchString(filename):
 		return FileTypeImage
 	case reIgnore.MatchString(filename):
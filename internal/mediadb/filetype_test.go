@@ -12,6 +12,8 @@ func TestGetFileType(t *testing.T) {
 		{"test.mp3", FileTypeTrack},
 		{"test.ogg", FileTypeTrack},
 		{"test.m3u", FileTypePlaylist},
+		{"album.cue", FileTypeCueSheet},
+		{"ALBUM.CUE", FileTypeCueSheet},
 		{"cover.jpg", FileTypeImage},
 		{"cover.png", FileTypeImage},
 		{"info.txt", FileTypeIgnored},
@@ -0,0 +1,184 @@
+package mediadb
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+const (
+	// minDuplicateSimilarity is the aurelib.FingerprintSimilarity above which
+	// two tracks are considered to be the same recording.
+	minDuplicateSimilarity = 0.8
+
+	// maxDuplicateDurationDifference is the largest difference in duration, in
+	// seconds, between tracks that are considered to be the same recording.
+	maxDuplicateDurationDifference = 3.
+)
+
+// insertFingerprints stores the fingerprints of the added and changed tracks
+// in result.
+func insertFingerprints(tx *sql.Tx, result *ScanResult) error {
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO fingerprints (hash, fingerprint) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, tracks := range [][]ScannedTrack{result.AddedTracks, result.ChangedTracks} {
+		for i := range tracks {
+			t := &tracks[i]
+			if t.Fingerprint == nil {
+				continue
+			}
+			if _, err := stmt.Exec(t.Hash, encodeFingerprint(t.Fingerprint)); err != nil {
+				return fmt.Errorf("failed to insert fingerprint: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func encodeFingerprint(fingerprint []uint32) []byte {
+	data := make([]byte, 0, len(fingerprint)*4)
+	for _, value := range fingerprint {
+		data = binary.LittleEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+func decodeFingerprint(data []byte) []uint32 {
+	fingerprint := make([]uint32, len(data)/4)
+	for i := range fingerprint {
+		fingerprint[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return fingerprint
+}
+
+// fingerprintedHashes returns the hashes of the tracks for which fingerprinting
+// has been attempted, including those with an empty fingerprint because it
+// failed.
+func (db *DB) fingerprintedHashes() (map[string]bool, error) {
+	rows, err := db.db.Query(`SELECT hash FROM fingerprints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes[string(hash)] = true
+	}
+	return hashes, rows.Err()
+}
+
+// hasFingerprint reports whether fingerprinting has been attempted for the
+// track with the given hash.
+func (db *DB) hasFingerprint(hash []byte) (bool, error) {
+	var exists bool
+	err := db.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM fingerprints WHERE hash = ?)`, hash).Scan(&exists)
+	return exists, err
+}
+
+// FindDuplicates returns groups of tracks that are the same recording,
+// according to their acoustic fingerprints, such as copies of a track in
+// different formats. Tracks without fingerprints are left out. Each group is
+// ordered by path, and the groups are ordered by the path of their first
+// track.
+func (db *DB) FindDuplicates() ([][]Track, error) {
+	fingerprints := make(map[string][]uint32)
+	// empty fingerprints only record that fingerprinting was attempted
+	rows, err := db.db.Query(`SELECT hash, fingerprint FROM fingerprints WHERE length(fingerprint) > 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, data []byte
+		if err := rows.Scan(&hash, &data); err != nil {
+			return nil, err
+		}
+		fingerprints[string(hash)] = decodeFingerprint(data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var tracks []Track
+	if err := db.ForEachTrack(func(t *Track) error {
+		if _, ok := fingerprints[string(t.Hash)]; ok {
+			tracks = append(tracks, *t)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Only tracks of similar duration can be duplicates, so each track is
+	// compared with those that follow it in order of duration until the
+	// difference is too large.
+	slices.SortFunc(tracks, func(a, b Track) int {
+		return cmp.Compare(a.Metadata.Duration, b.Metadata.Duration)
+	})
+
+	// groups are tracked with a disjoint-set forest over the indices of tracks
+	parents := make([]int, len(tracks))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+
+	for i := range tracks {
+		a := fingerprints[string(tracks[i].Hash)]
+		for j := i + 1; j < len(tracks); j++ {
+			if tracks[j].Metadata.Duration-tracks[i].Metadata.Duration > maxDuplicateDurationDifference {
+				break
+			}
+			if find(i) == find(j) {
+				continue
+			}
+			b := fingerprints[string(tracks[j].Hash)]
+			if aurelib.FingerprintSimilarity(a, b) >= minDuplicateSimilarity {
+				parents[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]Track)
+	for i := range tracks {
+		root := find(i)
+		members[root] = append(members[root], tracks[i])
+	}
+	trackPath := func(t Track) string {
+		return JoinLibraryPath(t.Dir, t.Name)
+	}
+	var groups [][]Track
+	for _, group := range members {
+		if len(group) < 2 {
+			continue
+		}
+		slices.SortFunc(group, func(a, b Track) int {
+			return strings.Compare(trackPath(a), trackPath(b))
+		})
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b []Track) int {
+		return strings.Compare(trackPath(a[0]), trackPath(b[0]))
+	})
+	return groups, nil
+}
@@ -270,12 +270,14 @@ type imageHashCache struct {
 }
 
 // collectAndProcessTrackImages opens the audio file and scans the directory for
-// images, processing each one. New images (not in cache) are sent through
+// images, processing each one. The image file named cover, if any, comes
+// before all others. New images (not in cache) are sent through
 // imageCh for the consumer to insert. The cache prevents duplicate processing
 // both across scans (pre-loaded data) and within the current scan (worker
 // updates). Returns the ordered image hashes for track_images linking.
 func collectAndProcessTrackImages(
 	trackFsPath string,
+	cover string,
 	cache *imageHashCache,
 	imageCh chan<- processedImage,
 ) [][32]byte {
@@ -319,17 +321,29 @@ func collectAndProcessTrackImages(
 		hashes = append(hashes, result.hash)
 	}
 
+	// Preferred cover image from the directory config.
+	if cover != "" {
+		coverPath := filepath.Join(filepath.Dir(trackFsPath), cover)
+		if mimeType, ok := knownImageExts[strings.ToLower(filepath.Ext(cover))]; !ok {
+			slog.Warn("unknown cover image type", "path", coverPath)
+		} else if data, err := os.ReadFile(coverPath); err != nil {
+			slog.Warn("image processing failed", "context", "readFile", "path", coverPath, "error", err)
+		} else {
+			addImage(data, mimeType, coverPath)
+		}
+	}
+
 	// Attached images from the audio file. The path is already resolved to
-	// the real source file (even for fragments), so open directly.
-	src, err := aurelib.NewFileSource(trackFsPath)
-	if err != nil {
+	// the real source file (even for fragments), so open directly. The other
+	// images are still collected if it can't be opened.
+	if src, err := aurelib.NewFileSource(trackFsPath); err != nil {
 		slog.Warn("failed to open source for images", "path", trackFsPath, "error", err)
-		return nil
-	}
-	for _, img := range src.AttachedImages() {
-		addImage(img.Data, img.Format.MimeType(), trackFsPath)
+	} else {
+		for _, img := range src.AttachedImages() {
+			addImage(img.Data, img.Format.MimeType(), trackFsPath)
+		}
+		src.Destroy()
 	}
-	src.Destroy()
 
 	// Directory images.
 	for _, ref := range collectDirectoryImagePaths(trackFsPath) {
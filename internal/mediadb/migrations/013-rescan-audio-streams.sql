@@ -0,0 +1,3 @@
+-- v13: Force tracks to be rescanned so that files with several audio streams are
+-- indexed with a list of their streams.
+UPDATE tracks_with_deletes SET mtime = 0;
@@ -0,0 +1,8 @@
+-- v14: Cache of waveform peak data, keyed by track hash.
+CREATE TABLE waveforms (
+    hash   BLOB NOT NULL,
+    points INTEGER NOT NULL,
+    peaks  BLOB NOT NULL,
+
+    PRIMARY KEY (hash, points)
+);
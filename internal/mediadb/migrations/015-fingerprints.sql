@@ -0,0 +1,5 @@
+-- v15: Acoustic fingerprints, keyed by track hash.
+CREATE TABLE fingerprints (
+    hash        BLOB PRIMARY KEY,
+    fingerprint BLOB NOT NULL
+);
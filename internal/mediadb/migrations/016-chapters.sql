@@ -0,0 +1,7 @@
+-- v16: Chapters embedded in audio files, keyed by track hash, so that files
+-- don't need to be opened again to expand them into fragments. A row with an
+-- empty list records that a file has no chapters.
+CREATE TABLE chapters (
+    hash     BLOB PRIMARY KEY,
+    chapters TEXT NOT NULL
+);
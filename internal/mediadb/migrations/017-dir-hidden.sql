@@ -0,0 +1,3 @@
+-- v17: Directories can be hidden from listings and search results by their
+-- aurelius.yaml or those of their ancestors.
+ALTER TABLE dirs ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- v18: Waveforms are stored once per track at full resolution, and reduced to
+-- the requested number of points when they are read. Cached waveforms at
+-- particular resolutions are discarded.
+DROP TABLE waveforms;
+
+CREATE TABLE waveforms (
+    hash  BLOB PRIMARY KEY,
+    peaks BLOB NOT NULL
+);
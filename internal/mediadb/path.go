@@ -29,3 +29,9 @@ func JoinLibraryPath(dir, name string) string {
 	}
 	return dir + "/" + name
 }
+
+// isUnderLibraryDir reports whether libraryPath is the library directory dir
+// or one of its descendants.
+func isUnderLibraryDir(libraryPath, dir string) bool {
+	return dir == "" || libraryPath == dir || strings.HasPrefix(libraryPath, dir+"/")
+}
@@ -0,0 +1,96 @@
+package mediadb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// hiddenFilePattern matches hidden files and directories, which are excluded
+// from the library unless an include pattern matches them.
+const hiddenFilePattern = ".*"
+
+// filePatterns holds glob patterns for files and directories that are added
+// to the library or left out of it. Patterns without a slash match names, and
+// others match paths relative to dir.
+type filePatterns struct {
+	dir     string // library path of the directory the patterns apply to
+	include []string
+	exclude []string
+
+	// hidden is set for the exclusion of hidden files, which isn't replaced
+	// by the exclude patterns of a directory's config.
+	hidden bool
+}
+
+// match reports whether the file or directory at libraryPath, which is
+// under p.dir, matches one of patterns.
+func (p *filePatterns) match(patterns []string, libraryPath string) bool {
+	relPath := libraryPath
+	if p.dir != "" {
+		relPath = strings.TrimPrefix(libraryPath, p.dir+"/")
+	}
+	name := path.Base(libraryPath)
+	for _, pattern := range patterns {
+		subject := name
+		if strings.Contains(pattern, "/") {
+			subject = relPath
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedBy reports whether the file or directory at libraryPath is excluded
+// by a list of pattern sets, ordered from the most to the least specific. The
+// first set with a matching pattern decides, and its include patterns take
+// precedence over its exclude patterns.
+func excludedBy(patterns []filePatterns, libraryPath string) bool {
+	for i := range patterns {
+		p := &patterns[i]
+		if p.match(p.include, libraryPath) {
+			return false
+		}
+		if p.match(p.exclude, libraryPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// libraryPatterns returns the pattern sets that apply to the whole library:
+// the given include and exclude patterns, and the exclusion of hidden files.
+func libraryPatterns(include, exclude []string) []filePatterns {
+	return []filePatterns{
+		{include: include, exclude: exclude},
+		{exclude: []string{hiddenFilePattern}, hidden: true},
+	}
+}
+
+// withoutExcludes returns a copy of a list of pattern sets without their
+// exclude patterns, apart from the exclusion of hidden files.
+func withoutExcludes(patterns []filePatterns) []filePatterns {
+	var result []filePatterns
+	for _, p := range patterns {
+		if !p.hidden {
+			p.exclude = nil
+		}
+		if len(p.include) > 0 || len(p.exclude) > 0 {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// validatePatterns returns an error if any of the given glob patterns is
+// malformed.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
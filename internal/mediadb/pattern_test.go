@@ -0,0 +1,38 @@
+package mediadb
+
+import "testing"
+
+func TestExcludedBy(t *testing.T) {
+	patterns := []filePatterns{
+		{dir: "a", include: []string{"keep.sample.flac", ".cover.flac"}, exclude: []string{"b/*"}},
+		{include: []string{".*.flac"}, exclude: []string{"*.sample.flac", "a/Samples"}},
+		{exclude: []string{hiddenFilePattern}},
+	}
+	tests := []struct {
+		libraryPath string
+		want        bool
+	}{
+		{"a/x.flac", false},
+		{"a/x.sample.flac", true},
+		{"a/keep.sample.flac", false},
+		{"a/Samples", true},
+		{"a/b/x.flac", true},
+		{"a/.hidden", true},
+		{"a/.cover.flac", false},
+		{"a/.hidden.flac", false},
+	}
+	for _, tt := range tests {
+		if got := excludedBy(patterns, tt.libraryPath); got != tt.want {
+			t.Errorf("excludedBy(%q) = %v, want %v", tt.libraryPath, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if err := validatePatterns([]string{"*.flac", "a/[bc]/*"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validatePatterns([]string{"*.flac", "["}); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
@@ -0,0 +1,149 @@
+package mediadb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// needsLoudness reports whether t should be rescanned to measure its loudness,
+// because ReplayGain computation was enabled after it was last scanned.
+func (s *Scanner) needsLoudness(t *Track) bool {
+	return s.computeReplayGain && t.Metadata.ReplayGain == nil && t.Metadata.Loudness == nil
+}
+
+// storeLoudness stores the loudness measured by meter in the metadata of a
+// track without ReplayGain tags, along with ReplayGain values derived from it
+// if it could be measured. Album gain is set to the track gain until it is
+// computed by updateComputedAlbumGain.
+func storeLoudness(metadata *TrackMetadata, meter *aurelib.LoudnessMeter) {
+	loudness, ok := meter.Loudness()
+	metadata.Loudness = &Loudness{Integrated: loudness.Integrated, TruePeak: loudness.TruePeak}
+	if ok {
+		metadata.ReplayGain = computedReplayGain(loudness, loudness)
+	}
+}
+
+// computedReplayGain returns the ReplayGain values of a track with the given
+// track and album loudness.
+func computedReplayGain(track, album aurelib.Loudness) *ReplayGain {
+	return &ReplayGain{
+		Track:       track.ReplayGain(true),
+		Album:       album.ReplayGain(true),
+		TrackNoclip: track.ReplayGain(false),
+		AlbumNoclip: album.ReplayGain(false),
+		Computed:    true,
+	}
+}
+
+// trackDirs returns the directories containing tracks that were added,
+// changed, removed, or moved.
+func (r *ScanResult) trackDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	for _, t := range r.AddedTracks {
+		dirs[t.Dir] = true
+	}
+	for _, t := range r.ChangedTracks {
+		dirs[t.Dir] = true
+	}
+	for _, t := range r.RemovedTracks {
+		dirs[t.Dir] = true
+	}
+	for _, m := range r.Moves {
+		dirs[m.OldDir] = true
+		dirs[m.NewDir] = true
+	}
+	return dirs
+}
+
+// updateComputedAlbumGain recomputes the album gain of the tracks in dirs
+// whose ReplayGain was computed, treating each directory as an album. The
+// album loudness is the duration-weighted mean of the power of the tracks'
+// loudness, and the album peak is the greatest of their peaks. Fragment source
+// files don't contribute to the album loudness, since their audio is counted
+// in their fragments.
+func updateComputedAlbumGain(tx *sql.Tx, dirs map[string]bool) error {
+	selectStmt, err := tx.Prepare(`SELECT ` + trackColumns + ` FROM tracks WHERE dir = ?`)
+	if err != nil {
+		return err
+	}
+	defer selectStmt.Close()
+	updateStmt, err := tx.Prepare(`UPDATE tracks_with_deletes SET metadata = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer updateStmt.Close()
+
+	for dir := range dirs {
+		tracks, err := func() ([]*Track, error) {
+			rows, err := selectStmt.Query(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query tracks for album gain: %w", err)
+			}
+			defer rows.Close()
+			var tracks []*Track
+			for rows.Next() {
+				t, err := scanTrack(rows)
+				if err != nil {
+					return nil, fmt.Errorf("failed to scan track for album gain: %w", err)
+				}
+				tracks = append(tracks, t)
+			}
+			return tracks, rows.Err()
+		}()
+		if err != nil {
+			return err
+		}
+
+		fragmentSourceFiles := make(map[string]bool)
+		for _, t := range tracks {
+			if t.Metadata.Fragment != nil {
+				fragmentSourceFiles[t.Metadata.Fragment.SourceFile] = true
+			}
+		}
+
+		var albumTracks []*Track
+		var power, duration float64
+		album := aurelib.Loudness{}
+		for _, t := range tracks {
+			rg := t.Metadata.ReplayGain
+			if rg == nil || !rg.Computed || t.Metadata.Loudness == nil {
+				continue
+			}
+			albumTracks = append(albumTracks, t)
+			if fragmentSourceFiles[t.Name] {
+				continue
+			}
+			power += t.Metadata.Duration * math.Pow(10, t.Metadata.Loudness.Integrated/10)
+			duration += t.Metadata.Duration
+			album.TruePeak = max(album.TruePeak, t.Metadata.Loudness.TruePeak)
+		}
+		if duration <= 0 {
+			continue
+		}
+		album.Integrated = 10 * math.Log10(power/duration)
+
+		for _, t := range albumTracks {
+			track := aurelib.Loudness{
+				Integrated: t.Metadata.Loudness.Integrated,
+				TruePeak:   t.Metadata.Loudness.TruePeak,
+			}
+			rg := computedReplayGain(track, album)
+			if *rg == *t.Metadata.ReplayGain {
+				continue
+			}
+			t.Metadata.ReplayGain = rg
+			metadataJSON, err := json.Marshal(t.Metadata)
+			if err != nil {
+				return fmt.Errorf("failed to marshal metadata: %w", err)
+			}
+			if _, err := updateStmt.Exec(string(metadataJSON), t.ID); err != nil {
+				return fmt.Errorf("failed to update album gain: %w", err)
+			}
+		}
+	}
+	return nil
+}
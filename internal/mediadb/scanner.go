@@ -7,13 +7,16 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -58,6 +61,7 @@ type ChangeSet struct {
 	Moves   []Move
 
 	AddedDirs        []Dir
+	ChangedDirs      []Dir // dirs whose hidden flag changed
 	RemovedDirs      []Dir
 	ImageChangedDirs []string // dirs whose image files changed
 
@@ -78,6 +82,8 @@ type ScannedTrack struct {
 	Hash     []byte
 	Tags     map[string]string
 	Metadata TrackMetadata
+
+	Fingerprint []uint32 // acoustic fingerprint, if fingerprinting is enabled; empty if it failed
 }
 
 // ScanResult contains the fully resolved changes, ready to apply.
@@ -87,6 +93,7 @@ type ScanResult struct {
 	RemovedTracks    []Track
 	Moves            []Move
 	AddedDirs        []Dir
+	ChangedDirs      []Dir // dirs whose hidden flag changed
 	RemovedDirs      []Dir
 	ImageChangedDirs []string // dirs whose image files changed
 
@@ -108,6 +115,8 @@ type resolvedFragment struct {
 // WalkResult holds the filesystem state collected by walkFilesystem and
 // enriched by expandFragments.
 type WalkResult struct {
+	Root string // library path of the walked directory tree
+
 	Files      map[string]FileInfo // audio tracks keyed by library path
 	Dirs       map[string]Dir      // directories keyed by library path
 	Playlists  map[string]FileInfo // M3U playlists keyed by library path
@@ -121,17 +130,91 @@ type WalkResult struct {
 	// DirImages maps directory library paths to the image files found in
 	// each directory during the walk. Used to compute image fingerprints.
 	DirImages map[string][]imageFileEntry
+
+	// CueSheets maps directory library paths to the cue sheets found in each
+	// directory during the walk.
+	CueSheets map[string][]FileInfo
+
+	// Chapters maps the hashes of audio files whose chapters were read during
+	// the scan to their chapters, to be stored by Apply.
+	Chapters map[string][]Chapter
+
+	// Configs maps directory library paths to their effective configs,
+	// including the settings inherited from their ancestors and the library.
+	// The configs of directories without entries are loaded on demand by
+	// dirConfig.
+	Configs map[string]*DirConfig
 }
 
 // Scanner coordinates filesystem scanning and database reconciliation.
 type Scanner struct {
 	db       *DB
 	rootPath string
+
+	onHashesReplaced  func(hashes [][]byte)
+	computeReplayGain bool
+	detectSilence     bool
+	silenceThreshold  float64 // in dBFS
+	fingerprint       bool
+
+	// libraryConfig holds the include and exclude patterns that apply to the
+	// whole library, which aurelius.yaml files inherit.
+	libraryConfig *DirConfig
 }
 
 // NewScanner creates a new Scanner.
 func NewScanner(db *DB, rootPath string) *Scanner {
-	return &Scanner{db: db, rootPath: rootPath}
+	return &Scanner{
+		db:            db,
+		rootPath:      rootPath,
+		libraryConfig: &DirConfig{patterns: libraryPatterns(nil, nil)},
+	}
+}
+
+// FilePatterns sets glob patterns for files and directories that are added to
+// the library even if they would be excluded, such as hidden files, and that
+// are left out of it. They are matched like the include and exclude patterns
+// of an aurelius.yaml in the library root, which take precedence over them.
+// Files that GetFileType ignores are never added. The next full scan adds and removes files according to the new patterns. It
+// must not be called while a scan is in progress.
+func (s *Scanner) FilePatterns(include, exclude []string) error {
+	if err := validatePatterns(slices.Concat(include, exclude)); err != nil {
+		return err
+	}
+	s.libraryConfig = &DirConfig{patterns: libraryPatterns(include, exclude)}
+	return nil
+}
+
+// OnHashesReplaced sets a function to be called after changes are applied to
+// the database, with the previous hashes of tracks whose contents changed. It
+// allows data derived from the old contents to be discarded. It must be set
+// before scanning begins.
+func (s *Scanner) OnHashesReplaced(fn func(hashes [][]byte)) {
+	s.onHashesReplaced = fn
+}
+
+// ComputeReplayGain sets whether the loudness of tracks without ReplayGain tags
+// is measured during scanning, so that ReplayGain can be applied to them
+// anyway. Album gain is computed from the tracks of each directory. It must be
+// set before scanning begins.
+func (s *Scanner) ComputeReplayGain(enabled bool) {
+	s.computeReplayGain = enabled
+}
+
+// DetectSilence sets whether the silence at the start and end of each track
+// is measured during scanning, so that it can be skipped during playback.
+// Audio is considered silent where it doesn't exceed threshold, in dBFS. It
+// must be set before scanning begins.
+func (s *Scanner) DetectSilence(enabled bool, threshold float64) {
+	s.detectSilence = enabled
+	s.silenceThreshold = threshold
+}
+
+// ComputeFingerprints sets whether an acoustic fingerprint of each track is
+// computed during scanning, so that duplicates can be found with
+// DB.FindDuplicates. It must be set before scanning begins.
+func (s *Scanner) ComputeFingerprints(enabled bool) {
+	s.fingerprint = enabled
 }
 
 // fsPath returns the absolute filesystem path for a library path.
@@ -139,6 +222,70 @@ func (s *Scanner) fsPath(dir, name string) string {
 	return filepath.Join(s.rootPath, filepath.FromSlash(dir), name)
 }
 
+// dirConfig returns the effective config of the library directory dir, with
+// the settings it inherits from its ancestors and the library, loading the
+// configs involved if they aren't in wr.Configs.
+func (s *Scanner) dirConfig(wr *WalkResult, dir string) *DirConfig {
+	config, ok := wr.Configs[dir]
+	if !ok {
+		config = inheritDirConfig(s.parentConfig(wr, dir), s.loadDirConfig(dir), dir)
+		wr.Configs[dir] = config
+	}
+	return config
+}
+
+// parentConfig returns the effective config that the library directory dir
+// inherits settings from: that of its parent, or the library's for the root.
+func (s *Scanner) parentConfig(wr *WalkResult, dir string) *DirConfig {
+	if dir == "" {
+		return s.libraryConfig
+	}
+	return s.dirConfig(wr, CleanLibraryPath(path.Dir(dir)))
+}
+
+// excluded reports whether the file name in the library directory dir is
+// excluded by the config that applies to it, or is in an excluded directory.
+// The directory's own config file is only excluded along with the directory.
+func (s *Scanner) excluded(wr *WalkResult, dir, name string) bool {
+	if name != dirConfigName && s.dirConfig(wr, dir).excludes(JoinLibraryPath(dir, name)) {
+		return true
+	}
+	for dir != "" {
+		parent, _ := SplitLibraryPath(dir)
+		if s.dirConfig(wr, parent).excludes(dir) {
+			return true
+		}
+		dir = parent
+	}
+	return false
+}
+
+// loadDirConfig reads the config of the library directory dir. It returns nil
+// if the directory has no config or it can't be parsed.
+func (s *Scanner) loadDirConfig(dir string) *DirConfig {
+	configPath := s.fsPath(dir, dirConfigName)
+	config, err := LoadDirConfig(configPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to parse dir config", "path", configPath, "error", err)
+		}
+		return nil
+	}
+	return config
+}
+
+// trackMtime returns the mtime recorded for the track name, whose file has the
+// given mtime, in a directory with the given effective config. Tracks whose
+// metadata is overridden by the config take the latest mtime of the configs
+// that override it if it is later, so that they are rescanned when one of
+// them changes, but not when another setting of an ancestor config does.
+func trackMtime(config *DirConfig, name string, mtime int64) int64 {
+	if !config.overridesTrack(name) {
+		return mtime
+	}
+	return computeFragmentMtime(config.overridesMtime, mtime)
+}
+
 // computeFragmentMtime computes a fragment's mtime from its config and source
 // file mtimes.
 func computeFragmentMtime(configMtime, sourceMtime int64) int64 {
@@ -148,29 +295,27 @@ func computeFragmentMtime(configMtime, sourceMtime int64) int64 {
 	return configMtime
 }
 
-// loadFragmentMtime computes a fragment's mtime by stat-ing the config and source
-// files on disk. Returns 0 if the config file cannot be found.
-func (s *Scanner) loadFragmentMtime(dir, sourceFile string) int64 {
-	configInfo, err := os.Lstat(s.fsPath(dir, dirConfigName))
-	if err != nil {
-		return 0
-	}
-	var sourceMtime int64
-	if sourceInfo, err := os.Lstat(s.fsPath(dir, sourceFile)); err == nil {
-		sourceMtime = sourceInfo.ModTime().Unix()
-	}
-	return computeFragmentMtime(configInfo.ModTime().Unix(), sourceMtime)
-}
-
 // FullScan walks the entire filesystem, diffs against the DB, detects moves,
 // collects metadata, and applies the result.
 func (s *Scanner) FullScan() error {
 	slog.Info("starting full media library scan", "root", s.rootPath)
 	start := time.Now()
 
+	if err := s.scanTree(""); err != nil {
+		return err
+	}
+
+	slog.Info("full scan complete", "duration", time.Since(start))
+	return nil
+}
+
+// scanTree scans the library directory root and its descendants as FullScan
+// scans the whole library. Files moved into or out of the tree are treated
+// as added or removed, since they aren't matched with files outside it.
+func (s *Scanner) scanTree(root string) error {
 	// Phase 1: Walk filesystem.
-	slog.Info("walking filesystem")
-	wr, err := s.walkFilesystem()
+	slog.Info("walking filesystem", "dir", root)
+	wr, err := s.walkFilesystem(root)
 	if err != nil {
 		return fmt.Errorf("filesystem walk failed: %w", err)
 	}
@@ -201,6 +346,7 @@ func (s *Scanner) FullScan() error {
 		"removed", len(changes.Removed),
 		"moved", len(changes.Moves),
 		"addedDirs", len(changes.AddedDirs),
+		"changedDirs", len(changes.ChangedDirs),
 		"removedDirs", len(changes.RemovedDirs),
 		"imageChangedDirs", len(changes.ImageChangedDirs),
 		"addedPlaylists", len(changes.AddedPlaylists),
@@ -220,23 +366,27 @@ func (s *Scanner) FullScan() error {
 	if err := s.Apply(wr, result); err != nil {
 		return fmt.Errorf("apply failed: %w", err)
 	}
-
-	slog.Info("full scan complete", "duration", time.Since(start))
 	return nil
 }
 
-// walkFilesystem walks the media library root and returns a WalkResult.
-func (s *Scanner) walkFilesystem() (*WalkResult, error) {
+// walkFilesystem walks the library directory root and its descendants and
+// returns a WalkResult. Files and directories excluded by the configs that
+// apply to them are skipped.
+func (s *Scanner) walkFilesystem(root string) (*WalkResult, error) {
 	wr := &WalkResult{
+		Root:       root,
 		Files:      make(map[string]FileInfo),
 		Dirs:       make(map[string]Dir),
 		Playlists:  make(map[string]FileInfo),
 		DirConfigs: make(map[string]FileInfo),
 		Fragments:  make(map[string]resolvedFragment),
 		DirImages:  make(map[string][]imageFileEntry),
+		CueSheets:  make(map[string][]FileInfo),
+		Chapters:   make(map[string][]Chapter),
+		Configs:    make(map[string]*DirConfig),
 	}
 
-	err := filepath.WalkDir(s.rootPath, func(fsPath string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(s.fsPath(root, ""), func(fsPath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			slog.Warn("walk error", "path", fsPath, "error", err)
 			return nil
@@ -244,8 +394,8 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 
 		name := d.Name()
 
-		// Skip hidden files/dirs and all symlinks.
-		if strings.HasPrefix(name, ".") || d.Type()&os.ModeSymlink != 0 {
+		// Skip all symlinks.
+		if d.Type()&os.ModeSymlink != 0 {
 			if d.IsDir() {
 				return filepath.SkipDir
 			}
@@ -264,7 +414,15 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 			if libraryPath == "" {
 				return nil
 			}
-			wr.Dirs[libraryPath] = Dir{Path: libraryPath, Parent: CleanLibraryPath(path.Dir(libraryPath))}
+			parent := CleanLibraryPath(path.Dir(libraryPath))
+			if s.dirConfig(wr, parent).excludes(libraryPath) {
+				return filepath.SkipDir
+			}
+			wr.Dirs[libraryPath] = Dir{
+				Path:   libraryPath,
+				Parent: parent,
+				Hidden: s.dirConfig(wr, libraryPath).hidden(),
+			}
 			return nil
 		}
 
@@ -272,6 +430,11 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 			return nil
 		}
 
+		dir := CleanLibraryPath(path.Dir(libraryPath))
+		if name != dirConfigName && s.dirConfig(wr, dir).excludes(libraryPath) {
+			return nil
+		}
+
 		info, err := d.Info()
 		if err != nil {
 			slog.Warn("failed to get file info", "path", fsPath, "error", err)
@@ -279,7 +442,7 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 		}
 
 		entry := FileInfo{
-			Dir:   CleanLibraryPath(path.Dir(libraryPath)),
+			Dir:   dir,
 			Name:  name,
 			Mtime: info.ModTime().Unix(),
 		}
@@ -291,6 +454,8 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 			wr.Playlists[libraryPath] = entry
 		case FileTypeDirConfig:
 			wr.DirConfigs[entry.Dir] = entry
+		case FileTypeCueSheet:
+			wr.CueSheets[entry.Dir] = append(wr.CueSheets[entry.Dir], entry)
 		case FileTypeImage:
 			wr.DirImages[entry.Dir] = append(wr.DirImages[entry.Dir], imageFileEntry{
 				Name:  name,
@@ -305,78 +470,170 @@ func (s *Scanner) walkFilesystem() (*WalkResult, error) {
 	return wr, err
 }
 
-// expandFragments parses aurelius.yaml files and adds synthetic fragment
-// entries to wr.Files. It also populates wr.Fragments for use during
-// metadata collection.
+// expandFragments parses aurelius.yaml files and cue sheets and adds
+// synthetic fragment entries to wr.Files, along with fragments for the
+// chapters embedded in audio files that have no fragments defined. It also
+// populates wr.Fragments for use during metadata collection.
 func (s *Scanner) expandFragments(wr *WalkResult) {
-	for dir, configEntry := range wr.DirConfigs {
-		configPath := s.fsPath(dir, dirConfigName)
-		config, err := LoadDirConfig(configPath)
+	// Group audio files by directory to resolve fragment sources.
+	dirFiles := make(map[string]map[string]FileInfo)
+	for _, entry := range wr.Files {
+		if dirFiles[entry.Dir] == nil {
+			dirFiles[entry.Dir] = make(map[string]FileInfo)
+		}
+		dirFiles[entry.Dir][entry.Name] = entry
+	}
+
+	dirs := make(map[string]bool)
+	for dir := range wr.DirConfigs {
+		dirs[dir] = true
+	}
+	for dir := range wr.CueSheets {
+		dirs[dir] = true
+	}
+
+	ignoreChapterDirs := make(map[string]bool)
+	fragmentedFiles := make(map[string]bool)
+
+	for dir := range dirs {
+		config := s.dirConfig(wr, dir)
+		if config != nil {
+			ignoreChapterDirs[dir] = config.IgnoreChapters
+		}
+
+		for _, entry := range s.resolveDirFragments(wr, dir, config, wr.CueSheets[dir], dirFiles[dir]) {
+			libraryPath := JoinLibraryPath(dir, entry.Name)
+			wr.Files[libraryPath] = entry
+			fragmentedFiles[JoinLibraryPath(dir, wr.Fragments[libraryPath].SourceFile)] = true
+		}
+	}
+
+	if len(wr.Fragments) > 0 {
+		slog.Info("expanded fragments from dir configs and cue sheets", "count", len(wr.Fragments))
+	}
+
+	s.expandChapters(wr, ignoreChapterDirs, fragmentedFiles)
+
+	// Tracks whose metadata is overridden by the configs that apply to their
+	// directories are rescanned when they change.
+	for key, entry := range wr.Files {
+		entry.Mtime = trackMtime(s.dirConfig(wr, entry.Dir), entry.Name, entry.Mtime)
+		wr.Files[key] = entry
+	}
+}
+
+// resolveDirFragments resolves the fragments defined for the audio files in
+// the library directory dir by its effective config, which may be nil, and
+// by its cue sheets. The fragments are added to wr.Fragments, and their entries are
+// returned. sources holds the audio files in the directory, keyed by name.
+// The fragments of each source file are only taken from one definition, with
+// aurelius.yaml taking precedence over cue sheets, in order of name.
+func (s *Scanner) resolveDirFragments(
+	wr *WalkResult,
+	dir string,
+	config *DirConfig,
+	cueSheets []FileInfo,
+	sources map[string]FileInfo,
+) []FileInfo {
+	// definitionFile is a file that defines fragments.
+	type definitionFile struct {
+		fsPath    string
+		mtime     int64
+		fragments []FragmentConfig
+	}
+
+	var files []definitionFile
+	if config != nil && len(config.Fragments) > 0 {
+		files = append(files, definitionFile{
+			fsPath:    s.fsPath(dir, dirConfigName),
+			mtime:     config.mtime,
+			fragments: config.Fragments,
+		})
+	}
+
+	cueSheets = slices.Clone(cueSheets)
+	slices.SortFunc(cueSheets, func(a, b FileInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	audioFiles := make(map[string]bool, len(sources))
+	for name := range sources {
+		audioFiles[name] = true
+	}
+	for _, cueSheet := range cueSheets {
+		fsPath := s.fsPath(dir, cueSheet.Name)
+		fragments, err := LoadCueSheet(fsPath)
 		if err != nil {
-			slog.Warn("failed to parse dir config", "path", configPath, "error", err)
+			slog.Warn("failed to parse cue sheet", "path", fsPath, "error", err)
 			continue
 		}
-		if len(config.Fragments) == 0 {
-			continue
+		for i := range fragments {
+			if source, ok := resolveCueSource(fragments[i].Source, audioFiles); ok {
+				fragments[i].Source = source
+			}
 		}
+		files = append(files, definitionFile{fsPath: fsPath, mtime: cueSheet.Mtime, fragments: fragments})
+	}
+
+	var entries []FileInfo
 
-		// Pre-compute the config file hash for fragment hashing.
-		configHash, err := computeFullHash(configPath)
+	// Track per-source fragment numbering.
+	sourceFragmentCount := make(map[string]int)
+	sourceHashes := make(map[string][]byte)
+
+	for _, file := range files {
+		// Pre-compute the definition file hash for fragment hashing.
+		fileHash, err := computeFullHash(file.fsPath)
 		if err != nil {
-			slog.Warn("failed to hash dir config", "path", configPath, "error", err)
+			slog.Warn("failed to hash fragment definitions", "path", file.fsPath, "error", err)
 			continue
 		}
 
-		// Track per-source fragment numbering.
-		sourceFragmentCount := make(map[string]int)
+		definedSources := make(map[string]bool) // sources with fragments in this file
 
-		for i := range config.Fragments {
-			def := &config.Fragments[i]
+		for i := range file.fragments {
+			def := &file.fragments[i]
 			sourceFile := def.Source
-			if _, ok := wr.Files[JoinLibraryPath(dir, sourceFile)]; !ok {
+			source, ok := sources[sourceFile]
+			if !ok {
 				slog.Warn("fragment source file not found",
-					"dir", dir, "source", sourceFile)
+					"dir", dir, "source", sourceFile, "definedIn", filepath.Base(file.fsPath))
 				continue
 			}
-
-			sourceFragmentCount[sourceFile]++
-			fragIdx := sourceFragmentCount[sourceFile]
-			syntheticName := MakeFragmentName(sourceFile, fragIdx)
-			libraryPath := JoinLibraryPath(dir, syntheticName)
-
-			var sourceMtime int64
-			if sourceEntry, ok := wr.Files[JoinLibraryPath(dir, sourceFile)]; ok {
-				sourceMtime = sourceEntry.Mtime
+			if sourceFragmentCount[sourceFile] > 0 && !definedSources[sourceFile] {
+				// Fragments of this source were defined by an earlier file.
+				continue
 			}
-			mtime := computeFragmentMtime(configEntry.Mtime, sourceMtime)
+			definedSources[sourceFile] = true
 
 			// Compute a combined hash for move detection.
-			sourceHash, err := computePartialHash(s.fsPath(dir, sourceFile))
-			if err != nil {
-				slog.Warn("failed to hash fragment source", "dir", dir, "name", sourceFile, "error", err)
-				continue
+			sourceHash, ok := sourceHashes[sourceFile]
+			if !ok {
+				if sourceHash, err = computePartialHash(s.fsPath(dir, sourceFile)); err != nil {
+					slog.Warn("failed to hash fragment source", "dir", dir, "name", sourceFile, "error", err)
+					continue
+				}
+				sourceHashes[sourceFile] = sourceHash
 			}
-			fragHash := computeFragmentHash(configHash, sourceHash, fragIdx)
 
-			wr.Files[libraryPath] = FileInfo{
+			sourceFragmentCount[sourceFile]++
+			fragIdx := sourceFragmentCount[sourceFile]
+			entry := FileInfo{
 				Dir:   dir,
-				Name:  syntheticName,
-				Mtime: mtime,
+				Name:  MakeFragmentName(sourceFile, fragIdx),
+				Mtime: computeFragmentMtime(file.mtime, source.Mtime),
 			}
 
-			wr.Fragments[libraryPath] = resolvedFragment{
+			wr.Fragments[JoinLibraryPath(dir, entry.Name)] = resolvedFragment{
 				SourceFSPath: s.fsPath(dir, sourceFile),
 				SourceFile:   sourceFile,
 				Config:       def,
 				Index:        fragIdx,
-				hash:         fragHash,
+				hash:         computeFragmentHash(fileHash, sourceHash, fragIdx),
 			}
+			entries = append(entries, entry)
 		}
 	}
-
-	if len(wr.Fragments) > 0 {
-		slog.Info("expanded fragments from dir configs", "count", len(wr.Fragments))
-	}
+	return entries
 }
 
 // computeFragmentHash computes a hash for a fragment entry by combining the
@@ -394,11 +651,23 @@ func computeFragmentHash(configHash, sourceHash []byte, fragmentIndex int) []byt
 func (s *Scanner) diffAgainstDB(wr *WalkResult) (*ChangeSet, error) {
 	changes := &ChangeSet{}
 
-	// Compare tracks.
+	var fingerprinted map[string]bool
+	if s.fingerprint {
+		var err error
+		if fingerprinted, err = s.db.fingerprintedHashes(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Compare tracks. Only those in the walked tree are considered.
 	err := s.db.ForEachTrack(func(t *Track) error {
+		if !isUnderLibraryDir(t.Dir, wr.Root) {
+			return nil
+		}
 		key := JoinLibraryPath(t.Dir, t.Name)
 		if fileInfo, ok := wr.Files[key]; ok {
-			if fileInfo.Mtime != t.Mtime {
+			if fileInfo.Mtime != t.Mtime || s.needsLoudness(t) || s.needsSilence(t) ||
+				s.fingerprint && !fingerprinted[string(t.Hash)] {
 				changes.Changed = append(changes.Changed, fileInfo)
 			}
 			delete(wr.Files, key)
@@ -443,6 +712,8 @@ func (s *Scanner) diffAgainstDB(wr *WalkResult) (*ChangeSet, error) {
 		dbDir, exists := dbDirs[dirPath]
 		if !exists {
 			changes.AddedDirs = append(changes.AddedDirs, dir)
+		} else if dir.Hidden != dbDir.Hidden {
+			changes.ChangedDirs = append(changes.ChangedDirs, dir)
 		}
 		// Compare image fingerprints for existing and new dirs.
 		newFP := computeDirImageFingerprint(wr.DirImages[dirPath])
@@ -451,12 +722,17 @@ func (s *Scanner) diffAgainstDB(wr *WalkResult) (*ChangeSet, error) {
 		}
 		delete(dbDirs, dirPath)
 	}
-	for _, dir := range dbDirs {
-		changes.RemovedDirs = append(changes.RemovedDirs, dir)
+	for dirPath, dir := range dbDirs {
+		if isUnderLibraryDir(dirPath, wr.Root) {
+			changes.RemovedDirs = append(changes.RemovedDirs, dir)
+		}
 	}
 
 	// Compare playlists.
 	err = s.db.ForEachM3UPlaylist(func(p *M3UPlaylist) error {
+		if !isUnderLibraryDir(p.Dir, wr.Root) {
+			return nil
+		}
 		key := JoinLibraryPath(p.Dir, p.Name)
 		if fileInfo, ok := wr.Playlists[key]; ok {
 			if fileInfo.Mtime != p.Mtime {
@@ -602,13 +878,14 @@ func (s *Scanner) collectMetadata(wr *WalkResult, changes *ChangeSet) (*ScanResu
 		RemovedTracks:    changes.Removed,
 		Moves:            changes.Moves,
 		AddedDirs:        changes.AddedDirs,
+		ChangedDirs:      changes.ChangedDirs,
 		RemovedDirs:      changes.RemovedDirs,
 		ImageChangedDirs: changes.ImageChangedDirs,
 	}
 
 	// Collect metadata for added tracks.
 	for _, entry := range changes.Added {
-		scanned, err := s.scanFile(wr, entry.FileInfo, entry.Hash)
+		scanned, err := s.scanFile(wr, entry.FileInfo, entry.Hash, nil)
 		if err != nil {
 			slog.Warn("failed to scan added file", "dir", entry.Dir, "name", entry.Name, "error", err)
 			continue
@@ -616,8 +893,19 @@ func (s *Scanner) collectMetadata(wr *WalkResult, changes *ChangeSet) (*ScanResu
 		result.AddedTracks = append(result.AddedTracks, *scanned)
 	}
 
+	// Moved tracks keep their metadata, unless their tags are overridden by
+	// the config of the directory they were moved from or to.
+	changed := slices.Clone(changes.Changed)
+	previousPaths := make(map[string]string)
+	for _, m := range changes.Moves {
+		if s.dirConfig(wr, m.OldDir).overridesTrack(m.OldName) || s.dirConfig(wr, m.NewDir).overridesTrack(m.NewName) {
+			changed = append(changed, FileInfo{Dir: m.NewDir, Name: m.NewName, Mtime: m.NewMtime})
+			previousPaths[JoinLibraryPath(m.NewDir, m.NewName)] = JoinLibraryPath(m.OldDir, m.OldName)
+		}
+	}
+
 	// Collect metadata for changed tracks (also recompute hash).
-	for _, entry := range changes.Changed {
+	for _, entry := range changed {
 		var hash []byte
 		key := JoinLibraryPath(entry.Dir, entry.Name)
 		if rf, ok := wr.Fragments[key]; ok {
@@ -630,7 +918,20 @@ func (s *Scanner) collectMetadata(wr *WalkResult, changes *ChangeSet) (*ScanResu
 				continue
 			}
 		}
-		scanned, err := s.scanFile(wr, entry, hash)
+		// The analyses of a track whose audio is unchanged, such as one
+		// rescanned because a config overriding its tags changed, are kept.
+		previousPath, ok := previousPaths[key]
+		if !ok {
+			previousPath = key
+		}
+		previous, err := s.db.GetTrack(previousPath)
+		if err != nil {
+			slog.Warn("failed to look up changed track", "path", previousPath, "error", err)
+		}
+		if previous != nil && !bytes.Equal(previous.Hash, hash) {
+			previous = nil
+		}
+		scanned, err := s.scanFile(wr, entry, hash, previous)
 		if err != nil {
 			slog.Warn("failed to scan changed file", "dir", entry.Dir, "name", entry.Name, "error", err)
 			continue
@@ -710,25 +1011,26 @@ func (s *Scanner) resolveTrackFSPath(wr *WalkResult, dir, name string) string {
 	return s.fsPath(dir, name)
 }
 
-// scanFile opens an audio file and extracts metadata.
-func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte) (*ScannedTrack, error) {
+// scanFile opens an audio file and extracts metadata. previous, if not nil, is
+// the track previously scanned from the same audio, whose analyses are reused.
+func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte, previous *Track) (*ScannedTrack, error) {
 	libraryPath := JoinLibraryPath(entry.Dir, entry.Name)
 	rf, isFragment := wr.Fragments[libraryPath]
 
-	var src aurelib.Source
-	var err error
-	if isFragment {
-		src, err = fragment.New(rf.SourceFSPath, rf.Config.Start, rf.Config.End)
-	} else {
-		src, err = aurelib.NewFileSource(s.fsPath(entry.Dir, entry.Name))
-	}
+	src, err := s.openSource(wr, entry)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %s/%s: %w", entry.Dir, entry.Name, err)
+		return nil, err
 	}
 	defer src.Destroy()
 
 	tags := maputil.LowerCaseKeys(src.Tags())
 
+	// Apply directory tag overrides.
+	config := s.dirConfig(wr, entry.Dir)
+	if config != nil {
+		maps.Copy(tags, config.Tags)
+	}
+
 	// Apply fragment tag overrides.
 	if isFragment {
 		if rf.Config.Track != "" {
@@ -747,6 +1049,17 @@ func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte) (*Scanne
 		}
 	}
 
+	// Apply per-file tag overrides.
+	if config != nil {
+		for key, value := range config.FileTags[entry.Name] {
+			if value == "" {
+				delete(tags, key)
+			} else {
+				tags[key] = value
+			}
+		}
+	}
+
 	streamInfo := src.StreamInfo()
 
 	metadata := TrackMetadata{
@@ -756,6 +1069,9 @@ func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte) (*Scanne
 		SampleRate:   streamInfo.SampleRate,
 		SampleFormat: streamInfo.SampleFormat(),
 	}
+	if config != nil {
+		metadata.ReplayGainMode = config.ReplayGain
+	}
 
 	// Store fragment info in metadata.
 	if isFragment {
@@ -764,6 +1080,20 @@ func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte) (*Scanne
 			Start:      rf.Config.Start.Seconds(),
 			End:        rf.Config.End.Seconds(),
 		}
+	} else if fileSrc, ok := src.(*aurelib.FileSource); ok {
+		if streams := fileSrc.AudioStreams(); len(streams) > 1 {
+			for _, stream := range streams {
+				metadata.Streams = append(metadata.Streams, AudioStream{
+					Index:        stream.Index,
+					Language:     stream.Language,
+					Title:        stream.Title,
+					Dispositions: stream.Dispositions,
+					Codec:        stream.CodecName,
+					SampleRate:   stream.StreamInfo.SampleRate,
+					Channels:     stream.StreamInfo.ChannelCount(),
+				})
+			}
+		}
 	}
 
 	// Collect all four ReplayGain combinations.
@@ -783,14 +1113,48 @@ func (s *Scanner) scanFile(wr *WalkResult, entry FileInfo, hash []byte) (*Scanne
 		}
 	}
 
+	fingerprint, err := s.analyzeTrack(wr, entry, &metadata, previous)
+	if err != nil {
+		slog.Warn("failed to analyze track", "path", libraryPath, "error", err)
+	}
+
+	// Padding only applies at the boundaries of the whole file. It is counted
+	// by the analyses if they decoded the whole file, and read from the file's
+	// packets otherwise.
+	if fileSrc, ok := src.(*aurelib.FileSource); ok && !metadata.PaddingScanned {
+		if start, end, sampleCount, err := fileSrc.ScanPadding(); err != nil {
+			slog.Warn("failed to scan padding", "path", libraryPath, "error", err)
+			metadata.PaddingScanned = true
+		} else {
+			storePadding(&metadata, start, end, sampleCount)
+		}
+	}
+
 	return &ScannedTrack{
-		FileInfo: entry,
-		Hash:     hash,
-		Tags:     tags,
-		Metadata: metadata,
+		FileInfo:    entry,
+		Hash:        hash,
+		Tags:        tags,
+		Metadata:    metadata,
+		Fingerprint: fingerprint,
 	}, nil
 }
 
+// openSource opens the audio of a file found by walkFilesystem, which may be a
+// fragment of another file.
+func (s *Scanner) openSource(wr *WalkResult, entry FileInfo) (aurelib.Source, error) {
+	var src aurelib.Source
+	var err error
+	if rf, isFragment := wr.Fragments[JoinLibraryPath(entry.Dir, entry.Name)]; isFragment {
+		src, err = fragment.New(rf.SourceFSPath, rf.Config.Start, rf.Config.End)
+	} else {
+		src, err = aurelib.NewFileSource(s.fsPath(entry.Dir, entry.Name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s/%s: %w", entry.Dir, entry.Name, err)
+	}
+	return src, nil
+}
+
 // marshalTrackJSON marshals the JSON fields of a ScannedTrack.
 func marshalTrackJSON(t *ScannedTrack) (tagsJSON, metadataJSON string, err error) {
 	tagsBytes, err := json.Marshal(t.Tags)
@@ -891,6 +1255,7 @@ func (s *Scanner) processAndInsertTrackImages(wr *WalkResult, tx *sql.Tx, tracks
 	// images.
 	type dirGroup struct {
 		dir    string
+		cover  string // preferred cover image, if any
 		tracks []trackImageWork
 	}
 	groupsByDir := make(map[string]*dirGroup)
@@ -898,6 +1263,9 @@ func (s *Scanner) processAndInsertTrackImages(wr *WalkResult, tx *sql.Tx, tracks
 		g, ok := groupsByDir[item.dir]
 		if !ok {
 			g = &dirGroup{dir: item.dir}
+			if config := s.dirConfig(wr, item.dir); config != nil {
+				g.cover = config.Cover
+			}
 			groupsByDir[item.dir] = g
 		}
 		g.tracks = append(g.tracks, item)
@@ -940,7 +1308,7 @@ func (s *Scanner) processAndInsertTrackImages(wr *WalkResult, tx *sql.Tx, tracks
 					if trackPath == "" {
 						trackPath = s.resolveTrackFSPath(wr, item.dir, item.name)
 					}
-					hashes := collectAndProcessTrackImages(trackPath, cache, imageCh)
+					hashes := collectAndProcessTrackImages(trackPath, group.cover, cache, imageCh)
 					mappingsMu.Lock()
 					mappings = append(mappings, trackImageMapping{trackID: item.trackID, hashes: hashes})
 					mappingsMu.Unlock()
@@ -1030,7 +1398,13 @@ func (s *Scanner) Apply(wr *WalkResult, result *ScanResult) error {
 	var imageWork []trackImageWork
 
 	// Changed.
+	var replacedHashes [][]byte
 	if len(result.ChangedTracks) > 0 {
+		hashStmt, err := tx.Prepare(`SELECT hash FROM tracks_with_deletes WHERE dir = ? AND name = ?`)
+		if err != nil {
+			return err
+		}
+		defer hashStmt.Close()
 		updateStmt, err := tx.Prepare(
 			`UPDATE tracks_with_deletes SET mtime = ?, hash = ?, tags = ?, metadata = ?
 			WHERE dir = ? AND name = ? RETURNING id`,
@@ -1045,6 +1419,13 @@ func (s *Scanner) Apply(wr *WalkResult, result *ScanResult) error {
 			if err != nil {
 				return err
 			}
+			var oldHash []byte
+			if err := hashStmt.QueryRow(t.Dir, t.Name).Scan(&oldHash); err != nil {
+				return fmt.Errorf("failed to query track hash: %w", err)
+			}
+			if !bytes.Equal(oldHash, t.Hash) {
+				replacedHashes = append(replacedHashes, oldHash)
+			}
 			var trackID int64
 			if err := updateStmt.QueryRow(t.Mtime, t.Hash, tagsJSON, metadataJSON, t.Dir, t.Name).Scan(&trackID); err != nil {
 				return fmt.Errorf("failed to update track: %w", err)
@@ -1150,18 +1531,35 @@ func (s *Scanner) Apply(wr *WalkResult, result *ScanResult) error {
 
 	// Added dirs.
 	if len(result.AddedDirs) > 0 {
-		stmt, err := tx.Prepare(`INSERT OR IGNORE INTO dirs (path, parent) VALUES (?, ?)`)
+		stmt, err := tx.Prepare(
+			`INSERT INTO dirs (path, parent, hidden) VALUES (?, ?, ?)
+			ON CONFLICT(path) DO UPDATE SET hidden = excluded.hidden`,
+		)
 		if err != nil {
 			return err
 		}
 		defer stmt.Close()
 		for _, d := range result.AddedDirs {
-			if _, err := stmt.Exec(d.Path, d.Parent); err != nil {
+			if _, err := stmt.Exec(d.Path, d.Parent, d.Hidden); err != nil {
 				return fmt.Errorf("failed to insert dir: %w", err)
 			}
 		}
 	}
 
+	// Changed dirs.
+	if len(result.ChangedDirs) > 0 {
+		stmt, err := tx.Prepare(`UPDATE dirs SET hidden = ? WHERE path = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, d := range result.ChangedDirs {
+			if _, err := stmt.Exec(d.Hidden, d.Path); err != nil {
+				return fmt.Errorf("failed to update dir: %w", err)
+			}
+		}
+	}
+
 	// Update image fingerprints for dirs whose images changed.
 	if len(result.ImageChangedDirs) > 0 {
 		fpStmt, err := tx.Prepare(`UPDATE dirs SET image_fingerprint = ? WHERE path = ?`)
@@ -1287,6 +1685,23 @@ func (s *Scanner) Apply(wr *WalkResult, result *ScanResult) error {
 		}
 	}
 
+	// Fingerprints.
+	if err := insertFingerprints(tx, result); err != nil {
+		return err
+	}
+
+	// Chapters.
+	if err := insertChapters(tx, wr); err != nil {
+		return err
+	}
+
+	// Computed album gain depends on every track in the directory.
+	if s.computeReplayGain {
+		if err := updateComputedAlbumGain(tx, result.trackDirs()); err != nil {
+			return err
+		}
+	}
+
 	// Prune directories that contain no tracks or playlists (recursively).
 	if _, err := tx.Exec(`
 		WITH RECURSIVE occupied AS (
@@ -1300,9 +1715,13 @@ func (s *Scanner) Apply(wr *WalkResult, result *ScanResult) error {
 		return fmt.Errorf("failed to prune empty directories: %w", err)
 	}
 
-	err = tx.Commit()
-	if err == nil {
-		committed = true
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	return err
+	committed = true
+
+	if len(replacedHashes) > 0 && s.onHashesReplaced != nil {
+		s.onHashesReplaced(replacedHashes)
+	}
+	return nil
 }
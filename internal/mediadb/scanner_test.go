@@ -1,9 +1,13 @@
 package mediadb
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"maps"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // setupScannerTest creates a temp dir with a test audio file, opens a DB,
@@ -310,3 +314,373 @@ func TestDetectRevivalsSameLocation(t *testing.T) {
 		t.Errorf("expected track to preserve original ID %d, got %d", originalID, track.ID)
 	}
 }
+
+func TestDirConfigOverrides(t *testing.T) {
+	scanner, db, tmpDir := setupScannerTest(t)
+
+	original, err := db.GetTrack("test.ogg")
+	if err != nil || original == nil {
+		t.Fatal("expected test.ogg to be in DB")
+	}
+
+	// Detect silence, and alter the result, to tell whether it is measured
+	// again when the track is rescanned.
+	scanner.DetectSilence(true, -60)
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+	if _, err := db.db.Exec(
+		`UPDATE tracks SET metadata = json_set(metadata, '$.silence.leading', 123) WHERE name = 'test.ogg'`,
+	); err != nil {
+		t.Fatalf("failed to update metadata: %v", err)
+	}
+
+	flowerData, err := os.ReadFile(filepath.Join(testMediaPath(), "flower.jpg"))
+	if err != nil {
+		t.Fatalf("failed to read image: %v", err)
+	}
+	for _, name := range []string{"flower.jpg", "front.jpg"} {
+		data, err := os.ReadFile(filepath.Join(testMediaPath(), name))
+		if err != nil {
+			t.Fatalf("failed to read image: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, name), data, 0o644); err != nil {
+			t.Fatalf("failed to write image: %v", err)
+		}
+	}
+
+	// writeConfig writes aurelius.yaml with an mtime later than any before,
+	// so that the scanner detects the change.
+	configTime := time.Unix(original.Mtime+2, 0)
+	writeConfig := func(content string) {
+		t.Helper()
+		configPath := filepath.Join(tmpDir, "aurelius.yaml")
+		if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write aurelius.yaml: %v", err)
+		}
+		configTime = configTime.Add(2 * time.Second)
+		if err := os.Chtimes(configPath, configTime, configTime); err != nil {
+			t.Fatalf("failed to set mtime: %v", err)
+		}
+	}
+
+	writeConfig(`album: Fixed Album
+year: 2001
+compilation: true
+cover: flower.jpg
+files:
+  test.ogg:
+    title: Fixed Title
+    artist: ""
+`)
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+
+	track, err := db.GetTrack("test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected test.ogg to still be in DB")
+	}
+	for key, want := range map[string]string{
+		"album":       "Fixed Album",
+		"date":        "2001",
+		"compilation": "1",
+		"title":       "Fixed Title",
+	} {
+		if track.Tags[key] != want {
+			t.Errorf("expected tag %q to be %q, got %q", key, want, track.Tags[key])
+		}
+	}
+	if _, ok := track.Tags["artist"]; ok {
+		t.Errorf("expected artist tag to be removed, got %q", track.Tags["artist"])
+	}
+	if track.Mtime <= original.Mtime {
+		t.Errorf("expected mtime to be taken from the config")
+	}
+	if silence := track.Metadata.Silence; silence == nil || silence.Leading != 123 {
+		t.Errorf("expected silence of the unchanged audio to be kept, got %+v", silence)
+	}
+
+	// The preferred cover comes first, despite front.jpg's name.
+	if len(track.Images) == 0 {
+		t.Fatal("expected track to have images")
+	}
+	var originalHash []byte
+	if err := db.db.QueryRow(
+		`SELECT original_hash FROM images WHERE hash = ?`, track.Images[0].Hash,
+	).Scan(&originalHash); err != nil {
+		t.Fatalf("failed to look up image: %v", err)
+	}
+	if flowerHash := sha256.Sum256(flowerData); !bytes.Equal(originalHash, flowerHash[:]) {
+		t.Error("expected flower.jpg to be the first image")
+	}
+
+	// Without overrides, the file's own tags are restored.
+	writeConfig("chapters: true\n")
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+
+	track, err = db.GetTrack("test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected test.ogg to still be in DB")
+	}
+	if !maps.Equal(track.Tags, original.Tags) {
+		t.Errorf("expected original tags %v, got %v", original.Tags, track.Tags)
+	}
+	if track.Mtime != original.Mtime {
+		t.Errorf("expected mtime %d, got %d", original.Mtime, track.Mtime)
+	}
+}
+
+func TestInheritedDirConfig(t *testing.T) {
+	scanner, db, tmpDir := setupScannerTest(t)
+
+	srcData, err := os.ReadFile(filepath.Join(testMediaPath(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	for _, name := range []string{
+		"alpha/test.ogg",
+		"alpha/test.sample.ogg",
+		"alpha/beta/test.ogg",
+		"alpha/skip/test.ogg",
+	} {
+		fsPath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fsPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fsPath, srcData, 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	// writeConfig writes an aurelius.yaml with an mtime later than any before,
+	// so that the scanner detects the change.
+	configTime := time.Now()
+	writeConfig := func(dir, content string) {
+		t.Helper()
+		configPath := filepath.Join(tmpDir, filepath.FromSlash(dir), "aurelius.yaml")
+		if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write aurelius.yaml: %v", err)
+		}
+		configTime = configTime.Add(2 * time.Second)
+		if err := os.Chtimes(configPath, configTime, configTime); err != nil {
+			t.Fatalf("failed to set mtime: %v", err)
+		}
+	}
+	writeConfig("", `genre: Inherited
+replaygain: album
+exclude: ["*.sample.ogg", "alpha/skip"]
+`)
+	writeConfig("alpha/beta", "genre: Nested\nhidden: true\n")
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+
+	for libraryPath, wantGenre := range map[string]string{
+		"test.ogg":            "Inherited",
+		"alpha/test.ogg":      "Inherited",
+		"alpha/beta/test.ogg": "Nested",
+	} {
+		track, err := db.GetTrack(libraryPath)
+		if err != nil || track == nil {
+			t.Fatalf("expected %s to be in DB", libraryPath)
+		}
+		if track.Tags["genre"] != wantGenre {
+			t.Errorf("%s: expected genre %q, got %q", libraryPath, wantGenre, track.Tags["genre"])
+		}
+		if track.Metadata.ReplayGainMode != "album" {
+			t.Errorf("%s: expected ReplayGain mode to be inherited, got %q", libraryPath, track.Metadata.ReplayGainMode)
+		}
+	}
+	for _, libraryPath := range []string{"alpha/test.sample.ogg", "alpha/skip/test.ogg"} {
+		if track, err := db.GetTrack(libraryPath); err != nil || track != nil {
+			t.Errorf("expected %s to be excluded", libraryPath)
+		}
+	}
+
+	// Hidden directories and their tracks are left out of listings and
+	// search results.
+	dirs, err := db.AllDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs["alpha"].Hidden || !dirs["alpha/beta"].Hidden {
+		t.Errorf("expected only alpha/beta to be hidden, got %v", dirs)
+	}
+	if _, ok := dirs["alpha/skip"]; ok {
+		t.Error("expected alpha/skip to be excluded")
+	}
+	response, err := db.Search("alpha", 100)
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	found := false
+	for _, result := range response.Results {
+		if isUnderLibraryDir(result.Path, "alpha/beta") {
+			t.Errorf("expected hidden %s not to be found", result.Path)
+		}
+		found = found || result.Path == "alpha/test.ogg"
+	}
+	if !found {
+		t.Errorf("expected alpha/test.ogg to be found, got %v", response.Results)
+	}
+
+	// Settings that don't override tags don't cause tracks to be rescanned.
+	before, err := db.GetTrack("alpha/test.ogg")
+	if err != nil || before == nil {
+		t.Fatal("expected alpha/test.ogg to be in DB")
+	}
+	writeConfig("alpha", "chapters: true\n")
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+	if track, err := db.GetTrack("alpha/test.ogg"); err != nil || track == nil || track.Mtime != before.Mtime {
+		t.Errorf("expected alpha/test.ogg not to be rescanned, got %+v", track)
+	}
+
+	// Changes to an ancestor's config apply to its descendants.
+	writeConfig("", "genre: Changed\n")
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+
+	track, err := db.GetTrack("alpha/test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected alpha/test.ogg to still be in DB")
+	}
+	if track.Tags["genre"] != "Changed" || track.Metadata.ReplayGainMode != "" {
+		t.Errorf("expected ancestor change to apply, got genre %q and ReplayGain mode %q",
+			track.Tags["genre"], track.Metadata.ReplayGainMode)
+	}
+	for _, libraryPath := range []string{"alpha/test.sample.ogg", "alpha/skip/test.ogg"} {
+		if track, err := db.GetTrack(libraryPath); err != nil || track == nil {
+			t.Errorf("expected %s to be added once no longer excluded", libraryPath)
+		}
+	}
+}
+
+func TestFilePatterns(t *testing.T) {
+	scanner, db, tmpDir := setupScannerTest(t)
+
+	srcData, err := os.ReadFile(filepath.Join(testMediaPath(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	for _, name := range []string{
+		".hidden.ogg",
+		".hidden/test.ogg",
+		"Samples/test.ogg",
+		"alpha/test.sample.ogg",
+	} {
+		fsPath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fsPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fsPath, srcData, 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	// expectTracks checks which of the files written above are in the DB.
+	expectTracks := func(want map[string]bool) {
+		t.Helper()
+		for libraryPath, wantFound := range want {
+			track, err := db.GetTrack(libraryPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := track != nil; found != wantFound {
+				t.Errorf("%s: expected found = %v, got %v", libraryPath, wantFound, found)
+			}
+		}
+	}
+
+	// Hidden files and directories are excluded by default.
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+	expectTracks(map[string]bool{
+		".hidden.ogg":           false,
+		".hidden/test.ogg":      false,
+		"Samples/test.ogg":      true,
+		"alpha/test.sample.ogg": true,
+	})
+
+	// Changing the patterns re-indexes the library on the next scan.
+	if err := scanner.FilePatterns([]string{".hidden.ogg"}, []string{"Samples", "*.sample.ogg"}); err != nil {
+		t.Fatalf("FilePatterns failed: %v", err)
+	}
+	if err := scanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+	expectTracks(map[string]bool{
+		".hidden.ogg":           true,
+		".hidden/test.ogg":      false,
+		"Samples/test.ogg":      false,
+		"alpha/test.sample.ogg": false,
+	})
+
+	if err := scanner.FilePatterns(nil, []string{"["}); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
+
+func TestTrackPadding(t *testing.T) {
+	_, db, tmpDir := setupScannerTest(t)
+
+	track, err := db.GetTrack("test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected test.ogg to be in DB")
+	}
+	sampleCount := track.Metadata.SampleCount
+	if sampleCount == 0 {
+		t.Fatal("expected scan to store the sample count")
+	}
+	expected := uint64(track.Metadata.Duration * float64(track.Metadata.SampleRate))
+	if diff := max(sampleCount, expected) - min(sampleCount, expected); diff > uint64(track.Metadata.SampleRate/10) {
+		t.Errorf("expected about %d samples, got %d", expected, sampleCount)
+	}
+	if !track.Metadata.PaddingScanned {
+		t.Error("expected scan to mark the padding as scanned")
+	}
+
+	// the padding counted while decoding for an analysis must match the
+	// padding read from the file's packets
+	analysisDB, err := Open(filepath.Join(t.TempDir(), "analysis.db"))
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	t.Cleanup(func() { analysisDB.Close() })
+	analysisScanner := NewScanner(analysisDB, tmpDir)
+	analysisScanner.DetectSilence(true, -60)
+	if err := analysisScanner.FullScan(); err != nil {
+		t.Fatalf("full scan failed: %v", err)
+	}
+	analyzed, err := analysisDB.GetTrack("test.ogg")
+	if err != nil || analyzed == nil {
+		t.Fatal("expected test.ogg to be in analysis DB")
+	}
+	if a, m := analyzed.Metadata, track.Metadata; a.StartPadding != m.StartPadding ||
+		a.EndTrimming != m.EndTrimming || a.SampleCount != m.SampleCount || !a.PaddingScanned {
+		t.Errorf("expected padding %d/%d/%d from analysis, got %d/%d/%d",
+			m.StartPadding, m.EndTrimming, m.SampleCount, a.StartPadding, a.EndTrimming, a.SampleCount)
+	}
+
+	// a stale hash must not overwrite the metadata of a changed track
+	if err := db.SetTrackPadding("test.ogg", []byte("stale"), 1, 2, 3); err != nil {
+		t.Fatalf("SetTrackPadding failed: %v", err)
+	}
+	if track, _ = db.GetTrack("test.ogg"); track.Metadata.SampleCount != sampleCount {
+		t.Errorf("expected sample count %d after stale update, got %d", sampleCount, track.Metadata.SampleCount)
+	}
+
+	if err := db.SetTrackPadding("test.ogg", track.Hash, 1, 2, 3); err != nil {
+		t.Fatalf("SetTrackPadding failed: %v", err)
+	}
+	track, _ = db.GetTrack("test.ogg")
+	if m := track.Metadata; m.StartPadding != 1 || m.EndTrimming != 2 || m.SampleCount != 3 {
+		t.Errorf("expected padding 1/2/3, got %d/%d/%d", m.StartPadding, m.EndTrimming, m.SampleCount)
+	}
+}
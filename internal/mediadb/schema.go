@@ -31,6 +31,36 @@ type ReplayGain struct {
 	Album       float64 `json:"album"`
 	TrackNoclip float64 `json:"trackNoclip"`
 	AlbumNoclip float64 `json:"albumNoclip"`
+
+	// Computed is true if the values were derived from a loudness measurement
+	// by the scanner rather than read from the track's tags.
+	Computed bool `json:"computed,omitempty"`
+}
+
+// Loudness holds the EBU R128 loudness measured for a track that has no
+// ReplayGain tags.
+type Loudness struct {
+	Integrated float64 `json:"integrated"` // integrated loudness in LUFS
+	TruePeak   float64 `json:"truePeak"`   // linear true peak sample value
+
+	// Failed is true if the track couldn't be decoded to measure its loudness.
+	// It isn't measured again until the file changes.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// Silence holds the durations of the silence detected at the start and end of
+// a track.
+type Silence struct {
+	Leading  float64 `json:"leading"`  // in seconds
+	Trailing float64 `json:"trailing"` // in seconds
+
+	// Threshold is the level, in dBFS, below which audio was considered
+	// silent. The track is scanned again if the configured threshold differs.
+	Threshold float64 `json:"threshold"`
+
+	// Failed is true if the track couldn't be decoded to detect silence. It
+	// isn't scanned again until the file or the threshold changes.
+	Failed bool `json:"failed,omitempty"`
 }
 
 // Fragment holds the resolved fragment definition for a track that
@@ -41,6 +71,27 @@ type Fragment struct {
 	End        float64 `json:"end"`        // end time in seconds (0 = end of file)
 }
 
+// Chapter describes a chapter embedded in an audio file, which is exposed as
+// a fragment of the file.
+type Chapter struct {
+	Start  float64 `json:"start"` // start time in seconds
+	End    float64 `json:"end"`   // end time in seconds (0 = end of file)
+	Title  string  `json:"title,omitempty"`
+	Artist string  `json:"artist,omitempty"`
+}
+
+// AudioStream describes one of the audio streams of a file that has several,
+// each of which can be selected for playback.
+type AudioStream struct {
+	Index        int      `json:"index"` // position among the file's audio streams
+	Language     string   `json:"language,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Dispositions []string `json:"dispositions,omitempty"`
+	Codec        string   `json:"codec,omitempty"`
+	SampleRate   uint     `json:"sampleRate"`
+	Channels     uint     `json:"channels"`
+}
+
 // TrackMetadata holds audio properties stored in the metadata JSON column.
 type TrackMetadata struct {
 	Duration     float64     `json:"duration"`
@@ -48,8 +99,25 @@ type TrackMetadata struct {
 	BitRate      int         `json:"bitRate"`
 	SampleRate   uint        `json:"sampleRate"`
 	SampleFormat string      `json:"sampleFormat"`
+	StartPadding uint        `json:"startPadding,omitempty"` // samples to trim from the start for gapless playback
+	EndTrimming  uint        `json:"endTrimming,omitempty"`  // samples to trim from the end for gapless playback
+	SampleCount  uint64      `json:"sampleCount,omitempty"`  // exact number of samples in a whole file; 0 if unknown
 	ReplayGain   *ReplayGain `json:"replayGain,omitempty"`
+	Loudness     *Loudness   `json:"loudness,omitempty"` // set if ReplayGain was computed, or couldn't be
 	Fragment     *Fragment   `json:"fragment,omitempty"`
+	Silence      *Silence    `json:"silence,omitempty"` // set if silence detection is enabled
+
+	// Streams lists the file's audio streams if it has more than one.
+	Streams []AudioStream `json:"streams,omitempty"`
+
+	// PaddingScanned is set once the padding and sample count have been
+	// scanned, even if they couldn't be determined, so that the file isn't
+	// scanned for them again.
+	PaddingScanned bool `json:"paddingScanned,omitempty"`
+
+	// ReplayGainMode is the mode applied when a client doesn't request one,
+	// as set in the config of the track's directory or its ancestors.
+	ReplayGainMode string `json:"replayGainMode,omitempty"`
 }
 
 // Image describes an image associated with a track. The binary data is
@@ -79,6 +147,7 @@ type Dir struct {
 	Path             string
 	Parent           string
 	ImageFingerprint []byte
+	Hidden           bool // hidden from directory listings and search results
 }
 
 // M3UPlaylist represents a row in the m3u_playlists table.
@@ -13,7 +13,7 @@ CREATE INDEX idx_tracks_dir_name ON "tracks_with_deletes"(dir, name);
 CREATE TABLE dirs (
     path    TEXT PRIMARY KEY,
     parent  TEXT NOT NULL
-, image_fingerprint BLOB);
+, image_fingerprint BLOB, hidden INTEGER NOT NULL DEFAULT 0);
 CREATE INDEX idx_dirs_parent ON dirs(parent);
 CREATE TABLE favorites (
     track_id INTEGER PRIMARY KEY REFERENCES tracks_with_deletes(id) ON DELETE CASCADE,
@@ -150,3 +150,15 @@ CREATE TRIGGER search_dir_ad AFTER DELETE ON dirs
 BEGIN
     DELETE FROM search_index WHERE dir = OLD.path AND name = '' AND type = 'dir';
 END;
+CREATE TABLE fingerprints (
+    hash        BLOB PRIMARY KEY,
+    fingerprint BLOB NOT NULL
+);
+CREATE TABLE chapters (
+    hash     BLOB PRIMARY KEY,
+    chapters TEXT NOT NULL
+);
+CREATE TABLE waveforms (
+    hash  BLOB PRIMARY KEY,
+    peaks BLOB NOT NULL
+);
@@ -52,6 +52,13 @@ func (db *DB) Search(query string, limit int) (*SearchResponse, error) {
 			)
 		)`)
 
+	// Exclude hidden directories and the tracks in them.
+	where.WriteString(`
+		AND NOT EXISTS (
+			SELECT 1 FROM dirs d
+			WHERE d.path = si.dir AND d.hidden = 1
+		)`)
+
 	if mods.dirsOnly {
 		where.WriteString(` AND si.type = 'dir'`)
 	}
@@ -0,0 +1,26 @@
+package mediadb
+
+import (
+	"time"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// needsSilence reports whether t should be rescanned to detect silence,
+// because silence detection was enabled or the silence threshold was changed
+// after it was last scanned.
+func (s *Scanner) needsSilence(t *Track) bool {
+	return s.detectSilence &&
+		(t.Metadata.Silence == nil || t.Metadata.Silence.Threshold != s.silenceThreshold)
+}
+
+// storeSilence stores the silence found by meter at the start and end of a
+// track in metadata, along with the threshold with which meter was created.
+func storeSilence(metadata *TrackMetadata, meter *aurelib.SilenceMeter, threshold float64) {
+	leading, trailing := meter.Silence()
+	metadata.Silence = &Silence{
+		Leading:   float64(leading) / float64(time.Second),
+		Trailing:  float64(trailing) / float64(time.Second),
+		Threshold: threshold,
+	}
+}
@@ -2,6 +2,7 @@ package mediadb
 
 import (
 	"context"
+	"errors"
 	"io/fs"
 	"log/slog"
 	"os"
@@ -168,11 +169,6 @@ func (w *Watcher) handleEvent(event fsnotify.Event, pending map[string]*pendingE
 
 	absPath := event.Name
 
-	// Skip hidden files/dirs.
-	if strings.HasPrefix(filepath.Base(absPath), ".") {
-		return
-	}
-
 	// Determine the new event kind.
 	var newKind eventKind
 	switch {
@@ -254,6 +250,18 @@ func (w *Watcher) handleEvent(event fsnotify.Event, pending map[string]*pendingE
 // handleNewDir adds watches for a new directory and walks it to discover
 // any files already present (handles directory moves into the watched tree).
 func (w *Watcher) handleNewDir(absPath string, pending map[string]*pendingEvent) {
+	// Excluded directories aren't watched or walked. Events for their
+	// contents are filtered again when the batch is processed, with the
+	// configs current at that time.
+	wr := &WalkResult{Configs: make(map[string]*DirConfig)}
+	excluded := func(absPath string) bool {
+		dir, name, ok := w.toLibraryPath(absPath)
+		return !ok || w.scanner.excluded(wr, dir, name)
+	}
+	if excluded(absPath) {
+		return
+	}
+
 	// Record the directory itself as created.
 	pending[absPath] = &pendingEvent{kind: eventCreated, isDir: true}
 
@@ -272,15 +280,15 @@ func (w *Watcher) handleNewDir(absPath string, pending map[string]*pendingEvent)
 			return nil
 		}
 
-		// Skip hidden files/dirs and symlinks.
-		if strings.HasPrefix(d.Name(), ".") || d.Type()&os.ModeSymlink != 0 {
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
+		// Skip symlinks.
+		if d.Type()&os.ModeSymlink != 0 {
 			return nil
 		}
 
 		if d.IsDir() {
+			if excluded(p) {
+				return filepath.SkipDir
+			}
 			pending[p] = &pendingEvent{kind: eventCreated, isDir: true}
 			if err := w.fsWatcher.Add(p); err != nil {
 				slog.Warn("failed to watch new subdirectory", "path", p, "error", err)
@@ -332,52 +340,94 @@ func (w *Watcher) processBatch(events map[string]*pendingEvent) {
 	// can store fragment metadata for collectMetadata to use.
 	wr := &WalkResult{
 		Fragments: make(map[string]resolvedFragment),
+		Chapters:  make(map[string][]Chapter),
+		Configs:   make(map[string]*DirConfig),
 	}
-	processedDirConfigs := make(map[string]bool)
-	modifiedTrackDirs := make(map[string]bool)
+	dirConfigEvents := make(map[string]*pendingEvent)
+	fragmentSources := make(map[string]map[string]bool)
 
 	for absPath, ev := range events {
 		if ev.isDir {
-			w.processDirEvent(absPath, ev, changes)
-		} else {
-			w.processFileEvent(absPath, ev, wr, changes)
-
-			dir, name, ok := w.toLibraryPath(absPath)
-			if ok {
-				switch GetFileType(name) {
-				case FileTypeDirConfig:
-					processedDirConfigs[dir] = true
-				case FileTypeTrack:
-					if ev.kind == eventModified || ev.kind == eventCreated {
-						modifiedTrackDirs[dir] = true
-					}
-				case FileTypeImage, FileTypePlaylist, FileTypeIgnored:
-				}
+			w.processDirEvent(absPath, ev, wr, changes)
+			continue
+		}
+
+		// Files excluded by the configs that apply to them are ignored.
+		dir, name, ok := w.toLibraryPath(absPath)
+		if !ok || w.scanner.excluded(wr, dir, name) {
+			continue
+		}
+		w.processFileEvent(absPath, ev, wr, changes)
+
+		switch GetFileType(name) {
+		case FileTypeDirConfig:
+			dirConfigEvents[dir] = ev
+		case FileTypeCueSheet:
+			if _, ok := dirConfigEvents[dir]; !ok {
+				dirConfigEvents[dir] = nil
 			}
+		case FileTypeTrack:
+			if _, ok := dirConfigEvents[dir]; !ok && w.affectsFragments(wr, dir, name, ev, fragmentSources) {
+				dirConfigEvents[dir] = nil
+			}
+		case FileTypeImage, FileTypePlaylist, FileTypeIgnored:
 		}
 	}
 
-	// When a source audio file is modified, re-evaluate the dir config for
-	// that directory so fragments derived from it are updated.
-	for dir := range modifiedTrackDirs {
-		if processedDirConfigs[dir] {
-			continue
+	// Process dir config events after the other events, since the config
+	// applies to the tracks they add or change. When a cue sheet, or an audio
+	// file that fragments may be derived from, is added, modified or removed,
+	// re-evaluate the fragments of its directory so those derived from it,
+	// whether defined in the dir config, a cue sheet or by a file's chapters,
+	// are updated.
+	var changedConfigDirs []string
+	for dir, ev := range dirConfigEvents {
+		if w.processDirConfigEvent(dir, wr, changes) && ev != nil {
+			changedConfigDirs = append(changedConfigDirs, dir)
 		}
-		configPath := w.scanner.fsPath(dir, dirConfigName)
-		if _, err := os.Lstat(configPath); err != nil {
-			continue
+	}
+
+	applied := false
+	if len(changes.Added) > 0 || len(changes.Changed) > 0 ||
+		len(changes.Removed) > 0 || len(changes.AddedDirs) > 0 ||
+		len(changes.RemovedDirs) > 0 || len(changes.ImageChangedDirs) > 0 ||
+		len(changes.AddedPlaylists) > 0 || len(changes.ChangedPlaylists) > 0 ||
+		len(changes.RemovedPlaylists) > 0 {
+		if !w.applyChanges(wr, changes) {
+			return
 		}
-		w.processDirConfigEvent(configPath, dir, &pendingEvent{kind: eventModified}, wr, changes)
+		applied = true
 	}
 
-	if len(changes.Added) == 0 && len(changes.Changed) == 0 &&
-		len(changes.Removed) == 0 && len(changes.AddedDirs) == 0 &&
-		len(changes.RemovedDirs) == 0 && len(changes.ImageChangedDirs) == 0 &&
-		len(changes.AddedPlaylists) == 0 && len(changes.ChangedPlaylists) == 0 &&
-		len(changes.RemovedPlaylists) == 0 {
-		return
+	// The settings of a changed config are inherited by the subdirectories
+	// of its directory, and its exclude patterns may add or remove any file
+	// in them, so rescan the whole tree.
+	slices.Sort(changedConfigDirs)
+	var lastRoot string
+	for i, dir := range changedConfigDirs {
+		if i > 0 && isUnderLibraryDir(dir, lastRoot) {
+			continue // already rescanned with an ancestor
+		}
+		lastRoot = dir
+		if err := w.scanner.scanTree(dir); err != nil {
+			slog.Error("watcher rescan failed", "dir", dir, "error", err)
+			return
+		}
+		applied = true
+	}
+	if len(changedConfigDirs) > 0 {
+		w.syncWatches()
 	}
 
+	if applied && w.config.OnBatchApplied != nil {
+		w.config.OnBatchApplied()
+	}
+}
+
+// applyChanges resolves and applies the changes of a batch to the database.
+// It reports whether they were applied.
+func (w *Watcher) applyChanges(wr *WalkResult, changes *ChangeSet) bool {
+
 	// Deduplicate Removed entries. A track may appear both from an
 	// individual file Remove event and from removeDirRecursive when its
 	// parent directory is also removed.
@@ -398,7 +448,7 @@ func (w *Watcher) processBatch(events map[string]*pendingEvent) {
 	detectMoves(changes)
 	if err := w.scanner.detectRevivals(changes); err != nil {
 		slog.Error("watcher revival detection failed", "error", err)
-		return
+		return false
 	}
 
 	slog.Info("watcher batch",
@@ -418,17 +468,51 @@ func (w *Watcher) processBatch(events map[string]*pendingEvent) {
 	result, err := w.scanner.collectMetadata(wr, changes)
 	if err != nil {
 		slog.Error("watcher metadata collection failed", "error", err)
-		return
+		return false
 	}
 
 	// Apply to database.
 	if err := w.scanner.Apply(wr, result); err != nil {
 		slog.Error("watcher apply failed", "error", err)
-		return
+		return false
 	}
+	return true
+}
 
-	if w.config.OnBatchApplied != nil {
-		w.config.OnBatchApplied()
+// syncWatches updates the watched directories after a rescan: directories
+// that are now excluded are no longer watched, and watches are added for the
+// directories in the database that aren't watched yet, such as those that
+// were excluded before.
+func (w *Watcher) syncWatches() {
+	wr := &WalkResult{Configs: make(map[string]*DirConfig)}
+	for dirPath := range w.watchedDirs {
+		if dirPath == w.rootPath {
+			continue
+		}
+		dir, name, ok := w.toLibraryPath(dirPath)
+		if !ok || !w.scanner.excluded(wr, dir, name) {
+			continue
+		}
+		if err := w.fsWatcher.Remove(dirPath); err != nil {
+			slog.Warn("failed to stop watching directory", "path", dirPath, "error", err)
+		}
+		delete(w.watchedDirs, dirPath)
+	}
+
+	dirs, err := w.scanner.db.AllDirs()
+	if err != nil {
+		slog.Warn("watcher: failed to look up dirs", "error", err)
+		return
+	}
+	for _, d := range dirs {
+		dirPath := filepath.Join(w.rootPath, filepath.FromSlash(d.Path))
+		if w.watchedDirs[dirPath] {
+			continue
+		}
+		if err := w.fsWatcher.Add(dirPath); err != nil {
+			slog.Warn("failed to watch directory", "path", dirPath, "error", err)
+		}
+		w.watchedDirs[dirPath] = true
 	}
 }
 
@@ -441,19 +525,28 @@ func (w *Watcher) processFileEvent(absPath string, ev *pendingEvent, wr *WalkRes
 
 	switch GetFileType(name) {
 	case FileTypeTrack:
-		w.processTrackEvent(absPath, dir, name, ev, changes)
+		w.processTrackEvent(absPath, dir, name, ev, wr, changes)
 	case FileTypePlaylist:
 		w.processPlaylistEvent(absPath, dir, name, ev, changes)
 	case FileTypeImage:
 		w.processImageFileEvent(dir, ev, changes)
-	case FileTypeDirConfig:
-		w.processDirConfigEvent(absPath, dir, ev, wr, changes)
+	case FileTypeDirConfig, FileTypeCueSheet:
+		// handled per directory by processBatch
 	case FileTypeIgnored:
 	}
 }
 
-// processTrackEvent handles a single track file event.
-func (w *Watcher) processTrackEvent(absPath, dir, name string, ev *pendingEvent, changes *ChangeSet) {
+// processTrackEvent handles a single track file event. The mtime of an added or
+// changed track includes that of the config that applies to it, as in a full
+// scan.
+func (w *Watcher) processTrackEvent(
+	absPath, dir, name string,
+	ev *pendingEvent,
+	wr *WalkResult,
+	changes *ChangeSet,
+) {
+	config := w.scanner.dirConfig(wr, dir)
+
 	switch ev.kind {
 	case eventCreated:
 		info, err := os.Lstat(absPath)
@@ -470,7 +563,7 @@ func (w *Watcher) processTrackEvent(absPath, dir, name string, ev *pendingEvent,
 			return
 		}
 		changes.Added = append(changes.Added, HashedFileInfo{
-			FileInfo: FileInfo{Dir: dir, Name: name, Mtime: info.ModTime().Unix()},
+			FileInfo: FileInfo{Dir: dir, Name: name, Mtime: trackMtime(config, name, info.ModTime().Unix())},
 			Hash:     hash,
 		})
 
@@ -484,7 +577,7 @@ func (w *Watcher) processTrackEvent(absPath, dir, name string, ev *pendingEvent,
 			return
 		}
 		changes.Changed = append(changes.Changed, FileInfo{
-			Dir: dir, Name: name, Mtime: info.ModTime().Unix(),
+			Dir: dir, Name: name, Mtime: trackMtime(config, name, info.ModTime().Unix()),
 		})
 
 	case eventRemoved:
@@ -551,7 +644,7 @@ func (w *Watcher) processImageFileEvent(dir string, ev *pendingEvent, changes *C
 }
 
 // processDirEvent handles a single directory event in the batch.
-func (w *Watcher) processDirEvent(absPath string, ev *pendingEvent, changes *ChangeSet) {
+func (w *Watcher) processDirEvent(absPath string, ev *pendingEvent, wr *WalkResult, changes *ChangeSet) {
 	libraryDir, ok := w.toLibraryDirPath(absPath)
 	if !ok {
 		return
@@ -562,9 +655,13 @@ func (w *Watcher) processDirEvent(absPath string, ev *pendingEvent, changes *Cha
 		if libraryDir == "" {
 			return
 		}
+		if parent, name := SplitLibraryPath(libraryDir); w.scanner.excluded(wr, parent, name) {
+			return
+		}
 		changes.AddedDirs = append(changes.AddedDirs, Dir{
 			Path:   libraryDir,
 			Parent: CleanLibraryPath(path.Dir(libraryDir)),
+			Hidden: w.scanner.dirConfig(wr, libraryDir).hidden(),
 		})
 
 	case eventModified:
@@ -615,113 +712,209 @@ func (w *Watcher) removeDirRecursive(libraryDir string, changes *ChangeSet) {
 	}
 }
 
+// affectsFragments reports whether an event for the audio file name in the
+// library directory dir may change the fragments of the directory: if the
+// directory has a config, which may define fragments of the file, if fragments
+// were derived from the file before, or if it has chapters. Re-evaluating the
+// fragments of a directory lists and hashes all of its audio files, so it is
+// avoided for other files. fragmentSources caches the source files of the
+// existing fragments in each directory.
+func (w *Watcher) affectsFragments(
+	wr *WalkResult,
+	dir, name string,
+	ev *pendingEvent,
+	fragmentSources map[string]map[string]bool,
+) bool {
+	if _, err := os.Lstat(w.scanner.fsPath(dir, dirConfigName)); err == nil {
+		return true
+	}
+
+	sources, ok := fragmentSources[dir]
+	if !ok {
+		tracks, err := w.scanner.db.GetTracksInDir(dir)
+		if err != nil {
+			slog.Warn("watcher: failed to look up tracks", "dir", dir, "error", err)
+			return true
+		}
+		sources = make(map[string]bool)
+		for _, t := range tracks {
+			if t.Metadata.Fragment != nil {
+				sources[t.Metadata.Fragment.SourceFile] = true
+			}
+		}
+		fragmentSources[dir] = sources
+	}
+	if sources[name] {
+		return true
+	}
+
+	if ev.kind == eventRemoved {
+		return false
+	}
+	fsPath := w.scanner.fsPath(dir, name)
+	info, err := os.Lstat(fsPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	hash, err := computePartialHash(fsPath)
+	if err != nil {
+		slog.Warn("watcher: failed to hash file", "dir", dir, "name", name, "error", err)
+		return false
+	}
+	source := FileInfo{Dir: dir, Name: name, Mtime: info.ModTime().Unix()}
+	chapters, err := w.scanner.fileChapters(wr, source, hash)
+	if err != nil {
+		slog.Warn("watcher: failed to read chapters", "dir", dir, "name", name, "error", err)
+		return false
+	}
+	return len(chapters) >= minChapters
+}
+
+// dirFiles lists the audio files in the library directory dir, keyed by
+// name, and the cue sheets in it, except those that are excluded. The results
+// are empty if the directory doesn't exist.
+func (w *Watcher) dirFiles(wr *WalkResult, dir string) (tracks map[string]FileInfo, cueSheets []FileInfo) {
+	tracks = make(map[string]FileInfo)
+	entries, err := os.ReadDir(w.scanner.fsPath(dir, ""))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("watcher: failed to list directory", "dir", dir, "error", err)
+		}
+		return tracks, nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fileType := GetFileType(name)
+		if fileType != FileTypeTrack && fileType != FileTypeCueSheet || w.scanner.excluded(wr, dir, name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		file := FileInfo{Dir: dir, Name: name, Mtime: info.ModTime().Unix()}
+		if fileType == FileTypeTrack {
+			tracks[name] = file
+		} else {
+			cueSheets = append(cueSheets, file)
+		}
+	}
+	return tracks, cueSheets
+}
+
 // processDirConfigEvent handles a change to an aurelius.yaml file. It diffs
-// the new fragment definitions against the existing fragment tracks in the
-// database and emits the appropriate add/change/remove entries.
-func (w *Watcher) processDirConfigEvent(absPath, dir string, ev *pendingEvent, wr *WalkResult, changes *ChangeSet) {
+// the fragments defined by the new config and the directory's cue sheets, and
+// those derived from the chapters of audio files that have no fragments
+// defined, against the existing fragment tracks in the database and emits the
+// appropriate add/change/remove entries. Tracks whose metadata is overridden
+// by the config, or by the ancestor configs it inherits from, are rescanned
+// when it changes. A missing config is treated as an empty one. It reports
+// whether the config was applied; a config that can't be parsed is ignored.
+func (w *Watcher) processDirConfigEvent(dir string, wr *WalkResult, changes *ChangeSet) bool {
 	// Get existing fragment tracks from the database.
 	existingTracks, err := w.scanner.db.GetTracksInDir(dir)
 	if err != nil {
 		slog.Warn("watcher: failed to look up tracks for dir config event", "dir", dir, "error", err)
-		return
+		return false
 	}
 
 	// Separate existing fragments from regular tracks.
 	existingFragments := make(map[string]*Track)
+	existingFiles := make(map[string]*Track)
 	for i := range existingTracks {
 		t := &existingTracks[i]
 		if t.Metadata.Fragment != nil {
 			existingFragments[t.Name] = t
+		} else {
+			existingFiles[t.Name] = t
 		}
 	}
 
-	if ev.kind == eventRemoved {
-		// Config removed: all fragments should be removed.
-		for _, t := range existingFragments {
-			changes.Removed = append(changes.Removed, *t)
-		}
-		return
-	}
-
-	// Config created or modified: parse and diff.
-	config, err := LoadDirConfig(absPath)
-	if err != nil {
-		slog.Warn("watcher: failed to parse dir config", "path", absPath, "error", err)
-		return
-	}
-
-	// Build a set of non-fragment audio filenames from existing DB tracks.
-	audioNameSet := make(map[string]bool)
-	for _, t := range existingTracks {
-		if t.Metadata.Fragment == nil {
-			audioNameSet[t.Name] = true
-		}
+	// Config created or modified: parse it. If it was removed, only fragments
+	// defined by cue sheets or derived from chapters remain, along with the
+	// settings inherited from ancestor configs.
+	configPath := w.scanner.fsPath(dir, dirConfigName)
+	config, err := LoadDirConfig(configPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("watcher: failed to parse dir config", "path", configPath, "error", err)
+		return false
 	}
+	config = inheritDirConfig(w.scanner.parentConfig(wr, dir), config, dir)
+	wr.Configs[dir] = config
 
-	// Pre-compute config file hash.
-	configHash, err := computeFullHash(absPath)
-	if err != nil {
-		slog.Warn("watcher: failed to hash dir config", "path", absPath, "error", err)
-		return
-	}
+	// List the audio files in the directory that fragments can be derived
+	// from, and the cue sheets that define them.
+	sources, cueSheets := w.dirFiles(wr, dir)
 
-	// Expand new fragments.
 	newFragments := make(map[string]bool)
-	sourceFragmentCount := make(map[string]int)
-
-	for i := range config.Fragments {
-		def := &config.Fragments[i]
-		sourceFile := def.Source
-		if !audioNameSet[sourceFile] {
-			slog.Warn("watcher: fragment source file not found",
-				"dir", dir, "source", sourceFile)
-			continue
-		}
-
-		sourceFragmentCount[sourceFile]++
-		fragIdx := sourceFragmentCount[sourceFile]
-		syntheticName := MakeFragmentName(sourceFile, fragIdx)
-		newFragments[syntheticName] = true
 
-		mtime := w.scanner.loadFragmentMtime(dir, sourceFile)
-
-		if existing, ok := existingFragments[syntheticName]; ok {
+	// diffFragment compares a resolved fragment with the existing track of
+	// the same name, if any.
+	diffFragment := func(entry FileInfo) {
+		entry.Mtime = trackMtime(config, entry.Name, entry.Mtime)
+		newFragments[entry.Name] = true
+		if existing, ok := existingFragments[entry.Name]; ok {
 			// Fragment exists — check if changed.
-			if existing.Mtime != mtime {
-				changes.Changed = append(changes.Changed, FileInfo{
-					Dir: dir, Name: syntheticName, Mtime: mtime,
-				})
+			if existing.Mtime != entry.Mtime {
+				changes.Changed = append(changes.Changed, entry)
 			}
 		} else {
 			// New fragment.
-			sourceHash, err := computePartialHash(w.scanner.fsPath(dir, sourceFile))
+			changes.Added = append(changes.Added, HashedFileInfo{
+				FileInfo: entry,
+				Hash:     wr.Fragments[JoinLibraryPath(dir, entry.Name)].hash,
+			})
+		}
+	}
+
+	// Expand new fragments.
+	fragmentedFiles := make(map[string]bool)
+	for _, entry := range w.scanner.resolveDirFragments(wr, dir, config, cueSheets, sources) {
+		fragmentedFiles[wr.Fragments[JoinLibraryPath(dir, entry.Name)].SourceFile] = true
+		diffFragment(entry)
+	}
+
+	// Expand chapters of files without fragments defined.
+	if config == nil || !config.IgnoreChapters {
+		for name, source := range sources {
+			if fragmentedFiles[name] {
+				continue
+			}
+			sourceHash, err := computePartialHash(w.scanner.fsPath(dir, name))
 			if err != nil {
-				slog.Warn("watcher: failed to hash fragment source", "dir", dir, "name", sourceFile, "error", err)
+				slog.Warn("watcher: failed to hash file", "dir", dir, "name", name, "error", err)
 				continue
 			}
-			fragHash := computeFragmentHash(configHash, sourceHash, fragIdx)
-			changes.Added = append(changes.Added, HashedFileInfo{
-				FileInfo: FileInfo{Dir: dir, Name: syntheticName, Mtime: mtime},
-				Hash:     fragHash,
-			})
+			for _, entry := range w.scanner.chapterFragments(wr, source, sourceHash) {
+				diffFragment(entry)
+			}
 		}
+	}
 
-		// Store resolved fragment for metadata collection.
-		libraryPath := JoinLibraryPath(dir, syntheticName)
-		sourceHash, _ := computePartialHash(w.scanner.fsPath(dir, sourceFile))
-		wr.Fragments[libraryPath] = resolvedFragment{
-			SourceFSPath: w.scanner.fsPath(dir, sourceFile),
-			SourceFile:   sourceFile,
-			Config:       def,
-			Index:        fragIdx,
-			hash:         computeFragmentHash(configHash, sourceHash, fragIdx),
+	// Apply the config's mtime to the directory's audio files, including
+	// those added or changed by this batch.
+	for name, source := range sources {
+		mtime := trackMtime(config, name, source.Mtime)
+		isSource := func(entry FileInfo) bool { return entry.Dir == dir && entry.Name == name }
+		if i := slices.IndexFunc(changes.Added, func(entry HashedFileInfo) bool {
+			return isSource(entry.FileInfo)
+		}); i >= 0 {
+			changes.Added[i].Mtime = mtime
+		} else if i := slices.IndexFunc(changes.Changed, isSource); i >= 0 {
+			changes.Changed[i].Mtime = mtime
+		} else if existing, ok := existingFiles[name]; ok && existing.Mtime != mtime {
+			changes.Changed = append(changes.Changed, FileInfo{Dir: dir, Name: name, Mtime: mtime})
 		}
 	}
 
-	// Remove fragments that no longer exist in the config.
+	// Remove fragments that no longer exist.
 	for name, t := range existingFragments {
 		if !newFragments[name] {
 			changes.Removed = append(changes.Removed, *t)
 		}
 	}
+	return true
 }
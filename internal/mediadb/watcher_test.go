@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/beakbeak/aurelius/pkg/aurelib"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -113,11 +114,12 @@ func TestEventCoalescing(t *testing.T) {
 			expected: map[string]eventKind{aPath: eventModified},
 		},
 		{
-			name: "hidden files are skipped",
+			// Hidden files are excluded when the batch is processed.
+			name: "hidden files are kept",
 			events: []fsnotify.Event{
 				{Name: hiddenPath, Op: fsnotify.Create},
 			},
-			expected: map[string]eventKind{},
+			expected: map[string]eventKind{hiddenPath: eventCreated},
 		},
 		{
 			name: "create for nonexistent file then remove is no-op",
@@ -877,6 +879,329 @@ func TestWatcherFragmentImageAdd(t *testing.T) {
 	}
 }
 
+func TestWatcherChapters(t *testing.T) {
+	_, db, _, tmpDir, batchApplied := setupWatcherTest(t)
+
+	// Mark chapters in a copy of the test file with Vorbis comments, outside
+	// of the library, before adding it.
+	srcData, err := os.ReadFile(filepath.Join(testMediaPath(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("failed to read source: %v", err)
+	}
+	chapteredPath := filepath.Join(t.TempDir(), "book.ogg")
+	if err := os.WriteFile(chapteredPath, srcData, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := aurelib.WriteTags(chapteredPath, map[string]string{
+		"CHAPTER001":     "00:00:00.000",
+		"CHAPTER001NAME": "Opening",
+		"CHAPTER002":     "00:00:05.000",
+		"CHAPTER002NAME": "Finale",
+	}); err != nil {
+		t.Fatalf("WriteTags failed: %v", err)
+	}
+	chapteredData, err := os.ReadFile(chapteredPath)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "book.ogg"), chapteredData, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	for i, title := range []string{"Opening", "Finale"} {
+		name := MakeFragmentName("book.ogg", i+1)
+		track, err := db.GetTrack(name)
+		if err != nil {
+			t.Fatalf("GetTrack error: %v", err)
+		}
+		if track == nil {
+			t.Fatalf("expected chapter %q to be in DB", name)
+		}
+		if track.Metadata.Fragment == nil || track.Metadata.Fragment.SourceFile != "book.ogg" {
+			t.Errorf("expected %q to be a fragment of book.ogg, got %+v", name, track.Metadata.Fragment)
+		}
+		if track.Tags["title"] != title {
+			t.Errorf("expected title of %q to be %q, got %q", name, title, track.Tags["title"])
+		}
+	}
+	if track, _ := db.GetTrack(MakeFragmentName("test.ogg", 1)); track != nil {
+		t.Error("expected no fragments of test.ogg, which has no chapters")
+	}
+
+	// Chapters can be ignored with the dir config.
+	if err := os.WriteFile(filepath.Join(tmpDir, "aurelius.yaml"), []byte("chapters: false\n"), 0o644); err != nil {
+		t.Fatalf("failed to write aurelius.yaml: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	for i := range 2 {
+		name := MakeFragmentName("book.ogg", i+1)
+		if track, err := db.GetTrack(name); err != nil {
+			t.Fatalf("GetTrack error: %v", err)
+		} else if track != nil {
+			t.Errorf("expected chapter %q to be removed", name)
+		}
+	}
+	if track, err := db.GetTrack("book.ogg"); err != nil || track == nil {
+		t.Error("expected book.ogg to still be in DB")
+	}
+}
+
+func TestWatcherCueSheet(t *testing.T) {
+	_, db, _, tmpDir, batchApplied := setupWatcherTest(t)
+
+	// The cue sheet names the file the album was ripped to, before it was
+	// converted.
+	cueContent := `PERFORMER "Cue Artist"
+TITLE "Cue Album"
+FILE "test.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two"
+    INDEX 01 00:02:00
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "album.cue"), []byte(cueContent), 0o644); err != nil {
+		t.Fatalf("failed to write album.cue: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	for i, title := range []string{"One", "Two"} {
+		name := MakeFragmentName("test.ogg", i+1)
+		track, err := db.GetTrack(name)
+		if err != nil {
+			t.Fatalf("GetTrack error: %v", err)
+		}
+		if track == nil {
+			t.Fatalf("expected fragment %q to be in DB", name)
+		}
+		if track.Metadata.Fragment == nil || track.Metadata.Fragment.SourceFile != "test.ogg" {
+			t.Errorf("expected %q to be a fragment of test.ogg, got %+v", name, track.Metadata.Fragment)
+		}
+		if track.Tags["title"] != title || track.Tags["album"] != "Cue Album" ||
+			track.Tags["artist"] != "Cue Artist" {
+			t.Errorf("unexpected tags for %q: %v", name, track.Tags)
+		}
+	}
+	track, err := db.GetTrack(MakeFragmentName("test.ogg", 1))
+	if err != nil || track == nil {
+		t.Fatal("expected the first fragment to be in DB")
+	}
+	if track.Metadata.Fragment.End != 2 {
+		t.Errorf("expected the first fragment to end where the second starts, got %v", track.Metadata.Fragment.End)
+	}
+
+	// Fragments defined in the dir config take precedence.
+	yamlContent := `fragments:
+  - source: test.ogg
+    start: 1s
+    title: From Config
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "aurelius.yaml"), []byte(yamlContent), 0o644); err != nil {
+		t.Fatalf("failed to write aurelius.yaml: %v", err)
+	}
+	// Ensure mtime is later than the cue sheet's so the watcher detects a change.
+	futureTime := time.Unix(track.Mtime+2, 0)
+	if err := os.Chtimes(filepath.Join(tmpDir, "aurelius.yaml"), futureTime, futureTime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	if track, err := db.GetTrack(MakeFragmentName("test.ogg", 1)); err != nil || track == nil {
+		t.Fatal("expected the first fragment to still be in DB")
+	} else if track.Tags["title"] != "From Config" {
+		t.Errorf("expected the fragment from the dir config, got title %q", track.Tags["title"])
+	}
+	if track, _ := db.GetTrack(MakeFragmentName("test.ogg", 2)); track != nil {
+		t.Error("expected the second cue sheet fragment to be removed")
+	}
+
+	// Removing the config and the cue sheet removes the fragments.
+	if err := os.Remove(filepath.Join(tmpDir, "aurelius.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tmpDir, "album.cue")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	if track, _ := db.GetTrack(MakeFragmentName("test.ogg", 1)); track != nil {
+		t.Error("expected fragments to be removed with the cue sheet")
+	}
+	if track, err := db.GetTrack("test.ogg"); err != nil || track == nil {
+		t.Error("expected test.ogg to still be in DB")
+	}
+}
+
+func TestWatcherDirConfigOverrides(t *testing.T) {
+	_, db, _, tmpDir, batchApplied := setupWatcherTest(t)
+
+	original, err := db.GetTrack("test.ogg")
+	if err != nil || original == nil {
+		t.Fatal("expected test.ogg to be in DB")
+	}
+
+	configPath := filepath.Join(tmpDir, "aurelius.yaml")
+	if err := os.WriteFile(configPath, []byte("album: Watched Album\n"), 0o644); err != nil {
+		t.Fatalf("failed to write aurelius.yaml: %v", err)
+	}
+	// Ensure mtime is later than the initial scan so the watcher detects a change.
+	futureTime := time.Unix(original.Mtime+2, 0)
+	if err := os.Chtimes(configPath, futureTime, futureTime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	track, err := db.GetTrack("test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected test.ogg to still be in DB")
+	}
+	if track.Tags["album"] != "Watched Album" {
+		t.Errorf("expected album to be overridden, got %q", track.Tags["album"])
+	}
+
+	// New files in the directory are also overridden.
+	srcData, err := os.ReadFile(filepath.Join(testMediaPath(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "copy.ogg"), srcData, 0o644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	track, err = db.GetTrack("copy.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected copy.ogg to be added to DB")
+	}
+	if track.Tags["album"] != "Watched Album" {
+		t.Errorf("expected album of new file to be overridden, got %q", track.Tags["album"])
+	}
+
+	// Removing the config restores the files' own tags.
+	if err := os.Remove(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	track, err = db.GetTrack("test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected test.ogg to still be in DB")
+	}
+	if track.Tags["album"] != original.Tags["album"] {
+		t.Errorf("expected album %q to be restored, got %q", original.Tags["album"], track.Tags["album"])
+	}
+}
+
+func TestWatcherInheritedDirConfig(t *testing.T) {
+	w, db, _, tmpDir, batchApplied := setupWatcherTest(t)
+
+	// Add a directory tree to configure from its top.
+	srcData, err := os.ReadFile(filepath.Join(testMediaPath(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	deeperDir := filepath.Join(tmpDir, "sub", "deeper")
+	if err := os.MkdirAll(deeperDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.ogg", "skip.ogg"} {
+		if err := os.WriteFile(filepath.Join(deeperDir, name), srcData, 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+	extrasDir := filepath.Join(tmpDir, "sub", "extras")
+	if err := os.MkdirAll(extrasDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(extrasDir, "test.ogg"), srcData, 0o644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	original, err := db.GetTrack("sub/deeper/test.ogg")
+	if err != nil || original == nil {
+		t.Fatal("expected sub/deeper/test.ogg to be added to DB")
+	}
+
+	configPath := filepath.Join(tmpDir, "sub", "aurelius.yaml")
+	if err := os.WriteFile(configPath, []byte(`genre: Inherited
+hidden: true
+exclude: [skip.ogg, extras]
+`), 0o644); err != nil {
+		t.Fatalf("failed to write aurelius.yaml: %v", err)
+	}
+	// Ensure mtime is later than the initial scan so the watcher detects a change.
+	futureTime := time.Unix(original.Mtime+2, 0)
+	if err := os.Chtimes(configPath, futureTime, futureTime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	track, err := db.GetTrack("sub/deeper/test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected sub/deeper/test.ogg to still be in DB")
+	}
+	if track.Tags["genre"] != "Inherited" {
+		t.Errorf("expected genre to be inherited, got %q", track.Tags["genre"])
+	}
+	if track, err := db.GetTrack("sub/deeper/skip.ogg"); err != nil || track != nil {
+		t.Error("expected sub/deeper/skip.ogg to be excluded")
+	}
+	dir, err := db.GetDir("sub/deeper")
+	if err != nil || dir == nil {
+		t.Fatal("expected sub/deeper to still be in DB")
+	}
+	if !dir.Hidden {
+		t.Error("expected sub/deeper to be hidden")
+	}
+	if track, err := db.GetTrack("sub/extras/test.ogg"); err != nil || track != nil {
+		t.Error("expected sub/extras/test.ogg to be excluded")
+	}
+	if w.watchedDirs[extrasDir] {
+		t.Error("expected excluded sub/extras not to be watched")
+	}
+
+	// Removing the config restores the descendants.
+	if err := os.Remove(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForBatch(t, batchApplied)
+
+	track, err = db.GetTrack("sub/deeper/test.ogg")
+	if err != nil || track == nil {
+		t.Fatal("expected sub/deeper/test.ogg to still be in DB")
+	}
+	if track.Tags["genre"] != original.Tags["genre"] {
+		t.Errorf("expected genre %q to be restored, got %q", original.Tags["genre"], track.Tags["genre"])
+	}
+	if track, err := db.GetTrack("sub/deeper/skip.ogg"); err != nil || track == nil {
+		t.Error("expected sub/deeper/skip.ogg to be added again")
+	}
+	if dir, err := db.GetDir("sub/deeper"); err != nil || dir == nil || dir.Hidden {
+		t.Error("expected sub/deeper to be visible")
+	}
+	if track, err := db.GetTrack("sub/extras/test.ogg"); err != nil || track == nil {
+		t.Error("expected sub/extras/test.ogg to be added again")
+	}
+	if !w.watchedDirs[extrasDir] {
+		t.Error("expected sub/extras to be watched again")
+	}
+}
+
 func TestWatcherBatchCallback(t *testing.T) {
 	_, _, _, tmpDir, batchApplied := setupWatcherTest(t)
 
@@ -0,0 +1,61 @@
+package mediadb
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/beakbeak/aurelius/pkg/aurelib"
+)
+
+// Peaks are stored as pairs of little-endian 16-bit signed integers, with full
+// scale mapped to ±peakScale.
+const peakScale = math.MaxInt16
+
+// GetWaveform returns the cached full-resolution waveform of the track with the
+// given hash, as recorded by aurelib.WaveformMeter.Blocks. Returns (nil, nil)
+// if not found.
+func (db *DB) GetWaveform(hash []byte) ([]aurelib.Peak, error) {
+	var data []byte
+	err := db.db.QueryRow(`SELECT peaks FROM waveforms WHERE hash = ?`, hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data)%4 != 0 {
+		return nil, fmt.Errorf("invalid waveform data length: %v", len(data))
+	}
+
+	peaks := make([]aurelib.Peak, len(data)/4)
+	for i := range peaks {
+		peaks[i].Min = decodePeakValue(data[i*4:])
+		peaks[i].Max = decodePeakValue(data[i*4+2:])
+	}
+	return peaks, nil
+}
+
+// SaveWaveform caches the full-resolution waveform of the track with the given
+// hash. It is removed when no track has the hash any longer.
+func (db *DB) SaveWaveform(hash []byte, peaks []aurelib.Peak) error {
+	data := make([]byte, 0, len(peaks)*4)
+	for _, peak := range peaks {
+		data = binary.LittleEndian.AppendUint16(data, encodePeakValue(peak.Min))
+		data = binary.LittleEndian.AppendUint16(data, encodePeakValue(peak.Max))
+	}
+	_, err := db.db.Exec(
+		`INSERT OR REPLACE INTO waveforms (hash, peaks) VALUES (?, ?)`,
+		hash, data,
+	)
+	return err
+}
+
+func encodePeakValue(value float32) uint16 {
+	clamped := max(min(float64(value), 1), -1)
+	return uint16(int16(math.Round(clamped * peakScale)))
+}
+
+func decodePeakValue(data []byte) float32 {
+	return float32(int16(binary.LittleEndian.Uint16(data))) / peakScale
+}
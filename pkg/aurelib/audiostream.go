@@ -0,0 +1,188 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <libavformat/avformat.h>
+#include <libavcodec/codec_desc.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// An AudioStream describes one of the audio streams in a media file.
+type AudioStream struct {
+	Index        int      // The position of the stream among the file's audio streams.
+	Language     string   // The stream's language tag (usually ISO 639-2), if any.
+	Title        string   // The stream's title, if any.
+	Dispositions []string // Names of the stream's disposition flags ("default", "comment", etc.).
+	CodecName    string   // The name of the stream's codec.
+	StreamInfo   StreamInfo
+}
+
+// A SourceOption changes how a Source is opened.
+type SourceOption func(*sourceOptions)
+
+type sourceOptions struct {
+	streamIndex int // -1 if any
+	language    string
+	disposition string
+}
+
+// WithAudioStream selects the audio stream at the given position among the
+// file's audio streams (see AudioStream.Index).
+func WithAudioStream(index int) SourceOption {
+	return func(options *sourceOptions) {
+		options.streamIndex = index
+	}
+}
+
+// WithLanguage selects the first audio stream with the given language tag. The
+// comparison is case-insensitive.
+func WithLanguage(language string) SourceOption {
+	return func(options *sourceOptions) {
+		options.language = language
+	}
+}
+
+// WithDisposition selects the first audio stream with the given disposition
+// flag, named as by FFmpeg (e.g., "default", "comment", "visual_impaired").
+func WithDisposition(disposition string) SourceOption {
+	return func(options *sourceOptions) {
+		options.disposition = disposition
+	}
+}
+
+func newSourceOptions(options []SourceOption) sourceOptions {
+	result := sourceOptions{streamIndex: -1}
+	for _, option := range options {
+		option(&result)
+	}
+	return result
+}
+
+func (options *sourceOptions) String() string {
+	var criteria []string
+	if options.streamIndex >= 0 {
+		criteria = append(criteria, fmt.Sprintf("index %v", options.streamIndex))
+	}
+	if options.language != "" {
+		criteria = append(criteria, fmt.Sprintf("language %q", options.language))
+	}
+	if options.disposition != "" {
+		criteria = append(criteria, fmt.Sprintf("disposition %q", options.disposition))
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// selectAudioStream returns the first audio stream in formatCtx that matches
+// options, along with its position among the audio streams.
+func (options *sourceOptions) selectAudioStream(
+	formatCtx *C.AVFormatContext,
+) (*C.AVStream, int, error) {
+	dispositionFlag := C.int(0)
+	if options.disposition != "" {
+		cDisposition := C.CString(options.disposition)
+		defer C.free(unsafe.Pointer(cDisposition))
+		if dispositionFlag = C.av_disposition_from_string(cDisposition); dispositionFlag < 0 {
+			return nil, 0, fmt.Errorf("unknown disposition: %v", options.disposition)
+		}
+	}
+
+	var selected *C.AVStream
+	selectedIndex := 0
+	audioIndex := 0
+	forEachStream(formatCtx, func(stream *C.AVStream) bool {
+		if stream.codecpar.codec_type != C.AVMEDIA_TYPE_AUDIO {
+			return true
+		}
+		index := audioIndex
+		audioIndex++
+
+		if options.streamIndex >= 0 && index != options.streamIndex {
+			return true
+		}
+		if options.language != "" &&
+			!strings.EqualFold(dictGet(stream.metadata, "language"), options.language) {
+			return true
+		}
+		if dispositionFlag != 0 && stream.disposition&dispositionFlag == 0 {
+			return true
+		}
+		selected, selectedIndex = stream, index
+		return false
+	})
+
+	if audioIndex == 0 {
+		return nil, 0, fmt.Errorf("no audio streams")
+	}
+	if selected == nil {
+		return nil, 0, fmt.Errorf("no audio stream matching %v", options)
+	}
+	return selected, selectedIndex, nil
+}
+
+// dictGet returns the value of key in dict, or "" if there is none.
+func dictGet(dict *C.AVDictionary, key string) string {
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	if entry := C.av_dict_get(dict, cKey, nil, 0); entry != nil {
+		return C.GoString(entry.value)
+	}
+	return ""
+}
+
+// dispositionNames returns the names of the flags set in disposition.
+func dispositionNames(disposition C.int) []string {
+	var names []string
+	for bit := 0; bit < 32; bit++ {
+		flag := C.int(1) << bit
+		if disposition&flag == 0 {
+			continue
+		}
+		if name := C.av_disposition_to_string(flag); name != nil {
+			names = append(names, C.GoString(name))
+		}
+	}
+	return names
+}
+
+// AudioStreams returns a description of each audio stream in the file, in
+// order. AudioStreamIndex identifies the stream being decoded.
+func (src *sourceBase) AudioStreams() []AudioStream {
+	var streams []AudioStream
+	forEachStream(src.formatCtx, func(stream *C.AVStream) bool {
+		params := stream.codecpar
+		if params.codec_type != C.AVMEDIA_TYPE_AUDIO {
+			return true
+		}
+		var codecName string
+		if desc := C.avcodec_descriptor_get(params.codec_id); desc != nil {
+			codecName = C.GoString(desc.name)
+		}
+		streams = append(streams, AudioStream{
+			Index:        len(streams),
+			Language:     dictGet(stream.metadata, "language"),
+			Title:        dictGet(stream.metadata, "title"),
+			Dispositions: dispositionNames(stream.disposition),
+			CodecName:    codecName,
+			StreamInfo: StreamInfo{
+				SampleRate:    uint(params.sample_rate),
+				sampleFormat:  params.format,
+				channelLayout: channelLayoutToString(&params.ch_layout),
+			},
+		})
+		return true
+	})
+	return streams
+}
+
+// AudioStreamIndex returns the position among the file's audio streams (see
+// AudioStream.Index) of the stream being decoded.
+func (src *sourceBase) AudioStreamIndex() int {
+	return src.streamIndex
+}
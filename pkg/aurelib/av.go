@@ -8,6 +8,9 @@ Fixed-size Frames containing raw audio data are pulled from the Fifo and then
 passed to a Sink for encoding. A FileSink will write encoded data to disk, and a
 BufferSink will store encoded data in memory.
 
+Alternatively, encoded Packets can be read from a Source without decoding and
+passed to a BufferRemuxer, which stores them in a different container format.
+
 Where noted, some objects are backed by heap-allocated C data structures and
 must be destroyed with the Destroy method before being discarded.
 */
@@ -48,6 +51,16 @@ logCallback(
 	logMessage(level, buffer);
 }
 
+static int64_t
+avNoPtsValue() {
+	return AV_NOPTS_VALUE;
+}
+
+static AVDictionaryEntry*
+dictNext(AVDictionary* dict, AVDictionaryEntry* prev) {
+	return av_dict_get(dict, "", prev, AV_DICT_IGNORE_SUFFIX);
+}
+
 static void
 setLogCallback() {
 	av_log_set_callback(logCallback);
@@ -71,6 +84,7 @@ gatherInputExtensions() {
 import "C"
 import (
 	"fmt"
+	"maps"
 	"slices"
 	"strings"
 	"time"
@@ -79,6 +93,10 @@ import (
 
 var (
 	inputExtensions []string
+
+	// noPtsValue is FFmpeg's AV_NOPTS_VALUE, which marks an unknown
+	// timestamp.
+	noPtsValue = C.avNoPtsValue()
 )
 
 func init() {
@@ -121,6 +139,51 @@ func withChannelLayout(layoutStr string, f func(layout *C.AVChannelLayout)) {
 	f(&layout)
 }
 
+// newDictionary creates an AVDictionary containing the key/value pairs in
+// entries. The result must be freed with av_dict_free.
+func newDictionary(entries map[string]string) (*C.AVDictionary, error) {
+	var dict *C.AVDictionary
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		cKey := C.CString(key)
+		cValue := C.CString(entries[key])
+		err := C.av_dict_set(&dict, cKey, cValue, 0)
+		C.free(unsafe.Pointer(cKey))
+		C.free(unsafe.Pointer(cValue))
+		if err < 0 {
+			C.av_dict_free(&dict)
+			return nil, fmt.Errorf("failed to set option '%v': %v", key, avErr2Str(err))
+		}
+	}
+	return dict, nil
+}
+
+// dictionaryKeys returns the keys of all entries in an AVDictionary.
+func dictionaryKeys(dict *C.AVDictionary) []string {
+	var keys []string
+	var entry *C.AVDictionaryEntry
+	for {
+		if entry = C.dictNext(dict, entry); entry == nil {
+			break
+		}
+		keys = append(keys, C.GoString(entry.key))
+	}
+	return keys
+}
+
+// dictionaryEntries returns the key/value pairs of all entries in an
+// AVDictionary.
+func dictionaryEntries(dict *C.AVDictionary) map[string]string {
+	entries := make(map[string]string)
+	var entry *C.AVDictionaryEntry
+	for {
+		if entry = C.dictNext(dict, entry); entry == nil {
+			break
+		}
+		entries[C.GoString(entry.key)] = C.GoString(entry.value)
+	}
+	return entries
+}
+
 // A StreamInfo contains properties of an audio stream.
 type StreamInfo struct {
 	SampleRate uint // The stream's sample rate in Hz.
@@ -145,6 +208,21 @@ func (info *StreamInfo) channelCount() C.int {
 	return count
 }
 
+// ChannelCount returns the number of audio channels in the stream.
+func (info *StreamInfo) ChannelCount() uint {
+	return uint(info.channelCount())
+}
+
+// BytesPerSample returns the size in bytes of a single sample of a single
+// channel in the stream's sample format, or 0 if the size is unknown.
+func (info *StreamInfo) BytesPerSample() uint {
+	size := C.av_get_bytes_per_sample(C.enum_AVSampleFormat(info.sampleFormat))
+	if size < 0 {
+		return 0
+	}
+	return uint(size)
+}
+
 // ChannelLayout returns the stream's channel layout in a form that can be
 // assigned to SinkConfig.ChannelLayout. It is not human-readable.
 func (info *StreamInfo) ChannelLayout() string {
@@ -187,6 +265,60 @@ func (frame Frame) IsEmpty() bool {
 	return frame.frame == nil || frame.Size == 0
 }
 
+// float32Samples returns the audio data of a Frame in packed 32-bit float
+// format ("flt") with the given number of channels, without copying it.
+func (frame Frame) float32Samples(channelCount uint) []float32 {
+	return unsafe.Slice((*float32)(unsafe.Pointer(frame.frame.data[0])), frame.Size*channelCount)
+}
+
+// A Packet contains encoded audio data read from a Source by
+// Source.ReadPacket.
+//
+// It is backed by a heap-allocated C data structure, so it must be destroyed
+// with Destroy or passed to a function that takes ownership, such as
+// BufferRemuxer.WritePacket.
+type Packet struct {
+	packet   *C.AVPacket
+	timeBase C.AVRational
+}
+
+// Destroy frees C heap memory used by the Packet.
+func (packet Packet) Destroy() {
+	if packet.packet != nil {
+		C.av_packet_free(&packet.packet)
+	}
+}
+
+// StartTime returns the stream time offset of the start of the Packet's
+// audio, or 0 if it is unknown.
+func (packet Packet) StartTime() time.Duration {
+	if packet.packet == nil {
+		return 0
+	}
+	if packet.packet.pts != noPtsValue {
+		return durationFromTimeBase(packet.packet.pts, packet.timeBase)
+	}
+	if packet.packet.dts != noPtsValue {
+		return durationFromTimeBase(packet.packet.dts, packet.timeBase)
+	}
+	return 0
+}
+
+// Duration returns the duration of the Packet's audio, or 0 if it is unknown.
+func (packet Packet) Duration() time.Duration {
+	if packet.packet == nil || packet.packet.duration <= 0 {
+		return 0
+	}
+	return durationFromTimeBase(packet.packet.duration, packet.timeBase)
+}
+
+// CodecParameters describes the encoding of an audio stream. It is used to
+// set up a BufferRemuxer to receive a Source's Packets.
+type CodecParameters struct {
+	params   *C.AVCodecParameters
+	timeBase C.AVRational
+}
+
 func durationToTimeBase(
 	duration time.Duration,
 	timeBase C.AVRational,
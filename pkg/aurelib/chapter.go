@@ -0,0 +1,81 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavutil
+
+#include <libavformat/avformat.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// A Chapter is a section of a file marked by its container, such as a chapter
+// of an audiobook or a track of a DJ mix.
+type Chapter struct {
+	Start time.Duration
+	End   time.Duration // 0 if the chapter lasts until the end of the file
+
+	// Tags holds metadata describing the chapter, usually including its title.
+	Tags map[string]string
+}
+
+// Chapters returns the chapters marked in the Source's container, ordered by
+// start time. The result is empty if the file has no chapters.
+func (src *sourceBase) Chapters() []Chapter {
+	return chaptersFromFormat(src.formatCtx)
+}
+
+// ReadChapters returns the chapters marked in the file at path, ordered by
+// start time. It only reads the file's header, so it is much faster than
+// opening the file with NewFileSource.
+func ReadChapters(path string) ([]Chapter, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var formatCtx *C.AVFormatContext
+	if err := C.avformat_open_input(&formatCtx, cPath, nil, nil); err < 0 {
+		return nil, fmt.Errorf("failed to open file: %v", avErr2Str(err))
+	}
+	defer C.avformat_close_input(&formatCtx)
+
+	return chaptersFromFormat(formatCtx), nil
+}
+
+func chaptersFromFormat(formatCtx *C.AVFormatContext) []Chapter {
+	avChapters := unsafe.Slice(formatCtx.chapters, formatCtx.nb_chapters)
+	chapters := make([]Chapter, 0, len(avChapters))
+	for _, avChapter := range avChapters {
+		chapter := Chapter{
+			Start: durationFromTimeBase(avChapter.start, avChapter.time_base),
+			Tags:  dictionaryEntries(avChapter.metadata),
+		}
+		// Some formats only mark where each chapter starts.
+		if avChapter.end != noPtsValue && avChapter.end > avChapter.start {
+			chapter.End = durationFromTimeBase(avChapter.end, avChapter.time_base)
+		}
+		chapters = append(chapters, chapter)
+	}
+
+	slices.SortStableFunc(chapters, func(a, b Chapter) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	for i := range chapters {
+		if chapters[i].End == 0 && i+1 < len(chapters) {
+			chapters[i].End = chapters[i+1].Start
+		}
+	}
+	if last := len(chapters) - 1; last >= 0 && formatCtx.duration > 0 {
+		// a last chapter ending at the end of the file lasts until the end
+		duration := durationFromTimeBase(formatCtx.duration, C.AVRational{1, C.AV_TIME_BASE})
+		if chapters[last].End >= duration {
+			chapters[last].End = 0
+		}
+	}
+	return chapters
+}
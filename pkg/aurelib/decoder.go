@@ -0,0 +1,187 @@
+package aurelib
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A Decoder decodes audio data from a Source and converts it to the format of
+// a Sink, collecting it in a Fifo. It performs the decoding half of Transcode
+// for callers that consume the audio themselves, such as to mix several
+// Sources into one stream. Additional outputs in other formats may be added
+// with AddOutput, so that a Source is decoded only once for several Sinks.
+type Decoder struct {
+	// DecodeError, if not nil, is called with each recoverable error returned
+	// by Source.Decode. Decoding continues after such errors.
+	DecodeError func(err error)
+
+	src       Source
+	startTime time.Duration
+	outputs   []*decoderOutput
+
+	done bool
+	err  error // a non-recoverable decoding error
+}
+
+// decoderOutput holds the audio decoded by a Decoder in one output format.
+type decoderOutput struct {
+	resampler *Resampler
+	fifo      *Fifo
+
+	startSample    int64 // first sample to be produced
+	sampleRate     float64
+	discardSamples int64 // decoded samples still to be discarded; -1 if unknown
+}
+
+// NewDecoder creates a Decoder that converts the output of src to the format
+// described by streamInfo, applying a linear gain of volume.
+//
+// If startTime is nonzero, the Source is seeked to startTime, and any samples
+// decoded before it are discarded, so that decoding starts precisely at
+// startTime regardless of where seeking lands. Otherwise, decoding starts at
+// the Source's current position.
+//
+// The Decoder is backed by heap-allocated C data structures, so it must be
+// destroyed with Destroy before it is discarded. Destroy doesn't destroy the
+// Source.
+func NewDecoder(
+	src Source,
+	streamInfo StreamInfo,
+	volume float64,
+	startTime time.Duration,
+) (*Decoder, error) {
+	if startTime > 0 {
+		if err := src.SeekTo(startTime); err != nil {
+			return nil, fmt.Errorf("seek failed: %w", err)
+		}
+	}
+
+	d := &Decoder{
+		src:       src,
+		startTime: startTime,
+	}
+	if _, err := d.AddOutput(streamInfo, volume); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// AddOutput adds an output to the Decoder that converts the output of the
+// Source to the format described by streamInfo, applying a linear gain of
+// volume, and returns the Fifo in which it is collected. The caller must
+// consume audio from every output's Fifo, since Fill only considers the first.
+// AddOutput must be called before Fill.
+func (d *Decoder) AddOutput(streamInfo StreamInfo, volume float64) (*Fifo, error) {
+	out := &decoderOutput{
+		sampleRate: float64(streamInfo.SampleRate),
+	}
+	out.startSample = int64(math.Round(d.startTime.Seconds() * out.sampleRate))
+	if d.startTime > 0 {
+		out.discardSamples = -1 // unknown until the first frame is received
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			out.destroy()
+		}
+	}()
+
+	var err error
+	if out.fifo, err = NewFifo(streamInfo); err != nil {
+		return nil, fmt.Errorf("failed to create FIFO: %w", err)
+	}
+	if out.resampler, err = NewResampler(); err != nil {
+		return nil, fmt.Errorf("failed to create resampler: %w", err)
+	}
+	if err := out.resampler.Setup(d.src.StreamInfo(), streamInfo, volume); err != nil {
+		return nil, fmt.Errorf("failed to setup resampler: %w", err)
+	}
+
+	success = true
+	d.outputs = append(d.outputs, out)
+	return out.fifo, nil
+}
+
+// Destroy frees the resources held by the Decoder. The Source is not
+// destroyed.
+func (d *Decoder) Destroy() {
+	for _, out := range d.outputs {
+		out.destroy()
+	}
+	d.outputs = nil
+}
+
+func (out *decoderOutput) destroy() {
+	if out.resampler != nil {
+		out.resampler.Destroy()
+		out.resampler = nil
+	}
+	if out.fifo != nil {
+		out.fifo.Destroy()
+		out.fifo = nil
+	}
+}
+
+// Fifo returns the Fifo holding the audio decoded so far for the output
+// created by NewDecoder. The caller consumes audio by reading from it.
+func (d *Decoder) Fifo() *Fifo {
+	return d.outputs[0].fifo
+}
+
+// Done returns true when the end of the Source has been reached, or when it
+// can't be read any further (see Err).
+func (d *Decoder) Done() bool {
+	return d.done
+}
+
+// Err returns the non-recoverable error that stopped decoding, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Fill decodes audio until the Fifo returned by Fifo holds at least
+// sampleCount samples or decoding is done. An error is returned if decoded audio can't be received or
+// converted, in which case the Decoder shouldn't be used again.
+func (d *Decoder) Fill(sampleCount uint) error {
+	for !d.done && d.Fifo().Size() < sampleCount {
+		if recoverable, err := d.src.Decode(); err != nil {
+			if !recoverable {
+				d.err = err
+				d.done = true
+				return nil
+			}
+			if d.DecodeError != nil {
+				d.DecodeError(err)
+			}
+		}
+
+		for {
+			receiveStatus, err := d.src.ReceiveFrame()
+			if err != nil {
+				return fmt.Errorf("failed to receive frame: %w", err)
+			}
+			if receiveStatus == ReceiveFrameEof {
+				d.done = true
+				return nil
+			}
+			if receiveStatus != ReceiveFrameCopyAndCallAgain {
+				break
+			}
+
+			for _, out := range d.outputs {
+				if out.discardSamples < 0 {
+					frameSample := int64(math.Round(d.src.FrameStartTime().Seconds() * out.sampleRate))
+					out.discardSamples = max(out.startSample-frameSample, 0)
+				}
+
+				if err := d.src.ResampleFrame(out.resampler, out.fifo); err != nil {
+					return fmt.Errorf("failed to copy frame to output: %w", err)
+				}
+				out.discardSamples -= int64(out.fifo.Drain(uint(out.discardSamples)))
+			}
+		}
+	}
+	return nil
+}
@@ -49,6 +49,19 @@ func (fifo *Fifo) Size() uint {
 	return uint(C.av_audio_fifo_size(fifo.fifo))
 }
 
+// Drain discards at most the first sampleCount samples from the Fifo's audio
+// buffer. It returns the number of samples discarded.
+func (fifo *Fifo) Drain(sampleCount uint) uint {
+	sampleCount = min(sampleCount, fifo.Size())
+	if sampleCount == 0 {
+		return 0
+	}
+	if C.av_audio_fifo_drain(fifo.fifo, C.int(sampleCount)) < 0 {
+		return 0
+	}
+	return sampleCount
+}
+
 func (fifo *Fifo) read(
 	data *unsafe.Pointer,
 	sampleCount C.int,
@@ -63,6 +76,21 @@ func (fifo *Fifo) write(
 	return C.av_audio_fifo_write(fifo.fifo, data, sampleCount)
 }
 
+// WriteFrame appends the audio data contained in a Frame to the Fifo's audio
+// buffer. The Frame must be in the format accepted by the Fifo. The caller
+// retains ownership of the Frame.
+func (fifo *Fifo) WriteFrame(frame Frame) error {
+	if frame.IsEmpty() {
+		return nil
+	}
+	if fifo.write(
+		(*unsafe.Pointer)(unsafe.Pointer(frame.frame.extended_data)), C.int(frame.Size),
+	) < C.int(frame.Size) {
+		return fmt.Errorf("failed to write data to FIFO")
+	}
+	return nil
+}
+
 // ReadFrame removes at most maxFrameSize samples from the Fifo's audio buffer
 // and returns them in a Frame object.
 //
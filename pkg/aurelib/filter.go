@@ -0,0 +1,248 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavfilter libavutil
+
+#include <libavfilter/avfilter.h>
+#include <libavfilter/buffersink.h>
+#include <libavfilter/buffersrc.h>
+#include <libavutil/opt.h>
+#include <stdlib.h>
+
+static int
+avErrorEOF() {
+	return AVERROR_EOF;
+}
+
+static int
+avErrorEAGAIN() {
+	return AVERROR(EAGAIN);
+}
+
+static int
+setupBufferSource(
+	AVFilterContext* ctx,
+	enum AVSampleFormat sampleFormat,
+	int sampleRate,
+	char const* channelLayout
+) {
+	AVRational timeBase = {1, sampleRate};
+	int err;
+	if ((err = av_opt_set(ctx, "channel_layout", channelLayout, AV_OPT_SEARCH_CHILDREN)) < 0
+		|| (err = av_opt_set_sample_fmt(ctx, "sample_fmt", sampleFormat, AV_OPT_SEARCH_CHILDREN)) < 0
+		|| (err = av_opt_set_int(ctx, "sample_rate", sampleRate, AV_OPT_SEARCH_CHILDREN)) < 0
+		|| (err = av_opt_set_q(ctx, "time_base", timeBase, AV_OPT_SEARCH_CHILDREN)) < 0
+	) {
+		return err;
+	}
+	return avfilter_init_str(ctx, NULL);
+}
+
+static int
+setupBufferSink(
+	AVFilterContext* ctx,
+	enum AVSampleFormat sampleFormat,
+	int sampleRate,
+	char const* channelLayout
+) {
+	enum AVSampleFormat sampleFormats[] = {sampleFormat, AV_SAMPLE_FMT_NONE};
+	int sampleRates[] = {sampleRate, -1};
+	int err;
+	if ((err = av_opt_set_int_list(
+			ctx, "sample_fmts", sampleFormats, AV_SAMPLE_FMT_NONE, AV_OPT_SEARCH_CHILDREN)) < 0
+		|| (err = av_opt_set_int_list(
+			ctx, "sample_rates", sampleRates, -1, AV_OPT_SEARCH_CHILDREN)) < 0
+		|| (err = av_opt_set(ctx, "ch_layouts", channelLayout, AV_OPT_SEARCH_CHILDREN)) < 0
+	) {
+		return err;
+	}
+	return avfilter_init_str(ctx, NULL);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// A FilterGraph processes unencoded audio data with a graph of FFmpeg filters
+// (libavfilter). It accepts and produces audio data in the same format, so it
+// can be placed between the Fifo filled by Source.ResampleFrame and a Sink.
+type FilterGraph struct {
+	graph      *C.AVFilterGraph
+	src        *C.AVFilterContext // "abuffer" filter receiving input Frames
+	sink       *C.AVFilterContext // "abuffersink" filter producing output
+	frame      *C.AVFrame         // holds output from sink
+	streamInfo StreamInfo
+	pts        int64             // the timestamp of the next input Frame
+	metadata   map[string]string // metadata of the last output Frame
+}
+
+// Destroy frees any resources held by the FilterGraph so that it may be
+// discarded.
+func (g *FilterGraph) Destroy() {
+	if g.frame != nil {
+		C.av_frame_free(&g.frame)
+	}
+	if g.graph != nil {
+		C.avfilter_graph_free(&g.graph) // frees src and sink
+	}
+}
+
+// NewFilterGraph creates a FilterGraph from a filter description in the syntax
+// used by FFmpeg's -af option (e.g., "loudnorm", "atempo=1.25", or
+// "equalizer=f=100:t=q:w=1:g=6,dynaudnorm"). Audio data is passed to the
+// graph and returned from it in the format described by info.
+//
+// The FilterGraph is backed by a heap-allocated C data structure, so it must
+// be destroyed with Destroy before it is discarded.
+func NewFilterGraph(spec string, info StreamInfo) (*FilterGraph, error) {
+	if spec == "" {
+		spec = "anull"
+	}
+
+	success := false
+	g := &FilterGraph{streamInfo: info}
+	defer func() {
+		if !success {
+			g.Destroy()
+		}
+	}()
+
+	if g.graph = C.avfilter_graph_alloc(); g.graph == nil {
+		return nil, fmt.Errorf("failed to allocate filter graph")
+	}
+	if g.frame = C.av_frame_alloc(); g.frame == nil {
+		return nil, fmt.Errorf("failed to allocate frame")
+	}
+
+	cChannelLayout := C.CString(info.channelLayout)
+	defer C.free(unsafe.Pointer(cChannelLayout))
+
+	var err error
+	if g.src, err = g.allocFilter("abuffer", "in"); err != nil {
+		return nil, err
+	}
+	if avErr := C.setupBufferSource(
+		g.src, info.sampleFormat, C.int(info.SampleRate), cChannelLayout,
+	); avErr < 0 {
+		return nil, fmt.Errorf("failed to set up filter input: %v", avErr2Str(avErr))
+	}
+
+	if g.sink, err = g.allocFilter("abuffersink", "out"); err != nil {
+		return nil, err
+	}
+	if avErr := C.setupBufferSink(
+		g.sink, info.sampleFormat, C.int(info.SampleRate), cChannelLayout,
+	); avErr < 0 {
+		return nil, fmt.Errorf("failed to set up filter output: %v", avErr2Str(avErr))
+	}
+
+	// the unconnected input and output of the parsed graph are connected to
+	// src and sink
+	outputs := C.avfilter_inout_alloc()
+	inputs := C.avfilter_inout_alloc()
+	defer C.avfilter_inout_free(&outputs)
+	defer C.avfilter_inout_free(&inputs)
+	if outputs == nil || inputs == nil {
+		return nil, fmt.Errorf("failed to allocate filter graph endpoints")
+	}
+	cIn := C.CString("in")
+	defer C.free(unsafe.Pointer(cIn))
+	cOut := C.CString("out")
+	defer C.free(unsafe.Pointer(cOut))
+	outputs.name = C.av_strdup(cIn)
+	outputs.filter_ctx = g.src
+	inputs.name = C.av_strdup(cOut)
+	inputs.filter_ctx = g.sink
+
+	cSpec := C.CString(spec)
+	defer C.free(unsafe.Pointer(cSpec))
+	if avErr := C.avfilter_graph_parse_ptr(g.graph, cSpec, &inputs, &outputs, nil); avErr < 0 {
+		return nil, fmt.Errorf("failed to parse filter graph %q: %v", spec, avErr2Str(avErr))
+	}
+	if avErr := C.avfilter_graph_config(g.graph, nil); avErr < 0 {
+		return nil, fmt.Errorf("failed to configure filter graph %q: %v", spec, avErr2Str(avErr))
+	}
+
+	success = true
+	return g, nil
+}
+
+func (g *FilterGraph) allocFilter(filterName, name string) (*C.AVFilterContext, error) {
+	cFilterName := C.CString(filterName)
+	defer C.free(unsafe.Pointer(cFilterName))
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	filter := C.avfilter_get_by_name(cFilterName)
+	if filter == nil {
+		return nil, fmt.Errorf("filter not found: %v", filterName)
+	}
+	ctx := C.avfilter_graph_alloc_filter(g.graph, filter, cName)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to allocate filter: %v", filterName)
+	}
+	return ctx, nil
+}
+
+// StreamInfo returns an object describing the format of audio data accepted
+// and produced by the FilterGraph.
+func (g *FilterGraph) StreamInfo() StreamInfo {
+	return g.streamInfo
+}
+
+// WriteFrame passes a Frame to the FilterGraph. The Frame must be in the format
+// described by StreamInfo. The caller retains ownership of the Frame.
+//
+// Passing an empty Frame marks the end of the input, so that filters that
+// buffer audio data can produce the rest of their output. No more Frames
+// should be written afterward.
+func (g *FilterGraph) WriteFrame(frame Frame) error {
+	if frame.IsEmpty() {
+		if err := C.av_buffersrc_add_frame(g.src, nil); err < 0 {
+			return fmt.Errorf("failed to flush filter graph: %v", avErr2Str(err))
+		}
+		return nil
+	}
+
+	frame.frame.pts = C.int64_t(g.pts)
+	g.pts += int64(frame.Size)
+	if err := C.av_buffersrc_write_frame(g.src, frame.frame); err < 0 {
+		return fmt.Errorf("failed to write frame to filter graph: %v", avErr2Str(err))
+	}
+	return nil
+}
+
+// ReadFrames transfers all of the audio data available from the FilterGraph to
+// fifo, which must accept the format described by StreamInfo. It returns true
+// once the FilterGraph has produced all of its output after the end of the
+// input was marked by WriteFrame.
+func (g *FilterGraph) ReadFrames(fifo *Fifo) (done bool, _ error) {
+	for {
+		err := C.av_buffersink_get_frame(g.sink, g.frame)
+		if err == C.avErrorEAGAIN() {
+			return false, nil
+		} else if err == C.avErrorEOF() {
+			return true, nil
+		} else if err < 0 {
+			return false, fmt.Errorf("failed to read frame from filter graph: %v", avErr2Str(err))
+		}
+
+		if g.frame.metadata != nil {
+			g.metadata = dictionaryEntries(g.frame.metadata)
+		}
+		sampleCount := g.frame.nb_samples
+		written := fifo.write((*unsafe.Pointer)(unsafe.Pointer(g.frame.extended_data)), sampleCount)
+		C.av_frame_unref(g.frame)
+		if written < sampleCount {
+			return false, fmt.Errorf("failed to write data to FIFO")
+		}
+	}
+}
+
+// Metadata returns the metadata attached by filters (such as "ebur128") to the
+// last Frame read with ReadFrames that had any.
+func (g *FilterGraph) Metadata() map[string]string {
+	return g.metadata
+}
@@ -0,0 +1,222 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavutil
+
+#include <libavutil/samplefmt.h>
+*/
+import "C"
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// FingerprintDuration is the length of audio from the start of a track that
+// is needed for a fingerprint. Audio passed to a FingerprintMeter beyond it is
+// still measured, but the measurement can be stopped there with
+// TranscodeOptions.EndTime.
+const FingerprintDuration = 120 * time.Second
+
+const (
+	fingerprintSampleRate   = 11025
+	fingerprintFrameSize    = 4096 // samples per analyzed frame
+	fingerprintHopSize      = 1024 // samples between the starts of frames
+	fingerprintBandCount    = 33   // frequency bands compared by each frame
+	fingerprintMinFrequency = 300.
+	fingerprintMaxFrequency = 2000.
+
+	// fingerprintMaxOffset is the number of frames by which two fingerprints
+	// may be shifted relative to each other when they are compared, to allow
+	// for differences in encoder delay and leading silence: about 3 seconds.
+	fingerprintMaxOffset = 3 * fingerprintSampleRate / fingerprintHopSize
+
+	// fingerprintMinOverlap is the number of frames that must be compared
+	// for two fingerprints to be considered similar at all.
+	fingerprintMinOverlap = 20
+)
+
+// A FingerprintMeter is a Sink that computes an acoustic fingerprint of the
+// audio data passed to it, which can be compared with others by
+// FingerprintSimilarity to recognize the same recording in different
+// encodings. A Source can be measured by passing it to Transcode along with
+// the FingerprintMeter.
+//
+// The fingerprint follows the approach of Haitsma and Kalker: the audio is
+// downmixed to mono and divided into overlapping frames, and each frame is
+// described by 32 bits that record whether the energy difference between
+// adjacent frequency bands rose or fell since the previous frame. This makes
+// it robust against changes in volume and lossy compression.
+type FingerprintMeter struct {
+	streamInfo  StreamInfo
+	window      []float64
+	bandBins    []int // the first FFT bin of each band, and the end of the last
+	samples     []float64
+	re, im      []float64 // FFT buffers
+	previous    []float64 // band energies of the previous frame
+	fingerprint []uint32
+}
+
+// NewFingerprintMeter creates a new FingerprintMeter.
+func NewFingerprintMeter() *FingerprintMeter {
+	m := &FingerprintMeter{
+		streamInfo: StreamInfo{
+			SampleRate:    fingerprintSampleRate,
+			sampleFormat:  C.AV_SAMPLE_FMT_FLT,
+			channelLayout: "mono",
+		},
+		window:   make([]float64, fingerprintFrameSize),
+		bandBins: make([]int, fingerprintBandCount+1),
+		re:       make([]float64, fingerprintFrameSize),
+		im:       make([]float64, fingerprintFrameSize),
+	}
+	for i := range m.window {
+		m.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrameSize-1))
+	}
+	for i := range m.bandBins {
+		frequency := fingerprintMinFrequency *
+			math.Pow(fingerprintMaxFrequency/fingerprintMinFrequency, float64(i)/fingerprintBandCount)
+		m.bandBins[i] = int(math.Round(frequency * fingerprintFrameSize / fingerprintSampleRate))
+	}
+	return m
+}
+
+// Destroy does nothing, since a FingerprintMeter holds no C heap memory. It is
+// provided to satisfy the Sink interface.
+func (m *FingerprintMeter) Destroy() {}
+
+// StreamInfo returns an object describing the format of audio data accepted
+// by the FingerprintMeter.
+func (m *FingerprintMeter) StreamInfo() StreamInfo {
+	return m.streamInfo
+}
+
+// FrameSize returns the number of samples per Frame expected by Encode.
+func (m *FingerprintMeter) FrameSize() uint {
+	return fingerprintHopSize
+}
+
+// InitialPadding returns 0, since a FingerprintMeter doesn't encode audio.
+func (m *FingerprintMeter) InitialPadding() uint {
+	return 0
+}
+
+// Encode analyzes a chunk of audio data. It takes ownership of the Frame, so
+// the caller should not call Frame.Destroy after calling Encode.
+//
+// Passing an empty Frame concludes the measurement. The return value will be
+// true when no more Frames will be accepted.
+func (m *FingerprintMeter) Encode(frame Frame) (done bool, _ error) {
+	defer frame.Destroy()
+
+	if frame.IsEmpty() {
+		return true, nil
+	}
+
+	for _, sample := range frame.float32Samples(1) {
+		m.samples = append(m.samples, float64(sample))
+	}
+	for len(m.samples) >= fingerprintFrameSize {
+		m.analyzeFrame(m.samples[:fingerprintFrameSize])
+		m.samples = append(m.samples[:0], m.samples[fingerprintHopSize:]...)
+	}
+	return false, nil
+}
+
+func (m *FingerprintMeter) analyzeFrame(samples []float64) {
+	for i, sample := range samples {
+		m.re[i] = sample * m.window[i]
+		m.im[i] = 0
+	}
+	fft(m.re, m.im)
+
+	energies := make([]float64, fingerprintBandCount)
+	for band := range energies {
+		for bin := m.bandBins[band]; bin < m.bandBins[band+1]; bin++ {
+			energies[band] += m.re[bin]*m.re[bin] + m.im[bin]*m.im[bin]
+		}
+	}
+
+	if m.previous != nil {
+		var subFingerprint uint32
+		for band := 0; band < fingerprintBandCount-1; band++ {
+			difference := (energies[band] - energies[band+1]) -
+				(m.previous[band] - m.previous[band+1])
+			if difference > 0 {
+				subFingerprint |= 1 << band
+			}
+		}
+		m.fingerprint = append(m.fingerprint, subFingerprint)
+	}
+	m.previous = energies
+}
+
+// fft replaces re and im, the real and imaginary parts of a sequence whose
+// length is a power of 2, with their discrete Fourier transform.
+func fft(re, im []float64) {
+	n := len(re)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			re[i], re[j] = re[j], re[i]
+			im[i], im[j] = im[j], im[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		angle := -2 * math.Pi / float64(size)
+		stepRe, stepIm := math.Cos(angle), math.Sin(angle)
+		for start := 0; start < n; start += size {
+			wRe, wIm := 1., 0.
+			for k := range size / 2 {
+				a, b := start+k, start+k+size/2
+				tRe := re[b]*wRe - im[b]*wIm
+				tIm := re[b]*wIm + im[b]*wRe
+				re[b], im[b] = re[a]-tRe, im[a]-tIm
+				re[a], im[a] = re[a]+tRe, im[a]+tIm
+				wRe, wIm = wRe*stepRe-wIm*stepIm, wRe*stepIm+wIm*stepRe
+			}
+		}
+	}
+}
+
+// WriteTrailer does nothing. It is provided to satisfy the Sink interface.
+func (m *FingerprintMeter) WriteTrailer() error {
+	return nil
+}
+
+// Fingerprint returns the fingerprint of the audio data analyzed so far, with
+// one value for each frame.
+func (m *FingerprintMeter) Fingerprint() []uint32 {
+	return m.fingerprint
+}
+
+// FingerprintSimilarity compares two fingerprints produced by a
+// FingerprintMeter, and returns the fraction of their bits that match when
+// they are best aligned. Fingerprints of the same recording are usually more
+// than 0.8 similar, while those of unrelated audio are around 0.5. Frames in
+// which neither fingerprint has any bits set, as in digital silence, are
+// ignored.
+func FingerprintSimilarity(a, b []uint32) float64 {
+	best := 0.
+	for offset := -fingerprintMaxOffset; offset <= fingerprintMaxOffset; offset++ {
+		matching, compared := 0, 0
+		for i := max(0, -offset); i < len(a) && i+offset < len(b); i++ {
+			x, y := a[i], b[i+offset]
+			if x == 0 && y == 0 {
+				continue
+			}
+			matching += 32 - bits.OnesCount32(x^y)
+			compared += 32
+		}
+		if compared < fingerprintMinOverlap*32 || 2*compared < min(len(a), len(b))*32 {
+			continue
+		}
+		best = max(best, float64(matching)/float64(compared))
+	}
+	return best
+}
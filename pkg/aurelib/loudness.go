@@ -0,0 +1,166 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavutil
+
+#include <libavutil/samplefmt.h>
+*/
+import "C"
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// loudnessMeterSampleRate is the sample rate required by FFmpeg's ebur128
+	// filter.
+	loudnessMeterSampleRate = 48000
+
+	// loudnessMeterFrameSize is the number of samples per Frame accepted by a
+	// LoudnessMeter (100 ms, the step between EBU R128 measurement blocks).
+	loudnessMeterFrameSize = 4800
+
+	// replayGainReference is the loudness, in LUFS, to which ReplayGain 2.0
+	// normalizes audio.
+	replayGainReference = -18.
+
+	// silentLoudness is the integrated loudness reported by the ebur128 filter
+	// when no part of the audio is loud enough to be measured.
+	silentLoudness = -70.
+)
+
+// A Loudness describes the loudness of audio as measured according to EBU
+// R128.
+type Loudness struct {
+	Integrated float64 // Integrated loudness in LUFS.
+	TruePeak   float64 // Linear true peak sample value, where 1 is full scale.
+}
+
+// Gain returns the gain in dB that brings audio to the ReplayGain 2.0
+// reference loudness of -18 LUFS.
+func (l Loudness) Gain() float64 {
+	return replayGainReference - l.Integrated
+}
+
+// ReplayGain returns the volume scale factor that brings audio to the
+// ReplayGain 2.0 reference loudness, as for Source.ReplayGain.
+//
+// If preventClipping is true, the returned value will be clamped such that the
+// scaled true peak does not exceed the maximum representable value.
+func (l Loudness) ReplayGain(preventClipping bool) float64 {
+	volume := volumeFromGain(l.Gain())
+	if preventClipping && l.TruePeak > 0 {
+		volume = clampVolumeToPeak(volume, l.TruePeak)
+	}
+	return volume
+}
+
+// A LoudnessMeter is a Sink that measures the loudness and true peak of the
+// audio data passed to it, using FFmpeg's ebur128 filter. Audio is measured
+// in stereo at 48 kHz; a Source can be measured by passing it to Transcode
+// along with the LoudnessMeter.
+type LoudnessMeter struct {
+	graph    *FilterGraph
+	fifo     *Fifo // receives filtered audio data, which is discarded
+	loudness Loudness
+	measured bool
+}
+
+// Destroy frees any resources held by the LoudnessMeter so that it may be
+// discarded.
+func (m *LoudnessMeter) Destroy() {
+	if m.fifo != nil {
+		m.fifo.Destroy()
+	}
+	if m.graph != nil {
+		m.graph.Destroy()
+	}
+}
+
+// NewLoudnessMeter creates a new LoudnessMeter.
+//
+// The LoudnessMeter is backed by a heap-allocated C data structure, so it must
+// be destroyed with Destroy before it is discarded.
+func NewLoudnessMeter() (*LoudnessMeter, error) {
+	info := StreamInfo{
+		SampleRate:    loudnessMeterSampleRate,
+		sampleFormat:  C.AV_SAMPLE_FMT_DBL,
+		channelLayout: "stereo",
+	}
+
+	success := false
+	m := &LoudnessMeter{loudness: Loudness{Integrated: silentLoudness}}
+	defer func() {
+		if !success {
+			m.Destroy()
+		}
+	}()
+
+	var err error
+	if m.graph, err = NewFilterGraph("ebur128=peak=true:metadata=1", info); err != nil {
+		return nil, err
+	}
+	if m.fifo, err = NewFifo(info); err != nil {
+		return nil, fmt.Errorf("failed to create FIFO: %w", err)
+	}
+
+	success = true
+	return m, nil
+}
+
+// StreamInfo returns an object describing the format of audio data accepted
+// by the LoudnessMeter.
+func (m *LoudnessMeter) StreamInfo() StreamInfo {
+	return m.graph.StreamInfo()
+}
+
+// FrameSize returns the number of samples per Frame expected by Encode.
+func (m *LoudnessMeter) FrameSize() uint {
+	return loudnessMeterFrameSize
+}
+
+// InitialPadding returns 0, since a LoudnessMeter doesn't encode audio.
+func (m *LoudnessMeter) InitialPadding() uint {
+	return 0
+}
+
+// Encode measures a chunk of audio data. It takes ownership of the Frame, so
+// the caller should not call Frame.Destroy after calling Encode.
+//
+// Passing an empty Frame concludes the measurement. The return value will be
+// true when no more Frames will be accepted.
+func (m *LoudnessMeter) Encode(frame Frame) (done bool, _ error) {
+	defer frame.Destroy()
+
+	if err := m.graph.WriteFrame(frame); err != nil {
+		return false, err
+	}
+	done, err := m.graph.ReadFrames(m.fifo)
+	if err != nil {
+		return false, err
+	}
+	m.fifo.Drain(m.fifo.Size())
+
+	metadata := m.graph.Metadata()
+	if integrated, err := strconv.ParseFloat(metadata["lavfi.r128.I"], 64); err == nil {
+		m.measured = integrated > silentLoudness
+		m.loudness.Integrated = max(integrated, silentLoudness)
+	}
+	if truePeak, err := strconv.ParseFloat(metadata["lavfi.r128.true_peak"], 64); err == nil {
+		m.loudness.TruePeak = truePeak
+	}
+	return done || frame.IsEmpty(), nil
+}
+
+// WriteTrailer does nothing. It is provided to satisfy the Sink interface.
+func (m *LoudnessMeter) WriteTrailer() error {
+	return nil
+}
+
+// Loudness returns the loudness of the audio data measured so far. It returns
+// false if the audio was too short or too quiet to be measured, in which case
+// the integrated loudness is reported as -70 LUFS, the lowest that can be
+// measured.
+func (m *LoudnessMeter) Loudness() (Loudness, bool) {
+	return m.loudness, m.measured
+}
@@ -0,0 +1,77 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavutil
+
+#include <libavutil/frame.h>
+#include <libavutil/samplefmt.h>
+#include <math.h>
+#include <stdint.h>
+
+#define CROSSFADE_SAMPLES(type, bias, roundFn) { \
+	type* outData = (type*)out->extended_data[plane]; \
+	type const* inData = (type const*)in->extended_data[plane]; \
+	for (int i = 0; i < count; ++i) { \
+		double t = (double)(offset + i / interleaved) / length; \
+		double mixed = (outData[i] - bias) * (1 - t) + (inData[i] - bias) * t; \
+		outData[i] = (type)(roundFn(mixed) + bias); \
+	} \
+}
+
+static double
+noRound(double x) {
+	return x;
+}
+
+static void
+crossfade(AVFrame* out, AVFrame const* in, int offset, int length) {
+	int channels = out->ch_layout.nb_channels;
+	int planar = av_sample_fmt_is_planar(out->format);
+	int planes = planar ? channels : 1;
+	int interleaved = planar ? 1 : channels;
+	int count = out->nb_samples * interleaved;
+
+	for (int plane = 0; plane < planes; ++plane) {
+		switch (av_get_packed_sample_fmt(out->format)) {
+		case AV_SAMPLE_FMT_U8:  CROSSFADE_SAMPLES(uint8_t, 128, lrint); break;
+		case AV_SAMPLE_FMT_S16: CROSSFADE_SAMPLES(int16_t, 0, lrint); break;
+		case AV_SAMPLE_FMT_S32: CROSSFADE_SAMPLES(int32_t, 0, lrint); break;
+		case AV_SAMPLE_FMT_S64: CROSSFADE_SAMPLES(int64_t, 0, llrint); break;
+		case AV_SAMPLE_FMT_FLT: CROSSFADE_SAMPLES(float, 0, noRound); break;
+		case AV_SAMPLE_FMT_DBL: CROSSFADE_SAMPLES(double, 0, noRound); break;
+		default: break;
+		}
+	}
+}
+*/
+import "C"
+import "fmt"
+
+// CrossfadeFrames mixes the audio data of in into out, fading out from full
+// volume while in fades in from silence. The fade is linear and spans length
+// samples; offset is the position within the fade of the first sample in the
+// Frames, which allows a fade to be applied across several pairs of Frames.
+//
+// The Frames must have the same format and size. out is modified in place,
+// and the caller retains ownership of both Frames.
+func CrossfadeFrames(out Frame, in Frame, offset uint, length uint) error {
+	if out.IsEmpty() {
+		return nil
+	}
+	if in.Size != out.Size {
+		return fmt.Errorf("frame sizes differ (%v, %v)", out.Size, in.Size)
+	}
+	if in.frame.format != out.frame.format ||
+		in.frame.ch_layout.nb_channels != out.frame.ch_layout.nb_channels {
+		return fmt.Errorf("frame formats differ")
+	}
+	if offset+out.Size > length {
+		return fmt.Errorf("frames extend past the end of the fade")
+	}
+	if C.av_frame_make_writable(out.frame) < 0 {
+		return fmt.Errorf("failed to make frame writable")
+	}
+
+	C.crossfade(out.frame, in.frame, C.int(offset), C.int(length))
+	return nil
+}
@@ -0,0 +1,109 @@
+package aurelib
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// mp3DecoderDelay is the number of samples by which an MP3 decoder's output
+// lags its input. It is included in the initial padding reported by FFmpeg's
+// libmp3lame encoder, but not in the delay stored in a LAME tag.
+const mp3DecoderDelay = 528 + 1
+
+// NewMP3InfoFrame returns an MP3 frame containing a Xing header and LAME tag
+// that describe a stream of sampleCount samples, as encoded by an MP3 encoder
+// with the given initial padding (see Sink.InitialPadding). When the frame is
+// placed before the encoded audio, players that understand the LAME tag trim
+// the encoder delay and padding, which allows gapless playback.
+//
+// FFmpeg's MP3 muxer writes this frame itself only if its output is seekable,
+// which isn't the case when streaming.
+func NewMP3InfoFrame(
+	sampleRate uint,
+	channelCount uint,
+	initialPadding uint,
+	sampleCount uint64,
+) ([]byte, error) {
+	var versionBits, sampleRateIndex, bitRateIndex byte
+	var samplesPerFrame, frameSize, sideInfoSize uint
+
+	switch sampleRate {
+	case 44100, 48000, 32000: // MPEG-1
+		versionBits = 0b11
+		samplesPerFrame = 1152
+		bitRateIndex = 9 // 128 kbit/s
+		frameSize = 144 * 128000 / sampleRate
+		sideInfoSize = 32
+		if channelCount == 1 {
+			sideInfoSize = 17
+		}
+	case 22050, 24000, 16000: // MPEG-2
+		versionBits = 0b10
+		samplesPerFrame = 576
+		bitRateIndex = 8 // 64 kbit/s
+		frameSize = 72 * 64000 / sampleRate
+	case 11025, 12000, 8000: // MPEG-2.5
+		versionBits = 0b00
+		samplesPerFrame = 576
+		bitRateIndex = 8 // 64 kbit/s
+		frameSize = 72 * 64000 / sampleRate
+	default:
+		return nil, fmt.Errorf("unsupported sample rate for MP3: %v", sampleRate)
+	}
+	if versionBits != 0b11 {
+		sideInfoSize = 17
+		if channelCount == 1 {
+			sideInfoSize = 9
+		}
+	}
+
+	switch sampleRate {
+	case 44100, 22050, 11025:
+		sampleRateIndex = 0
+	case 48000, 24000, 12000:
+		sampleRateIndex = 1
+	case 32000, 16000, 8000:
+		sampleRateIndex = 2
+	}
+
+	channelModeBits := byte(0b00) // stereo
+	if channelCount == 1 {
+		channelModeBits = 0b11 // mono
+	}
+
+	// The stream ends after the last frame needed to hold the padded audio
+	// plus the decoder delay. The end padding is everything after the audio.
+	frameCount := (uint64(initialPadding) + sampleCount + uint64(samplesPerFrame) - 1) / uint64(samplesPerFrame)
+	encoderDelay := max(int64(initialPadding)-mp3DecoderDelay, 0)
+	endPadding := int64(frameCount*uint64(samplesPerFrame)) - encoderDelay - int64(sampleCount)
+	if encoderDelay > 0xfff || endPadding < 0 || endPadding > 0xfff {
+		return nil, fmt.Errorf("padding out of range (delay %v, padding %v)", encoderDelay, endPadding)
+	}
+	if frameCount > 0xffffffff {
+		return nil, fmt.Errorf("stream too long")
+	}
+
+	frame := make([]byte, frameSize)
+
+	// frame header: sync word, version, layer III, no CRC
+	frame[0] = 0xff
+	frame[1] = 0xe0 | versionBits<<3 | 0b01<<1 | 1
+	frame[2] = bitRateIndex<<4 | sampleRateIndex<<2
+	frame[3] = channelModeBits << 6
+
+	// Xing header, following the (empty) side information
+	xing := frame[4+sideInfoSize:]
+	copy(xing, "Xing")
+	binary.BigEndian.PutUint32(xing[4:], 0x1) // flags: frame count present
+	binary.BigEndian.PutUint32(xing[8:], uint32(frameCount))
+
+	// LAME tag; fields other than the delay and padding are left unspecified
+	lame := xing[12:]
+	copy(lame, "LAME3.100")
+	delayAndPadding := uint32(encoderDelay)<<12 | uint32(endPadding)
+	lame[21] = byte(delayAndPadding >> 16)
+	lame[22] = byte(delayAndPadding >> 8)
+	lame[23] = byte(delayAndPadding)
+
+	return frame, nil
+}
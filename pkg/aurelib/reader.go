@@ -0,0 +1,196 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <libavformat/avformat.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+// implemented in Go
+int aurelibReaderRead(void* opaque, uint8_t* data, int dataSize);
+int64_t aurelibReaderSeek(void* opaque, int64_t offset, int whence);
+
+typedef int (*Reader_read_t)(void*, uint8_t*, int);
+typedef int64_t (*Reader_seek_t)(void*, int64_t, int);
+
+static int
+readerErrorEOF() {
+	return AVERROR_EOF;
+}
+
+static int
+readerErrorIO() {
+	return AVERROR(EIO);
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// readerBufferSize is the size of the buffer through which FFmpeg reads from
+// a ReaderSource's io.ReadSeeker.
+const readerBufferSize = 64 * 1024
+
+// A ReaderSource decodes audio data read from an io.ReadSeeker, such as an
+// in-memory buffer or a file in an archive.
+type ReaderSource struct {
+	sourceBase
+
+	reader io.ReadSeeker
+	ioCtx  *C.AVIOContext
+	opaque unsafe.Pointer // C memory holding a cgo.Handle to the ReaderSource
+	err    error          // the last error returned by reader
+}
+
+// Destroy frees any resources held by the Source so that it may be discarded.
+// The io.ReadSeeker is not closed.
+func (src *ReaderSource) Destroy() {
+	src.sourceBase.Destroy()
+	if src.ioCtx != nil {
+		C.av_freep(unsafe.Pointer(&src.ioCtx.buffer))
+		C.avio_context_free(&src.ioCtx)
+	}
+	if src.opaque != nil {
+		freeOpaqueHandle(src.opaque)
+		src.opaque = nil
+	}
+}
+
+// NewReaderSource creates a new ReaderSource that will read audio data from
+// reader. The data may be in any format that FFmpeg can detect from its
+// contents. options select an audio stream as for NewFileSource.
+//
+// The Source is backed by a heap-allocated C data structure, so it must be
+// destroyed with Destroy before it is discarded. reader must remain usable
+// until then.
+func NewReaderSource(reader io.ReadSeeker, options ...SourceOption) (*ReaderSource, error) {
+	success := false
+	src := &ReaderSource{reader: reader}
+	defer func() {
+		if !success {
+			src.Destroy()
+		}
+	}()
+
+	if src.opaque = newOpaqueHandle(src); src.opaque == nil {
+		return nil, fmt.Errorf("failed to allocate I/O context data")
+	}
+
+	ioCtxBuffer := C.av_malloc(readerBufferSize)
+	if ioCtxBuffer == nil {
+		return nil, fmt.Errorf("failed to allocate I/O buffer")
+	}
+	if src.ioCtx = C.avio_alloc_context(
+		(*C.uchar)(ioCtxBuffer), readerBufferSize, 0, src.opaque,
+		C.Reader_read_t(unsafe.Pointer(C.aurelibReaderRead)), nil,
+		C.Reader_seek_t(unsafe.Pointer(C.aurelibReaderSeek)),
+	); src.ioCtx == nil {
+		C.av_free(ioCtxBuffer)
+		return nil, fmt.Errorf("failed to allocate I/O context")
+	}
+
+	if src.formatCtx = C.avformat_alloc_context(); src.formatCtx == nil {
+		return nil, fmt.Errorf("failed to allocate format context")
+	}
+	src.formatCtx.pb = src.ioCtx
+
+	// avformat_open_input frees the format context if it fails
+	if err := C.avformat_open_input(&src.formatCtx, nil, nil, nil); err < 0 {
+		if src.err != nil {
+			return nil, fmt.Errorf("failed to open input: %w", src.err)
+		}
+		return nil, fmt.Errorf("failed to open input: %v", avErr2Str(err))
+	}
+
+	if err := src.init(newSourceOptions(options)); err != nil {
+		return nil, err
+	}
+	success = true
+	return src, nil
+}
+
+// newOpaqueHandle returns C memory holding a cgo.Handle to value, for use as
+// the opaque pointer passed to the callbacks of an AVIOContext. It returns nil
+// if allocation fails. The memory must be freed with freeOpaqueHandle.
+func newOpaqueHandle(value any) unsafe.Pointer {
+	opaque := C.malloc(C.size_t(unsafe.Sizeof(cgo.Handle(0))))
+	if opaque != nil {
+		*(*cgo.Handle)(opaque) = cgo.NewHandle(value)
+	}
+	return opaque
+}
+
+// opaqueHandleValue returns the value referred to by memory allocated with
+// newOpaqueHandle.
+func opaqueHandleValue(opaque unsafe.Pointer) any {
+	return (*(*cgo.Handle)(opaque)).Value()
+}
+
+// freeOpaqueHandle frees memory allocated with newOpaqueHandle.
+func freeOpaqueHandle(opaque unsafe.Pointer) {
+	(*(*cgo.Handle)(opaque)).Delete()
+	C.free(opaque)
+}
+
+func readerSourceFromOpaque(opaque unsafe.Pointer) *ReaderSource {
+	return opaqueHandleValue(opaque).(*ReaderSource)
+}
+
+//export aurelibReaderRead
+func aurelibReaderRead(opaque unsafe.Pointer, data *C.uint8_t, dataSize C.int) C.int {
+	src := readerSourceFromOpaque(opaque)
+	buffer := unsafe.Slice((*byte)(unsafe.Pointer(data)), int(dataSize))
+
+	// io.Reader allows Read to return no data without an error
+	for {
+		count, err := src.reader.Read(buffer)
+		if count > 0 {
+			return C.int(count)
+		}
+		if errors.Is(err, io.EOF) {
+			return C.readerErrorEOF()
+		}
+		if err != nil {
+			src.err = err
+			return C.readerErrorIO()
+		}
+	}
+}
+
+//export aurelibReaderSeek
+func aurelibReaderSeek(opaque unsafe.Pointer, offset C.int64_t, whence C.int) C.int64_t {
+	src := readerSourceFromOpaque(opaque)
+
+	if whence&C.AVSEEK_SIZE != 0 {
+		current, err := src.reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			src.err = err
+			return C.int64_t(C.readerErrorIO())
+		}
+		size, err := src.reader.Seek(0, io.SeekEnd)
+		if err != nil {
+			src.err = err
+			return C.int64_t(C.readerErrorIO())
+		}
+		if _, err := src.reader.Seek(current, io.SeekStart); err != nil {
+			src.err = err
+			return C.int64_t(C.readerErrorIO())
+		}
+		return C.int64_t(size)
+	}
+
+	// SEEK_SET, SEEK_CUR and SEEK_END have the same values as io.SeekStart,
+	// io.SeekCurrent and io.SeekEnd
+	position, err := src.reader.Seek(int64(offset), int(whence&^C.AVSEEK_FORCE))
+	if err != nil {
+		src.err = err
+		return C.int64_t(C.readerErrorIO())
+	}
+	return C.int64_t(position)
+}
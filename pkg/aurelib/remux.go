@@ -0,0 +1,146 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// A BufferRemuxer stores encoded audio Packets in a memory buffer using a
+// different container format, without decoding or re-encoding them.
+type BufferRemuxer struct {
+	bufferIO
+	formatCtx *C.AVFormatContext
+	stream    *C.AVStream
+
+	timeOffset    C.int64_t
+	timeOffsetSet bool
+}
+
+// Destroy frees any resources held by the BufferRemuxer so that it may be
+// discarded.
+func (remuxer *BufferRemuxer) Destroy() {
+	if remuxer.formatCtx != nil {
+		C.avformat_free_context(remuxer.formatCtx)
+		remuxer.formatCtx = nil
+	}
+	remuxer.bufferIO.destroy()
+}
+
+// NewBufferRemuxer creates a new BufferRemuxer that will store Packets
+// described by params in the container format specified by
+// containerFormatName (e.g., "matroska", "mp3", "ogg"). The format name is
+// interpreted by FFmpeg's av_guess_format(). The container must support the
+// codec described by params.
+//
+// muxerOptions has the same meaning as SinkConfig.MuxerOptions.
+//
+// Timestamps are shifted so that the first Packet written starts at time 0.
+//
+// The BufferRemuxer is backed by a heap-allocated C data structure, so it must
+// be destroyed with Destroy before it is discarded.
+func NewBufferRemuxer(
+	containerFormatName string,
+	params CodecParameters,
+	muxerOptions map[string]string,
+) (*BufferRemuxer, error) {
+	cFormatName := C.CString(containerFormatName)
+	defer C.free(unsafe.Pointer(cFormatName))
+
+	format := C.av_guess_format(cFormatName, nil, nil)
+	if format == nil {
+		return nil, fmt.Errorf("failed to determine container format")
+	}
+
+	success := false
+	remuxer := BufferRemuxer{}
+	defer func() {
+		if !success {
+			remuxer.Destroy()
+		}
+	}()
+
+	if err := remuxer.initBuffer(); err != nil {
+		return nil, err
+	}
+
+	if remuxer.formatCtx = C.avformat_alloc_context(); remuxer.formatCtx == nil {
+		return nil, fmt.Errorf("failed to allocate format context")
+	}
+	remuxer.formatCtx.oformat = format
+	remuxer.formatCtx.pb = remuxer.ioCtx
+
+	if remuxer.stream = C.avformat_new_stream(remuxer.formatCtx, nil); remuxer.stream == nil {
+		return nil, fmt.Errorf("failed to create output stream")
+	}
+	if avErr := C.avcodec_parameters_copy(remuxer.stream.codecpar, params.params); avErr < 0 {
+		return nil, fmt.Errorf("failed to copy codec parameters: %v", avErr2Str(avErr))
+	}
+	// the input container's codec tag is likely meaningless in the output
+	remuxer.stream.codecpar.codec_tag = 0
+	remuxer.stream.time_base = params.timeBase
+
+	options, err := newDictionary(muxerOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer C.av_dict_free(&options)
+
+	if avErr := C.avformat_write_header(remuxer.formatCtx, &options); avErr < 0 {
+		return nil, fmt.Errorf("failed to write header: %v", avErr2Str(avErr))
+	}
+	if unused := dictionaryKeys(options); len(unused) > 0 {
+		return nil, fmt.Errorf("unrecognized muxer options: %v", unused)
+	}
+
+	success = true
+	return &remuxer, nil
+}
+
+// WritePacket writes a Packet to the container. It takes ownership of the
+// Packet, so the caller should not call Packet.Destroy after calling
+// WritePacket.
+func (remuxer *BufferRemuxer) WritePacket(packet Packet) error {
+	defer packet.Destroy()
+
+	p := packet.packet
+	if !remuxer.timeOffsetSet {
+		if p.pts != noPtsValue {
+			remuxer.timeOffset = p.pts
+		} else if p.dts != noPtsValue {
+			remuxer.timeOffset = p.dts
+		}
+		remuxer.timeOffsetSet = true
+	}
+
+	if p.pts != noPtsValue {
+		p.pts -= remuxer.timeOffset
+	}
+	if p.dts != noPtsValue {
+		p.dts -= remuxer.timeOffset
+	}
+	C.av_packet_rescale_ts(p, packet.timeBase, remuxer.stream.time_base)
+	p.stream_index = remuxer.stream.index
+	p.pos = -1
+
+	if err := C.av_write_frame(remuxer.formatCtx, p); err < 0 {
+		return fmt.Errorf("failed to write frame: %s", avErr2Str(err))
+	}
+	return nil
+}
+
+// WriteTrailer finalizes data written to the container. No more Packets may be
+// written afterward.
+func (remuxer *BufferRemuxer) WriteTrailer() error {
+	if err := C.av_write_trailer(remuxer.formatCtx); err < 0 {
+		return fmt.Errorf("failed to write trailer: %s", avErr2Str(err))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavutil
+
+#include <libavutil/samplefmt.h>
+*/
+import "C"
+import (
+	"math"
+	"time"
+)
+
+// silenceMeterFrameSize is the number of samples per Frame accepted by a
+// SilenceMeter.
+const silenceMeterFrameSize = 4096
+
+// A SilenceMeter is a Sink that finds the silence at the start and end of the
+// audio data passed to it. A Source can be measured by passing it to Transcode
+// along with the SilenceMeter.
+type SilenceMeter struct {
+	streamInfo   StreamInfo
+	channelCount uint
+	threshold    float32 // linear amplitude at or below which audio is silent
+
+	sampleCount uint64 // samples received
+	firstSound  uint64 // index of the first sample above threshold
+	lastSound   uint64 // index of the last sample above threshold
+	heardSound  bool
+}
+
+// NewSilenceMeter creates a new SilenceMeter that accepts audio data with the
+// sample rate and channel layout described by info, such as the StreamInfo of
+// the Source to be measured. Audio is considered silent where no channel
+// exceeds threshold, in dBFS (e.g., -60).
+func NewSilenceMeter(info StreamInfo, threshold float64) *SilenceMeter {
+	info.sampleFormat = C.AV_SAMPLE_FMT_FLT
+	return &SilenceMeter{
+		streamInfo:   info,
+		channelCount: info.ChannelCount(),
+		threshold:    float32(math.Pow(10, threshold/20)),
+	}
+}
+
+// Destroy does nothing, since a SilenceMeter holds no C heap memory. It is
+// provided to satisfy the Sink interface.
+func (m *SilenceMeter) Destroy() {}
+
+// StreamInfo returns an object describing the format of audio data accepted
+// by the SilenceMeter.
+func (m *SilenceMeter) StreamInfo() StreamInfo {
+	return m.streamInfo
+}
+
+// FrameSize returns the number of samples per Frame expected by Encode.
+func (m *SilenceMeter) FrameSize() uint {
+	return silenceMeterFrameSize
+}
+
+// InitialPadding returns 0, since a SilenceMeter doesn't encode audio.
+func (m *SilenceMeter) InitialPadding() uint {
+	return 0
+}
+
+// Encode examines a chunk of audio data. It takes ownership of the Frame, so
+// the caller should not call Frame.Destroy after calling Encode.
+//
+// Passing an empty Frame concludes the measurement. The return value will be
+// true when no more Frames will be accepted.
+func (m *SilenceMeter) Encode(frame Frame) (done bool, _ error) {
+	defer frame.Destroy()
+
+	if frame.IsEmpty() {
+		return true, nil
+	}
+
+	samples := frame.float32Samples(m.channelCount)
+	for i := uint(0); i < frame.Size; i++ {
+		for _, sample := range samples[i*m.channelCount : (i+1)*m.channelCount] {
+			if sample > m.threshold || sample < -m.threshold {
+				if !m.heardSound {
+					m.firstSound = m.sampleCount
+					m.heardSound = true
+				}
+				m.lastSound = m.sampleCount
+				break
+			}
+		}
+		m.sampleCount++
+	}
+	return false, nil
+}
+
+// WriteTrailer does nothing. It is provided to satisfy the Sink interface.
+func (m *SilenceMeter) WriteTrailer() error {
+	return nil
+}
+
+// Silence returns the durations of the silence at the start and end of the
+// audio data measured so far. If the audio is silent throughout, both are 0.
+func (m *SilenceMeter) Silence() (leading, trailing time.Duration) {
+	if !m.heardSound {
+		return 0, 0
+	}
+	sampleRate := uint64(m.streamInfo.SampleRate)
+	toDuration := func(samples uint64) time.Duration {
+		// calculate with microsecond precision to prevent overflow
+		return time.Duration(samples*1000000/sampleRate) * time.Microsecond
+	}
+	return toDuration(m.firstSound), toDuration(m.sampleCount - m.lastSound - 1)
+}
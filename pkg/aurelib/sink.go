@@ -98,6 +98,7 @@ Buffer_read(
 import "C"
 import (
 	"fmt"
+	"time"
 	"unsafe"
 )
 
@@ -113,6 +114,11 @@ type Sink interface {
 	// FrameSize returns the number of samples per Frame expected by Encode.
 	FrameSize() uint
 
+	// InitialPadding returns the number of samples of padding (encoder delay)
+	// that the encoder inserts at the start of the stream. A player should
+	// discard this many samples for gapless playback.
+	InitialPadding() uint
+
 	// Encode encodes a chunk of audio data. It takes ownership of the Frame, so
 	// the caller should not call Frame.Destroy after calling Encode.
 	//
@@ -131,8 +137,8 @@ type Sink interface {
 }
 
 // SinkConfig contains audio format and encoding configuration used by
-// NewBufferSink and NewFileSink. It should be created with NewSinkConfig to
-// provide default values.
+// NewBufferSink, NewWriterSink and NewFileSink. It should be created with
+// NewSinkConfig to provide default values.
 type SinkConfig struct {
 	// ChannelLayout describes the number and position of audio channels. It
 	// uses the same format as FFmpeg's av_get_channel_layout().
@@ -154,7 +160,11 @@ type SinkConfig struct {
 	//     Example: "stereo+FC" = "2c+FC" = "2c+1c" = "0x7"
 	ChannelLayout string
 
-	SampleRate uint // Sample rate in Hz. (Default: 44100)
+	// SampleRate is the sample rate in Hz. If the encoder only supports a
+	// fixed set of sample rates (e.g., libopus), the closest supported rate
+	// is used instead; see Sink.StreamInfo for the rate actually chosen.
+	// (Default: 44100)
+	SampleRate uint
 
 	// SampleFormat is an abbreviation of the stream's sample format ("s16",
 	// "flt", "u8p", etc.). If unspecified, the format is determined by the
@@ -196,6 +206,33 @@ type SinkConfig struct {
 	// This should be enabled when deterministic output is needed, such as when
 	// performing automated testing.
 	BitExact bool
+
+	// MuxerOptions contains private options for the container format's muxer,
+	// such as "movflags" for MP4. They are passed to FFmpeg's
+	// avformat_write_header(). An error is returned by NewBufferSink and
+	// NewFileSink if an option is not recognized by the muxer.
+	// (Default: nil)
+	MuxerOptions map[string]string
+
+	// EncoderOptions contains private options for the audio encoder, such as
+	// "reservoir" for libmp3lame. They are passed to FFmpeg's avcodec_open2().
+	// An error is returned by NewBufferSink and NewFileSink if an option is not
+	// recognized by the encoder. (Default: nil)
+	EncoderOptions map[string]string
+
+	// StartTime is the timestamp assigned to the first sample encoded. It can
+	// be used to produce independently encoded segments of a longer stream
+	// with continuous timestamps. (Default: 0)
+	StartTime time.Duration
+
+	// OutputStart and OutputEnd limit the encoded packets written to the
+	// container to those whose timestamps fall between them. A zero value
+	// doesn't limit that side. Together with StartTime, they allow a segment to
+	// be encoded with extra audio on either side, so that the encoder's priming
+	// and trailing padding are discarded rather than heard at the segment's
+	// boundaries. (Default: 0)
+	OutputStart time.Duration
+	OutputEnd   time.Duration
 }
 
 // NewSinkConfig creates a new SinkConfig object with default values.
@@ -261,6 +298,49 @@ func (config *SinkConfig) getSampleFormat(
 	return allowedFormats[0]
 }
 
+func allowedSampleRatesFromCodec(codec *C.AVCodec) []C.int {
+	if codec.supported_samplerates == nil {
+		return nil
+	}
+
+	rateArray := (*[1 << 30]C.int)(unsafe.Pointer(codec.supported_samplerates))
+	rateCount := 0
+	for rateArray[rateCount] != 0 {
+		rateCount++
+	}
+
+	return rateArray[:rateCount:rateCount]
+}
+
+func (config *SinkConfig) getSampleRate(
+	allowedRates []C.int,
+) C.int {
+	requested := C.int(config.SampleRate)
+	if len(allowedRates) == 0 {
+		return requested
+	}
+
+	best := allowedRates[0]
+	for _, rate := range allowedRates {
+		if rate == requested {
+			return rate
+		}
+
+		// prefer the closest rate, breaking ties in favor of the higher one
+		distance, bestDistance := rate-requested, best-requested
+		if distance < 0 {
+			distance = -distance
+		}
+		if bestDistance < 0 {
+			bestDistance = -bestDistance
+		}
+		if distance < bestDistance || (distance == bestDistance && rate > best) {
+			best = rate
+		}
+	}
+	return best
+}
+
 func (config *SinkConfig) getCodec() *C.AVCodec {
 	cCodecName := C.CString(config.Codec)
 	defer C.free(unsafe.Pointer(cCodecName))
@@ -271,8 +351,13 @@ func (config *SinkConfig) getCodec() *C.AVCodec {
 type sinkBase struct {
 	formatCtx *C.AVFormatContext
 	codecCtx  *C.AVCodecContext
+	stream    *C.AVStream
 
 	runningTime C.int64_t
+
+	// bounds of the packet timestamps that are written, or zero
+	outputStart C.int64_t
+	outputEnd   C.int64_t
 }
 
 // Destroy frees any resources held by the Sink so that it may be discarded.
@@ -339,26 +424,72 @@ func NewFileSink(
 	return &sink, nil
 }
 
+// A bufferIO is an FFmpeg I/O context that stores written data in a memory
+// buffer.
+type bufferIO struct {
+	ioCtx  *C.AVIOContext
+	buffer *C.Buffer
+}
+
+func (bio *bufferIO) initBuffer() error {
+	if bio.buffer = C.Buffer_new(); bio.buffer == nil {
+		return fmt.Errorf("failed to allocate buffer")
+	}
+
+	ioCtxBufferSize := 4096
+	ioCtxBuffer := C.av_malloc(C.size_t(ioCtxBufferSize))
+
+	if bio.ioCtx = C.avio_alloc_context(
+		(*C.uchar)(ioCtxBuffer), C.int(ioCtxBufferSize), 1, unsafe.Pointer(bio.buffer),
+		C.Buffer_read_t(unsafe.Pointer(C.Buffer_read)),
+		C.Buffer_write_t(unsafe.Pointer(C.Buffer_write)), nil,
+	); bio.ioCtx == nil {
+		C.av_free(unsafe.Pointer(ioCtxBuffer))
+		return fmt.Errorf("failed to allocate I/O context")
+	}
+	return nil
+}
+
+func (bio *bufferIO) destroy() {
+	if bio.ioCtx != nil {
+		C.av_free(unsafe.Pointer(bio.ioCtx.buffer))
+		C.av_free(unsafe.Pointer(bio.ioCtx))
+		bio.ioCtx = nil
+	}
+	if bio.buffer != nil {
+		C.Buffer_delete(bio.buffer)
+		bio.buffer = nil
+	}
+}
+
+// Buffer returns the current contents of the encoded data buffer.
+func (bio *bufferIO) Buffer() []byte {
+	return (*[1 << 30]byte)(unsafe.Pointer(bio.buffer.data))[:bio.buffer.size:bio.buffer.capacity]
+}
+
+// Flush moves any data held in FFmpeg's internal I/O buffer to the encoded
+// data buffer. It can be used to retrieve the container header, which is
+// written on creation, before any audio has been written.
+func (bio *bufferIO) Flush() {
+	C.avio_flush(bio.ioCtx)
+}
+
+// Drain discards at most the first byteCount bytes from the encoded data
+// buffer. It returns the number of bytes discarded.
+func (bio *bufferIO) Drain(byteCount uint) uint {
+	return uint(C.Buffer_read(unsafe.Pointer(bio.buffer), nil, C.int(byteCount)))
+}
+
 // A BufferSink writes encoded audio to a memory buffer.
 type BufferSink struct {
 	sinkBase
-	ioCtx  *C.AVIOContext
-	buffer *C.Buffer
+	bufferIO
 }
 
 // Destroy frees any resources held by the Sink so that it may be discarded.
 func (sink *BufferSink) Destroy() {
 	sink.sinkBase.Destroy()
-
-	if sink.ioCtx != nil {
-		C.av_free(unsafe.Pointer(sink.ioCtx.buffer))
-		C.av_free(unsafe.Pointer(sink.ioCtx))
-		sink.ioCtx = nil
-	}
-	if sink.buffer != nil {
-		C.Buffer_delete(sink.buffer)
-		sink.buffer = nil
-	}
+	sink.bufferIO.destroy()
 }
 
 // NewBufferSink creates a new BufferSink that will store audio data in the
@@ -388,20 +519,8 @@ func NewBufferSink(
 		}
 	}()
 
-	if sink.buffer = C.Buffer_new(); sink.buffer == nil {
-		return nil, fmt.Errorf("failed to allocate buffer")
-	}
-
-	ioCtxBufferSize := 4096
-	ioCtxBuffer := C.av_malloc(C.size_t(ioCtxBufferSize))
-
-	if sink.ioCtx = C.avio_alloc_context(
-		(*C.uchar)(ioCtxBuffer), C.int(ioCtxBufferSize), 1, unsafe.Pointer(sink.buffer),
-		C.Buffer_read_t(unsafe.Pointer(C.Buffer_read)),
-		C.Buffer_write_t(unsafe.Pointer(C.Buffer_write)), nil,
-	); sink.ioCtx == nil {
-		C.av_free(unsafe.Pointer(ioCtxBuffer))
-		return nil, fmt.Errorf("failed to allocate I/O context")
+	if err := sink.initBuffer(); err != nil {
+		return nil, err
 	}
 
 	if err := sink.init(format, sink.ioCtx, config); err != nil {
@@ -412,17 +531,6 @@ func NewBufferSink(
 	return &sink, nil
 }
 
-// Buffer returns the current contents of the BufferSink's encoded data buffer.
-func (sink *BufferSink) Buffer() []byte {
-	return (*[1 << 30]byte)(unsafe.Pointer(sink.buffer.data))[:sink.buffer.size:sink.buffer.capacity]
-}
-
-// Drain discards at most the first byteCount bytes from the BufferSink's
-// encoded data buffer. It returns the number of bytes discarded.
-func (sink *BufferSink) Drain(byteCount uint) uint {
-	return uint(C.Buffer_read(unsafe.Pointer(sink.buffer), nil, C.int(byteCount)))
-}
-
 func (sink *sinkBase) init(
 	format *C.AVOutputFormat,
 	ioCtx *C.AVIOContext,
@@ -443,15 +551,17 @@ func (sink *sinkBase) init(
 	if stream == nil {
 		return fmt.Errorf("failed to create output stream")
 	}
-
-	// set the sample rate for the container
-	stream.time_base.num = 1
-	stream.time_base.den = C.int(config.SampleRate)
+	sink.stream = stream
 
 	codec := config.getCodec()
 	if codec == nil {
 		return fmt.Errorf("failed to find output encoder '%v'", config.Codec)
 	}
+	sampleRate := config.getSampleRate(allowedSampleRatesFromCodec(codec))
+
+	// set the sample rate for the container
+	stream.time_base.num = 1
+	stream.time_base.den = sampleRate
 
 	if sink.codecCtx = C.avcodec_alloc_context3(codec); sink.codecCtx == nil {
 		return fmt.Errorf("failed to allocate encoding context")
@@ -460,7 +570,10 @@ func (sink *sinkBase) init(
 	if err := channelLayoutFromString(config.ChannelLayout, &sink.codecCtx.ch_layout); err != nil {
 		return err
 	}
-	sink.codecCtx.sample_rate = C.int(config.SampleRate)
+	sink.codecCtx.sample_rate = sampleRate
+	sink.runningTime = durationToTimeBase(config.StartTime, stream.time_base)
+	sink.outputStart = durationToTimeBase(config.OutputStart, stream.time_base)
+	sink.outputEnd = durationToTimeBase(config.OutputEnd, stream.time_base)
 	sink.codecCtx.sample_fmt = config.getSampleFormat(allowedFormatsFromCodec(codec))
 	sink.codecCtx.time_base = stream.time_base
 
@@ -483,16 +596,37 @@ func (sink *sinkBase) init(
 		sink.codecCtx.flags |= C.AV_CODEC_FLAG_BITEXACT
 	}
 
-	if avErr := C.avcodec_open2(sink.codecCtx, codec, nil); avErr < 0 {
+	encoderOptions, err := newDictionary(config.EncoderOptions)
+	if err != nil {
+		return err
+	}
+	defer C.av_dict_free(&encoderOptions)
+
+	if avErr := C.avcodec_open2(sink.codecCtx, codec, &encoderOptions); avErr < 0 {
 		return fmt.Errorf("failed to open output codec: %v", avErr2Str(avErr))
 	}
+	if unused := dictionaryKeys(encoderOptions); len(unused) > 0 {
+		return fmt.Errorf("unrecognized encoder options: %v", unused)
+	}
 	if avErr := C.avcodec_parameters_from_context(stream.codecpar, sink.codecCtx); avErr < 0 {
 		return fmt.Errorf("failed to initialize stream parameters")
 	}
 
-	if avErr := C.avformat_write_header(sink.formatCtx, nil); avErr < 0 {
+	muxerOptions, err := newDictionary(config.MuxerOptions)
+	if err != nil {
+		return err
+	}
+	defer C.av_dict_free(&muxerOptions)
+
+	if avErr := C.avformat_write_header(sink.formatCtx, &muxerOptions); avErr < 0 {
 		return fmt.Errorf("failed to write header: %v", avErr2Str(avErr))
 	}
+
+	// avformat_write_header() leaves options it didn't consume in the
+	// dictionary
+	if unused := dictionaryKeys(muxerOptions); len(unused) > 0 {
+		return fmt.Errorf("unrecognized muxer options: %v", unused)
+	}
 	return nil
 }
 
@@ -505,6 +639,16 @@ func (sink *sinkBase) FrameSize() uint {
 	return uint(value)
 }
 
+// InitialPadding returns the number of samples of padding (encoder delay) that
+// the encoder inserts at the start of the stream. A player should discard this
+// many samples for gapless playback.
+func (sink *sinkBase) InitialPadding() uint {
+	if sink.codecCtx.initial_padding <= 0 {
+		return 0
+	}
+	return uint(sink.codecCtx.initial_padding)
+}
+
 // Encode encodes a chunk of audio data. It takes ownership of the Frame, so the
 // caller should not call Frame.Destroy after calling Encode.
 //
@@ -554,6 +698,15 @@ func (sink *sinkBase) write() (eof bool, _ error) {
 			return false, fmt.Errorf("failed to receive packet from encoder: %s", avErr2Str(err))
 		}
 
+		if packet.pts != noPtsValue &&
+			((sink.outputStart > 0 && packet.pts < sink.outputStart) ||
+				(sink.outputEnd > 0 && packet.pts >= sink.outputEnd)) {
+			continue
+		}
+
+		// the muxer may have chosen a different time base for the stream
+		C.av_packet_rescale_ts(packet, sink.codecCtx.time_base, sink.stream.time_base)
+
 		if err := C.av_write_frame(sink.formatCtx, packet); err < 0 {
 			return false, fmt.Errorf("failed to write frame: %s", avErr2Str(err))
 		}
@@ -582,7 +735,7 @@ func (sink *sinkBase) StreamInfo() StreamInfo {
 // WriteTrailer.
 func FlushSink(sink Sink) error {
 	if _, err := sink.Encode(Frame{}); err != nil {
-		return fmt.Errorf("failed to encode empty frame: %v", err)
+		return fmt.Errorf("failed to encode empty frame: %w", err)
 	}
 	return sink.WriteTrailer()
 }
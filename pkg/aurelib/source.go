@@ -8,6 +8,7 @@ package aurelib
 #include <libavcodec/avcodec.h>
 #include <libavcodec/codec_desc.h>
 #include <libavcodec/codec_id.h>
+#include <libavutil/intreadwrite.h>
 #include <libavutil/replaygain.h>
 #include <stdlib.h>
 #include <string.h>
@@ -27,6 +28,21 @@ strEmpty() {
 	return "";
 }
 
+// packetSkipSamples reads the number of samples to be discarded from the start
+// and end of a packet's decoded audio. It returns 0 if the packet doesn't
+// specify any.
+static int
+packetSkipSamples(AVPacket* packet, uint32_t* start, uint32_t* end) {
+	size_t size = 0;
+	uint8_t* data = av_packet_get_side_data(packet, AV_PKT_DATA_SKIP_SAMPLES, &size);
+	if (!data || size < 8) {
+		return 0;
+	}
+	*start = AV_RL32(data);
+	*end = AV_RL32(data + 4);
+	return 1;
+}
+
 // streamGetSideData returns the side data of the given type from the stream,
 // or NULL if not found. Handles both the old AVStream.side_data API
 // (libavformat < 61) and the new AVCodecParameters.side_data API.
@@ -50,6 +66,7 @@ streamGetSideData(AVStream *stream, enum AVPacketSideDataType type) {
 import "C"
 import (
 	"fmt"
+	"io"
 	"math"
 	"regexp"
 	"strconv"
@@ -137,7 +154,10 @@ type Source interface {
 	FrameSize() uint
 
 	// FrameStartTime returns the stream time offset of the start of the last
-	// frame received by a call to ReceiveFrame.
+	// frame received by a call to ReceiveFrame. It is measured from the same
+	// point as the offsets accepted by SeekTo, so for a Source that plays part
+	// of a file, such as a fragment.Fragment, it is relative to the start of
+	// that part rather than the start of the file.
 	FrameStartTime() time.Duration
 
 	// CopyFrame copies the data received by ReceiveFrame to the supplied Fifo.
@@ -166,6 +186,23 @@ type Source interface {
 	CodecName() string
 }
 
+// A PacketSource is a Source that can also provide its encoded audio data
+// without decoding it, so that it can be remuxed into another container.
+type PacketSource interface {
+	Source
+
+	// ReadPacket reads the next packet of encoded audio data without decoding
+	// it. It returns io.EOF when the end of the stream is reached.
+	//
+	// ReadPacket and Decode both consume packets from the input, so they
+	// should not be used on the same Source.
+	ReadPacket() (Packet, error)
+
+	// CodecParameters returns an object describing the encoding of the
+	// Packets returned by ReadPacket.
+	CodecParameters() CodecParameters
+}
+
 // ReplayGainMode indicates which set of ReplayGain data to use in volume
 // adjustment.
 type ReplayGainMode int
@@ -196,11 +233,19 @@ type sourceBase struct {
 	attachedImages []AttachedImage
 	codecName      string
 
-	formatCtx *C.AVFormatContext
-	codecCtx  *C.AVCodecContext
-	stream    *C.AVStream
+	formatCtx   *C.AVFormatContext
+	codecCtx    *C.AVCodecContext
+	stream      *C.AVStream
+	streamIndex int // position of stream among the audio streams
 
 	frame *C.AVFrame
+
+	// decodedPadding counts the padding of the packets read by Decode since
+	// the stream was opened or last sought to its beginning. It describes
+	// the whole stream once decodedToEnd is set, unless decodeSkipped is.
+	decodedPadding paddingCounter
+	decodedToEnd   bool
+	decodeSkipped  bool // set if packets were skipped by a seek or ReadPacket
 }
 
 // A FileSource decodes audio data from a file stored in the local filesystem.
@@ -228,11 +273,12 @@ func (src *sourceBase) Destroy() {
 //
 // The file may be in any format supported by FFmpeg, including formats that
 // also include video data. If the file contains multiple audio streams, the
-// first one reported by FFmpeg will be used.
+// first one reported by FFmpeg will be used, unless options select another (see
+// WithAudioStream, WithLanguage and WithDisposition).
 //
 // The Source is backed by a heap-allocated C data structure, so it must be
 // destroyed with Destroy before it is discarded.
-func NewFileSource(path string) (*FileSource, error) {
+func NewFileSource(path string, options ...SourceOption) (*FileSource, error) {
 	success := false
 	src := FileSource{Path: path}
 	defer func() {
@@ -248,7 +294,7 @@ func NewFileSource(path string) (*FileSource, error) {
 		return nil, fmt.Errorf("failed to open file: %v", avErr2Str(err))
 	}
 
-	if err := src.init(); err != nil {
+	if err := src.init(newSourceOptions(options)); err != nil {
 		return nil, err
 	}
 	success = true
@@ -277,23 +323,25 @@ func copyPacketData(packet *C.AVPacket) []byte {
 	return data
 }
 
-func (src *sourceBase) init() error {
+func (src *sourceBase) init(options sourceOptions) error {
 	// gather streams
 	if err := C.avformat_find_stream_info(src.formatCtx, nil); err < 0 {
 		return fmt.Errorf("failed to find stream info: %v", avErr2Str(err))
 	}
 
-	// find first audio stream
+	// find the requested audio stream
+	var err error
+	if src.stream, src.streamIndex, err = options.selectAudioStream(src.formatCtx); err != nil {
+		return err
+	}
+
+	// don't demux packets of other streams
 	forEachStream(src.formatCtx, func(stream *C.AVStream) bool {
-		if stream.codecpar.codec_type == C.AVMEDIA_TYPE_AUDIO {
-			src.stream = stream
-			return false // stop iteration
+		if stream != src.stream {
+			stream.discard = C.AVDISCARD_ALL
 		}
-		return true // continue iteration
+		return true
 	})
-	if src.stream == nil {
-		return fmt.Errorf("no audio streams")
-	}
 
 	codec := C.avcodec_find_decoder(src.stream.codecpar.codec_id)
 	if codec == nil {
@@ -516,10 +564,19 @@ func (src *sourceBase) Decode() (recoverable bool, err error) {
 	packet := C.av_packet_alloc()
 	defer C.av_packet_free(&packet)
 
-	if err := C.av_read_frame(src.formatCtx, packet); err == C.avErrorEOF() {
-		// return?
-	} else if err < 0 {
-		return false, fmt.Errorf("failed to read frame: %v", avErr2Str(err))
+	for {
+		if err := C.av_read_frame(src.formatCtx, packet); err == C.avErrorEOF() {
+			// an empty packet flushes the decoder
+			src.decodedToEnd = true
+			break
+		} else if err < 0 {
+			return false, fmt.Errorf("failed to read frame: %v", avErr2Str(err))
+		}
+		if packet.stream_index == src.stream.index {
+			src.decodedPadding.add(packet)
+			break
+		}
+		C.av_packet_unref(packet)
 	}
 	defer C.av_packet_unref(packet)
 
@@ -615,11 +672,21 @@ func (src *sourceBase) Duration() time.Duration {
 
 // Seek causes streaming to continue from the given offset relative to the
 // beginning of the audio stream.
+//
+// Seeking is not sample-accurate; decoding may resume somewhat before the
+// requested offset. FrameStartTime can be used to find the actual position.
 func (src *sourceBase) SeekTo(offset time.Duration) error {
 	streamOffset := durationToTimeBase(offset, src.stream.time_base)
 	if err := C.av_seek_frame(src.formatCtx, src.stream.index, streamOffset, C.int(0)); err < 0 {
 		return fmt.Errorf("unknown error")
 	}
+
+	// discard frames buffered by the decoder from before the seek
+	C.avcodec_flush_buffers(src.codecCtx)
+
+	src.decodedPadding = paddingCounter{}
+	src.decodedToEnd = false
+	src.decodeSkipped = offset > 0
 	return nil
 }
 
@@ -637,3 +704,136 @@ func (src *sourceBase) BitRate() int {
 func (src *sourceBase) CodecName() string {
 	return src.codecName
 }
+
+// ReadPacket reads the next packet of encoded audio data without decoding it.
+// It returns io.EOF when the end of the stream is reached.
+//
+// ReadPacket and Decode both consume packets from the input, so they should not
+// be used on the same Source.
+func (src *sourceBase) ReadPacket() (Packet, error) {
+	src.decodeSkipped = true
+
+	packet := C.av_packet_alloc()
+	if packet == nil {
+		return Packet{}, fmt.Errorf("failed to allocate packet")
+	}
+
+	for {
+		if err := C.av_read_frame(src.formatCtx, packet); err == C.avErrorEOF() {
+			C.av_packet_free(&packet)
+			return Packet{}, io.EOF
+		} else if err < 0 {
+			C.av_packet_free(&packet)
+			return Packet{}, fmt.Errorf("failed to read frame: %v", avErr2Str(err))
+		}
+
+		if packet.stream_index == src.stream.index {
+			return Packet{packet: packet, timeBase: src.stream.time_base}, nil
+		}
+		C.av_packet_unref(packet)
+	}
+}
+
+// CodecParameters returns an object describing the encoding of the Packets
+// returned by ReadPacket.
+func (src *sourceBase) CodecParameters() CodecParameters {
+	return CodecParameters{params: src.stream.codecpar, timeBase: src.stream.time_base}
+}
+
+// ScanPadding reads the entire audio stream to find the number of samples at
+// its start and end that aren't part of the audio, such as the delay and
+// padding added by an encoder. They are discarded automatically by Decode, but
+// a player must trim them itself when the file is played as-is.
+//
+// sampleCount is the number of samples that Decode produces for the whole
+// stream, as given by the durations of its packets. Unlike Duration, it is
+// exact. It is zero if the packets don't describe their durations.
+//
+// ScanPadding consumes the input, so the stream is returned to its beginning
+// afterward. For a Source that streams part of a file, the result describes
+// the whole file. If the whole stream has already been decoded, DecodedPadding
+// returns the same result without reading it again.
+func (src *FileSource) ScanPadding() (startPadding, endTrimming uint, sampleCount uint64, err error) {
+	packet := C.av_packet_alloc()
+	if packet == nil {
+		return 0, 0, 0, fmt.Errorf("failed to allocate packet")
+	}
+	defer C.av_packet_free(&packet)
+
+	var counter paddingCounter
+	for {
+		if avErr := C.av_read_frame(src.formatCtx, packet); avErr == C.avErrorEOF() {
+			break
+		} else if avErr < 0 {
+			return 0, 0, 0, fmt.Errorf("failed to read frame: %v", avErr2Str(avErr))
+		}
+
+		if packet.stream_index == src.stream.index {
+			counter.add(packet)
+		}
+		C.av_packet_unref(packet)
+	}
+
+	if err := src.SeekTo(0); err != nil {
+		return 0, 0, 0, err
+	}
+	startPadding, endTrimming, sampleCount = counter.result(src.stream)
+	return startPadding, endTrimming, sampleCount, nil
+}
+
+// DecodedPadding returns the same values as ScanPadding, counted from the
+// packets read by Decode. ok is false unless Decode has read the whole stream
+// since the Source was opened or last sought to its beginning.
+func (src *FileSource) DecodedPadding() (startPadding, endTrimming uint, sampleCount uint64, ok bool) {
+	if !src.decodedToEnd || src.decodeSkipped {
+		return 0, 0, 0, false
+	}
+	startPadding, endTrimming, sampleCount = src.decodedPadding.result(src.stream)
+	return startPadding, endTrimming, sampleCount, true
+}
+
+// A paddingCounter accumulates the padding and durations described by the
+// packets of an audio stream, for ScanPadding and DecodedPadding.
+type paddingCounter struct {
+	startPadding, endTrimming uint
+	foundStart, foundEnd      bool
+	totalDuration             C.int64_t
+	unknownDuration           bool
+}
+
+func (c *paddingCounter) add(packet *C.AVPacket) {
+	var start, end C.uint32_t
+	if C.packetSkipSamples(packet, &start, &end) != 0 {
+		c.startPadding += uint(start)
+		c.endTrimming += uint(end)
+		c.foundStart = c.foundStart || start > 0
+		c.foundEnd = c.foundEnd || end > 0
+	}
+	if packet.duration > 0 {
+		c.totalDuration += packet.duration
+	} else {
+		c.unknownDuration = true
+	}
+}
+
+func (c *paddingCounter) result(stream *C.AVStream) (startPadding, endTrimming uint, sampleCount uint64) {
+	startPadding, endTrimming = c.startPadding, c.endTrimming
+
+	// some codecs (e.g., Opus) describe padding only in the stream's
+	// parameters, leaving the decoder to skip it
+	if !c.foundStart && stream.codecpar.initial_padding > 0 {
+		startPadding = uint(stream.codecpar.initial_padding)
+	}
+	if !c.foundEnd && stream.codecpar.trailing_padding > 0 {
+		endTrimming = uint(stream.codecpar.trailing_padding)
+	}
+
+	if !c.unknownDuration && c.totalDuration > 0 {
+		totalSamples := C.av_rescale_q(
+			c.totalDuration, stream.time_base, C.AVRational{1, stream.codecpar.sample_rate})
+		if trimmed := C.int64_t(startPadding + endTrimming); totalSamples > trimmed {
+			sampleCount = uint64(totalSamples - trimmed)
+		}
+	}
+	return startPadding, endTrimming, sampleCount
+}
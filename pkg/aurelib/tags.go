@@ -0,0 +1,237 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include <stdlib.h>
+
+static int
+avErrorEOF() {
+	return AVERROR_EOF;
+}
+
+// copyChapters adds copies of the chapters of in to out.
+static int
+copyChapters(AVFormatContext* out, const AVFormatContext* in) {
+	for (unsigned int i = 0; i < in->nb_chapters; i++) {
+		const AVChapter* inChapter = in->chapters[i];
+		AVChapter* outChapter = av_mallocz(sizeof(AVChapter));
+		if (!outChapter) {
+			return AVERROR(ENOMEM);
+		}
+		outChapter->id = inChapter->id;
+		outChapter->time_base = inChapter->time_base;
+		outChapter->start = inChapter->start;
+		outChapter->end = inChapter->end;
+
+		int err = av_dict_copy(&outChapter->metadata, inChapter->metadata, 0);
+		if (err < 0) {
+			av_free(outChapter);
+			return err;
+		}
+		err = av_dynarray_add_nofree(&out->chapters, (int*)&out->nb_chapters, outChapter);
+		if (err < 0) {
+			av_dict_free(&outChapter->metadata);
+			av_free(outChapter);
+			return err;
+		}
+	}
+	return 0;
+}
+*/
+import "C"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// WriteTags updates the metadata of the audio file at path by remuxing it with
+// FFmpeg, without decoding or re-encoding any of its streams. Each entry of
+// tags replaces the tag with the same key, ignoring case, or removes it if the
+// value is empty. Other tags are kept.
+//
+// The file is written to a temporary file in the same directory, which then
+// replaces the original, so the original is left unchanged if writing fails.
+// The container format is chosen by the file extension, and every stream and
+// chapter of the original, including attached pictures, is copied to the new
+// file.
+func WriteTags(path string, tags map[string]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var inCtx *C.AVFormatContext
+	if avErr := C.avformat_open_input(&inCtx, cPath, nil, nil); avErr < 0 {
+		return fmt.Errorf("failed to open file: %v", avErr2Str(avErr))
+	}
+	defer C.avformat_close_input(&inCtx)
+	if avErr := C.avformat_find_stream_info(inCtx, nil); avErr < 0 {
+		return fmt.Errorf("failed to find stream info: %v", avErr2Str(avErr))
+	}
+
+	format := C.av_guess_format(nil, cPath, nil)
+	if format == nil {
+		return fmt.Errorf("failed to determine container format")
+	}
+
+	// the temporary file is hidden, and has the same extension as the original
+	// so that it is recognized by FFmpeg
+	dir, name := filepath.Split(path)
+	tempFile, err := os.CreateTemp(dir, "."+name+".tmp*"+filepath.Ext(name))
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	success := false
+	defer func() {
+		if !success {
+			os.Remove(tempPath)
+		}
+	}()
+
+	cTempPath := C.CString(tempPath)
+	defer C.free(unsafe.Pointer(cTempPath))
+
+	var outCtx *C.AVFormatContext
+	if avErr := C.avformat_alloc_output_context2(&outCtx, format, nil, cTempPath); avErr < 0 {
+		return fmt.Errorf("failed to allocate format context: %v", avErr2Str(avErr))
+	}
+	defer func() {
+		if outCtx.pb != nil {
+			C.avio_closep(&outCtx.pb)
+		}
+		C.avformat_free_context(outCtx)
+	}()
+
+	// updateDict applies tags to the metadata in dict
+	updateDict := func(dict **C.AVDictionary) error {
+		for key, value := range tags {
+			cKey := C.CString(key)
+			var cValue *C.char
+			if value != "" {
+				cValue = C.CString(value)
+			}
+			avErr := C.av_dict_set(dict, cKey, cValue, 0)
+			C.free(unsafe.Pointer(cKey))
+			if cValue != nil {
+				C.free(unsafe.Pointer(cValue))
+			}
+			if avErr < 0 {
+				return fmt.Errorf("failed to set tag %q: %v", key, avErr2Str(avErr))
+			}
+		}
+		return nil
+	}
+
+	if avErr := C.av_dict_copy(&outCtx.metadata, inCtx.metadata, 0); avErr < 0 {
+		return fmt.Errorf("failed to copy metadata: %v", avErr2Str(avErr))
+	}
+	if err := updateDict(&outCtx.metadata); err != nil {
+		return err
+	}
+
+	if avErr := C.copyChapters(outCtx, inCtx); avErr < 0 {
+		return fmt.Errorf("failed to copy chapters: %v", avErr2Str(avErr))
+	}
+
+	inStreams := unsafe.Slice(inCtx.streams, inCtx.nb_streams)
+	outStreams := make([]*C.AVStream, len(inStreams))
+	for i, inStream := range inStreams {
+		outStream := C.avformat_new_stream(outCtx, nil)
+		if outStream == nil {
+			return fmt.Errorf("failed to create output stream")
+		}
+		if avErr := C.avcodec_parameters_copy(outStream.codecpar, inStream.codecpar); avErr < 0 {
+			return fmt.Errorf("failed to copy codec parameters: %v", avErr2Str(avErr))
+		}
+		outStream.codecpar.codec_tag = 0
+		outStream.time_base = inStream.time_base
+		outStream.disposition = inStream.disposition
+		if avErr := C.av_dict_copy(&outStream.metadata, inStream.metadata, 0); avErr < 0 {
+			return fmt.Errorf("failed to copy stream metadata: %v", avErr2Str(avErr))
+		}
+		// some formats, such as Ogg, store tags with the audio stream
+		if inStream.codecpar.codec_type == C.AVMEDIA_TYPE_AUDIO {
+			if err := updateDict(&outStream.metadata); err != nil {
+				return err
+			}
+		}
+		outStreams[i] = outStream
+	}
+
+	if format.flags&C.AVFMT_NOFILE == 0 {
+		if avErr := C.avio_open(&outCtx.pb, cTempPath, C.AVIO_FLAG_WRITE); avErr < 0 {
+			return fmt.Errorf("failed to open temporary file: %v", avErr2Str(avErr))
+		}
+	}
+	if avErr := C.avformat_write_header(outCtx, nil); avErr < 0 {
+		return fmt.Errorf("failed to write header: %v", avErr2Str(avErr))
+	}
+
+	packet := C.av_packet_alloc()
+	if packet == nil {
+		return fmt.Errorf("failed to allocate packet")
+	}
+	defer C.av_packet_free(&packet)
+
+	for {
+		if avErr := C.av_read_frame(inCtx, packet); avErr == C.avErrorEOF() {
+			break
+		} else if avErr < 0 {
+			return fmt.Errorf("failed to read packet: %v", avErr2Str(avErr))
+		}
+
+		// streams that appear after the header was read have no output stream
+		if packet.stream_index < 0 || int(packet.stream_index) >= len(outStreams) {
+			C.av_packet_unref(packet)
+			continue
+		}
+
+		inStream := inStreams[packet.stream_index]
+		outStream := outStreams[packet.stream_index]
+		C.av_packet_rescale_ts(packet, inStream.time_base, outStream.time_base)
+		packet.pos = -1
+
+		// av_interleaved_write_frame takes ownership of the packet's data
+		if avErr := C.av_interleaved_write_frame(outCtx, packet); avErr < 0 {
+			return fmt.Errorf("failed to write packet: %v", avErr2Str(avErr))
+		}
+	}
+
+	if avErr := C.av_write_trailer(outCtx); avErr < 0 {
+		return fmt.Errorf("failed to write trailer: %v", avErr2Str(avErr))
+	}
+	if outCtx.pb != nil {
+		if avErr := C.avio_closep(&outCtx.pb); avErr < 0 {
+			return fmt.Errorf("failed to close temporary file: %v", avErr2Str(avErr))
+		}
+	}
+
+	if err := os.Chmod(tempPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// the new contents must reach the disk before they replace the original,
+	// so that a crash can't leave an empty file in its place
+	if tempFile, err = os.Open(tempPath); err != nil {
+		return err
+	}
+	err = tempFile.Sync()
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	success = true
+	return nil
+}
@@ -0,0 +1,281 @@
+package aurelib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TranscodeOptions controls the behavior of Transcode. It should be created
+// with NewTranscodeOptions to provide default values.
+type TranscodeOptions struct {
+	// Volume is a linear gain applied to the audio data while resampling.
+	Volume float64
+
+	// StartTime is the position in the Source at which to start transcoding.
+	// If it is nonzero, the Source is seeked to StartTime, and any samples
+	// decoded before it are discarded, so that transcoding starts precisely at
+	// StartTime regardless of where seeking lands. Otherwise, transcoding
+	// starts at the Source's current position.
+	StartTime time.Duration
+
+	// EndTime is the position in the Source at which to stop transcoding. Zero
+	// means the end of the Source.
+	EndTime time.Duration
+
+	// Filter, if not empty, describes a FilterGraph through which the audio
+	// data is passed before it is encoded (see NewFilterGraph). StartTime and
+	// EndTime refer to the Source, so the length of the output may differ if
+	// the filters change the tempo.
+	Filter string
+
+	// Progress, if not nil, is called after each batch of Frames is passed to
+	// the Sink, with the duration of the audio encoded so far.
+	Progress func(encoded time.Duration)
+
+	// DecodeError, if not nil, is called with each recoverable error returned
+	// by Source.Decode. Transcoding continues after such errors.
+	DecodeError func(err error)
+}
+
+// NewTranscodeOptions returns a TranscodeOptions with default values: the
+// whole Source is transcoded at its original volume.
+func NewTranscodeOptions() *TranscodeOptions {
+	return &TranscodeOptions{Volume: 1}
+}
+
+// Transcode decodes audio data from src, converts it to the format accepted by
+// sink, and encodes it with sink until the end of src or options.EndTime is
+// reached. The Sink is then flushed with FlushSink, so it should not be used
+// again. If options is nil, the defaults of NewTranscodeOptions are used.
+//
+// Transcode returns ctx.Err() without flushing the Sink if ctx is canceled. If
+// the Source can't be read any further, the audio decoded so far is encoded and
+// the Sink is flushed before the error is returned.
+func Transcode(
+	ctx context.Context,
+	src Source,
+	sink Sink,
+	options *TranscodeOptions,
+) error {
+	if options == nil {
+		options = NewTranscodeOptions()
+	}
+
+	sinkStreamInfo := sink.StreamInfo()
+
+	decoder, err := NewDecoder(src, sinkStreamInfo, options.Volume, options.StartTime)
+	if err != nil {
+		return err
+	}
+	defer decoder.Destroy()
+	decoder.DecodeError = options.DecodeError
+	fifo := decoder.Fifo()
+
+	// with a filter, decoded audio passes from fifo through the FilterGraph to
+	// filteredFifo
+	var filterGraph *FilterGraph
+	var filteredFifo *Fifo
+	if options.Filter != "" {
+		if filterGraph, err = NewFilterGraph(options.Filter, sinkStreamInfo); err != nil {
+			return err
+		}
+		defer filterGraph.Destroy()
+
+		if filteredFifo, err = NewFifo(sinkStreamInfo); err != nil {
+			return fmt.Errorf("failed to create FIFO: %w", err)
+		}
+		defer filteredFifo.Destroy()
+	}
+
+	sampleRate := float64(sinkStreamInfo.SampleRate)
+	remainingSamples := int64(math.MaxInt64)
+	if options.EndTime > 0 {
+		remainingSamples = int64(math.Round(options.EndTime.Seconds()*sampleRate)) -
+			int64(math.Round(options.StartTime.Seconds()*sampleRate))
+	}
+
+	encodedSamples := uint64(0)
+	getEncodedTime := func() time.Duration {
+		// calculate with millisecond precision to prevent overflow
+		return time.Duration(((encodedSamples * 1000) /
+			uint64(sinkStreamInfo.SampleRate)) * 1000000)
+	}
+
+	encode := func(from *Fifo, final bool, limit *int64) error {
+		encoded, _, err := encodeFifo(sink, from, final, limit)
+		encodedSamples += encoded
+		return err
+	}
+
+	done := false
+	for !done && remainingSamples > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := decoder.Fill(sink.FrameSize()); err != nil {
+			return err
+		}
+		done = decoder.Done()
+
+		if filterGraph == nil {
+			if err := encode(fifo, done, &remainingSamples); err != nil {
+				return err
+			}
+		} else {
+			frame, err := fifo.ReadFrame(uint(min(int64(fifo.Size()), remainingSamples)))
+			if err != nil {
+				return fmt.Errorf("failed to read frame from FIFO: %w", err)
+			}
+			remainingSamples -= int64(frame.Size)
+			err = filterGraph.WriteFrame(frame)
+			frame.Destroy()
+			if err != nil {
+				return err
+			}
+
+			final := done || remainingSamples <= 0
+			if final {
+				if err := filterGraph.WriteFrame(Frame{}); err != nil {
+					return err
+				}
+			}
+			if _, err := filterGraph.ReadFrames(filteredFifo); err != nil {
+				return err
+			}
+			unlimited := int64(math.MaxInt64)
+			if err := encode(filteredFifo, final, &unlimited); err != nil {
+				return err
+			}
+		}
+
+		if options.Progress != nil {
+			options.Progress(getEncodedTime())
+		}
+	}
+
+	if err := FlushSink(sink); err != nil {
+		return fmt.Errorf("failed to flush sink: %w", err)
+	}
+	if err := decoder.Err(); err != nil {
+		return fmt.Errorf("failed to decode frame: %w", err)
+	}
+	return nil
+}
+
+// encodeFifo passes audio data from a Fifo to sink, at most *limit samples.
+// Unless final is set, only complete Frames are passed. It returns the number of
+// samples passed, and whether the Sink reported that it needs no more data.
+func encodeFifo(sink Sink, from *Fifo, final bool, limit *int64) (uint64, bool, error) {
+	outFrameSize := sink.FrameSize()
+	if final {
+		outFrameSize = 1
+	}
+	encoded := uint64(0)
+	for *limit > 0 && from.Size() >= min(outFrameSize, uint(*limit)) {
+		frame, err := from.ReadFrame(min(sink.FrameSize(), uint(*limit)))
+		if err != nil {
+			return encoded, false, fmt.Errorf("failed to read frame from FIFO: %w", err)
+		}
+		*limit -= int64(frame.Size)
+		encoded += uint64(frame.Size)
+		done, err := sink.Encode(frame)
+		if err != nil {
+			return encoded, false, fmt.Errorf("failed to encode frame: %w", err)
+		}
+		if done {
+			return encoded, true, nil
+		}
+	}
+	return encoded, false, nil
+}
+
+// A TranscodeOutput is a Sink to which TranscodeAll passes audio data.
+type TranscodeOutput struct {
+	Sink Sink
+
+	// EndTime is the position in the Source at which to stop passing audio
+	// data to the Sink. Zero means the end of the Source.
+	EndTime time.Duration
+}
+
+// TranscodeAll decodes audio data from the start of src once, and passes it to
+// the Sink of each output as Transcode would. Each Sink is flushed with
+// FlushSink once its EndTime or the end of src is reached, or when it reports
+// from Encode that it needs no more data, in which case it isn't flushed.
+// Decoding stops when every Sink is finished. Recoverable decoding errors are
+// ignored.
+//
+// TranscodeAll returns ctx.Err() without flushing the remaining Sinks if ctx is
+// canceled. If the Source can't be read any further, the audio decoded so far
+// is encoded and the Sinks are flushed before the error is returned.
+func TranscodeAll(ctx context.Context, src Source, outputs []TranscodeOutput) error {
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	decoder, err := NewDecoder(src, outputs[0].Sink.StreamInfo(), 1, 0)
+	if err != nil {
+		return err
+	}
+	defer decoder.Destroy()
+
+	fifos := make([]*Fifo, len(outputs))
+	remainingSamples := make([]int64, len(outputs))
+	for i, output := range outputs {
+		streamInfo := output.Sink.StreamInfo()
+		if i == 0 {
+			fifos[i] = decoder.Fifo()
+		} else if fifos[i], err = decoder.AddOutput(streamInfo, 1); err != nil {
+			return err
+		}
+
+		remainingSamples[i] = math.MaxInt64
+		if output.EndTime > 0 {
+			remainingSamples[i] = int64(math.Round(output.EndTime.Seconds() * float64(streamInfo.SampleRate)))
+		}
+	}
+
+	finished := make([]bool, len(outputs))
+	active := len(outputs)
+	for active > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := decoder.Fill(outputs[0].Sink.FrameSize()); err != nil {
+			return err
+		}
+		done := decoder.Done()
+
+		for i, output := range outputs {
+			if finished[i] {
+				fifos[i].Drain(fifos[i].Size())
+				continue
+			}
+
+			_, sinkDone, err := encodeFifo(output.Sink, fifos[i], done, &remainingSamples[i])
+			if err != nil {
+				return err
+			}
+			if !sinkDone && !done && remainingSamples[i] > 0 {
+				continue
+			}
+
+			finished[i] = true
+			active--
+			if !sinkDone {
+				if err := FlushSink(output.Sink); err != nil {
+					return fmt.Errorf("failed to flush sink: %w", err)
+				}
+			}
+		}
+	}
+
+	if err := decoder.Err(); err != nil {
+		return fmt.Errorf("failed to decode frame: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavutil
+
+#include <libavutil/samplefmt.h>
+*/
+import "C"
+import "math"
+
+const (
+	// waveformMeterFrameSize is the number of samples per Frame accepted by a
+	// WaveformMeter.
+	waveformMeterFrameSize = 4096
+
+	// waveformBlocksPerSecond is the number of Peaks recorded by a
+	// WaveformMeter for each second of audio, from which Peaks at lower
+	// resolutions are derived.
+	waveformBlocksPerSecond = 100
+)
+
+// A Peak is the range of sample values in a span of audio, across all
+// channels. Full scale is -1 to 1.
+type Peak struct {
+	Min float32
+	Max float32
+}
+
+// A WaveformMeter is a Sink that records the Peaks of the audio data passed to
+// it, so that a waveform can be drawn. A Source can be measured by passing it
+// to Transcode along with the WaveformMeter.
+type WaveformMeter struct {
+	streamInfo    StreamInfo
+	channelCount  uint
+	blockSize     uint // samples per recorded Peak
+	blocks        []Peak
+	current       Peak
+	currentLength uint // samples in current
+}
+
+// NewWaveformMeter creates a new WaveformMeter that accepts audio data with
+// the sample rate and channel layout described by info, such as the StreamInfo
+// of the Source to be measured.
+func NewWaveformMeter(info StreamInfo) *WaveformMeter {
+	info.sampleFormat = C.AV_SAMPLE_FMT_FLT
+	return &WaveformMeter{
+		streamInfo:   info,
+		channelCount: info.ChannelCount(),
+		blockSize:    max(info.SampleRate/waveformBlocksPerSecond, 1),
+	}
+}
+
+// Destroy does nothing, since a WaveformMeter holds no C heap memory. It is
+// provided to satisfy the Sink interface.
+func (m *WaveformMeter) Destroy() {}
+
+// StreamInfo returns an object describing the format of audio data accepted
+// by the WaveformMeter.
+func (m *WaveformMeter) StreamInfo() StreamInfo {
+	return m.streamInfo
+}
+
+// FrameSize returns the number of samples per Frame expected by Encode.
+func (m *WaveformMeter) FrameSize() uint {
+	return waveformMeterFrameSize
+}
+
+// InitialPadding returns 0, since a WaveformMeter doesn't encode audio.
+func (m *WaveformMeter) InitialPadding() uint {
+	return 0
+}
+
+// Encode records the Peaks of a chunk of audio data. It takes ownership of the
+// Frame, so the caller should not call Frame.Destroy after calling Encode.
+//
+// Passing an empty Frame concludes the measurement. The return value will be
+// true when no more Frames will be accepted.
+func (m *WaveformMeter) Encode(frame Frame) (done bool, _ error) {
+	defer frame.Destroy()
+
+	if frame.IsEmpty() {
+		if m.currentLength > 0 {
+			m.blocks = append(m.blocks, m.current)
+			m.currentLength = 0
+		}
+		return true, nil
+	}
+
+	samples := frame.float32Samples(m.channelCount)
+	for i := uint(0); i < frame.Size; i++ {
+		if m.currentLength == 0 {
+			m.current = Peak{Min: math.MaxFloat32, Max: -math.MaxFloat32}
+		}
+		for _, sample := range samples[i*m.channelCount : (i+1)*m.channelCount] {
+			m.current.Min = min(m.current.Min, sample)
+			m.current.Max = max(m.current.Max, sample)
+		}
+		if m.currentLength++; m.currentLength == m.blockSize {
+			m.blocks = append(m.blocks, m.current)
+			m.currentLength = 0
+		}
+	}
+	return false, nil
+}
+
+// WriteTrailer does nothing. It is provided to satisfy the Sink interface.
+func (m *WaveformMeter) WriteTrailer() error {
+	return nil
+}
+
+// Peaks returns the Peaks of count spans of equal length covering the audio
+// data measured so far. Fewer are returned if the audio is too short, with at
+// most waveformBlocksPerSecond Peaks per second.
+func (m *WaveformMeter) Peaks(count int) []Peak {
+	return DownsamplePeaks(m.blocks, count)
+}
+
+// Blocks returns the Peaks of the audio data measured so far at the full
+// resolution of the WaveformMeter, waveformBlocksPerSecond Peaks per second.
+// Lower resolutions can be derived from them with DownsamplePeaks.
+func (m *WaveformMeter) Blocks() []Peak {
+	return append([]Peak(nil), m.blocks...)
+}
+
+// DownsamplePeaks combines peaks into count spans of equal length. If there are
+// no more than count peaks, a copy of peaks is returned.
+func DownsamplePeaks(peaks []Peak, count int) []Peak {
+	if count >= len(peaks) {
+		return append([]Peak(nil), peaks...)
+	}
+	result := make([]Peak, count)
+	for i := range result {
+		span := peaks[i*len(peaks)/count : (i+1)*len(peaks)/count]
+		result[i] = span[0]
+		for _, peak := range span[1:] {
+			result[i].Min = min(result[i].Min, peak.Min)
+			result[i].Max = max(result[i].Max, peak.Max)
+		}
+	}
+	return result
+}
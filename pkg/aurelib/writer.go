@@ -0,0 +1,176 @@
+package aurelib
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <libavformat/avformat.h>
+#include <stdlib.h>
+
+// implemented in Go
+int aurelibWriterWrite(void* opaque, uint8_t* data, int dataSize);
+
+typedef int (*Writer_write_t)(void*, uint8_t*, int);
+
+static int
+writerErrorIO() {
+	return AVERROR(EIO);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// writerBufferSize is the size of the buffer through which FFmpeg writes to a
+// WriterSink's io.Writer.
+const writerBufferSize = 4096
+
+// A WriterSink writes encoded audio to an io.Writer as it is produced.
+//
+// Each call to Encode or WriteTrailer passes all of the data encoded so far to
+// the io.Writer before returning, so a slow io.Writer slows down encoding. If
+// the io.Writer returns an error, the Sink's methods return an error wrapping
+// it.
+type WriterSink struct {
+	sinkBase
+
+	writer io.Writer
+	ioCtx  *C.AVIOContext
+	opaque unsafe.Pointer // C memory holding a cgo.Handle to the WriterSink
+	err    error          // the first error returned by writer
+}
+
+// Destroy frees any resources held by the Sink so that it may be discarded.
+// The io.Writer is not closed.
+func (sink *WriterSink) Destroy() {
+	sink.sinkBase.Destroy()
+	if sink.ioCtx != nil {
+		C.av_freep(unsafe.Pointer(&sink.ioCtx.buffer))
+		C.avio_context_free(&sink.ioCtx)
+	}
+	if sink.opaque != nil {
+		freeOpaqueHandle(sink.opaque)
+		sink.opaque = nil
+	}
+}
+
+// NewWriterSink creates a new WriterSink that will write audio data to writer
+// in the container format specified by containerFormatName, as for
+// NewBufferSink. The container header is written before NewWriterSink
+// returns.
+//
+// The Sink is backed by a heap-allocated C data structure, so it must be
+// destroyed with Destroy before it is discarded.
+func NewWriterSink(
+	containerFormatName string,
+	config *SinkConfig,
+	writer io.Writer,
+) (*WriterSink, error) {
+	cFormatName := C.CString(containerFormatName)
+	defer C.free(unsafe.Pointer(cFormatName))
+
+	format := C.av_guess_format(cFormatName, nil, nil)
+	if format == nil {
+		return nil, fmt.Errorf("failed to determine container format")
+	}
+
+	success := false
+	sink := &WriterSink{writer: writer}
+	defer func() {
+		if !success {
+			sink.Destroy()
+		}
+	}()
+
+	if sink.opaque = newOpaqueHandle(sink); sink.opaque == nil {
+		return nil, fmt.Errorf("failed to allocate I/O context data")
+	}
+
+	ioCtxBuffer := C.av_malloc(writerBufferSize)
+	if ioCtxBuffer == nil {
+		return nil, fmt.Errorf("failed to allocate I/O buffer")
+	}
+	if sink.ioCtx = C.avio_alloc_context(
+		(*C.uchar)(ioCtxBuffer), writerBufferSize, 1, sink.opaque,
+		nil, C.Writer_write_t(unsafe.Pointer(C.aurelibWriterWrite)), nil,
+	); sink.ioCtx == nil {
+		C.av_free(ioCtxBuffer)
+		return nil, fmt.Errorf("failed to allocate I/O context")
+	}
+
+	if err := sink.init(format, sink.ioCtx, config); err != nil {
+		return nil, sink.wrapError(err)
+	}
+	if err := sink.flush(); err != nil {
+		return nil, err
+	}
+
+	success = true
+	return sink, nil
+}
+
+// Encode encodes a chunk of audio data and writes the result. It takes
+// ownership of the Frame, so the caller should not call Frame.Destroy after
+// calling Encode.
+//
+// Passing an empty Frame will cause the encoder to flush any buffered data and
+// conclude encoding. See FlushSink.
+//
+// The return value will be true when the encoder has completed encoding and
+// will no longer accept any Frames.
+func (sink *WriterSink) Encode(frame Frame) (done bool, err error) {
+	if sink.err != nil {
+		frame.Destroy()
+		return false, sink.wrapError(nil)
+	}
+	if done, err = sink.sinkBase.Encode(frame); err != nil {
+		return done, sink.wrapError(err)
+	}
+	return done, sink.flush()
+}
+
+// WriteTrailer finalizes data written to the audio container format.
+//
+// It should be called after flushing the encoder by passing an empty Frame to
+// Encode. See FlushSink.
+func (sink *WriterSink) WriteTrailer() error {
+	if err := sink.sinkBase.WriteTrailer(); err != nil {
+		return sink.wrapError(err)
+	}
+	return sink.flush()
+}
+
+// flush passes any data held in FFmpeg's I/O buffer to the io.Writer.
+func (sink *WriterSink) flush() error {
+	C.avio_flush(sink.ioCtx)
+	if sink.err != nil {
+		return sink.wrapError(nil)
+	}
+	return nil
+}
+
+// wrapError returns an error describing a failure of the io.Writer if there
+// was one, or err otherwise.
+func (sink *WriterSink) wrapError(err error) error {
+	if sink.err != nil {
+		return fmt.Errorf("failed to write: %w", sink.err)
+	}
+	return err
+}
+
+//export aurelibWriterWrite
+func aurelibWriterWrite(opaque unsafe.Pointer, data *C.uint8_t, dataSize C.int) C.int {
+	sink := opaqueHandleValue(opaque).(*WriterSink)
+	if sink.err != nil {
+		return C.writerErrorIO()
+	}
+
+	buffer := unsafe.Slice((*byte)(unsafe.Pointer(data)), int(dataSize))
+	if _, err := sink.writer.Write(buffer); err != nil {
+		sink.err = err
+		return C.writerErrorIO()
+	}
+	return dataSize
+}
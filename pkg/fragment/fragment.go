@@ -4,6 +4,7 @@ package fragment
 
 import (
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/beakbeak/aurelius/pkg/aurelib"
@@ -18,12 +19,17 @@ type Fragment struct {
 }
 
 // New creates a new Fragment from a source audio file path and start/end
-// times. A zero endTime means the end of the file.
-func New(sourceFilePath string, startTime, endTime time.Duration) (*Fragment, error) {
+// times. A zero endTime means the end of the file. options are passed to
+// aurelib.NewFileSource.
+func New(
+	sourceFilePath string,
+	startTime, endTime time.Duration,
+	options ...aurelib.SourceOption,
+) (*Fragment, error) {
 	f := Fragment{startTime: startTime, endTime: endTime}
 	success := false
 
-	src, err := aurelib.NewFileSource(sourceFilePath)
+	src, err := aurelib.NewFileSource(sourceFilePath, options...)
 	if err != nil {
 		return &f, fmt.Errorf("failed to open '%v': %w", sourceFilePath, err)
 	}
@@ -76,6 +82,13 @@ func (f *Fragment) SeekTo(offset time.Duration) error {
 	return f.FileSource.SeekTo(offset)
 }
 
+// See aurelib.Source.FrameStartTime. The returned time is relative to the
+// start of the fragment, like the offsets accepted by SeekTo. The position in
+// the source file is returned by f.FileSource.FrameStartTime.
+func (f *Fragment) FrameStartTime() time.Duration {
+	return f.FileSource.FrameStartTime() - f.startTime
+}
+
 // See aurelib.Source.ReceiveFrame.
 func (f *Fragment) ReceiveFrame() (aurelib.ReceiveFrameStatus, error) {
 	status, err := f.FileSource.ReceiveFrame()
@@ -84,3 +97,25 @@ func (f *Fragment) ReceiveFrame() (aurelib.ReceiveFrameStatus, error) {
 	}
 	return status, err
 }
+
+// See aurelib.Source.ReadPacket. Packets are trimmed to the bounds of the
+// fragment at packet granularity: packets that end before the start time are
+// skipped, and the stream ends at the first packet that begins at or after the
+// end time.
+func (f *Fragment) ReadPacket() (aurelib.Packet, error) {
+	for {
+		packet, err := f.FileSource.ReadPacket()
+		if err != nil {
+			return packet, err
+		}
+		if packet.StartTime() >= f.endTime {
+			packet.Destroy()
+			return aurelib.Packet{}, io.EOF
+		}
+		if packet.StartTime()+packet.Duration() <= f.startTime {
+			packet.Destroy()
+			continue
+		}
+		return packet, nil
+	}
+}
@@ -111,6 +111,7 @@ export class Player extends EventDispatcher<PlayerEventMap> {
                 streamConfig,
                 0,
                 this._discardedTracks.pop(),
+                this._defaultReplayGain(),
             );
 
             // Check that this preload wasn't invalidated while we were fetching.
@@ -126,15 +127,19 @@ export class Player extends EventDispatcher<PlayerEventMap> {
         }
     }
 
+    // In "auto" mode, the ReplayGain mode set for a track's directory takes
+    // precedence over the hint, so the mode is left for Track.fetch to choose.
     private _resolveStreamConfig(): StreamConfig {
         if (this._streamConfig.replayGain === "auto") {
-            const config = copyJson(this._streamConfig);
-            config.replayGain = this._replayGainHint;
-            return config;
+            return { ...copyJson(this._streamConfig), replayGain: undefined };
         }
         return this._streamConfig;
     }
 
+    private _defaultReplayGain(): ReplayGainMode | undefined {
+        return this._streamConfig.replayGain === "auto" ? this._replayGainHint : undefined;
+    }
+
     // Start backup stall detection timer to catch unreported stalls.
     private _startStallDetection(): void {
         if (!this._stallDetectionEnabled) {
@@ -263,7 +268,13 @@ export class Player extends EventDispatcher<PlayerEventMap> {
         } else {
             this._discardPreload();
             const streamConfig = this._resolveStreamConfig();
-            track = await Track.fetch(url, streamConfig, startTime, this._discardedTracks.pop());
+            track = await Track.fetch(
+                url,
+                streamConfig,
+                startTime,
+                this._discardedTracks.pop(),
+                this._defaultReplayGain(),
+            );
         }
 
         if (this.track) {
@@ -21,6 +21,7 @@ export interface TrackInfo {
     readonly sampleRate: number;
     readonly sampleFormat: string;
     readonly dir: string;
+    readonly replayGainMode?: ReplayGainMode;
 
     favorite: boolean;
 }
@@ -64,7 +65,9 @@ function streamQueryString(config: StreamConfig, startTime = 0): string {
 
     const keys = Object.keys(config) as (keyof StreamConfig)[];
     for (let i = 0; i < keys.length; ++i) {
-        addArgument(keys[i], `${config[keys[i]]}`);
+        if (config[keys[i]] !== undefined) {
+            addArgument(keys[i], `${config[keys[i]]}`);
+        }
     }
 
     if (startTime > 0) {
@@ -99,14 +102,18 @@ export class Track {
         this._audio.src = "";
     }
 
+    // If streamConfig doesn't set a ReplayGain mode, the one set for the
+    // track's directory is used, or else defaultReplayGain.
     public static async fetch(
         url: string,
         streamConfig: StreamConfig,
         startTime = 0,
         recycledTrack?: Track,
+        defaultReplayGain?: ReplayGainMode,
     ): Promise<Track> {
         streamConfig = copyJson(streamConfig);
         const info = await fetchTrackInfo(url);
+        streamConfig.replayGain ??= info.replayGainMode ?? defaultReplayGain;
         const audio = recycledTrack?._audio ?? new Audio();
         let gain = 1;
         switch (streamConfig.replayGain) {